@@ -1,14 +1,26 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/sipcapture/hepop-go/internal/alias"
 	"github.com/sipcapture/hepop-go/internal/api"
+	"github.com/sipcapture/hepop-go/internal/archive"
 	"github.com/sipcapture/hepop-go/internal/config"
+	"github.com/sipcapture/hepop-go/internal/denylist"
+	"github.com/sipcapture/hepop-go/internal/dialog"
+	"github.com/sipcapture/hepop-go/internal/fraud"
+	"github.com/sipcapture/hepop-go/internal/input"
+	"github.com/sipcapture/hepop-go/internal/pipeline"
+	"github.com/sipcapture/hepop-go/internal/registrar"
+	"github.com/sipcapture/hepop-go/internal/rtpstats"
+	"github.com/sipcapture/hepop-go/internal/server"
 	"github.com/sipcapture/hepop-go/internal/writer"
 )
 
@@ -20,8 +32,26 @@ func main() {
 		log.Fatalf("error loading configuration: %v", err)
 	}
 
+	// the uploader is closed after the writer, which finishes its files on
+	// close
+	var archived func(path string)
+	var pending func(path string) bool
+	if cfg.Archive.Enable {
+		uploader, dir, err := initializeArchive(cfg)
+		if err != nil {
+			log.Fatalf("error initializing archive: %v", err)
+		}
+		defer uploader.Close()
+		archived = func(path string) {
+			if err := uploader.Upload(dir, path); err != nil {
+				log.Printf("error archiving %s: %v", path, err)
+			}
+		}
+		pending = uploader.Pending
+	}
+
 	// initialize writer
-	hepWriter, err := initializeWriter(cfg)
+	hepWriter, err := initializeWriter(cfg, archived, pending)
 	if err != nil {
 		log.Fatalf("error initializing writer: %v", err)
 	}
@@ -30,6 +60,154 @@ func main() {
 			log.Printf("error closing writer: %v", err)
 		}
 	}()
+
+	// start HEP server
+	hepServer := server.NewHEPServer(&server.Config{
+		Host: cfg.Server.Host,
+		Port: cfg.Server.Port,
+	}, hepWriter)
+
+	if cfg.Server.Input == "nats" {
+		natsInput, err := input.NewNATSInput(input.NATSConfig{
+			URL:      cfg.Server.NATS.URL,
+			Subject:  cfg.Server.NATS.Subject,
+			Encoding: cfg.Server.NATS.Encoding,
+			Stream:   cfg.Server.NATS.Stream,
+			Durable:  cfg.Server.NATS.Durable,
+			Username: cfg.Server.NATS.Username,
+			Password: cfg.Server.NATS.Password,
+			Token:    cfg.Server.NATS.Token,
+		})
+		if err != nil {
+			log.Fatalf("error initializing NATS input: %v", err)
+		}
+		hepServer.SetInput(natsInput)
+	}
+
+	// The masker runs last on the write path, the records the observers
+	// build are masked on output
+	var masker *pipeline.Masker
+	if len(cfg.Pipeline.Masking.Profiles) > 0 {
+		masker, err = initializeMasker(cfg)
+		if err != nil {
+			log.Fatalf("error initializing masking: %v", err)
+		}
+	}
+
+	if cfg.CDR.Enable {
+		tracker, err := initializeCDRTracker(cfg, hepWriter, masker)
+		if err != nil {
+			log.Fatalf("error initializing CDR tracker: %v", err)
+		}
+		hepServer.AddObserver(tracker)
+		defer tracker.Close()
+	}
+
+	if cfg.RTPStats.Enable {
+		analyzer, err := initializeRTPAnalyzer(cfg, hepWriter, masker)
+		if err != nil {
+			log.Fatalf("error initializing RTP analyzer: %v", err)
+		}
+		hepServer.AddObserver(analyzer)
+		defer analyzer.Close()
+	}
+
+	var denyList *denylist.List
+	if cfg.DenyList.Enable || len(cfg.DenyList.Entries) > 0 || (cfg.Fraud.Enable && cfg.Fraud.DenyOffenders) {
+		denyList = denylist.New()
+		for _, entry := range cfg.DenyList.Entries {
+			if _, err := denyList.Add(entry, "configuration", 0); err != nil {
+				log.Fatalf("error in deny list entry %s: %v", entry, err)
+			}
+		}
+		hepServer.SetDenyList(denyList)
+	}
+
+	if cfg.Fraud.Enable {
+		detector, alerts, err := initializeFraudDetector(cfg, denyList, masker)
+		if err != nil {
+			log.Fatalf("error initializing fraud detection: %v", err)
+		}
+		hepServer.AddObserver(detector)
+		defer detector.Close()
+		if alerts != nil {
+			defer alerts.Close()
+		}
+	}
+
+	var registrations *registrar.Store
+	if cfg.Registrations.Enable {
+		registrations = registrar.NewStore(registrar.Config{
+			HistorySize:      cfg.Registrations.HistorySize,
+			FailureRetention: cfg.Registrations.FailureRetention,
+		})
+		if masker != nil {
+			registrations.SetMask(masker.MaskRegistration)
+		}
+		hepServer.AddObserver(registrations)
+		defer registrations.Close()
+	}
+
+	if enrichment := cfg.Pipeline.Enrichment; enrichment.GeoIPDatabase != "" || enrichment.ASNDatabase != "" || len(enrichment.Lookups) > 0 {
+		enricher, err := initializeEnricher(cfg)
+		if err != nil {
+			log.Fatalf("error initializing enrichment: %v", err)
+		}
+		hepServer.AddStage(enricher)
+		defer enricher.Close()
+	}
+
+	var filter *pipeline.Filter
+	if len(cfg.Pipeline.Filter.Rules) > 0 || cfg.Pipeline.Filter.RulesFile != "" {
+		filter, err = initializeFilter(cfg)
+		if err != nil {
+			log.Fatalf("error initializing filter: %v", err)
+		}
+		hepServer.AddStage(filter)
+		defer filter.Close()
+	}
+
+	if cfg.Pipeline.Dedup.Enable {
+		dedup, err := pipeline.NewDeduplicator(pipeline.DedupConfig{
+			Window:     cfg.Pipeline.Dedup.Window,
+			Scope:      cfg.Pipeline.Dedup.Scope,
+			TrackNodes: cfg.Pipeline.Dedup.TrackNodes,
+		})
+		if err != nil {
+			log.Fatalf("error initializing dedup: %v", err)
+		}
+		hepServer.AddStage(dedup)
+		defer dedup.Close()
+	}
+
+	if cfg.Pipeline.Retention.Enable {
+		retention, err := pipeline.NewRetention(pipeline.RetentionConfig{
+			Keep:        cfg.Pipeline.Retention.Keep,
+			Window:      cfg.Pipeline.Retention.Window,
+			Sample:      cfg.Pipeline.Retention.Sample,
+			CallTimeout: cfg.Pipeline.Retention.CallTimeout,
+			MaxCalls:    cfg.Pipeline.Retention.MaxCalls,
+		})
+		if err != nil {
+			log.Fatalf("error initializing retention: %v", err)
+		}
+		hepServer.AddStage(retention)
+		defer retention.Close()
+	}
+
+	if masker != nil {
+		hepServer.AddStage(masker)
+	}
+
+	if err := hepServer.Start(); err != nil {
+		log.Fatalf("error starting HEP server: %v", err)
+	}
+	defer func() {
+		if err := hepServer.Stop(); err != nil {
+			log.Printf("error stopping HEP server: %v", err)
+		}
+	}()
+
 	// start API
 	apiServer := api.NewAPI(&api.Config{
 		Host:        cfg.API.Host,
@@ -37,6 +215,25 @@ func main() {
 		EnablePprof: cfg.API.EnablePprof,
 		AuthToken:   cfg.API.AuthToken,
 	}, hepWriter)
+	if registrations != nil {
+		apiServer.SetRegistrationStore(registrations)
+	}
+	if filter != nil {
+		apiServer.SetFilter(filter)
+	}
+	if denyList != nil {
+		apiServer.SetDenyList(denyList)
+	}
+	if pw, ok := hepWriter.(*writer.ParquetWriter); ok && cfg.API.EnableSQL {
+		apiServer.SetSQL(pw.DuckDB())
+	}
+	if cfg.Aliases.FilePath != "" {
+		aliases, err := alias.NewStore(cfg.Aliases.FilePath)
+		if err != nil {
+			log.Fatalf("error loading aliases: %v", err)
+		}
+		apiServer.SetAliasStore(aliases)
+	}
 	go func() {
 		if err := apiServer.Start(); err != nil {
 			log.Fatalf("error starting API: %v", err)
@@ -54,23 +251,125 @@ func main() {
 	waitForShutdown(apiServer)
 }
 
-// initializeWriter initializes the writer based on the configuration
-func initializeWriter(cfg *config.Config) (writer.Writer, error) {
+// initializeWriter creates the configured writer, the parquet and pcap
+// writers call closed with every finished file and the pcap writer keeps
+// the pending ones when removing old files
+func initializeWriter(cfg *config.Config, closed func(path string), pending func(path string) bool) (writer.Writer, error) {
 	switch cfg.Writers.Type {
 	case "clickhouse":
 		return writer.NewClickHouseWriter(writer.ClickHouseConfig{
-			Host:     cfg.Writers.ClickHouse.Host,
-			Port:     cfg.Writers.ClickHouse.Port,
-			Database: cfg.Writers.ClickHouse.Database,
-			Table:    cfg.Writers.ClickHouse.Table,
-			Username: cfg.Writers.ClickHouse.Username,
-			Password: cfg.Writers.ClickHouse.Password,
+			Host:      cfg.Writers.ClickHouse.Host,
+			Port:      cfg.Writers.ClickHouse.Port,
+			Database:  cfg.Writers.ClickHouse.Database,
+			Table:     cfg.Writers.ClickHouse.Table,
+			CDRTable:  cfg.Writers.ClickHouse.CDRTable,
+			LogTable:  cfg.Writers.ClickHouse.LogTable,
+			RTPTable:  cfg.Writers.ClickHouse.RTPTable,
+			Username:  cfg.Writers.ClickHouse.Username,
+			Password:  cfg.Writers.ClickHouse.Password,
+			BatchSize: cfg.Writers.BatchSize,
 		})
 	case "elastic":
-		return writer.NewElasticWriter(writer.ElasticConfig{})
+		return writer.NewElasticWriter(writer.ElasticConfig{
+			URLs:      cfg.Writers.Elastic.URLs,
+			Username:  cfg.Writers.Elastic.Username,
+			Password:  cfg.Writers.Elastic.Password,
+			IndexName: cfg.Writers.Elastic.IndexName,
+			CDRIndex:  cfg.Writers.Elastic.CDRIndex,
+			LogIndex:  cfg.Writers.Elastic.LogIndex,
+			RTPIndex:  cfg.Writers.Elastic.RTPIndex,
+			BatchSize: cfg.Writers.BatchSize,
+		})
 	case "parquet":
 		return writer.NewParquetWriter(writer.ParquetConfig{
-			FilePath: cfg.Writers.Parquet.FilePath,
+			Dir:          cfg.Writers.Parquet.Dir,
+			Compression:  cfg.Writers.Parquet.Compression,
+			RowGroupSize: cfg.Writers.Parquet.RowGroupSize,
+			MaxRows:      cfg.Writers.Parquet.MaxRows,
+			MaxAge:       cfg.Writers.Parquet.MaxAge,
+			QueryTimeout: cfg.Writers.Parquet.QueryTimeout,
+			QueryMaxRows: cfg.Writers.Parquet.QueryMaxRows,
+			MemoryLimit:  cfg.Writers.Parquet.MemoryLimit,
+			BatchSize:    cfg.Writers.BatchSize,
+			Closed:       closed,
+		})
+	case "loki":
+		return writer.NewLokiWriter(writer.LokiConfig{
+			URL:       cfg.Writers.Loki.URL,
+			Labels:    cfg.Writers.Loki.Labels,
+			Job:       cfg.Writers.Loki.Job,
+			Format:    cfg.Writers.Loki.Format,
+			TenantID:  cfg.Writers.Loki.TenantID,
+			Username:  cfg.Writers.Loki.Username,
+			Password:  cfg.Writers.Loki.Password,
+			BatchSize: cfg.Writers.BatchSize,
+			Timeout:   cfg.Writers.Loki.Timeout,
+		})
+	case "postgres":
+		return writer.NewPostgresWriter(writer.PostgresConfig{
+			Host:      cfg.Writers.Postgres.Host,
+			Port:      cfg.Writers.Postgres.Port,
+			Database:  cfg.Writers.Postgres.Database,
+			Username:  cfg.Writers.Postgres.Username,
+			Password:  cfg.Writers.Postgres.Password,
+			SSLMode:   cfg.Writers.Postgres.SSLMode,
+			BatchSize: cfg.Writers.BatchSize,
+		})
+	case "kafka":
+		return writer.NewKafkaWriter(writer.KafkaConfig{
+			Brokers:            cfg.Writers.Kafka.Brokers,
+			Topic:              cfg.Writers.Kafka.Topic,
+			Topics:             cfg.Writers.Kafka.Topics,
+			Encoding:           cfg.Writers.Kafka.Encoding,
+			Compression:        cfg.Writers.Kafka.Compression,
+			ClientID:           cfg.Writers.Kafka.ClientID,
+			Linger:             cfg.Writers.Kafka.Linger,
+			DeliveryTimeout:    cfg.Writers.Kafka.DeliveryTimeout,
+			MaxBufferedRecords: cfg.Writers.Kafka.MaxBufferedRecords,
+		})
+	case "nats":
+		return writer.NewNATSWriter(writer.NATSConfig{
+			URL:           cfg.Writers.NATS.URL,
+			SubjectPrefix: cfg.Writers.NATS.SubjectPrefix,
+			Encoding:      cfg.Writers.NATS.Encoding,
+			Username:      cfg.Writers.NATS.Username,
+			Password:      cfg.Writers.NATS.Password,
+			Token:         cfg.Writers.NATS.Token,
+		})
+	case "metrics":
+		return writer.NewMetricsWriter(writer.MetricsConfig{
+			URL:      cfg.Writers.Metrics.URL,
+			Format:   cfg.Writers.Metrics.Format,
+			Window:   cfg.Writers.Metrics.Window,
+			Labels:   cfg.Writers.Metrics.Labels,
+			Token:    cfg.Writers.Metrics.Token,
+			Username: cfg.Writers.Metrics.Username,
+			Password: cfg.Writers.Metrics.Password,
+			Timeout:  cfg.Writers.Metrics.Timeout,
+		})
+	case "pcap":
+		return writer.NewPcapWriter(writer.PcapConfig{
+			Dir:            cfg.Writers.Pcap.Dir,
+			Prefix:         cfg.Writers.Pcap.Prefix,
+			Format:         cfg.Writers.Pcap.Format,
+			MaxSize:        cfg.Writers.Pcap.MaxSize,
+			RotateInterval: cfg.Writers.Pcap.RotateInterval,
+			MaxFiles:       cfg.Writers.Pcap.MaxFiles,
+			BatchSize:      cfg.Writers.BatchSize,
+			Closed:         closed,
+			Pending:        pending,
+		})
+	case "file":
+		return writer.NewFileWriter(writer.FileConfig{
+			Dir:            cfg.Writers.File.Dir,
+			Prefix:         cfg.Writers.File.Prefix,
+			Payload:        cfg.Writers.File.Payload,
+			Compression:    cfg.Writers.File.Compression,
+			MaxSize:        cfg.Writers.File.MaxSize,
+			RotateInterval: cfg.Writers.File.RotateInterval,
+			MaxFiles:       cfg.Writers.File.MaxFiles,
+			SearchFiles:    cfg.Writers.File.SearchFiles,
+			BatchSize:      cfg.Writers.BatchSize,
 		})
 	// Add other writer types if necessary
 	default:
@@ -78,6 +377,174 @@ func initializeWriter(cfg *config.Config) (writer.Writer, error) {
 	}
 }
 
+// initializeArchive creates the uploader for the files of the parquet or pcap
+// writer and queues the files a previous run left behind. It returns the
+// writer directory the object keys are relative to.
+func initializeArchive(cfg *config.Config) (*archive.Uploader, string, error) {
+	var dir string
+	switch cfg.Writers.Type {
+	case "parquet":
+		dir = cfg.Writers.Parquet.Dir
+	case "pcap":
+		dir = cfg.Writers.Pcap.Dir
+	default:
+		return nil, "", fmt.Errorf("archive requires the parquet or pcap writer, got %s", cfg.Writers.Type)
+	}
+	uploader, err := archive.NewUploader(archive.Config{
+		Endpoint:    cfg.Archive.Endpoint,
+		Region:      cfg.Archive.Region,
+		Bucket:      cfg.Archive.Bucket,
+		AccessKey:   cfg.Archive.AccessKey,
+		SecretKey:   cfg.Archive.SecretKey,
+		PathStyle:   cfg.Archive.PathStyle,
+		Prefix:      cfg.Archive.Prefix,
+		PartSize:    cfg.Archive.PartSize,
+		Retries:     cfg.Archive.Retries,
+		RetryDelay:  cfg.Archive.RetryDelay,
+		Timeout:     cfg.Archive.Timeout,
+		DeleteLocal: cfg.Archive.DeleteLocal,
+		Manifest:    cfg.Archive.Manifest,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := uploader.UploadDir(dir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("error queueing files of %s for archiving: %v", dir, err)
+	}
+	return uploader, dir, nil
+}
+
+// initializeCDRTracker creates the SIP dialog tracker, the writer has to
+// support storing CDRs
+func initializeCDRTracker(cfg *config.Config, hepWriter writer.Writer, masker *pipeline.Masker) (*dialog.Tracker, error) {
+	cdrWriter, ok := hepWriter.(writer.CDRWriter)
+	if !ok {
+		return nil, fmt.Errorf("writer %s does not support CDRs", cfg.Writers.Type)
+	}
+	if masker != nil {
+		cdrWriter = masker.CDRWriter(cdrWriter)
+	}
+	return dialog.NewTracker(dialog.Config{
+		InviteTimeout: cfg.CDR.InviteTimeout,
+		DialogTimeout: cfg.CDR.DialogTimeout,
+	}, cdrWriter), nil
+}
+
+// initializeRTPAnalyzer creates the RTP stream analyzer, the writer has to
+// support storing RTP reports
+func initializeRTPAnalyzer(cfg *config.Config, hepWriter writer.Writer, masker *pipeline.Masker) (*rtpstats.Analyzer, error) {
+	reportWriter, ok := hepWriter.(writer.RTPReportWriter)
+	if !ok {
+		return nil, fmt.Errorf("writer %s does not support RTP reports", cfg.Writers.Type)
+	}
+	if masker != nil {
+		reportWriter = masker.RTPReportWriter(reportWriter)
+	}
+	return rtpstats.NewAnalyzer(rtpstats.Config{
+		ReportInterval: cfg.RTPStats.ReportInterval,
+		StreamTimeout:  cfg.RTPStats.StreamTimeout,
+	}, reportWriter), nil
+}
+
+// initializeFraudDetector creates the fraud detectors and the webhook writer
+// for their alerts when a URL is configured
+func initializeFraudDetector(cfg *config.Config, denyList *denylist.List, masker *pipeline.Masker) (*fraud.Detector, *writer.WebhookWriter, error) {
+	var alerts *writer.WebhookWriter
+	if cfg.Fraud.Webhook.URL != "" {
+		var err error
+		alerts, err = writer.NewWebhookWriter(writer.WebhookConfig{
+			URL:       cfg.Fraud.Webhook.URL,
+			Headers:   cfg.Fraud.Webhook.Headers,
+			Timeout:   cfg.Fraud.Webhook.Timeout,
+			QueueSize: cfg.Fraud.Webhook.QueueSize,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var scanners []string
+	if cfg.Fraud.Scanners.Enable {
+		scanners = cfg.Fraud.Scanners.UserAgents
+		if len(scanners) == 0 {
+			scanners = fraud.DefaultScannerUserAgents
+		}
+	}
+
+	fraudConfig := fraud.Config{
+		BruteForce:            fraud.Threshold{Count: cfg.Fraud.BruteForce.Count, Window: cfg.Fraud.BruteForce.Window},
+		InviteFlood:           fraud.Threshold{Count: cfg.Fraud.InviteFlood.Count, Window: cfg.Fraud.InviteFlood.Window},
+		ScannerUserAgents:     scanners,
+		International:         fraud.Threshold{Count: cfg.Fraud.International.Count, Window: cfg.Fraud.International.Window},
+		InternationalPrefixes: cfg.Fraud.International.Prefixes,
+		HomePrefixes:          cfg.Fraud.International.HomePrefixes,
+		Cooldown:              cfg.Fraud.Cooldown,
+		DenyOffenders:         cfg.Fraud.DenyOffenders,
+		DenyTTL:               cfg.Fraud.DenyTTL,
+	}
+	if alerts == nil {
+		return fraud.NewDetector(fraudConfig, nil, denyList), nil, nil
+	}
+	var alertWriter writer.AlertWriter = alerts
+	if masker != nil {
+		alertWriter = masker.AlertWriter(alerts)
+	}
+	return fraud.NewDetector(fraudConfig, alertWriter, denyList), alerts, nil
+}
+
+// initializeEnricher opens the GeoIP databases and lookup tables
+func initializeEnricher(cfg *config.Config) (*pipeline.Enricher, error) {
+	var lookups []pipeline.LookupTable
+	for _, l := range cfg.Pipeline.Enrichment.Lookups {
+		lookups = append(lookups, pipeline.LookupTable{
+			File: l.File,
+			Key:  l.Key,
+		})
+	}
+	return pipeline.NewEnricher(pipeline.EnrichConfig{
+		GeoIPDatabase: cfg.Pipeline.Enrichment.GeoIPDatabase,
+		ASNDatabase:   cfg.Pipeline.Enrichment.ASNDatabase,
+		Lookups:       lookups,
+	})
+}
+
+// initializeFilter creates the filter stage from inline rules or a rules file
+func initializeFilter(cfg *config.Config) (*pipeline.Filter, error) {
+	var rules []pipeline.FilterRule
+	for _, r := range cfg.Pipeline.Filter.Rules {
+		rules = append(rules, pipeline.FilterRule{
+			Name:   r.Name,
+			Match:  r.Match,
+			Action: r.Action,
+		})
+	}
+	return pipeline.NewFilter(pipeline.FilterConfig{
+		Rules:          rules,
+		RulesFile:      cfg.Pipeline.Filter.RulesFile,
+		ReloadInterval: cfg.Pipeline.Filter.ReloadInterval,
+	})
+}
+
+// initializeMasker creates the masking stage from the configured profiles
+func initializeMasker(cfg *config.Config) (*pipeline.Masker, error) {
+	var profiles []pipeline.MaskProfile
+	for _, p := range cfg.Pipeline.Masking.Profiles {
+		profiles = append(profiles, pipeline.MaskProfile{
+			Name:         p.Name,
+			NodeIDs:      p.NodeIDs,
+			Networks:     p.Networks,
+			Mode:         p.Mode,
+			Key:          p.Key,
+			Users:        p.Users,
+			DisplayNames: p.DisplayNames,
+			Headers:      p.Headers,
+			SDP:          p.SDP,
+			IPs:          p.IPs,
+		})
+	}
+	return pipeline.NewMasker(profiles)
+}
+
 // waitForShutdown handles shutdown signals and gracefully stops the server
 func waitForShutdown(apiServer *api.API) {
 	sigChan := make(chan os.Signal, 1)
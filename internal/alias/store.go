@@ -0,0 +1,239 @@
+package alias
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrNotFound    = errors.New("alias not found")
+	ErrInvalidCIDR = errors.New("invalid ip or cidr")
+	ErrNameMissing = errors.New("alias name is required")
+)
+
+// Alias names an IP address or network, optionally restricted to a port
+// and to the packets of one capture node
+type Alias struct {
+	ID     string `json:"id"`
+	CIDR   string `json:"cidr"`
+	Port   uint16 `json:"port,omitempty"`
+	NodeID uint32 `json:"node_id,omitempty"`
+	Name   string `json:"name"`
+	Group  string `json:"group,omitempty"`
+
+	network *net.IPNet
+}
+
+// Store keeps the aliases in memory and persists them to a JSON file on
+// every change
+type Store struct {
+	filePath string
+	aliases  []*Alias
+	mu       sync.RWMutex
+}
+
+// NewStore loads the aliases from filePath, a missing file is an empty store
+func NewStore(filePath string) (*Store, error) {
+	s := &Store{filePath: filePath}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("read alias file: %w", err)
+	}
+
+	var aliases []*Alias
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		return nil, fmt.Errorf("parse alias file: %w", err)
+	}
+	for _, a := range aliases {
+		if err := a.validate(); err != nil {
+			return nil, fmt.Errorf("alias %s: %w", a.ID, err)
+		}
+	}
+	s.aliases = aliases
+	return s, nil
+}
+
+func (a *Alias) validate() error {
+	if a.Name == "" {
+		return ErrNameMissing
+	}
+
+	if ip := net.ParseIP(a.CIDR); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		a.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return nil
+	}
+
+	_, network, err := net.ParseCIDR(a.CIDR)
+	if err != nil {
+		return ErrInvalidCIDR
+	}
+	a.network = network
+	return nil
+}
+
+// List returns a copy of all aliases
+func (s *Store) List() []Alias {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]Alias, len(s.aliases))
+	for i, a := range s.aliases {
+		list[i] = *a
+	}
+	return list
+}
+
+// Get returns the alias with the given ID
+func (s *Store) Get(id string) (Alias, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, a := range s.aliases {
+		if a.ID == id {
+			return *a, nil
+		}
+	}
+	return Alias{}, ErrNotFound
+}
+
+// Create adds an alias and assigns its ID
+func (s *Store) Create(a Alias) (Alias, error) {
+	if err := a.validate(); err != nil {
+		return Alias{}, err
+	}
+	a.ID = uuid.NewString()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.aliases = append(s.aliases, &a)
+	if err := s.save(); err != nil {
+		s.aliases = s.aliases[:len(s.aliases)-1]
+		return Alias{}, err
+	}
+	return a, nil
+}
+
+// Update replaces the alias with the given ID
+func (s *Store) Update(id string, a Alias) (Alias, error) {
+	if err := a.validate(); err != nil {
+		return Alias{}, err
+	}
+	a.ID = id
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, old := range s.aliases {
+		if old.ID == id {
+			s.aliases[i] = &a
+			if err := s.save(); err != nil {
+				s.aliases[i] = old
+				return Alias{}, err
+			}
+			return a, nil
+		}
+	}
+	return Alias{}, ErrNotFound
+}
+
+// Delete removes the alias with the given ID
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, a := range s.aliases {
+		if a.ID == id {
+			old := s.aliases
+			s.aliases = append(append([]*Alias(nil), old[:i]...), old[i+1:]...)
+			if err := s.save(); err != nil {
+				s.aliases = old
+				return err
+			}
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// save writes the aliases to a temporary file and renames it over the
+// alias file, so a crash never leaves a truncated file behind
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.aliases, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode aliases: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.filePath), ".aliases-*.json")
+	if err != nil {
+		return fmt.Errorf("create alias file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write alias file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write alias file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.filePath); err != nil {
+		return fmt.Errorf("replace alias file: %w", err)
+	}
+	return nil
+}
+
+// Resolve returns the name and group of the most specific alias matching
+// the address. Longer prefixes win, then port and node specific aliases.
+func (s *Store) Resolve(ip string, port uint16, nodeID uint32) (string, string, bool) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", "", false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var best *Alias
+	bestScore := -1
+	for _, a := range s.aliases {
+		if (a.Port != 0 && a.Port != port) || (a.NodeID != 0 && a.NodeID != nodeID) {
+			continue
+		}
+		if !a.network.Contains(addr) {
+			continue
+		}
+
+		ones, _ := a.network.Mask.Size()
+		score := ones * 4
+		if a.Port != 0 {
+			score += 2
+		}
+		if a.NodeID != 0 {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = a, score
+		}
+	}
+
+	if best == nil {
+		return "", "", false
+	}
+	return best.Name, best.Group, true
+}
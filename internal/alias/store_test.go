@@ -0,0 +1,118 @@
+package alias
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreCRUDPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases.json")
+
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open empty store: %v", err)
+	}
+
+	created, err := s.Create(Alias{CIDR: "10.20.3.4", Name: "SBC-EU-1", Group: "sbc"})
+	if err != nil {
+		t.Fatalf("Failed to create alias: %v", err)
+	}
+	if created.ID == "" {
+		t.Fatal("Expected an ID to be assigned")
+	}
+
+	if _, err := s.Update(created.ID, Alias{CIDR: "10.20.3.0/24", Name: "SBC-EU", Group: "sbc"}); err != nil {
+		t.Fatalf("Failed to update alias: %v", err)
+	}
+	if _, err := s.Create(Alias{CIDR: "192.0.2.1", Name: "tmp"}); err != nil {
+		t.Fatalf("Failed to create alias: %v", err)
+	}
+
+	list := s.List()
+	if len(list) != 2 {
+		t.Fatalf("Expected 2 aliases, got %d", len(list))
+	}
+	if err := s.Delete(list[1].ID); err != nil {
+		t.Fatalf("Failed to delete alias: %v", err)
+	}
+
+	reloaded, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reload store: %v", err)
+	}
+	got, err := reloaded.Get(created.ID)
+	if err != nil {
+		t.Fatalf("Expected alias to survive reload: %v", err)
+	}
+	if got.Name != "SBC-EU" || got.CIDR != "10.20.3.0/24" {
+		t.Errorf("Unexpected reloaded alias %+v", got)
+	}
+	if len(reloaded.List()) != 1 {
+		t.Errorf("Expected deleted alias to stay deleted, got %d aliases", len(reloaded.List()))
+	}
+	if name, _, ok := reloaded.Resolve("10.20.3.99", 5060, 0); !ok || name != "SBC-EU" {
+		t.Errorf("Expected reloaded network to resolve, got %q", name)
+	}
+
+	// No temporary files are left behind
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the alias file, got %d entries", len(entries))
+	}
+}
+
+func TestStoreErrors(t *testing.T) {
+	s, _ := NewStore(filepath.Join(t.TempDir(), "aliases.json"))
+
+	if _, err := s.Create(Alias{CIDR: "not-an-ip", Name: "x"}); err != ErrInvalidCIDR {
+		t.Errorf("Expected ErrInvalidCIDR, got %v", err)
+	}
+	if _, err := s.Create(Alias{CIDR: "10.0.0.1"}); err != ErrNameMissing {
+		t.Errorf("Expected ErrNameMissing, got %v", err)
+	}
+	if _, err := s.Update("missing", Alias{CIDR: "10.0.0.1", Name: "x"}); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound on update, got %v", err)
+	}
+	if err := s.Delete("missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound on delete, got %v", err)
+	}
+}
+
+func TestStoreResolveMostSpecific(t *testing.T) {
+	s, _ := NewStore(filepath.Join(t.TempDir(), "aliases.json"))
+
+	for _, a := range []Alias{
+		{CIDR: "10.0.0.0/8", Name: "core"},
+		{CIDR: "10.1.0.0/16", Name: "site-a"},
+		{CIDR: "10.1.0.5", Name: "sbc"},
+		{CIDR: "10.1.0.5", Port: 5080, Name: "sbc-trunk"},
+		{CIDR: "10.1.0.5", Port: 5080, NodeID: 2002, Name: "sbc-trunk-b"},
+		{CIDR: "2001:db8::/32", Name: "v6"},
+	} {
+		if _, err := s.Create(a); err != nil {
+			t.Fatalf("Failed to create alias %s: %v", a.Name, err)
+		}
+	}
+
+	tests := []struct {
+		ip     string
+		port   uint16
+		nodeID uint32
+		want   string
+	}{
+		{"10.9.9.9", 5060, 0, "core"},
+		{"10.1.2.3", 5060, 0, "site-a"},
+		{"10.1.0.5", 5060, 0, "sbc"},
+		{"10.1.0.5", 5080, 2001, "sbc-trunk"},
+		{"10.1.0.5", 5080, 2002, "sbc-trunk-b"},
+		{"2001:db8::1", 5060, 0, "v6"},
+		{"192.0.2.1", 5060, 0, ""},
+	}
+	for _, tt := range tests {
+		name, _, _ := s.Resolve(tt.ip, tt.port, tt.nodeID)
+		if name != tt.want {
+			t.Errorf("Resolve(%s, %d, %d) = %q, want %q", tt.ip, tt.port, tt.nodeID, name, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sipcapture/hepop-go/internal/alias"
+	"github.com/sipcapture/hepop-go/internal/callflow"
+	"github.com/sipcapture/hepop-go/internal/writer"
+)
+
+// SetAliasStore enables the alias endpoints and alias resolution in search
+// and call flow results
+func (a *API) SetAliasStore(store *alias.Store) {
+	a.aliases = store
+}
+
+// resolver returns the alias store as a call flow resolver, or nil
+func (a *API) resolver() callflow.Resolver {
+	if a.aliases == nil {
+		return nil
+	}
+	return a.aliases
+}
+
+// applyAliases names the source and destination of search results
+func (a *API) applyAliases(results *writer.SearchResult) {
+	if a.aliases == nil {
+		return
+	}
+	for _, packet := range results.Results {
+		packet.SrcAlias, _, _ = a.aliases.Resolve(packet.SrcIP, packet.SrcPort, packet.NodeID)
+		packet.DstAlias, _, _ = a.aliases.Resolve(packet.DstIP, packet.DstPort, packet.NodeID)
+	}
+}
+
+func (a *API) requireAliases(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.aliases == nil {
+			http.Error(w, "alias store is disabled", http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *API) handleListAliases(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(a.aliases.List())
+}
+
+func (a *API) handleGetAlias(w http.ResponseWriter, r *http.Request) {
+	result, err := a.aliases.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		writeAliasError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (a *API) handleCreateAlias(w http.ResponseWriter, r *http.Request) {
+	var req alias.Alias
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := a.aliases.Create(req)
+	if err != nil {
+		writeAliasError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(result)
+}
+
+func (a *API) handleUpdateAlias(w http.ResponseWriter, r *http.Request) {
+	var req alias.Alias
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := a.aliases.Update(chi.URLParam(r, "id"), req)
+	if err != nil {
+		writeAliasError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (a *API) handleDeleteAlias(w http.ResponseWriter, r *http.Request) {
+	if err := a.aliases.Delete(chi.URLParam(r, "id")); err != nil {
+		writeAliasError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeAliasError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, alias.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, alias.ErrInvalidCIDR), errors.Is(err, alias.ErrNameMissing):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
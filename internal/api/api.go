@@ -3,23 +3,36 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/sipcapture/hepop-go/internal/alias"
+	"github.com/sipcapture/hepop-go/internal/callflow"
+	"github.com/sipcapture/hepop-go/internal/denylist"
+	"github.com/sipcapture/hepop-go/internal/manager"
+	"github.com/sipcapture/hepop-go/internal/pipeline"
+	"github.com/sipcapture/hepop-go/internal/registrar"
 	"github.com/sipcapture/hepop-go/internal/writer"
 	"github.com/sirupsen/logrus"
 )
 
 type API struct {
-	config  *Config
-	writer  writer.Writer
-	router  *chi.Mux
-	metrics *Metrics
-	server  *http.Server
+	config        *Config
+	writer        writer.Writer
+	registrations *registrar.Store
+	aliases       *alias.Store
+	filter        *pipeline.Filter
+	denyList      *denylist.List
+	sql           *manager.DuckDBManager
+	router        *chi.Mux
+	metrics       *Metrics
+	server        *http.Server
 }
 
 type Config struct {
@@ -65,6 +78,43 @@ func (a *API) setupRoutes() {
 		r.Get("/search", a.handleSearch)
 		r.Post("/search", a.handleSearch)
 
+		// Call flow
+		r.Get("/calls/{cid}/flow", a.handleCallFlow)
+
+		// Registrations
+		r.Get("/registrations", a.handleRegistrations)
+
+		// Aliases
+		r.Route("/aliases", func(r chi.Router) {
+			r.Use(a.requireAliases)
+			r.Get("/", a.handleListAliases)
+			r.Post("/", a.handleCreateAlias)
+			r.Get("/{id}", a.handleGetAlias)
+			r.Put("/{id}", a.handleUpdateAlias)
+			r.Delete("/{id}", a.handleDeleteAlias)
+		})
+
+		// Deny list
+		r.Route("/denylist", func(r chi.Router) {
+			r.Use(a.requireDenyList)
+			r.Get("/", a.handleListDenied)
+			r.Post("/", a.handleAddDenied)
+			r.Delete("/", a.handleRemoveDenied)
+		})
+
+		// Filter
+		r.Route("/filter", func(r chi.Router) {
+			r.Use(a.requireFilter)
+			r.Get("/rules", a.handleFilterRules)
+			r.Post("/reload", a.handleFilterReload)
+		})
+
+		// SQL
+		r.Route("/sql", func(r chi.Router) {
+			r.Use(a.requireSQL)
+			r.Post("/", a.handleSQL)
+		})
+
 		// Debug
 		if a.config.EnablePprof {
 			r.Mount("/debug", middleware.Profiler())
@@ -77,6 +127,11 @@ func (a *API) setupRoutes() {
 	}
 }
 
+// SetRegistrationStore enables the registrations endpoint
+func (a *API) SetRegistrationStore(store *registrar.Store) {
+	a.registrations = store
+}
+
 func (a *API) Start() error {
 	logrus.Infof("Starting HTTP API on %s", a.server.Addr)
 	return a.server.ListenAndServe()
@@ -118,13 +173,15 @@ func (a *API) handleStats(w http.ResponseWriter, r *http.Request) {
 }
 
 type SearchRequest struct {
-	Query     string    `json:"query"`
-	FromTime  time.Time `json:"from_time"`
-	ToTime    time.Time `json:"to_time"`
-	Limit     int       `json:"limit"`
-	Offset    int       `json:"offset"`
-	OrderBy   string    `json:"order_by"`
-	OrderDesc bool      `json:"order_desc"`
+	Query       string    `json:"query"`
+	FromTime    time.Time `json:"from_time"`
+	ToTime      time.Time `json:"to_time"`
+	Limit       int       `json:"limit"`
+	Offset      int       `json:"offset"`
+	OrderBy     string    `json:"order_by"`
+	OrderDesc   bool      `json:"order_desc"`
+	CIDs        []string  `json:"cids"`
+	IncludeLogs bool      `json:"include_logs"`
 }
 
 func (a *API) handleSearch(w http.ResponseWriter, r *http.Request) {
@@ -142,6 +199,8 @@ func (a *API) handleSearch(w http.ResponseWriter, r *http.Request) {
 		req.Offset, _ = strconv.Atoi(r.URL.Query().Get("offset"))
 		req.OrderBy = r.URL.Query().Get("order_by")
 		req.OrderDesc = r.URL.Query().Get("order_desc") == "true"
+		req.CIDs = r.URL.Query()["cid"]
+		req.IncludeLogs = r.URL.Query().Get("logs") == "true"
 
 		// Parse time range
 		if from := r.URL.Query().Get("from"); from != "" {
@@ -162,18 +221,101 @@ func (a *API) handleSearch(w http.ResponseWriter, r *http.Request) {
 
 	// Execute search
 	results, err := a.writer.Search(r.Context(), writer.SearchParams{
-		Query:     req.Query,
-		FromTime:  req.FromTime,
-		ToTime:    req.ToTime,
-		Limit:     req.Limit,
-		Offset:    req.Offset,
-		OrderBy:   req.OrderBy,
-		OrderDesc: req.OrderDesc,
+		Query:       req.Query,
+		FromTime:    req.FromTime,
+		ToTime:      req.ToTime,
+		Limit:       req.Limit,
+		Offset:      req.Offset,
+		OrderBy:     req.OrderBy,
+		OrderDesc:   req.OrderDesc,
+		CIDs:        req.CIDs,
+		IncludeLogs: req.IncludeLogs,
 	})
+	if errors.Is(err, writer.ErrParquetBadQuery) || errors.Is(err, writer.ErrPostgresBadQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	a.applyAliases(&results)
 	json.NewEncoder(w).Encode(results)
 }
+
+func (a *API) handleCallFlow(w http.ResponseWriter, r *http.Request) {
+	// Related calls, e.g. both legs through a B2BUA, can be added as cid
+	// query parameters
+	cids := []string{chi.URLParam(r, "cid")}
+	for _, cid := range r.URL.Query()["cid"] {
+		if cid != "" && !slices.Contains(cids, cid) {
+			cids = append(cids, cid)
+		}
+	}
+
+	params := writer.SearchParams{
+		CIDs:     cids,
+		FromTime: time.Now().Add(-24 * time.Hour),
+		ToTime:   time.Now(),
+		Limit:    5000,
+		OrderBy:  "timestamp",
+		// Application logs are shown between the messages they refer to
+		IncludeLogs: r.URL.Query().Get("logs") != "false",
+	}
+	if from := r.URL.Query().Get("from"); from != "" {
+		params.FromTime, _ = time.Parse(time.RFC3339, from)
+	}
+	if to := r.URL.Query().Get("to"); to != "" {
+		params.ToTime, _ = time.Parse(time.RFC3339, to)
+	}
+	if limit, _ := strconv.Atoi(r.URL.Query().Get("limit")); limit > 0 {
+		params.Limit = limit
+	}
+
+	results, err := a.writer.Search(r.Context(), params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(results.Results) == 0 {
+		http.Error(w, "call not found", http.StatusNotFound)
+		return
+	}
+
+	flow := callflow.Build(cids, results.Results, callflow.DefaultDedupWindow, a.resolver())
+	// RTP stream reports are kept apart from the packets by the writers
+	// storing them
+	if searcher, ok := a.writer.(writer.RTPReportSearcher); ok {
+		reports, err := searcher.SearchRTPReports(r.Context(), cids, params.FromTime, params.ToTime)
+		if err != nil {
+			logrus.Warnf("Reading RTP reports of %s failed: %v", cids[0], err)
+		}
+		flow.AddReports(reports, a.resolver())
+	}
+
+	json.NewEncoder(w).Encode(flow)
+}
+
+func (a *API) handleRegistrations(w http.ResponseWriter, r *http.Request) {
+	if a.registrations == nil {
+		http.Error(w, "registration tracking is disabled", http.StatusNotFound)
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit == 0 {
+		limit = 100
+	}
+
+	results := a.registrations.Search(
+		r.URL.Query().Get("aor"),
+		r.URL.Query().Get("failed") == "true",
+		limit,
+	)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total":   len(results),
+		"results": results,
+	})
+}
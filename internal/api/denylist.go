@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sipcapture/hepop-go/internal/denylist"
+)
+
+// DenyRequest adds an address or network to the deny list, TTL is a Go
+// duration such as 1h, empty for a permanent entry
+type DenyRequest struct {
+	CIDR   string `json:"cidr"`
+	Reason string `json:"reason"`
+	TTL    string `json:"ttl"`
+}
+
+// SetDenyList enables the deny list endpoints
+func (a *API) SetDenyList(list *denylist.List) {
+	a.denyList = list
+}
+
+func (a *API) requireDenyList(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.denyList == nil {
+			http.Error(w, "deny list is disabled", http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *API) handleListDenied(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(a.denyList.List())
+}
+
+func (a *API) handleAddDenied(w http.ResponseWriter, r *http.Request) {
+	var req DenyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl < 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entry, err := a.denyList.Add(req.CIDR, req.Reason, ttl)
+	if err != nil {
+		writeDenyListError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
+
+func (a *API) handleRemoveDenied(w http.ResponseWriter, r *http.Request) {
+	if err := a.denyList.Remove(r.URL.Query().Get("cidr")); err != nil {
+		writeDenyListError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeDenyListError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, denylist.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, denylist.ErrInvalidCIDR):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
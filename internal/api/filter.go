@@ -0,0 +1,43 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/sipcapture/hepop-go/internal/pipeline"
+)
+
+// SetFilter enables the filter endpoints
+func (a *API) SetFilter(filter *pipeline.Filter) {
+	a.filter = filter
+}
+
+func (a *API) requireFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.filter == nil {
+			http.Error(w, "filter is disabled", http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *API) handleFilterRules(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(a.filter.Rules())
+}
+
+func (a *API) handleFilterReload(w http.ResponseWriter, r *http.Request) {
+	if err := a.filter.Reload(); err != nil {
+		switch {
+		case errors.Is(err, pipeline.ErrFilterNoFile):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, pipeline.ErrExprSyntax), errors.Is(err, pipeline.ErrFilterBadAction):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(a.filter.Rules())
+}
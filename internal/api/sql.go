@@ -0,0 +1,54 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/sipcapture/hepop-go/internal/manager"
+)
+
+type SQLRequest struct {
+	Query string `json:"query"`
+}
+
+// SetSQL enables the read-only SQL endpoint on the parquet dataset
+func (a *API) SetSQL(engine *manager.DuckDBManager) {
+	a.sql = engine
+}
+
+func (a *API) requireSQL(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.sql == nil {
+			http.Error(w, "sql is disabled", http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *API) handleSQL(w http.ResponseWriter, r *http.Request) {
+	var req SQLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Query == "" {
+		http.Error(w, "query required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := a.sql.Query(r.Context(), req.Query)
+	if err != nil {
+		switch {
+		case errors.Is(err, manager.ErrQueryTimeout):
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		default:
+			// Not allowed queries and errors of DuckDB, e.g. unknown
+			// columns, are mistakes of the analyst
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,316 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Client speaks the subset of the S3 API the uploader needs, signed with
+// AWS Signature Version 4. It works with AWS, MinIO, Ceph and the other S3
+// compatible stores.
+type s3Client struct {
+	client    *http.Client
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	// pathStyle addresses objects as endpoint/bucket/key instead of
+	// bucket.endpoint/key, MinIO needs it
+	pathStyle bool
+	now       func() time.Time
+}
+
+// s3Error is the error document S3 answers failed requests with
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3 status %d", e.Status)
+	}
+	return fmt.Sprintf("s3 status %d: %s: %s", e.Status, e.Code, e.Message)
+}
+
+// retryable reports if a request failing with err may succeed when sent
+// again
+func retryable(err error) bool {
+	var s3err *s3Error
+	if errors.As(err, &s3err) {
+		return s3err.Status >= 500 || s3err.Status == http.StatusTooManyRequests || s3err.Code == "SlowDown"
+	}
+	return !errors.Is(err, context.Canceled)
+}
+
+// s3Object is the result of an upload or a HEAD request
+type s3Object struct {
+	ETag string
+	Size int64
+}
+
+// putObject uploads body in a single request, S3 verifies it with the MD5
+func (c *s3Client) putObject(ctx context.Context, key string, body []byte) (string, error) {
+	sum := md5.Sum(body)
+	header := http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}
+	resp, err := c.do(ctx, http.MethodPut, key, nil, header, body)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+func (c *s3Client) createMultipartUpload(ctx context.Context, key string) (string, error) {
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid multipart upload response: %w", err)
+	}
+	if result.UploadID == "" {
+		return "", fmt.Errorf("multipart upload response without upload id")
+	}
+	return result.UploadID, nil
+}
+
+func (c *s3Client) uploadPart(ctx context.Context, key, uploadID string, number int, body []byte) (string, error) {
+	sum := md5.Sum(body)
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	header := http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}
+	resp, err := c.do(ctx, http.MethodPut, key, query, header, body)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// completedPart is a part of a CompleteMultipartUpload request
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (c *s3Client) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []completedPart) (string, error) {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// S3 may fail the completion after answering 200
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		XMLName xml.Name
+		ETag    string `xml:"ETag"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.Unmarshal(data, &result); err != nil {
+		return "", fmt.Errorf("invalid complete multipart upload response: %w", err)
+	}
+	if result.XMLName.Local == "Error" {
+		return "", &s3Error{Status: http.StatusInternalServerError, Code: result.Code, Message: result.Message}
+	}
+	return result.ETag, nil
+}
+
+func (c *s3Client) abortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *s3Client) headObject(ctx context.Context, key string) (s3Object, error) {
+	resp, err := c.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return s3Object{}, err
+	}
+	resp.Body.Close()
+	return s3Object{ETag: resp.Header.Get("ETag"), Size: resp.ContentLength}, nil
+}
+
+// do sends a signed request and turns error responses into an *s3Error
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *c.endpoint
+	path := "/" + escapePath(key)
+	if c.pathStyle {
+		path = "/" + escapePath(c.bucket) + path
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	u.Path, u.RawPath = strings.TrimRight(c.endpoint.Path, "/")+unescapePath(path), strings.TrimRight(c.endpoint.EscapedPath(), "/")+path
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if len(body) == 0 {
+		// No body instead of an empty one for GET, HEAD and DELETE
+		req.Body, req.GetBody = http.NoBody, nil
+	}
+	c.sign(req, body)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		s3err := &s3Error{Status: resp.StatusCode}
+		if data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10)); len(data) > 0 {
+			xml.Unmarshal(data, s3err)
+		}
+		return nil, s3err
+	}
+	return resp, nil
+}
+
+// sign adds the Signature Version 4 authorization of the request
+func (c *s3Client) sign(req *http.Request, body []byte) {
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+	t := now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	payloadHash := emptySHA256
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Host and the x-amz-, content- and range headers are signed
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || strings.HasPrefix(lower, "content-") || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// escapePath encodes every byte of a key except the unreserved characters
+// and slashes, as Signature Version 4 requires
+func escapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func unescapePath(path string) string {
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		return path
+	}
+	return unescaped
+}
+
+// canonicalQuery encodes the query sorted by name with the Signature Version
+// 4 escaping, url.Values.Encode escapes spaces as +
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, strings.ReplaceAll(escapePath(name), "/", "%2F")+"="+strings.ReplaceAll(escapePath(value), "/", "%2F"))
+		}
+	}
+	return strings.Join(parts, "&")
+}
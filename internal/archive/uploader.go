@@ -0,0 +1,574 @@
+// Package archive ships the files the writers finish to S3 compatible object
+// storage.
+package archive
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrArchiveClosed  = errors.New("archive uploader is closed")
+	ErrArchiveBadPath = errors.New("file is not below the archive directory")
+)
+
+// maxBacklogDelay bounds the delay before a failed file is uploaded again
+const maxBacklogDelay = 10 * time.Minute
+
+type Config struct {
+	// Endpoint is the URL of the S3 API, e.g. https://s3.eu-west-1.amazonaws.com
+	// or http://minio:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses objects as endpoint/bucket/key, MinIO needs it
+	PathStyle bool
+	// Prefix is put before the path of the file below its directory. The
+	// placeholders {hostname}, {year}, {month}, {day} and {hour} are
+	// replaced, the time is the UTC modification time of the file.
+	Prefix string
+	// PartSize is the size of the parts of multipart uploads, smaller files
+	// are uploaded in one request. S3 requires at least 5 MB, default 16 MB.
+	PartSize int64
+	// Retries is the number of times a failed request is repeated, with
+	// RetryDelay doubling in between. Default 3, negative disables retries.
+	// A file that still fails is uploaded again later, the delay doubles
+	// from RetryDelay up to 10 minutes.
+	Retries    int
+	RetryDelay time.Duration
+	Timeout    time.Duration
+	// DeleteLocal removes files once the stored object was verified
+	DeleteLocal bool
+	// Manifest is the file a JSON line is appended to for every uploaded
+	// object, empty disables it
+	Manifest string
+}
+
+// ManifestEntry is the manifest line of an uploaded object
+type ManifestEntry struct {
+	Time   time.Time `json:"time"`
+	File   string    `json:"file"`
+	Bucket string    `json:"bucket"`
+	Key    string    `json:"key"`
+	Size   int64     `json:"size"`
+	ETag   string    `json:"etag"`
+}
+
+type upload struct {
+	dir  string
+	path string
+	// failures counts the failed attempts, due is the time of the next
+	failures int
+	due      time.Time
+}
+
+// Uploader uploads finished files in the background. A file whose object
+// already exists with the same size and ETag is not sent again. Objects are
+// verified with a HEAD request against the size and the MD5 based ETag
+// before the upload is recorded and the local file removed. Failed files
+// stay in the backlog and are retried.
+type Uploader struct {
+	config   Config
+	s3       *s3Client
+	hostname string
+	wake     chan struct{}
+	wg       sync.WaitGroup
+
+	// mu guards the manifest, the set of uploaded files and the backlog
+	mu       sync.Mutex
+	uploaded map[string]bool
+	backlog  []upload
+	// queued are the files in the backlog or being uploaded
+	queued map[string]bool
+	closed bool
+}
+
+func NewUploader(config Config) (*Uploader, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("archive endpoint and bucket are required")
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid archive endpoint: %s", config.Endpoint)
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.PartSize <= 0 {
+		config.PartSize = 16 << 20
+	}
+	if config.Retries < 0 {
+		config.Retries = 0
+	} else if config.Retries == 0 {
+		config.Retries = 3
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = time.Second
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Minute
+	}
+	hostname, _ := os.Hostname()
+
+	u := &Uploader{
+		config: config,
+		s3: &s3Client{
+			client:    &http.Client{},
+			endpoint:  endpoint,
+			region:    config.Region,
+			bucket:    config.Bucket,
+			accessKey: config.AccessKey,
+			secretKey: config.SecretKey,
+			pathStyle: config.PathStyle,
+		},
+		hostname: hostname,
+		wake:     make(chan struct{}, 1),
+		uploaded: make(map[string]bool),
+		queued:   make(map[string]bool),
+	}
+	if err := u.loadManifest(); err != nil {
+		return nil, err
+	}
+	u.wg.Add(1)
+	go u.uploadLoop()
+	return u, nil
+}
+
+// Upload queues a finished file, its key is the prefix and the path below
+// dir. A file already queued is not queued again.
+func (u *Uploader) Upload(dir, path string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		return ErrArchiveClosed
+	}
+	if u.queued[path] {
+		return nil
+	}
+	u.queued[path] = true
+	u.backlog = append(u.backlog, upload{dir: dir, path: path})
+	u.notify()
+	return nil
+}
+
+// Pending reports whether a file is queued or being uploaded
+func (u *Uploader) Pending(path string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.queued[path]
+}
+
+// notify wakes the upload loop, u.mu must be held
+func (u *Uploader) notify() {
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// UploadDir queues the files below dir that are not in the manifest, e.g.
+// the ones left over by a previous run. Hidden files are skipped, the
+// writers use them for files in progress.
+func (u *Uploader) UploadDir(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || path == u.config.Manifest {
+			return nil
+		}
+		u.mu.Lock()
+		done := u.uploaded[path]
+		u.mu.Unlock()
+		if done {
+			return nil
+		}
+		return u.Upload(dir, path)
+	})
+}
+
+func (u *Uploader) uploadLoop() {
+	defer u.wg.Done()
+
+	for {
+		file, ok := u.next()
+		if !ok {
+			return
+		}
+		err := u.upload(file)
+		u.done(file, err)
+	}
+}
+
+// next waits for the next due file of the backlog. Once the uploader is
+// closed every file is due and false is returned when the backlog is empty.
+func (u *Uploader) next() (upload, bool) {
+	for {
+		u.mu.Lock()
+		if u.closed && len(u.backlog) == 0 {
+			u.mu.Unlock()
+			return upload{}, false
+		}
+		now := time.Now()
+		var wait time.Duration
+		for i, file := range u.backlog {
+			if u.closed || !file.due.After(now) {
+				u.backlog = append(u.backlog[:i], u.backlog[i+1:]...)
+				u.mu.Unlock()
+				return file, true
+			}
+			if d := file.due.Sub(now); wait == 0 || d < wait {
+				wait = d
+			}
+		}
+		u.mu.Unlock()
+
+		if wait == 0 {
+			<-u.wake
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-u.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// done puts a failed file back into the backlog unless it can never
+// succeed. Failures after Close leave the file for the next start.
+func (u *Uploader) done(file upload, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err == nil {
+		delete(u.queued, file.path)
+		return
+	}
+	if u.closed || errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrArchiveBadPath) {
+		logrus.Errorf("Archiving %s failed: %v", file.path, err)
+		delete(u.queued, file.path)
+		return
+	}
+	delay := u.config.RetryDelay << file.failures
+	if delay <= 0 || delay > maxBacklogDelay {
+		delay = maxBacklogDelay
+	}
+	file.failures++
+	file.due = time.Now().Add(delay)
+	logrus.Errorf("Archiving %s failed, retrying in %s: %v", file.path, delay, err)
+	u.backlog = append(u.backlog, file)
+}
+
+func (u *Uploader) upload(file upload) error {
+	info, err := os.Stat(file.path)
+	if err != nil {
+		return err
+	}
+	key, err := u.key(file.dir, file.path, info.ModTime())
+	if err != nil {
+		return err
+	}
+
+	etag, err := u.etag(file.path, info.Size())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), u.config.Timeout)
+	defer cancel()
+
+	// A previous run may have uploaded the file without recording it
+	stored, err := u.stored(ctx, key, info.Size(), etag)
+	if err != nil {
+		return err
+	}
+	if !stored {
+		if info.Size() <= u.config.PartSize {
+			err = u.putObject(ctx, key, file.path)
+		} else {
+			err = u.multipartUpload(ctx, key, file.path, info.Size())
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var object s3Object
+	err = u.retry(ctx, func() (err error) {
+		object, err = u.s3.headObject(ctx, key)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("can't verify %s: %w", key, err)
+	}
+	if object.Size != info.Size() || strings.Trim(object.ETag, `"`) != etag {
+		return fmt.Errorf("verification of %s failed: stored %d bytes with ETag %s, expected %d bytes with ETag %s",
+			key, object.Size, object.ETag, info.Size(), etag)
+	}
+
+	if err := u.record(ManifestEntry{
+		Time:   time.Now().UTC(),
+		File:   file.path,
+		Bucket: u.config.Bucket,
+		Key:    key,
+		Size:   info.Size(),
+		ETag:   etag,
+	}); err != nil {
+		return err
+	}
+	if u.config.DeleteLocal {
+		if err := os.Remove(file.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// key returns the object key of a file
+func (u *Uploader) key(dir, file string, modTime time.Time) (string, error) {
+	rel, err := filepath.Rel(dir, file)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%w: %s is not below %s", ErrArchiveBadPath, file, dir)
+	}
+	t := modTime.UTC()
+	prefix := strings.NewReplacer(
+		"{hostname}", u.hostname,
+		"{year}", t.Format("2006"),
+		"{month}", t.Format("01"),
+		"{day}", t.Format("02"),
+		"{hour}", t.Format("15"),
+	).Replace(u.config.Prefix)
+	return strings.TrimPrefix(path.Join(prefix, filepath.ToSlash(rel)), "/"), nil
+}
+
+// etag returns the ETag S3 gives the object of a file: the MD5 of a file
+// sent in one request, or the MD5 of the part MD5s followed by the number
+// of parts for a multipart upload
+func (u *Uploader) etag(file string, size int64) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if size <= u.config.PartSize {
+		sum := md5.New()
+		if _, err := io.Copy(sum, f); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(sum.Sum(nil)), nil
+	}
+	sums := md5.New()
+	parts := 0
+	for offset := int64(0); offset < size; offset += u.config.PartSize {
+		sum := md5.New()
+		if _, err := io.Copy(sum, io.NewSectionReader(f, offset, u.config.PartSize)); err != nil {
+			return "", err
+		}
+		sums.Write(sum.Sum(nil))
+		parts++
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sums.Sum(nil)), parts), nil
+}
+
+// stored reports whether the object of a file already exists
+func (u *Uploader) stored(ctx context.Context, key string, size int64, etag string) (bool, error) {
+	var object s3Object
+	err := u.retry(ctx, func() (err error) {
+		object, err = u.s3.headObject(ctx, key)
+		return err
+	})
+	var s3err *s3Error
+	if errors.As(err, &s3err) && s3err.Status == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("can't check %s: %w", key, err)
+	}
+	return object.Size == size && strings.Trim(object.ETag, `"`) == etag, nil
+}
+
+// putObject uploads a small file
+func (u *Uploader) putObject(ctx context.Context, key, file string) error {
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	err = u.retry(ctx, func() error {
+		_, err := u.s3.putObject(ctx, key, body)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("can't upload %s: %w", key, err)
+	}
+	return nil
+}
+
+// multipartUpload uploads a file in parts
+func (u *Uploader) multipartUpload(ctx context.Context, key, file string, size int64) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var uploadID string
+	err = u.retry(ctx, func() (err error) {
+		uploadID, err = u.s3.createMultipartUpload(ctx, key)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("can't start upload of %s: %w", key, err)
+	}
+
+	if err := u.uploadParts(ctx, key, uploadID, f, size); err != nil {
+		// Parts of unfinished uploads are stored and billed until aborted
+		abortCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if aerr := u.s3.abortMultipartUpload(abortCtx, key, uploadID); aerr != nil {
+			logrus.Warnf("Can't abort upload of %s: %v", key, aerr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (u *Uploader) uploadParts(ctx context.Context, key, uploadID string, f *os.File, size int64) error {
+	var parts []completedPart
+	buf := make([]byte, u.config.PartSize)
+	for offset, number := int64(0), 1; offset < size; offset, number = offset+u.config.PartSize, number+1 {
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		body := buf[:n]
+
+		var etag string
+		err = u.retry(ctx, func() (err error) {
+			etag, err = u.s3.uploadPart(ctx, key, uploadID, number, body)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("can't upload part %d of %s: %w", number, key, err)
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: etag})
+	}
+
+	err := u.retry(ctx, func() error {
+		_, err := u.s3.completeMultipartUpload(ctx, key, uploadID, parts)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("can't complete upload of %s: %w", key, err)
+	}
+	return nil
+}
+
+// retry calls fn until it succeeds, fails permanently or the retries are
+// used up
+func (u *Uploader) retry(ctx context.Context, fn func() error) error {
+	delay := u.config.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == u.config.Retries || !retryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (u *Uploader) loadManifest() error {
+	if u.config.Manifest == "" {
+		return nil
+	}
+	f, err := os.Open(u.config.Manifest)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't read archive manifest: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry ManifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			u.uploaded[entry.File] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("can't read archive manifest: %w", err)
+	}
+	return nil
+}
+
+// record appends an uploaded object to the manifest
+func (u *Uploader) record(entry ManifestEntry) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.uploaded[entry.File] = true
+	if u.config.Manifest == "" {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(u.config.Manifest, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("can't write archive manifest: %w", err)
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("can't write archive manifest: %w", err)
+	}
+	return nil
+}
+
+// Close tries the files in the backlog once more and stops the uploader,
+// files that fail stay on disk for the next start
+func (u *Uploader) Close() error {
+	u.mu.Lock()
+	u.closed = true
+	u.notify()
+	u.mu.Unlock()
+	u.wg.Wait()
+	return nil
+}
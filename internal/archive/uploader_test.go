@@ -0,0 +1,406 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an S3 stand-in storing objects in memory. It checks the
+// signature of every request and fails the first requests of each kind
+// with 503 when flaky is set. With truncate set PUT stores all but the last
+// byte.
+type fakeS3 struct {
+	t      *testing.T
+	server *httptest.Server
+	signer *s3Client
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	etags    map[string]string
+	uploads  map[string]map[int][]byte
+	flaky    map[string]bool
+	calls    map[string]int
+	truncate bool
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	s := &fakeS3{
+		t:       t,
+		signer:  &s3Client{region: "us-east-1", accessKey: "hepop", secretKey: "secret"},
+		objects: make(map[string][]byte),
+		etags:   make(map[string]string),
+		uploads: make(map[string]map[int][]byte),
+		flaky:   make(map[string]bool),
+		calls:   make(map[string]int),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *fakeS3) serve(rw http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	// Sign the request as received, the signatures must match
+	check, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	for _, name := range []string{"Content-Md5", "X-Amz-Date"} {
+		if values, ok := r.Header[name]; ok {
+			check.Header[name] = values
+		}
+	}
+	date, _ := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	signer := *s.signer
+	signer.now = func() time.Time { return date }
+	signer.sign(check, body)
+	if check.Header.Get("Authorization") != r.Header.Get("Authorization") {
+		s.t.Errorf("Invalid signature for %s %s", r.Method, r.URL.RequestURI())
+		s.fail(rw, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := r.URL.Query()
+	kind := r.Method
+	if _, ok := query["uploads"]; ok {
+		kind = "create"
+	} else if query.Has("partNumber") {
+		kind = "part"
+	} else if query.Has("uploadId") && r.Method == http.MethodPost {
+		kind = "complete"
+	}
+	s.calls[kind]++
+	if s.flaky[kind] && s.calls[kind] == 1 {
+		s.fail(rw, http.StatusServiceUnavailable, "SlowDown")
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/archive/")
+	switch kind {
+	case http.MethodPut:
+		sum := md5.Sum(body)
+		if s.truncate {
+			body = body[:len(body)-1]
+		}
+		s.objects[key] = body
+		s.etags[key] = hex.EncodeToString(sum[:])
+		rw.Header().Set("ETag", `"`+s.etags[key]+`"`)
+	case http.MethodHead:
+		object, ok := s.objects[key]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Header().Set("ETag", `"`+s.etags[key]+`"`)
+		rw.Header().Set("Content-Length", fmt.Sprint(len(object)))
+	case "create":
+		id := fmt.Sprintf("upload-%d", len(s.uploads)+1)
+		s.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(rw, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case "part":
+		var number int
+		fmt.Sscan(query.Get("partNumber"), &number)
+		s.uploads[query.Get("uploadId")][number] = body
+		sum := md5.Sum(body)
+		rw.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case "complete":
+		var request struct {
+			Parts []completedPart `xml:"Part"`
+		}
+		xml.Unmarshal(body, &request)
+		var object []byte
+		sums := md5.New()
+		for i, part := range request.Parts {
+			data := s.uploads[query.Get("uploadId")][part.PartNumber]
+			sum := md5.Sum(data)
+			if part.PartNumber != i+1 || part.ETag != `"`+hex.EncodeToString(sum[:])+`"` {
+				s.fail(rw, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			object = append(object, data...)
+			sums.Write(sum[:])
+		}
+		delete(s.uploads, query.Get("uploadId"))
+		s.objects[key] = object
+		s.etags[key] = fmt.Sprintf("%s-%d", hex.EncodeToString(sums.Sum(nil)), len(request.Parts))
+		fmt.Fprintf(rw, `<CompleteMultipartUploadResult><ETag>"%s"</ETag></CompleteMultipartUploadResult>`, s.etags[key])
+	case http.MethodDelete:
+		delete(s.uploads, query.Get("uploadId"))
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *fakeS3) fail(rw http.ResponseWriter, status int, code string) {
+	rw.WriteHeader(status)
+	fmt.Fprintf(rw, "<Error><Code>%s</Code><Message>failed</Message></Error>", code)
+}
+
+func (s *fakeS3) object(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[key]
+	return object, ok
+}
+
+func newTestUploader(t *testing.T, s *fakeS3, config Config) *Uploader {
+	t.Helper()
+	config.Endpoint = s.server.URL
+	config.Bucket = "archive"
+	config.AccessKey = "hepop"
+	config.SecretKey = "secret"
+	config.PathStyle = true
+	config.RetryDelay = time.Millisecond
+	u, err := NewUploader(config)
+	if err != nil {
+		t.Fatalf("NewUploader failed: %v", err)
+	}
+	return u
+}
+
+func writeTestFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	os.Chtimes(path, modTime, modTime)
+}
+
+func readManifest(t *testing.T, path string) []ManifestEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	var entries []ManifestEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry ManifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Invalid manifest line %q", scanner.Text())
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestUploaderUpload(t *testing.T) {
+	s := newFakeS3(t)
+	s.flaky[http.MethodPut] = true
+	s.flaky["part"] = true
+	s.flaky["complete"] = true
+
+	dir := t.TempDir()
+	manifest := filepath.Join(t.TempDir(), "manifest.ndjson")
+	u := newTestUploader(t, s, Config{Prefix: "{hostname}/{year}/{month}", PartSize: 10, DeleteLocal: true, Manifest: manifest})
+
+	modTime := time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC)
+	small := filepath.Join(dir, "hep-20240305-120000.pcap")
+	large := filepath.Join(dir, "date=2024-03-05", "hour=12", "proto=sip", "part-1.parquet")
+	largeData := bytes.Repeat([]byte("0123456789abcdef"), 3)
+	writeTestFile(t, small, []byte("pcap data"), modTime)
+	writeTestFile(t, large, largeData, modTime)
+
+	u.Upload(dir, small)
+	u.Upload(dir, large)
+	u.Close()
+
+	hostname, _ := os.Hostname()
+	prefix := hostname + "/2024/03/"
+	if object, ok := s.object(prefix + "hep-20240305-120000.pcap"); !ok || string(object) != "pcap data" {
+		t.Errorf("Expected the pcap object, got %q", object)
+	}
+	if object, ok := s.object(prefix + "date=2024-03-05/hour=12/proto=sip/part-1.parquet"); !ok || !bytes.Equal(object, largeData) {
+		t.Errorf("Expected the parquet object from 5 parts, got %q", object)
+	}
+	if s.calls["part"] != 6 || s.calls["complete"] != 2 {
+		t.Errorf("Expected 5 parts and a completion after one retry each, got %v", s.calls)
+	}
+
+	for _, path := range []string{small, large} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed", path)
+		}
+	}
+	entries := readManifest(t, manifest)
+	if len(entries) != 2 || entries[0].File != small || entries[0].Bucket != "archive" || entries[0].Size != 9 ||
+		!strings.HasSuffix(entries[1].ETag, "-5") {
+		t.Errorf("Unexpected manifest %+v", entries)
+	}
+}
+
+func TestUploaderVerification(t *testing.T) {
+	s := newFakeS3(t)
+	dir := t.TempDir()
+	u := newTestUploader(t, s, Config{DeleteLocal: true, Retries: -1})
+	defer u.Close()
+
+	path := filepath.Join(dir, "hep.pcap")
+	writeTestFile(t, path, []byte("pcap data"), time.Now())
+	// Without retries the failed PUT is final
+	s.flaky[http.MethodPut] = true
+	if err := u.upload(upload{dir: dir, path: path}); err == nil {
+		t.Fatalf("Expected the failed upload to be reported")
+	}
+	s.truncate = true
+	if err := u.upload(upload{dir: dir, path: path}); err == nil || !strings.Contains(err.Error(), "verification") {
+		t.Fatalf("Expected the verification to fail, got %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected the file to be kept: %v", err)
+	}
+	s.truncate = false
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected the file to be kept: %v", err)
+	}
+	if err := u.upload(upload{dir: dir, path: path}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the file to be removed")
+	}
+
+	if err := u.upload(upload{dir: dir, path: filepath.Join(t.TempDir(), "other.pcap")}); err == nil {
+		t.Errorf("Expected an error for files outside the directory")
+	}
+}
+
+func TestUploaderUploadDir(t *testing.T) {
+	s := newFakeS3(t)
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "manifest.ndjson")
+	done := filepath.Join(dir, "a.parquet")
+	entry, _ := json.Marshal(ManifestEntry{File: done, Key: "a.parquet"})
+	writeTestFile(t, manifest, append(entry, '\n'), time.Now())
+	writeTestFile(t, done, []byte("a"), time.Now())
+	writeTestFile(t, filepath.Join(dir, "b.parquet"), []byte("b"), time.Now())
+	writeTestFile(t, filepath.Join(dir, "x", ".c.parquet.inprogress"), []byte("c"), time.Now())
+
+	u := newTestUploader(t, s, Config{Manifest: manifest})
+	if err := u.UploadDir(dir); err != nil {
+		t.Fatalf("UploadDir failed: %v", err)
+	}
+	u.Close()
+
+	if _, ok := s.object("b.parquet"); !ok || len(s.objects) != 1 {
+		t.Errorf("Expected the file missing from the manifest only, got %v", s.objects)
+	}
+	if entries := readManifest(t, manifest); len(entries) != 2 || entries[1].Key != "b.parquet" {
+		t.Errorf("Unexpected manifest %+v", entries)
+	}
+}
+
+func TestUploaderExistingObjects(t *testing.T) {
+	s := newFakeS3(t)
+	dir := t.TempDir()
+	small := filepath.Join(dir, "a.pcap")
+	large := filepath.Join(dir, "b.pcap")
+	writeTestFile(t, small, []byte("pcap data"), time.Now())
+	writeTestFile(t, large, bytes.Repeat([]byte("0123456789abcdef"), 3), time.Now())
+
+	u := newTestUploader(t, s, Config{PartSize: 10})
+	u.UploadDir(dir)
+	u.Close()
+	if s.calls[http.MethodPut] != 1 || s.calls["complete"] != 1 {
+		t.Fatalf("Expected both files to be uploaded, got %v", s.calls)
+	}
+
+	// Without manifest the next start finds the objects in the bucket
+	u = newTestUploader(t, s, Config{PartSize: 10})
+	u.UploadDir(dir)
+	u.Close()
+	if s.calls[http.MethodPut] != 1 || s.calls["create"] != 1 || s.calls["complete"] != 1 {
+		t.Errorf("Expected the stored objects not to be uploaded again, got %v", s.calls)
+	}
+
+	// A changed file is uploaded again
+	writeTestFile(t, small, []byte("other data"), time.Now())
+	u = newTestUploader(t, s, Config{PartSize: 10})
+	u.UploadDir(dir)
+	u.Close()
+	if object, _ := s.object("a.pcap"); string(object) != "other data" || s.calls[http.MethodPut] != 2 {
+		t.Errorf("Expected the changed file to be uploaded, got %q and %v", object, s.calls)
+	}
+}
+
+func TestUploaderBacklog(t *testing.T) {
+	s := newFakeS3(t)
+	s.flaky[http.MethodPut] = true
+	dir := t.TempDir()
+	u := newTestUploader(t, s, Config{Retries: -1})
+
+	// More files than fit in a queue of the default size
+	for i := 0; i < 1100; i++ {
+		writeTestFile(t, filepath.Join(dir, fmt.Sprintf("hep-%04d.pcap", i)), []byte("pcap data"), time.Now())
+	}
+	if err := u.UploadDir(dir); err != nil {
+		t.Fatalf("UploadDir failed: %v", err)
+	}
+
+	// The first PUT fails without retries, the file is uploaded again from
+	// the backlog
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		s.mu.Lock()
+		n := len(s.objects)
+		s.mu.Unlock()
+		if n == 1100 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 1100 objects, got %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	u.Close()
+	if s.calls[http.MethodPut] != 1101 {
+		t.Errorf("Expected every file once and one retry, got %d PUTs", s.calls[http.MethodPut])
+	}
+	if err := u.Upload(dir, filepath.Join(dir, "hep-0000.pcap")); !errors.Is(err, ErrArchiveClosed) {
+		t.Errorf("Expected ErrArchiveClosed, got %v", err)
+	}
+}
+
+func TestNewUploader(t *testing.T) {
+	for _, config := range []Config{
+		{Bucket: "archive"},
+		{Endpoint: "http://minio:9000"},
+		{Endpoint: "minio", Bucket: "archive"},
+	} {
+		if _, err := NewUploader(config); err == nil {
+			t.Errorf("Expected an error for %+v", config)
+		}
+	}
+	u, err := NewUploader(Config{Endpoint: "https://s3.eu-west-1.amazonaws.com", Bucket: "archive"})
+	if err != nil {
+		t.Fatalf("NewUploader failed: %v", err)
+	}
+	defer u.Close()
+	if u.config.Region != "us-east-1" || u.config.Retries != 3 || u.config.PartSize != 16<<20 {
+		t.Errorf("Unexpected defaults %+v", u.config)
+	}
+	endpoint, _ := url.Parse("https://s3.eu-west-1.amazonaws.com")
+	if *u.s3.endpoint != *endpoint {
+		t.Errorf("Unexpected endpoint %v", u.s3.endpoint)
+	}
+}
@@ -0,0 +1,251 @@
+package callflow
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sipcapture/hepop-go/internal/writer"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+// DefaultDedupWindow is how far apart two copies of the same message seen
+// by different capture agents may be. It is below the SIP T1 timer of
+// 500ms, so retransmissions are kept.
+const DefaultDedupWindow = 200 * time.Millisecond
+
+// Flow is a ladder diagram of one or more correlated calls
+type Flow struct {
+	CIDs     []string   `json:"cids"`
+	Hosts    []*Host    `json:"hosts"`
+	Messages []*Message `json:"messages"`
+}
+
+// Host is a column of the ladder diagram
+type Host struct {
+	ID    string `json:"id"`
+	IP    string `json:"ip"`
+	Port  uint16 `json:"port"`
+	Alias string `json:"alias,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+// Resolver names hosts, e.g. from the alias store
+type Resolver interface {
+	Resolve(ip string, port uint16, nodeID uint32) (name string, group string, ok bool)
+}
+
+// Message is an arrow between two hosts
+type Message struct {
+	Time      time.Time `json:"time"`
+	Src       string    `json:"src"`
+	Dst       string    `json:"dst"`
+	CID       string    `json:"cid"`
+	ProtoType uint8     `json:"proto_type"`
+	Type      string    `json:"type"`
+	Label     string    `json:"label"`
+	NodeIDs   []uint32  `json:"node_ids"`
+	Payload   string    `json:"payload,omitempty"`
+	// Report is the RTP stream summary of a qos message
+	Report *writer.RTPReport `json:"report,omitempty"`
+}
+
+// Build orders the packets by time, drops copies of the same message from
+// other capture points and groups the endpoints into hosts. The resolver
+// may be nil.
+func Build(cids []string, packets []*protocol.HEPPacket, dedupWindow time.Duration, resolver Resolver) *Flow {
+	sorted := make([]*protocol.HEPPacket, len(packets))
+	copy(sorted, packets)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time().Before(sorted[j].Time())
+	})
+
+	flow := &Flow{
+		CIDs:     cids,
+		Hosts:    []*Host{},
+		Messages: []*Message{},
+	}
+	hosts := make(map[string]*Host)
+	seen := make(map[uint64]*Message)
+
+	for _, packet := range sorted {
+		key := messageKey(packet)
+		if prev, ok := seen[key]; ok && packet.Time().Sub(prev.Time) <= dedupWindow {
+			for _, id := range nodeIDs(packet) {
+				if !slices.Contains(prev.NodeIDs, id) {
+					prev.NodeIDs = append(prev.NodeIDs, id)
+				}
+			}
+			continue
+		}
+
+		msg := &Message{
+			Time:      packet.Time(),
+			Src:       addHost(flow, hosts, resolver, packet.SrcIP, packet.SrcPort, packet.NodeID),
+			Dst:       addHost(flow, hosts, resolver, packet.DstIP, packet.DstPort, packet.NodeID),
+			CID:       packet.CID,
+			ProtoType: packet.ProtoType,
+			NodeIDs:   nodeIDs(packet),
+		}
+		msg.Type, msg.Label = describe(packet)
+		if msg.Type == "sip" || msg.Type == "log" {
+			if utf8.Valid(packet.Payload) {
+				msg.Payload = string(packet.Payload)
+			}
+		}
+
+		seen[key] = msg
+		flow.Messages = append(flow.Messages, msg)
+	}
+
+	return flow
+}
+
+// rtpStream identifies an RTP stream across its periodic reports
+type rtpStream struct {
+	ssrc    uint32
+	srcIP   string
+	srcPort uint16
+	dstIP   string
+	dstPort uint16
+}
+
+// AddReports adds the RTP stream reports of the calls as qos messages from
+// the stream source to its destination, at the end of the reported
+// interval. Only the latest report of each stream is shown, the final one
+// once the stream ended. The resolver may be nil.
+func (f *Flow) AddReports(reports []*writer.RTPReport, resolver Resolver) {
+	hosts := make(map[string]*Host, len(f.Hosts))
+	for _, host := range f.Hosts {
+		hosts[host.ID] = host
+	}
+
+	var streams []rtpStream
+	latest := make(map[rtpStream]*writer.RTPReport)
+	for _, report := range reports {
+		key := rtpStream{report.SSRC, report.SrcIP, report.SrcPort, report.DstIP, report.DstPort}
+		prev, ok := latest[key]
+		if !ok {
+			streams = append(streams, key)
+		}
+		if !ok || report.EndTime.After(prev.EndTime) {
+			latest[key] = report
+		}
+	}
+	if len(streams) == 0 {
+		return
+	}
+
+	for _, key := range streams {
+		report := latest[key]
+		f.Messages = append(f.Messages, &Message{
+			Time:      report.EndTime,
+			Src:       addHost(f, hosts, resolver, report.SrcIP, report.SrcPort, report.NodeID),
+			Dst:       addHost(f, hosts, resolver, report.DstIP, report.DstPort, report.NodeID),
+			CID:       report.CID,
+			ProtoType: protocol.ProtoTypeRTP,
+			Type:      "qos",
+			Label:     fmt.Sprintf("MOS %.1f, loss %.1f%%, jitter %.1f ms", report.MOS, report.LossPercent, report.JitterMs),
+			NodeIDs:   []uint32{report.NodeID},
+			Report:    report,
+		})
+	}
+	sort.SliceStable(f.Messages, func(i, j int) bool {
+		return f.Messages[i].Time.Before(f.Messages[j].Time)
+	})
+}
+
+// nodeIDs returns the agents that saw the packet, copies may already have
+// been merged before storage
+func nodeIDs(packet *protocol.HEPPacket) []uint32 {
+	if len(packet.NodeIDs) > 0 {
+		return slices.Clone(packet.NodeIDs)
+	}
+	return []uint32{packet.NodeID}
+}
+
+func addHost(flow *Flow, hosts map[string]*Host, resolver Resolver, ip string, port uint16, nodeID uint32) string {
+	id := net.JoinHostPort(ip, strconv.Itoa(int(port)))
+	if _, ok := hosts[id]; !ok {
+		host := &Host{ID: id, IP: ip, Port: port}
+		if resolver != nil {
+			host.Alias, host.Group, _ = resolver.Resolve(ip, port, nodeID)
+		}
+		hosts[id] = host
+		flow.Hosts = append(flow.Hosts, host)
+	}
+	return id
+}
+
+// messageKey identifies the same message captured at different points
+func messageKey(packet *protocol.HEPPacket) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s|%d|%s|%d|%d|", packet.SrcIP, packet.SrcPort, packet.DstIP, packet.DstPort, packet.ProtoType)
+	h.Write(packet.Payload)
+	return h.Sum64()
+}
+
+// describe returns the message type and the arrow label. Packets read back
+// from storage may not carry decoded fields, so SIP is decoded again here.
+func describe(packet *protocol.HEPPacket) (string, string) {
+	switch packet.ProtoType {
+	case protocol.ProtoTypeSIP:
+		msg := packet.SIP
+		if msg == nil {
+			var err error
+			if msg, err = protocol.DecodeSIP(packet.Payload); err != nil {
+				return "sip", "SIP"
+			}
+		}
+		if msg.IsRequest() {
+			return "sip", msg.Method
+		}
+		return "sip", fmt.Sprintf("%d %s", msg.StatusCode, msg.Reason)
+	case protocol.ProtoTypeRTCP:
+		return "rtcp", "RTCP"
+	case protocol.ProtoTypeDNS:
+		if packet.DNS != nil {
+			return "dns", fmt.Sprintf("%s %s", packet.DNS.QType, packet.DNS.QName)
+		}
+		return "dns", "DNS"
+	case protocol.ProtoTypeDiameter:
+		if packet.Diameter != nil {
+			return "diameter", packet.Diameter.Command
+		}
+		return "diameter", "Diameter"
+	case protocol.ProtoTypeLog:
+		msg := packet.Log
+		if msg == nil {
+			var err error
+			if msg, err = protocol.DecodeLog(packet.Payload); err != nil {
+				return "log", "LOG"
+			}
+		}
+		return "log", logLabel(msg)
+	default:
+		return "other", fmt.Sprintf("proto %d", packet.ProtoType)
+	}
+}
+
+// maxLogLabel keeps log arrows readable, the full line is in the payload
+const maxLogLabel = 60
+
+func logLabel(msg *protocol.LogMessage) string {
+	label := msg.Message
+	if len(label) > maxLogLabel {
+		cut := maxLogLabel
+		for cut > 0 && !utf8.RuneStart(label[cut]) {
+			cut--
+		}
+		label = label[:cut] + "..."
+	}
+	if msg.Level != "" {
+		label = msg.Level + ": " + label
+	}
+	return label
+}
@@ -0,0 +1,129 @@
+package callflow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sipcapture/hepop-go/internal/writer"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+// at sets the microseconds of a packet's capture time
+func at(packet *protocol.HEPPacket, usec uint32) *protocol.HEPPacket {
+	packet.TimestampUsec = usec
+	return packet
+}
+
+func flowPacket(ts uint64, node uint32, src, dst string, protoType uint8, payload string) *protocol.HEPPacket {
+	return &protocol.HEPPacket{
+		SrcIP:     src,
+		SrcPort:   5060,
+		DstIP:     dst,
+		DstPort:   5060,
+		Timestamp: ts,
+		NodeID:    node,
+		ProtoType: protoType,
+		CID:       "call-1",
+		Payload:   []byte(payload),
+	}
+}
+
+type staticResolver map[string]string
+
+func (r staticResolver) Resolve(ip string, port uint16, nodeID uint32) (string, string, bool) {
+	name, ok := r[ip]
+	return name, "sbc", ok
+}
+
+func TestBuildFlow(t *testing.T) {
+	invite := "INVITE sip:bob@example.com SIP/2.0\r\nCall-ID: call-1\r\nCSeq: 1 INVITE\r\n\r\n"
+	ok := "SIP/2.0 200 OK\r\nCall-ID: call-1\r\nCSeq: 1 INVITE\r\n\r\n"
+
+	packets := []*protocol.HEPPacket{
+		flowPacket(1002, 1, "10.0.0.2", "10.0.0.1", protocol.ProtoTypeSIP, ok),
+		flowPacket(1000, 1, "10.0.0.1", "10.0.0.2", protocol.ProtoTypeSIP, invite),
+		// Same INVITE seen by a second capture agent
+		at(flowPacket(1000, 2, "10.0.0.1", "10.0.0.2", protocol.ProtoTypeSIP, invite), 20000),
+		// Retransmission after T1 is a message of its own
+		at(flowPacket(1000, 1, "10.0.0.1", "10.0.0.2", protocol.ProtoTypeSIP, invite), 500000),
+		flowPacket(1003, 1, "10.0.0.1", "10.0.0.2", protocol.ProtoTypeLog, "call answered"),
+		// Retransmission well after the window is kept
+		flowPacket(1010, 1, "10.0.0.1", "10.0.0.2", protocol.ProtoTypeSIP, invite),
+	}
+
+	flow := Build([]string{"call-1"}, packets, DefaultDedupWindow, staticResolver{"10.0.0.2": "SBC-EU-1"})
+
+	if len(flow.Hosts) != 2 {
+		t.Fatalf("Expected 2 hosts, got %d", len(flow.Hosts))
+	}
+	if flow.Hosts[0].ID != "10.0.0.1:5060" || flow.Hosts[0].Alias != "" {
+		t.Errorf("Expected unnamed caller as first host, got %+v", flow.Hosts[0])
+	}
+	if flow.Hosts[1].Alias != "SBC-EU-1" || flow.Hosts[1].Group != "sbc" {
+		t.Errorf("Expected resolved alias for callee, got %+v", flow.Hosts[1])
+	}
+
+	if len(flow.Messages) != 5 {
+		t.Fatalf("Expected 5 messages, got %d", len(flow.Messages))
+	}
+
+	want := []struct {
+		label string
+		typ   string
+		nodes int
+	}{
+		{"INVITE", "sip", 2},
+		{"INVITE", "sip", 1},
+		{"200 OK", "sip", 1},
+		{"call answered", "log", 1},
+		{"INVITE", "sip", 1},
+	}
+	for i, w := range want {
+		msg := flow.Messages[i]
+		if msg.Label != w.label || msg.Type != w.typ || len(msg.NodeIDs) != w.nodes {
+			t.Errorf("Message %d: expected %s/%s with %d nodes, got %s/%s with %v",
+				i, w.typ, w.label, w.nodes, msg.Type, msg.Label, msg.NodeIDs)
+		}
+	}
+	if flow.Messages[3].Payload != "call answered" {
+		t.Errorf("Expected log text in payload, got %q", flow.Messages[3].Payload)
+	}
+}
+
+func TestFlowAddReports(t *testing.T) {
+	invite := "INVITE sip:bob@example.com SIP/2.0\r\nCall-ID: call-1\r\nCSeq: 1 INVITE\r\n\r\n"
+	bye := "BYE sip:bob@example.com SIP/2.0\r\nCall-ID: call-1\r\nCSeq: 2 BYE\r\n\r\n"
+	flow := Build([]string{"call-1"}, []*protocol.HEPPacket{
+		flowPacket(1000, 1, "10.0.0.1", "10.0.0.2", protocol.ProtoTypeSIP, invite),
+		flowPacket(1060, 1, "10.0.0.1", "10.0.0.2", protocol.ProtoTypeSIP, bye),
+	}, DefaultDedupWindow, nil)
+
+	report := func(end int64, srcIP, dstIP string, mos float64, final bool) *writer.RTPReport {
+		return &writer.RTPReport{
+			CID: "call-1", SSRC: 0x1234, NodeID: 1, SrcIP: srcIP, SrcPort: 4000, DstIP: dstIP, DstPort: 5000,
+			StartTime: time.Unix(1001, 0), EndTime: time.Unix(end, 0), MOS: mos, LossPercent: 1.5, JitterMs: 4.25, Final: final,
+		}
+	}
+	flow.AddReports([]*writer.RTPReport{
+		report(1011, "10.0.0.1", "10.0.0.2", 4.3, false),
+		report(1059, "10.0.0.1", "10.0.0.2", 4.1, true),
+		report(1021, "10.0.0.1", "10.0.0.2", 4.2, false),
+		report(1030, "10.0.0.3", "10.0.0.1", 3.9, false),
+	}, nil)
+
+	if len(flow.Hosts) != 6 || flow.Hosts[2].ID != "10.0.0.1:4000" || flow.Hosts[3].ID != "10.0.0.2:5000" {
+		t.Fatalf("Expected the media endpoints as hosts, got %+v", flow.Hosts)
+	}
+	want := []string{"INVITE", "MOS 3.9, loss 1.5%, jitter 4.2 ms", "MOS 4.1, loss 1.5%, jitter 4.2 ms", "BYE"}
+	if len(flow.Messages) != len(want) {
+		t.Fatalf("Expected %d messages, got %d", len(want), len(flow.Messages))
+	}
+	for i, label := range want {
+		if flow.Messages[i].Label != label {
+			t.Errorf("Message %d: expected %s, got %s", i, label, flow.Messages[i].Label)
+		}
+	}
+	if msg := flow.Messages[2]; msg.Type != "qos" || msg.Src != "10.0.0.1:4000" || msg.Report == nil || !msg.Report.Final {
+		t.Errorf("Expected the final report from the caller's media, got %+v", msg)
+	}
+}
@@ -13,6 +13,15 @@ type Config struct {
 	Writers WritersConfig `yaml:"writers"`
 	API     APIConfig     `yaml:"api"`
 	Metrics MetricsConfig `yaml:"metrics"`
+	CDR     CDRConfig     `yaml:"cdr"`
+
+	Registrations RegistrationsConfig `yaml:"registrations"`
+	Aliases       AliasesConfig       `yaml:"aliases"`
+	RTPStats      RTPStatsConfig      `yaml:"rtp_stats"`
+	Pipeline      PipelineConfig      `yaml:"pipeline"`
+	DenyList      DenyListConfig      `yaml:"deny_list"`
+	Fraud         FraudConfig         `yaml:"fraud"`
+	Archive       ArchiveConfig       `yaml:"archive"`
 }
 
 type ServerConfig struct {
@@ -23,21 +32,52 @@ type ServerConfig struct {
 	ReadTimeout   time.Duration `yaml:"read_timeout"`
 	WriteTimeout  time.Duration `yaml:"write_timeout"`
 	Workers       int           `yaml:"workers"`
+
+	// Input is hep to listen for HEP or nats to consume the packets another
+	// instance published
+	Input string           `yaml:"input"`
+	NATS  *NATSInputConfig `yaml:"nats,omitempty"`
+}
+
+type NATSInputConfig struct {
+	URL      string `yaml:"url"`
+	Subject  string `yaml:"subject"`
+	Encoding string `yaml:"encoding"` // json, protobuf, hep
+	Stream   string `yaml:"stream"`
+	Durable  string `yaml:"durable"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Token    string `yaml:"token"`
 }
 
 type WritersConfig struct {
-	Type          string        `yaml:"type"` // clickhouse, elastic, loki, multi
+	Type          string        `yaml:"type"` // clickhouse, elastic, parquet, loki, postgres, kafka, nats, metrics, pcap, file, multi
 	BatchSize     int           `yaml:"batch_size"`
 	FlushInterval time.Duration `yaml:"flush_interval"`
 
 	// Specific writer configs
-	ClickHouse *ClickHouseConfig `yaml:"clickhouse,omitempty"`
-	Elastic    *ElasticConfig    `yaml:"elastic,omitempty"`
-	Parquet    *ParquetConfig    `yaml:"parquet,omitempty"`
+	ClickHouse *ClickHouseConfig    `yaml:"clickhouse,omitempty"`
+	Elastic    *ElasticConfig       `yaml:"elastic,omitempty"`
+	Parquet    *ParquetConfig       `yaml:"parquet,omitempty"`
+	Loki       *LokiConfig          `yaml:"loki,omitempty"`
+	Postgres   *PostgresConfig      `yaml:"postgres,omitempty"`
+	Kafka      *KafkaConfig         `yaml:"kafka,omitempty"`
+	NATS       *NATSConfig          `yaml:"nats,omitempty"`
+	Metrics    *MetricsWriterConfig `yaml:"metrics,omitempty"`
+	Pcap       *PcapConfig          `yaml:"pcap,omitempty"`
+	File       *FileConfig          `yaml:"file,omitempty"`
 }
 
 type ParquetConfig struct {
-	FilePath string `yaml:"file_path"`
+	Dir          string        `yaml:"dir"`
+	Compression  string        `yaml:"compression"` // snappy, zstd, gzip, none
+	RowGroupSize int64         `yaml:"row_group_size"`
+	MaxRows      int64         `yaml:"max_rows"`
+	MaxAge       time.Duration `yaml:"max_age"`
+	// Search and the SQL endpoint query the dataset with DuckDB
+	QueryTimeout time.Duration `yaml:"query_timeout"`
+	QueryMaxRows int           `yaml:"query_max_rows"`
+	MemoryLimit  string        `yaml:"memory_limit"`
 }
 
 type ClickHouseConfig struct {
@@ -45,6 +85,9 @@ type ClickHouseConfig struct {
 	Port     int    `yaml:"port"`
 	Database string `yaml:"database"`
 	Table    string `yaml:"table"`
+	CDRTable string `yaml:"cdr_table"`
+	LogTable string `yaml:"log_table"`
+	RTPTable string `yaml:"rtp_table"`
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
 	Debug    bool   `yaml:"debug"`
@@ -53,16 +96,92 @@ type ClickHouseConfig struct {
 type ElasticConfig struct {
 	URLs      []string `yaml:"urls"`
 	IndexName string   `yaml:"index_name"`
+	CDRIndex  string   `yaml:"cdr_index"`
+	LogIndex  string   `yaml:"log_index"`
+	RTPIndex  string   `yaml:"rtp_index"`
 	Username  string   `yaml:"username"`
 	Password  string   `yaml:"password"`
 	Debug     bool     `yaml:"debug"`
 }
 
+type LokiConfig struct {
+	URL      string        `yaml:"url"`
+	Labels   []string      `yaml:"labels"`
+	Job      string        `yaml:"job"`
+	Format   string        `yaml:"format"` // protobuf, json
+	TenantID string        `yaml:"tenant_id"`
+	Username string        `yaml:"username"`
+	Password string        `yaml:"password"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+type PostgresConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Database string `yaml:"database"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	SSLMode  string `yaml:"ssl_mode"`
+}
+
+type KafkaConfig struct {
+	Brokers            []string         `yaml:"brokers"`
+	Topic              string           `yaml:"topic"`
+	Topics             map[uint8]string `yaml:"topics"`
+	Encoding           string           `yaml:"encoding"`    // json, protobuf, hep
+	Compression        string           `yaml:"compression"` // none, gzip, snappy, lz4, zstd
+	ClientID           string           `yaml:"client_id"`
+	Linger             time.Duration    `yaml:"linger"`
+	DeliveryTimeout    time.Duration    `yaml:"delivery_timeout"`
+	MaxBufferedRecords int              `yaml:"max_buffered_records"`
+}
+
+type NATSConfig struct {
+	URL           string `yaml:"url"`
+	SubjectPrefix string `yaml:"subject_prefix"`
+	Encoding      string `yaml:"encoding"` // json, protobuf, hep
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`
+	Token         string `yaml:"token"`
+}
+
+type MetricsWriterConfig struct {
+	URL      string            `yaml:"url"`
+	Format   string            `yaml:"format"` // influx, remote_write
+	Window   time.Duration     `yaml:"window"`
+	Labels   map[string]string `yaml:"labels"`
+	Token    string            `yaml:"token"`
+	Username string            `yaml:"username"`
+	Password string            `yaml:"password"`
+	Timeout  time.Duration     `yaml:"timeout"`
+}
+
+type PcapConfig struct {
+	Dir            string        `yaml:"dir"`
+	Prefix         string        `yaml:"prefix"`
+	Format         string        `yaml:"format"` // pcap, pcapng
+	MaxSize        int64         `yaml:"max_size"`
+	RotateInterval time.Duration `yaml:"rotate_interval"`
+	MaxFiles       int           `yaml:"max_files"`
+}
+
+type FileConfig struct {
+	Dir            string        `yaml:"dir"`
+	Prefix         string        `yaml:"prefix"`
+	Payload        string        `yaml:"payload"`     // text, base64
+	Compression    string        `yaml:"compression"` // gzip, zstd
+	MaxSize        int64         `yaml:"max_size"`
+	RotateInterval time.Duration `yaml:"rotate_interval"`
+	MaxFiles       int           `yaml:"max_files"`
+	SearchFiles    int           `yaml:"search_files"`
+}
+
 type APIConfig struct {
 	Host         string        `yaml:"host"`
 	Port         int           `yaml:"port"`
 	EnablePprof  bool          `yaml:"enable_pprof"`
 	AuthToken    string        `yaml:"auth_token"`
+	EnableSQL    bool          `yaml:"enable_sql"`
 	CorsOrigins  []string      `yaml:"cors_origins"`
 	ReadTimeout  time.Duration `yaml:"read_timeout"`
 	WriteTimeout time.Duration `yaml:"write_timeout"`
@@ -75,6 +194,153 @@ type MetricsConfig struct {
 	Path   string `yaml:"path"`
 }
 
+type CDRConfig struct {
+	Enable        bool          `yaml:"enable"`
+	InviteTimeout time.Duration `yaml:"invite_timeout"`
+	DialogTimeout time.Duration `yaml:"dialog_timeout"`
+}
+
+type RegistrationsConfig struct {
+	Enable           bool          `yaml:"enable"`
+	HistorySize      int           `yaml:"history_size"`
+	FailureRetention time.Duration `yaml:"failure_retention"`
+}
+
+type AliasesConfig struct {
+	FilePath string `yaml:"file_path"`
+}
+
+type RTPStatsConfig struct {
+	Enable         bool          `yaml:"enable"`
+	ReportInterval time.Duration `yaml:"report_interval"`
+	StreamTimeout  time.Duration `yaml:"stream_timeout"`
+}
+
+type DenyListConfig struct {
+	Enable  bool     `yaml:"enable"`
+	Entries []string `yaml:"entries"`
+}
+
+type FraudConfig struct {
+	Enable        bool                `yaml:"enable"`
+	BruteForce    ThresholdConfig     `yaml:"brute_force"`
+	InviteFlood   ThresholdConfig     `yaml:"invite_flood"`
+	Scanners      ScannersConfig      `yaml:"scanners"`
+	International InternationalConfig `yaml:"international"`
+	Cooldown      time.Duration       `yaml:"cooldown"`
+	DenyOffenders bool                `yaml:"deny_offenders"`
+	DenyTTL       time.Duration       `yaml:"deny_ttl"`
+	Webhook       WebhookConfig       `yaml:"webhook"`
+}
+
+type ThresholdConfig struct {
+	Count  int           `yaml:"count"`
+	Window time.Duration `yaml:"window"`
+}
+
+type ScannersConfig struct {
+	Enable     bool     `yaml:"enable"`
+	UserAgents []string `yaml:"user_agents"`
+}
+
+type InternationalConfig struct {
+	Count        int           `yaml:"count"`
+	Window       time.Duration `yaml:"window"`
+	Prefixes     []string      `yaml:"prefixes"`
+	HomePrefixes []string      `yaml:"home_prefixes"`
+}
+
+type WebhookConfig struct {
+	URL       string            `yaml:"url"`
+	Headers   map[string]string `yaml:"headers"`
+	Timeout   time.Duration     `yaml:"timeout"`
+	QueueSize int               `yaml:"queue_size"`
+}
+
+// ArchiveConfig configures the upload of finished parquet and pcap files to
+// S3 compatible object storage
+type ArchiveConfig struct {
+	Enable      bool          `yaml:"enable"`
+	Endpoint    string        `yaml:"endpoint"`
+	Region      string        `yaml:"region"`
+	Bucket      string        `yaml:"bucket"`
+	AccessKey   string        `yaml:"access_key"`
+	SecretKey   string        `yaml:"secret_key"`
+	PathStyle   bool          `yaml:"path_style"`
+	Prefix      string        `yaml:"prefix"`
+	PartSize    int64         `yaml:"part_size"`
+	Retries     int           `yaml:"retries"`
+	RetryDelay  time.Duration `yaml:"retry_delay"`
+	Timeout     time.Duration `yaml:"timeout"`
+	DeleteLocal bool          `yaml:"delete_local"`
+	Manifest    string        `yaml:"manifest"`
+}
+
+// PipelineConfig configures the stages between decoding and writing
+type PipelineConfig struct {
+	Enrichment EnrichmentConfig `yaml:"enrichment"`
+	Filter     FilterConfig     `yaml:"filter"`
+	Dedup      DedupConfig      `yaml:"dedup"`
+	Retention  RetentionConfig  `yaml:"retention"`
+	Masking    MaskingConfig    `yaml:"masking"`
+}
+
+type EnrichmentConfig struct {
+	GeoIPDatabase string         `yaml:"geoip_database"`
+	ASNDatabase   string         `yaml:"asn_database"`
+	Lookups       []LookupConfig `yaml:"lookups"`
+}
+
+type LookupConfig struct {
+	File string `yaml:"file"`
+	Key  string `yaml:"key"` // node_id, ip
+}
+
+type FilterConfig struct {
+	Rules          []FilterRuleConfig `yaml:"rules"`
+	RulesFile      string             `yaml:"rules_file"`
+	ReloadInterval time.Duration      `yaml:"reload_interval"`
+}
+
+type FilterRuleConfig struct {
+	Name   string `yaml:"name"`
+	Match  string `yaml:"match"`
+	Action string `yaml:"action"` // drop, keep, sample(n)
+}
+
+type DedupConfig struct {
+	Enable     bool          `yaml:"enable"`
+	Window     time.Duration `yaml:"window"`
+	Scope      string        `yaml:"scope"` // global, node
+	TrackNodes bool          `yaml:"track_nodes"`
+}
+
+type RetentionConfig struct {
+	Enable      bool          `yaml:"enable"`
+	Keep        string        `yaml:"keep"`
+	Window      time.Duration `yaml:"window"`
+	Sample      uint32        `yaml:"sample"`
+	CallTimeout time.Duration `yaml:"call_timeout"`
+	MaxCalls    int           `yaml:"max_calls"`
+}
+
+type MaskingConfig struct {
+	Profiles []MaskProfileConfig `yaml:"profiles"`
+}
+
+type MaskProfileConfig struct {
+	Name         string   `yaml:"name"`
+	NodeIDs      []uint32 `yaml:"node_ids"`
+	Networks     []string `yaml:"networks"`
+	Mode         string   `yaml:"mode"` // hash, redact
+	Key          string   `yaml:"key"`
+	Users        bool     `yaml:"users"`
+	DisplayNames bool     `yaml:"display_names"`
+	Headers      []string `yaml:"headers"`
+	SDP          bool     `yaml:"sdp"`
+	IPs          bool     `yaml:"ips"`
+}
+
 // LoadConfig loads the configuration from the file
 func LoadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
@@ -104,6 +370,16 @@ func (c *Config) Validate() error {
 		c.Server.Workers = 1
 	}
 
+	switch c.Server.Input {
+	case "", "hep":
+	case "nats":
+		if c.Server.NATS == nil {
+			return fmt.Errorf("nats input config required")
+		}
+	default:
+		return fmt.Errorf("unknown server input: %s", c.Server.Input)
+	}
+
 	if c.Writers.BatchSize <= 0 {
 		c.Writers.BatchSize = 1000
 	}
@@ -112,6 +388,74 @@ func (c *Config) Validate() error {
 		c.Writers.FlushInterval = time.Second
 	}
 
+	if c.CDR.InviteTimeout <= 0 {
+		c.CDR.InviteTimeout = 3 * time.Minute
+	}
+
+	if c.CDR.DialogTimeout <= 0 {
+		c.CDR.DialogTimeout = 12 * time.Hour
+	}
+
+	if c.Registrations.HistorySize <= 0 {
+		c.Registrations.HistorySize = 50
+	}
+
+	if c.Registrations.FailureRetention <= 0 {
+		c.Registrations.FailureRetention = 24 * time.Hour
+	}
+
+	if c.RTPStats.ReportInterval <= 0 {
+		c.RTPStats.ReportInterval = 10 * time.Second
+	}
+
+	if c.RTPStats.StreamTimeout <= 0 {
+		c.RTPStats.StreamTimeout = 30 * time.Second
+	}
+
+	if c.Fraud.BruteForce.Window <= 0 {
+		c.Fraud.BruteForce.Window = time.Minute
+	}
+
+	if c.Fraud.InviteFlood.Window <= 0 {
+		c.Fraud.InviteFlood.Window = 10 * time.Second
+	}
+
+	if c.Fraud.International.Window <= 0 {
+		c.Fraud.International.Window = time.Hour
+	}
+
+	if len(c.Fraud.International.Prefixes) == 0 {
+		c.Fraud.International.Prefixes = []string{"+", "00"}
+	}
+
+	if c.Fraud.Cooldown <= 0 {
+		c.Fraud.Cooldown = 10 * time.Minute
+	}
+
+	if c.Fraud.DenyTTL <= 0 {
+		c.Fraud.DenyTTL = time.Hour
+	}
+
+	if c.Pipeline.Filter.ReloadInterval <= 0 {
+		c.Pipeline.Filter.ReloadInterval = 5 * time.Second
+	}
+
+	if c.Pipeline.Dedup.Window <= 0 {
+		c.Pipeline.Dedup.Window = 200 * time.Millisecond
+	}
+
+	if c.Pipeline.Retention.Window <= 0 {
+		c.Pipeline.Retention.Window = 30 * time.Second
+	}
+
+	if c.Pipeline.Retention.CallTimeout <= 0 {
+		c.Pipeline.Retention.CallTimeout = time.Hour
+	}
+
+	if c.Pipeline.Retention.MaxCalls <= 0 {
+		c.Pipeline.Retention.MaxCalls = 100000
+	}
+
 	switch c.Writers.Type {
 	case "clickhouse":
 		if c.Writers.ClickHouse == nil {
@@ -121,6 +465,41 @@ func (c *Config) Validate() error {
 		if c.Writers.Elastic == nil {
 			return fmt.Errorf("elastic config required")
 		}
+	case "parquet":
+		if c.Writers.Parquet == nil {
+			return fmt.Errorf("parquet config required")
+		}
+	case "loki":
+		if c.Writers.Loki == nil {
+			return fmt.Errorf("loki config required")
+		}
+		if c.Writers.Loki.Labels == nil {
+			c.Writers.Loki.Labels = []string{"node_id", "proto_type", "sip_method"}
+		}
+	case "postgres":
+		if c.Writers.Postgres == nil {
+			return fmt.Errorf("postgres config required")
+		}
+	case "kafka":
+		if c.Writers.Kafka == nil {
+			return fmt.Errorf("kafka config required")
+		}
+	case "nats":
+		if c.Writers.NATS == nil {
+			return fmt.Errorf("nats config required")
+		}
+	case "metrics":
+		if c.Writers.Metrics == nil {
+			return fmt.Errorf("metrics config required")
+		}
+	case "pcap":
+		if c.Writers.Pcap == nil {
+			return fmt.Errorf("pcap config required")
+		}
+	case "file":
+		if c.Writers.File == nil {
+			return fmt.Errorf("file config required")
+		}
 
 	case "multi":
 		// At least one writer should be configured
@@ -132,5 +511,18 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("unknown writer type: %s", c.Writers.Type)
 	}
 
+	if c.API.EnableSQL && c.Writers.Type != "parquet" {
+		return fmt.Errorf("sql endpoint requires the parquet writer")
+	}
+
+	if c.Archive.Enable {
+		if c.Writers.Type != "parquet" && c.Writers.Type != "pcap" {
+			return fmt.Errorf("archive requires the parquet or pcap writer")
+		}
+		if c.Archive.Endpoint == "" || c.Archive.Bucket == "" {
+			return fmt.Errorf("archive endpoint and bucket required")
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,107 @@
+package decoder
+
+import (
+	"strings"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+// Decoder decodes HEP payloads into structured fields based on ProtoType
+// and keeps the state needed to correlate related packets
+type Decoder struct {
+	dns   *dnsTracker
+	media *mediaIndex
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{
+		dns:   newDNSTracker(defaultDNSTimeout),
+		media: newMediaIndex(defaultMediaTimeout),
+	}
+}
+
+// Decode fills the decoded fields of the packet. Packets with an unknown
+// ProtoType are left untouched.
+func (d *Decoder) Decode(packet *protocol.HEPPacket) error {
+	switch packet.ProtoType {
+	case protocol.ProtoTypeSIP:
+		return d.decodeSIP(packet)
+	case protocol.ProtoTypeDNS:
+		return d.decodeDNS(packet)
+	case protocol.ProtoTypeDiameter:
+		return d.decodeDiameter(packet)
+	case protocol.ProtoTypeLog:
+		return d.decodeLog(packet)
+	case protocol.ProtoTypeRTP:
+		d.media.tag(packet)
+		return d.decodeRTP(packet)
+	case protocol.ProtoTypeRTCP:
+		d.media.tag(packet)
+	}
+	return nil
+}
+
+func (d *Decoder) decodeSIP(packet *protocol.HEPPacket) error {
+	msg, err := protocol.DecodeSIP(packet.Payload)
+	if err != nil {
+		return err
+	}
+	packet.SIP = msg
+
+	if packet.CID == "" {
+		packet.CID = msg.CallID
+	}
+
+	if len(msg.Body) > 0 && strings.Contains(strings.ToLower(msg.Header("content-type")), "application/sdp") {
+		sdp, err := protocol.DecodeSDP(msg.Body)
+		if err != nil {
+			return err
+		}
+		msg.SDP = sdp
+		d.media.learn(packet.CID, sdp)
+	}
+	return nil
+}
+
+func (d *Decoder) decodeDNS(packet *protocol.HEPPacket) error {
+	msg, err := protocol.DecodeDNS(packet.Payload)
+	if err != nil {
+		return err
+	}
+	packet.DNS = msg
+	d.dns.track(packet)
+	return nil
+}
+
+func (d *Decoder) decodeDiameter(packet *protocol.HEPPacket) error {
+	msg, err := protocol.DecodeDiameter(packet.Payload)
+	if err != nil {
+		return err
+	}
+	packet.Diameter = msg
+
+	// Agents that do not set a correlation ID for Diameter get the
+	// Session-Id, so all messages of a Gx/Rx session share one CID
+	if packet.CID == "" {
+		packet.CID = msg.SessionID
+	}
+	return nil
+}
+
+func (d *Decoder) decodeLog(packet *protocol.HEPPacket) error {
+	msg, err := protocol.DecodeLog(packet.Payload)
+	if err != nil {
+		return err
+	}
+	packet.Log = msg
+	return nil
+}
+
+func (d *Decoder) decodeRTP(packet *protocol.HEPPacket) error {
+	hdr, err := protocol.DecodeRTP(packet.Payload)
+	if err != nil {
+		return err
+	}
+	packet.RTP = hdr
+	return nil
+}
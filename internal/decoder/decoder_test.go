@@ -0,0 +1,153 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+func dnsPayload(id uint16, flags uint16) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], flags)
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	msg = append(msg, 3, 's', 'i', 'p', 0, 0x00, 0x01, 0x00, 0x01)
+	return msg
+}
+
+func dnsPacket(src, dst string, srcPort, dstPort uint16, ts time.Duration, payload []byte) *protocol.HEPPacket {
+	return &protocol.HEPPacket{
+		Protocol:      17,
+		SrcIP:         src,
+		DstIP:         dst,
+		SrcPort:       srcPort,
+		DstPort:       dstPort,
+		Timestamp:     uint64(ts / time.Second),
+		TimestampUsec: uint32(ts % time.Second / time.Microsecond),
+		ProtoType:     protocol.ProtoTypeDNS,
+		Payload:       payload,
+	}
+}
+
+func TestDecodeDNSLatency(t *testing.T) {
+	d := NewDecoder()
+
+	query := dnsPacket("10.0.0.1", "10.0.0.53", 40000, 53, 1000*time.Second, dnsPayload(7, 0x0100))
+	if err := d.Decode(query); err != nil {
+		t.Fatalf("Failed to decode query: %v", err)
+	}
+	if query.DNS == nil || query.DNS.QName != "sip" {
+		t.Fatalf("Expected decoded query, got %+v", query.DNS)
+	}
+
+	// Same ID from a different client must not match
+	other := dnsPacket("10.0.0.53", "10.0.0.2", 53, 40000, 1003*time.Second, dnsPayload(7, 0x8180))
+	if err := d.Decode(other); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if other.DNS.LatencyMs != 0 {
+		t.Errorf("Expected no latency for unmatched response, got %v", other.DNS.LatencyMs)
+	}
+
+	response := dnsPacket("10.0.0.53", "10.0.0.1", 53, 40000, 1000*time.Second+30*time.Millisecond, dnsPayload(7, 0x8180))
+	if err := d.Decode(response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response.DNS.LatencyMs != 30 {
+		t.Errorf("Expected latency 30ms, got %v", response.DNS.LatencyMs)
+	}
+
+	// A retransmitted response has nothing left to match
+	again := dnsPacket("10.0.0.53", "10.0.0.1", 53, 40000, 1004*time.Second, dnsPayload(7, 0x8180))
+	d.Decode(again)
+	if again.DNS.LatencyMs != 0 {
+		t.Errorf("Expected no latency for duplicate response, got %v", again.DNS.LatencyMs)
+	}
+}
+
+func TestDecodeUnknownProtoType(t *testing.T) {
+	d := NewDecoder()
+	packet := &protocol.HEPPacket{ProtoType: 200, Payload: []byte("x")}
+	if err := d.Decode(packet); err != nil {
+		t.Errorf("Expected unknown proto type to be ignored, got %v", err)
+	}
+}
+
+func TestDecodeDiameterSessionCID(t *testing.T) {
+	d := NewDecoder()
+
+	// Minimal CCA carrying only a Session-Id AVP
+	payload := []byte{1, 0, 0, 36, 0x00, 0, 1, 16, 0, 0, 0, 4, 0, 0, 0, 1, 0, 0, 0, 2,
+		0, 0, 1, 7, 0x40, 0, 0, 13, 's', 'e', 's', 's', '1', 0, 0, 0}
+
+	packet := &protocol.HEPPacket{ProtoType: protocol.ProtoTypeDiameter, Payload: payload}
+	if err := d.Decode(packet); err != nil {
+		t.Fatalf("Failed to decode Diameter: %v", err)
+	}
+	if packet.CID != "sess1" {
+		t.Errorf("Expected CID from Session-Id, got %q", packet.CID)
+	}
+
+	packet = &protocol.HEPPacket{ProtoType: protocol.ProtoTypeDiameter, Payload: payload, CID: "call-1"}
+	d.Decode(packet)
+	if packet.CID != "call-1" {
+		t.Errorf("Expected agent CID to be kept, got %q", packet.CID)
+	}
+}
+
+func TestDecodeMediaCorrelation(t *testing.T) {
+	d := NewDecoder()
+
+	invite := "INVITE sip:bob@example.com SIP/2.0\r\n" +
+		"Call-ID: media-call-1\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"\r\n" +
+		"v=0\r\n" +
+		"c=IN IP4 192.0.2.10\r\n" +
+		"m=audio 49170 RTP/AVP 0\r\n"
+	sip := &protocol.HEPPacket{ProtoType: protocol.ProtoTypeSIP, Payload: []byte(invite)}
+	if err := d.Decode(sip); err != nil {
+		t.Fatalf("Failed to decode INVITE: %v", err)
+	}
+	if sip.SIP.SDP == nil || sip.SIP.SDP.Media[0].Port != 49170 {
+		t.Fatalf("Expected decoded SDP, got %+v", sip.SIP.SDP)
+	}
+
+	rtp := &protocol.HEPPacket{
+		SrcIP:     "198.51.100.20",
+		SrcPort:   30000,
+		DstIP:     "192.0.2.10",
+		DstPort:   49170,
+		ProtoType: protocol.ProtoTypeRTP,
+		Payload:   []byte{0x80, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0, 0, 1},
+	}
+	if err := d.Decode(rtp); err != nil {
+		t.Fatalf("Failed to decode RTP: %v", err)
+	}
+	if rtp.CID != "media-call-1" || rtp.RTP == nil {
+		t.Errorf("Expected RTP tagged with media-call-1, got %q", rtp.CID)
+	}
+
+	// RTCP uses the next port and goes back to the announcing side
+	rtcp := &protocol.HEPPacket{
+		SrcIP:     "192.0.2.10",
+		SrcPort:   49171,
+		DstIP:     "198.51.100.20",
+		DstPort:   30001,
+		ProtoType: protocol.ProtoTypeRTCP,
+	}
+	d.Decode(rtcp)
+	if rtcp.CID != "media-call-1" {
+		t.Errorf("Expected RTCP tagged with media-call-1, got %q", rtcp.CID)
+	}
+
+	// Agents that set a CID keep it
+	tagged := &protocol.HEPPacket{DstIP: "192.0.2.10", DstPort: 49171, ProtoType: protocol.ProtoTypeRTCP, CID: "agent"}
+	d.Decode(tagged)
+	if tagged.CID != "agent" {
+		t.Errorf("Expected the agent CID to be kept, got %q", tagged.CID)
+	}
+}
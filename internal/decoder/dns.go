@@ -0,0 +1,85 @@
+package decoder
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+const defaultDNSTimeout = 30 * time.Second
+
+// dnsTracker matches DNS responses to their queries by message ID and
+// 5-tuple to compute the response latency
+type dnsTracker struct {
+	timeout    time.Duration
+	pending    map[string]dnsQuery
+	lastExpire time.Time
+	mu         sync.Mutex
+}
+
+type dnsQuery struct {
+	sent     time.Time
+	received time.Time
+}
+
+func newDNSTracker(timeout time.Duration) *dnsTracker {
+	return &dnsTracker{
+		timeout: timeout,
+		pending: make(map[string]dnsQuery),
+	}
+}
+
+func (t *dnsTracker) track(packet *protocol.HEPPacket) {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire(now)
+
+	if !packet.DNS.Response {
+		t.pending[dnsKey(packet, false)] = dnsQuery{sent: packet.Time(), received: now}
+		return
+	}
+
+	key := dnsKey(packet, true)
+	query, ok := t.pending[key]
+	if !ok {
+		return
+	}
+	delete(t.pending, key)
+
+	latency := packet.Time().Sub(query.sent)
+	if latency < 0 {
+		latency = 0
+	}
+	packet.DNS.LatencyMs = float64(latency) / float64(time.Millisecond)
+}
+
+// expire drops queries that never got an answer
+func (t *dnsTracker) expire(now time.Time) {
+	if now.Sub(t.lastExpire) < time.Second {
+		return
+	}
+	t.lastExpire = now
+
+	for key, query := range t.pending {
+		if now.Sub(query.received) > t.timeout {
+			delete(t.pending, key)
+		}
+	}
+}
+
+// dnsKey builds the key from the client side of the exchange so that a
+// query and its response map to the same entry
+func dnsKey(packet *protocol.HEPPacket, response bool) string {
+	clientIP, clientPort := packet.SrcIP, packet.SrcPort
+	serverIP, serverPort := packet.DstIP, packet.DstPort
+	if response {
+		clientIP, clientPort, serverIP, serverPort = serverIP, serverPort, clientIP, clientPort
+	}
+	return fmt.Sprintf("%d|%d|%s:%d|%s:%d", packet.DNS.ID, packet.Protocol,
+		clientIP, clientPort, serverIP, serverPort)
+}
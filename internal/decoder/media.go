@@ -0,0 +1,103 @@
+package decoder
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+// defaultMediaTimeout is how long a media address is kept after the last
+// SDP or media packet that used it
+const defaultMediaTimeout = 5 * time.Minute
+
+// mediaIndex maps the RTP and RTCP addresses announced in SDP to the CID of
+// the call, so media captured without a correlation ID can be tagged
+type mediaIndex struct {
+	timeout    time.Duration
+	entries    map[string]*mediaEntry
+	lastExpire time.Time
+	mu         sync.Mutex
+}
+
+type mediaEntry struct {
+	cid      string
+	lastSeen time.Time
+}
+
+func newMediaIndex(timeout time.Duration) *mediaIndex {
+	return &mediaIndex{
+		timeout: timeout,
+		entries: make(map[string]*mediaEntry),
+	}
+}
+
+// learn records the media addresses of an offer or answer. Both are needed
+// as each side announces where it wants to receive.
+func (m *mediaIndex) learn(cid string, sdp *protocol.SDPSession) {
+	if cid == "" {
+		return
+	}
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expire(now)
+	for _, media := range sdp.Media {
+		// Port 0 rejects or disables the stream
+		if media.Connection == "" || media.Port == 0 {
+			continue
+		}
+		for _, port := range []uint16{media.Port, media.RTCPPort} {
+			m.entries[mediaKey(media.Connection, port)] = &mediaEntry{cid: cid, lastSeen: now}
+		}
+	}
+}
+
+// tag sets the CID of a media packet sent to or from a known address
+func (m *mediaIndex) tag(packet *protocol.HEPPacket) {
+	if packet.CID != "" {
+		return
+	}
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expire(now)
+	for _, key := range []string{
+		mediaKey(packet.DstIP, packet.DstPort),
+		mediaKey(packet.SrcIP, packet.SrcPort),
+	} {
+		if entry, ok := m.entries[key]; ok {
+			entry.lastSeen = now
+			packet.CID = entry.cid
+			return
+		}
+	}
+}
+
+// expire drops addresses without recent SDP or media
+func (m *mediaIndex) expire(now time.Time) {
+	if now.Sub(m.lastExpire) < time.Second {
+		return
+	}
+	m.lastExpire = now
+
+	for key, entry := range m.entries {
+		if now.Sub(entry.lastSeen) > m.timeout {
+			delete(m.entries, key)
+		}
+	}
+}
+
+func mediaKey(ip string, port uint16) string {
+	// Normalize IPv6 notation between SDP and HEP
+	if addr := net.ParseIP(ip); addr != nil {
+		ip = addr.String()
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(int(port)))
+}
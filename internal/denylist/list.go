@@ -0,0 +1,168 @@
+package denylist
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound    = errors.New("deny list entry not found")
+	ErrInvalidCIDR = errors.New("invalid ip or cidr")
+)
+
+// Entry denies packets from an address or network, until Expires when set
+type Entry struct {
+	CIDR    string     `json:"cidr"`
+	Reason  string     `json:"reason,omitempty"`
+	Added   time.Time  `json:"added"`
+	Expires *time.Time `json:"expires,omitempty"`
+
+	prefix netip.Prefix
+}
+
+func (e *Entry) expired(now time.Time) bool {
+	return e.Expires != nil && !now.Before(*e.Expires)
+}
+
+// List holds the sources whose packets are dropped at ingress
+type List struct {
+	entries map[netip.Prefix]*Entry
+	// bits counts the entries per prefix length
+	bits map[int]int
+	mu   sync.RWMutex
+}
+
+func New() *List {
+	return &List{
+		entries: make(map[netip.Prefix]*Entry),
+		bits:    make(map[int]int),
+	}
+}
+
+// Add denies an address or CIDR. A ttl of 0 adds a permanent entry. Adding
+// an existing entry updates its reason and expiry, permanent entries stay
+// permanent.
+func (l *List) Add(cidr, reason string, ttl time.Duration) (*Entry, error) {
+	prefix, err := parsePrefix(cidr)
+	if err != nil {
+		return nil, ErrInvalidCIDR
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[prefix]
+	if !ok || entry.expired(now) {
+		if !ok {
+			l.bits[prefix.Bits()]++
+		}
+		entry = &Entry{CIDR: prefix.String(), Added: now, prefix: prefix}
+		l.entries[prefix] = entry
+	} else if entry.Expires == nil && ttl > 0 {
+		ttl = 0
+	}
+
+	entry.Reason = reason
+	entry.Expires = nil
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		entry.Expires = &expires
+	}
+	copied := *entry
+	return &copied, nil
+}
+
+// Remove deletes an entry by its address or CIDR
+func (l *List) Remove(cidr string) error {
+	prefix, err := parsePrefix(cidr)
+	if err != nil {
+		return ErrInvalidCIDR
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.entries[prefix]; !ok {
+		return ErrNotFound
+	}
+	l.remove(prefix)
+	return nil
+}
+
+func (l *List) remove(prefix netip.Prefix) {
+	delete(l.entries, prefix)
+	if l.bits[prefix.Bits()]--; l.bits[prefix.Bits()] == 0 {
+		delete(l.bits, prefix.Bits())
+	}
+}
+
+// List returns the active entries ordered by CIDR and drops expired ones
+func (l *List) List() []Entry {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]Entry, 0, len(l.entries))
+	for prefix, entry := range l.entries {
+		if entry.expired(now) {
+			l.remove(prefix)
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return a.prefix.Addr().Compare(b.prefix.Addr())
+	})
+	return entries
+}
+
+// Denied reports whether ip is covered by an active entry
+func (l *List) Denied(ip string) bool {
+	return l.denied(ip, time.Now())
+}
+
+func (l *List) denied(ip string, now time.Time) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for bits := range l.bits {
+		if bits > addr.BitLen() {
+			continue
+		}
+		prefix, _ := addr.Prefix(bits)
+		if entry, ok := l.entries[prefix]; ok && !entry.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefix parses a CIDR or a single address
+func parsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,69 @@
+package denylist
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDenyList(t *testing.T) {
+	l := New()
+
+	if _, err := l.Add("198.51.100.0/24", "scanner network", 0); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if _, err := l.Add("203.0.113.7", "brute force", time.Hour); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if _, err := l.Add("2001:db8::/32", "", 0); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	for ip, want := range map[string]bool{
+		"198.51.100.99":      true,
+		"203.0.113.7":        true,
+		"203.0.113.8":        false,
+		"::ffff:203.0.113.7": true,
+		"2001:db8::1":        true,
+		"2001:db9::1":        false,
+		"not-an-ip":          false,
+	} {
+		if got := l.Denied(ip); got != want {
+			t.Errorf("Denied(%s) = %v, want %v", ip, got, want)
+		}
+	}
+
+	if l.denied("203.0.113.7", time.Now().Add(2*time.Hour)) {
+		t.Error("Expected the entry to expire")
+	}
+
+	entries := l.List()
+	if len(entries) != 3 || entries[0].CIDR != "198.51.100.0/24" || entries[1].Expires == nil {
+		t.Errorf("Unexpected entries: %+v", entries)
+	}
+
+	if err := l.Remove("198.51.100.0/24"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if l.Denied("198.51.100.99") {
+		t.Error("Expected the removed network to be allowed")
+	}
+	if err := l.Remove("198.51.100.0/24"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := l.Add("300.1.1.1", "", 0); !errors.Is(err, ErrInvalidCIDR) {
+		t.Errorf("Expected ErrInvalidCIDR, got %v", err)
+	}
+}
+
+func TestDenyListPermanentStays(t *testing.T) {
+	l := New()
+	l.Add("192.0.2.1", "manual", 0)
+	entry, err := l.Add("192.0.2.1", "invite flood", time.Minute)
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if entry.Expires != nil || entry.Reason != "invite flood" {
+		t.Errorf("Expected a permanent entry with the new reason, got %+v", entry)
+	}
+}
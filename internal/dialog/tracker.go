@@ -0,0 +1,302 @@
+package dialog
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sipcapture/hepop-go/internal/writer"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+type Config struct {
+	// InviteTimeout bounds how long an unanswered INVITE is tracked
+	InviteTimeout time.Duration
+	// DialogTimeout bounds how long an answered dialog is tracked without
+	// any packet, e.g. when the BYE was not captured
+	DialogTimeout time.Duration
+}
+
+// Tracker follows INVITE dialogs by CID and emits a CDR when the dialog
+// ends or times out
+type Tracker struct {
+	config  Config
+	writer  writer.CDRWriter
+	dialogs map[string]*dialog
+	mu      sync.Mutex
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// retryStatuses are INVITE responses the caller answers with a new INVITE
+// in the same dialog: digest challenges, 422 Session Interval Too Small
+// and 491 Request Pending
+var retryStatuses = map[int]bool{401: true, 407: true, 422: true, 491: true}
+
+type dialog struct {
+	cdr        writer.CDR
+	fromTag    string
+	inviteCSeq uint32
+	cancelled  bool
+	// challenged is set while the caller is expected to send the INVITE
+	// again, e.g. with credentials after a 407
+	challenged bool
+	created    time.Time
+	lastSeen   time.Time
+	lastPacket time.Time
+}
+
+func NewTracker(config Config, w writer.CDRWriter) *Tracker {
+	t := &Tracker{
+		config:  config,
+		writer:  w,
+		dialogs: make(map[string]*dialog),
+		done:    make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.expireLoop()
+	return t
+}
+
+// Observe updates the dialog state with a decoded SIP packet
+func (t *Tracker) Observe(packet *protocol.HEPPacket) {
+	msg := packet.SIP
+	if msg == nil {
+		return
+	}
+
+	key := packet.CID
+	if key == "" {
+		key = msg.CallID
+	}
+	if key == "" {
+		return
+	}
+
+	t.mu.Lock()
+	cdr := t.update(key, packet, msg)
+	t.mu.Unlock()
+
+	if cdr != nil {
+		t.emit(cdr)
+	}
+}
+
+// update applies one message to the dialog and returns the CDR if the
+// dialog is finished
+func (t *Tracker) update(key string, packet *protocol.HEPPacket, msg *protocol.SIPMessage) *writer.CDR {
+	ts := packet.Time()
+	d, ok := t.dialogs[key]
+
+	if msg.IsRequest() {
+		switch msg.Method {
+		case "INVITE":
+			// The INVITE sent again after a challenge continues the call
+			if ok && d.challenged && msg.To.Tag == "" && msg.CSeq > d.inviteCSeq {
+				d.inviteCSeq = msg.CSeq
+				d.challenged = false
+				d.cdr.FinalStatus = 0
+				d.cdr.Reason = ""
+				break
+			}
+			// Re-INVITEs and retransmissions only refresh the dialog
+			if ok || msg.To.Tag != "" {
+				break
+			}
+			now := time.Now()
+			d = &dialog{
+				fromTag:    msg.From.Tag,
+				inviteCSeq: msg.CSeq,
+				created:    now,
+				cdr: writer.CDR{
+					CID:        key,
+					CallID:     msg.CallID,
+					NodeID:     packet.NodeID,
+					FromUser:   msg.From.User,
+					FromURI:    msg.From.URI,
+					ToUser:     msg.To.User,
+					ToURI:      msg.To.URI,
+					SrcIP:      packet.SrcIP,
+					DstIP:      packet.DstIP,
+					UserAgent:  msg.UserAgent,
+					InviteTime: ts,
+				},
+			}
+			t.dialogs[key] = d
+			ok = true
+		case "CANCEL":
+			if ok && d.cdr.AnswerTime.IsZero() {
+				// Wait for the 487 so the CDR carries the final status
+				d.cancelled = true
+				d.cdr.EndTime = ts
+				d.cdr.TerminatedBy = "caller"
+			}
+		case "BYE":
+			if !ok {
+				return nil
+			}
+			d.cdr.EndTime = ts
+			d.cdr.TerminationCause = writer.CDRCompleted
+			d.cdr.TerminatedBy = "callee"
+			if msg.From.Tag == d.fromTag {
+				d.cdr.TerminatedBy = "caller"
+			}
+			if reason := msg.Header("reason"); reason != "" {
+				d.cdr.Reason = reason
+			}
+			return t.finish(key, d)
+		}
+	} else if ok && msg.CSeqMethod == "INVITE" && msg.CSeq == d.inviteCSeq {
+		switch {
+		case msg.StatusCode < 180:
+		case msg.StatusCode < 200:
+			if d.cdr.RingTime.IsZero() {
+				d.cdr.RingTime = ts
+			}
+		case msg.StatusCode < 300:
+			if d.cdr.AnswerTime.IsZero() {
+				d.cdr.AnswerTime = ts
+				d.cdr.FinalStatus = msg.StatusCode
+			}
+		default:
+			if !d.cdr.AnswerTime.IsZero() {
+				break
+			}
+			d.cdr.FinalStatus = msg.StatusCode
+			if retryStatuses[msg.StatusCode] && !d.cancelled {
+				// Keep the dialog for the next INVITE, the status stays
+				// final if none follows
+				d.challenged = true
+				d.cdr.Reason = msg.Reason
+				break
+			}
+			d.cdr.Reason = msg.Reason
+			if reason := msg.Header("reason"); reason != "" {
+				d.cdr.Reason = reason
+			}
+			if d.cancelled {
+				d.cdr.TerminationCause = writer.CDRCancelled
+			} else {
+				d.cdr.EndTime = ts
+				d.cdr.TerminationCause = writer.CDRFailed
+				d.cdr.TerminatedBy = "callee"
+			}
+			return t.finish(key, d)
+		}
+	}
+
+	if ok {
+		d.lastSeen = time.Now()
+		if ts.After(d.lastPacket) {
+			d.lastPacket = ts
+		}
+	}
+	return nil
+}
+
+// finish removes the dialog and computes the CDR timings
+func (t *Tracker) finish(key string, d *dialog) *writer.CDR {
+	delete(t.dialogs, key)
+
+	cdr := d.cdr
+	if cdr.EndTime.IsZero() {
+		cdr.EndTime = d.lastPacket
+	}
+
+	// Post-dial delay runs until the first ringing or final response
+	firstResponse := cdr.RingTime
+	if firstResponse.IsZero() {
+		firstResponse = cdr.AnswerTime
+	}
+	if firstResponse.IsZero() && cdr.TerminationCause == writer.CDRFailed {
+		firstResponse = cdr.EndTime
+	}
+	if !firstResponse.IsZero() {
+		cdr.SetupTimeMs = millis(firstResponse.Sub(cdr.InviteTime))
+	}
+
+	if !cdr.RingTime.IsZero() {
+		ringEnd := cdr.AnswerTime
+		if ringEnd.IsZero() {
+			ringEnd = cdr.EndTime
+		}
+		cdr.RingingTimeMs = millis(ringEnd.Sub(cdr.RingTime))
+	}
+
+	if !cdr.AnswerTime.IsZero() {
+		cdr.DurationMs = millis(cdr.EndTime.Sub(cdr.AnswerTime))
+	}
+
+	return &cdr
+}
+
+func (t *Tracker) emit(cdr *writer.CDR) {
+	if err := t.writer.WriteCDR(cdr); err != nil {
+		logrus.Errorf("CDR write error for %s: %v", cdr.CID, err)
+	}
+}
+
+func (t *Tracker) expireLoop() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-ticker.C:
+			for _, cdr := range t.expire(now) {
+				t.emit(cdr)
+			}
+		}
+	}
+}
+
+// expire finishes dialogs that exceeded their timeout
+func (t *Tracker) expire(now time.Time) []*writer.CDR {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var cdrs []*writer.CDR
+	for key, d := range t.dialogs {
+		answered := !d.cdr.AnswerTime.IsZero()
+		if (!answered && now.Sub(d.created) > t.config.InviteTimeout) ||
+			(answered && now.Sub(d.lastSeen) > t.config.DialogTimeout) {
+			d.cdr.TerminationCause = writer.CDRTimeout
+			if d.challenged {
+				// The caller gave up after the challenge
+				d.cdr.TerminationCause = writer.CDRFailed
+				d.cdr.TerminatedBy = "callee"
+			}
+			cdrs = append(cdrs, t.finish(key, d))
+		}
+	}
+	return cdrs
+}
+
+// Close stops the tracker and emits CDRs for dialogs still in progress
+func (t *Tracker) Close() error {
+	close(t.done)
+	t.wg.Wait()
+
+	t.mu.Lock()
+	var cdrs []*writer.CDR
+	for key, d := range t.dialogs {
+		d.cdr.TerminationCause = writer.CDRShutdown
+		cdrs = append(cdrs, t.finish(key, d))
+	}
+	t.mu.Unlock()
+
+	for _, cdr := range cdrs {
+		t.emit(cdr)
+	}
+	return nil
+}
+
+func millis(d time.Duration) int64 {
+	if d < 0 {
+		return 0
+	}
+	return d.Milliseconds()
+}
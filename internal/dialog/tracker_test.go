@@ -0,0 +1,228 @@
+package dialog
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sipcapture/hepop-go/internal/writer"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+type mockCDRWriter struct {
+	mu   sync.Mutex
+	cdrs []*writer.CDR
+}
+
+func (w *mockCDRWriter) WriteCDR(cdr *writer.CDR) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cdrs = append(w.cdrs, cdr)
+	return nil
+}
+
+func (w *mockCDRWriter) written() []*writer.CDR {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.cdrs
+}
+
+// sipPacket builds a decoded SIP packet. The first line is either a method
+// or a status code, from/to tags are passed explicitly.
+func sipPacket(t *testing.T, ts uint64, firstLine, fromTag, toTag, cseq string, extra ...string) *protocol.HEPPacket {
+	t.Helper()
+
+	startLine := firstLine + " sip:bob@example.com SIP/2.0"
+	if firstLine[0] >= '1' && firstLine[0] <= '6' {
+		startLine = "SIP/2.0 " + firstLine
+	}
+	to := "<sip:bob@example.com>"
+	if toTag != "" {
+		to += ";tag=" + toTag
+	}
+	payload := fmt.Sprintf("%s\r\nFrom: <sip:alice@example.com>;tag=%s\r\nTo: %s\r\nCall-ID: call-1\r\nCSeq: %s\r\n",
+		startLine, fromTag, to, cseq)
+	for _, header := range extra {
+		payload += header + "\r\n"
+	}
+	payload += "\r\n"
+
+	msg, err := protocol.DecodeSIP([]byte(payload))
+	if err != nil {
+		t.Fatalf("Failed to build SIP packet: %v", err)
+	}
+	return &protocol.HEPPacket{
+		SrcIP:     "10.0.0.1",
+		DstIP:     "10.0.0.2",
+		Timestamp: ts,
+		ProtoType: protocol.ProtoTypeSIP,
+		CID:       msg.CallID,
+		SIP:       msg,
+	}
+}
+
+func newTestTracker(w writer.CDRWriter) *Tracker {
+	return NewTracker(Config{InviteTimeout: time.Minute, DialogTimeout: time.Hour}, w)
+}
+
+func TestTrackerCompletedCall(t *testing.T) {
+	w := &mockCDRWriter{}
+	tr := newTestTracker(w)
+	defer tr.Close()
+
+	tr.Observe(sipPacket(t, 1000, "INVITE", "a", "", "1 INVITE"))
+	tr.Observe(sipPacket(t, 1000, "100 Trying", "a", "", "1 INVITE"))
+	tr.Observe(sipPacket(t, 1002, "180 Ringing", "a", "b", "1 INVITE"))
+	tr.Observe(sipPacket(t, 1007, "200 OK", "a", "b", "1 INVITE"))
+	tr.Observe(sipPacket(t, 1007, "ACK", "a", "b", "1 ACK"))
+	// Re-INVITE must not reset the dialog
+	tr.Observe(sipPacket(t, 1030, "INVITE", "a", "b", "2 INVITE"))
+	tr.Observe(sipPacket(t, 1067, "BYE", "b", "a", "1 BYE", "Reason: Q.850;cause=16"))
+
+	cdrs := w.written()
+	if len(cdrs) != 1 {
+		t.Fatalf("Expected 1 CDR, got %d", len(cdrs))
+	}
+	cdr := cdrs[0]
+
+	if cdr.TerminationCause != writer.CDRCompleted {
+		t.Errorf("Expected cause completed, got %s", cdr.TerminationCause)
+	}
+	if cdr.TerminatedBy != "callee" {
+		t.Errorf("Expected callee to hang up, got %s", cdr.TerminatedBy)
+	}
+	if cdr.FinalStatus != 200 {
+		t.Errorf("Expected final status 200, got %d", cdr.FinalStatus)
+	}
+	if cdr.SetupTimeMs != 2000 || cdr.RingingTimeMs != 5000 || cdr.DurationMs != 60000 {
+		t.Errorf("Unexpected timings setup=%d ringing=%d duration=%d",
+			cdr.SetupTimeMs, cdr.RingingTimeMs, cdr.DurationMs)
+	}
+	if cdr.Reason != "Q.850;cause=16" {
+		t.Errorf("Expected Reason header, got %s", cdr.Reason)
+	}
+	if cdr.FromUser != "alice" || cdr.ToUser != "bob" {
+		t.Errorf("Unexpected parties %s -> %s", cdr.FromUser, cdr.ToUser)
+	}
+}
+
+func TestTrackerMillisecondTimings(t *testing.T) {
+	w := &mockCDRWriter{}
+	tr := newTestTracker(w)
+	defer tr.Close()
+
+	at := func(packet *protocol.HEPPacket, usec uint32) *protocol.HEPPacket {
+		packet.TimestampUsec = usec
+		return packet
+	}
+	tr.Observe(at(sipPacket(t, 1000, "INVITE", "a", "", "1 INVITE"), 100000))
+	tr.Observe(at(sipPacket(t, 1000, "180 Ringing", "a", "b", "1 INVITE"), 350000))
+	tr.Observe(at(sipPacket(t, 1001, "200 OK", "a", "b", "1 INVITE"), 200000))
+	tr.Observe(at(sipPacket(t, 1001, "BYE", "a", "b", "2 BYE"), 950000))
+
+	cdrs := w.written()
+	if len(cdrs) != 1 {
+		t.Fatalf("Expected 1 CDR, got %d", len(cdrs))
+	}
+	if cdr := cdrs[0]; cdr.SetupTimeMs != 250 || cdr.RingingTimeMs != 850 || cdr.DurationMs != 750 {
+		t.Errorf("Unexpected timings setup=%d ringing=%d duration=%d",
+			cdr.SetupTimeMs, cdr.RingingTimeMs, cdr.DurationMs)
+	}
+}
+
+func TestTrackerFailedAndCancelledCalls(t *testing.T) {
+	w := &mockCDRWriter{}
+	tr := newTestTracker(w)
+	defer tr.Close()
+
+	tr.Observe(sipPacket(t, 1000, "INVITE", "a", "", "1 INVITE"))
+	tr.Observe(sipPacket(t, 1003, "486 Busy Here", "a", "b", "1 INVITE"))
+
+	tr.Observe(sipPacket(t, 2000, "INVITE", "a", "", "1 INVITE"))
+	tr.Observe(sipPacket(t, 2001, "180 Ringing", "a", "b", "1 INVITE"))
+	tr.Observe(sipPacket(t, 2009, "CANCEL", "a", "", "1 CANCEL"))
+	tr.Observe(sipPacket(t, 2009, "487 Request Terminated", "a", "b", "1 INVITE"))
+
+	cdrs := w.written()
+	if len(cdrs) != 2 {
+		t.Fatalf("Expected 2 CDRs, got %d", len(cdrs))
+	}
+
+	failed := cdrs[0]
+	if failed.TerminationCause != writer.CDRFailed || failed.FinalStatus != 486 {
+		t.Errorf("Expected failed 486, got %s %d", failed.TerminationCause, failed.FinalStatus)
+	}
+	if failed.SetupTimeMs != 3000 || failed.DurationMs != 0 {
+		t.Errorf("Unexpected timings setup=%d duration=%d", failed.SetupTimeMs, failed.DurationMs)
+	}
+	if failed.Reason != "Busy Here" {
+		t.Errorf("Expected reason phrase, got %s", failed.Reason)
+	}
+
+	cancelled := cdrs[1]
+	if cancelled.TerminationCause != writer.CDRCancelled || cancelled.FinalStatus != 487 {
+		t.Errorf("Expected cancelled 487, got %s %d", cancelled.TerminationCause, cancelled.FinalStatus)
+	}
+	if cancelled.TerminatedBy != "caller" || cancelled.RingingTimeMs != 8000 {
+		t.Errorf("Unexpected cancel by=%s ringing=%d", cancelled.TerminatedBy, cancelled.RingingTimeMs)
+	}
+}
+
+func TestTrackerAuthenticatedCall(t *testing.T) {
+	w := &mockCDRWriter{}
+	tr := newTestTracker(w)
+	defer tr.Close()
+
+	tr.Observe(sipPacket(t, 1000, "INVITE", "a", "", "1 INVITE"))
+	tr.Observe(sipPacket(t, 1000, "407 Proxy Authentication Required", "a", "p", "1 INVITE"))
+	tr.Observe(sipPacket(t, 1000, "ACK", "a", "p", "1 ACK"))
+	tr.Observe(sipPacket(t, 1001, "INVITE", "a", "", "2 INVITE", `Proxy-Authorization: Digest username="alice"`))
+	// A late copy of the challenge does not end the call
+	tr.Observe(sipPacket(t, 1001, "407 Proxy Authentication Required", "a", "p", "1 INVITE"))
+	tr.Observe(sipPacket(t, 1002, "180 Ringing", "a", "b", "2 INVITE"))
+	tr.Observe(sipPacket(t, 1004, "200 OK", "a", "b", "2 INVITE"))
+	tr.Observe(sipPacket(t, 1034, "BYE", "a", "b", "3 BYE"))
+
+	cdrs := w.written()
+	if len(cdrs) != 1 {
+		t.Fatalf("Expected 1 CDR, got %d", len(cdrs))
+	}
+	if cdr := cdrs[0]; cdr.TerminationCause != writer.CDRCompleted || cdr.FinalStatus != 200 || cdr.DurationMs != 30000 || cdr.SetupTimeMs != 2000 {
+		t.Errorf("Expected 1 answered CDR, got %+v", cdr)
+	}
+
+	// A challenge the caller does not answer ends as failed
+	tr.Observe(sipPacket(t, 2000, "INVITE", "c", "", "1 INVITE"))
+	tr.Observe(sipPacket(t, 2000, "401 Unauthorized", "c", "p", "1 INVITE"))
+	if got := w.written(); len(got) != 1 {
+		t.Fatalf("Expected the challenged dialog to stay open, got %d CDRs", len(got))
+	}
+	cdrs = tr.expire(time.Now().Add(2 * time.Minute))
+	if len(cdrs) != 1 || cdrs[0].TerminationCause != writer.CDRFailed || cdrs[0].FinalStatus != 401 {
+		t.Errorf("Expected 1 failed 401 CDR, got %+v", cdrs)
+	}
+}
+
+func TestTrackerTimeout(t *testing.T) {
+	w := &mockCDRWriter{}
+	tr := newTestTracker(w)
+
+	tr.Observe(sipPacket(t, 1000, "INVITE", "a", "", "1 INVITE"))
+	tr.Observe(sipPacket(t, 1001, "200 OK", "a", "b", "1 INVITE"))
+
+	if cdrs := tr.expire(time.Now().Add(30 * time.Minute)); len(cdrs) != 0 {
+		t.Fatalf("Expected answered call to be kept, got %d CDRs", len(cdrs))
+	}
+	cdrs := tr.expire(time.Now().Add(2 * time.Hour))
+	if len(cdrs) != 1 || cdrs[0].TerminationCause != writer.CDRTimeout {
+		t.Fatalf("Expected 1 timed out CDR, got %+v", cdrs)
+	}
+
+	// Dialogs left open are flushed on Close
+	tr.Observe(sipPacket(t, 3000, "INVITE", "c", "", "1 INVITE"))
+	tr.Close()
+	if got := w.written(); len(got) != 1 || got[0].TerminationCause != writer.CDRShutdown {
+		t.Errorf("Expected 1 shutdown CDR, got %+v", got)
+	}
+}
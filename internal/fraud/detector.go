@@ -0,0 +1,361 @@
+package fraud
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sipcapture/hepop-go/internal/denylist"
+	"github.com/sipcapture/hepop-go/internal/writer"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// Detector names reported in writer.Alert.Detector
+const (
+	DetectorBruteForce    = "brute_force"
+	DetectorInviteFlood   = "invite_flood"
+	DetectorScanner       = "scanner"
+	DetectorInternational = "international_spike"
+)
+
+// DefaultScannerUserAgents are user agents of common SIP scanning tools
+var DefaultScannerUserAgents = []string{
+	"friendly-scanner",
+	"sipvicious",
+	"sipcli",
+	"sip-scan",
+	"sipsak",
+	"iwar",
+	"sundayddr",
+	"vaxsipuseragent",
+	"pplsip",
+}
+
+// transactionTimeout matches SIP timer F, after which a transaction is
+// forgotten
+const transactionTimeout = 32 * time.Second
+
+// Threshold raises an alert when Count events happen within Window, a zero
+// Count disables the detector
+type Threshold struct {
+	Count  int
+	Window time.Duration
+}
+
+type Config struct {
+	// BruteForce counts failed REGISTER authentications per client: 403
+	// responses and 401 or 407 responses to a REGISTER with credentials.
+	// The challenge to the first REGISTER of a client is part of every
+	// registration and is not counted.
+	BruteForce Threshold
+	// InviteFlood counts INVITEs per source
+	InviteFlood Threshold
+	// ScannerUserAgents are matched case-insensitively as substrings of
+	// the User-Agent, empty disables the detector
+	ScannerUserAgents []string
+	// International counts new calls to international numbers per caller
+	International Threshold
+	// InternationalPrefixes mark dialed numbers as international unless
+	// they start with one of HomePrefixes
+	InternationalPrefixes []string
+	HomePrefixes          []string
+	// Cooldown suppresses repeated alerts for the same offender
+	Cooldown time.Duration
+	// DenyOffenders adds the source of brute force, flood and scanner alerts
+	// to the deny list for DenyTTL
+	DenyOffenders bool
+	DenyTTL       time.Duration
+}
+
+// Detector watches the SIP stream for fraud and abuse patterns
+type Detector struct {
+	config   Config
+	alerts   writer.AlertWriter
+	deny     *denylist.List
+	counters map[detectorKey]*counter
+	alerted  map[detectorKey]time.Time
+	// transactions are the recent SIP transactions by Call-ID and CSeq, so
+	// copies from several agents and retransmissions count once
+	transactions map[string]*transaction
+	mu           sync.Mutex
+	done         chan struct{}
+	wg           sync.WaitGroup
+}
+
+type detectorKey struct {
+	detector string
+	key      string
+}
+
+type transaction struct {
+	seen time.Time
+	// authorized is set when the request carried credentials
+	authorized bool
+	// failed is set when a failed authentication was counted
+	failed bool
+}
+
+// counter counts events in a fixed window starting at the first event
+type counter struct {
+	start  time.Time
+	window time.Duration
+	count  int
+}
+
+// NewDetector creates a detector. alerts and deny may be nil, alerts are
+// logged in any case.
+func NewDetector(config Config, alerts writer.AlertWriter, deny *denylist.List) *Detector {
+	if config.Cooldown <= 0 {
+		config.Cooldown = 10 * time.Minute
+	}
+	scanners := make([]string, len(config.ScannerUserAgents))
+	for i, ua := range config.ScannerUserAgents {
+		scanners[i] = strings.ToLower(ua)
+	}
+	config.ScannerUserAgents = scanners
+
+	d := &Detector{
+		config:       config,
+		alerts:       alerts,
+		deny:         deny,
+		counters:     make(map[detectorKey]*counter),
+		alerted:      make(map[detectorKey]time.Time),
+		transactions: make(map[string]*transaction),
+		done:         make(chan struct{}),
+	}
+	d.wg.Add(1)
+	go d.expireLoop()
+	return d
+}
+
+// Observe checks a packet against the detectors
+func (d *Detector) Observe(packet *protocol.HEPPacket) {
+	d.observe(packet, time.Now())
+}
+
+func (d *Detector) observe(packet *protocol.HEPPacket, now time.Time) {
+	msg := packet.SIP
+	if msg == nil {
+		return
+	}
+
+	var alerts []*writer.Alert
+	raise := func(alert *writer.Alert) {
+		alert.Time = now
+		alert.NodeID = packet.NodeID
+		alert.CID = packet.CID
+		alerts = append(alerts, alert)
+	}
+
+	d.mu.Lock()
+	tx, first := d.transaction(msg, now)
+	if msg.IsRequest() {
+		if first && msg.Method == "REGISTER" {
+			tx.authorized = msg.Header("authorization") != "" || msg.Header("proxy-authorization") != ""
+		}
+		if first && msg.Method == "INVITE" {
+			if n, ok := d.count(DetectorInviteFlood, packet.SrcIP, d.config.InviteFlood, now); ok {
+				raise(&writer.Alert{
+					Detector:  DetectorInviteFlood,
+					Source:    packet.SrcIP,
+					Count:     n,
+					WindowSec: d.config.InviteFlood.Window.Seconds(),
+					Message:   fmt.Sprintf("%d INVITEs from %s within %s", n, packet.SrcIP, d.config.InviteFlood.Window),
+				})
+			}
+			if number := protocol.ParseSIPAddress(msg.RequestURI).User; msg.To.Tag == "" && d.international(number) {
+				account := msg.From.User
+				if n, ok := d.count(DetectorInternational, account, d.config.International, now); ok {
+					raise(&writer.Alert{
+						Detector:  DetectorInternational,
+						Source:    packet.SrcIP,
+						Account:   account,
+						Number:    number,
+						Count:     n,
+						WindowSec: d.config.International.Window.Seconds(),
+						Message:   fmt.Sprintf("%d international calls from %s within %s, last to %s", n, account, d.config.International.Window, number),
+					})
+				}
+			}
+		}
+		if ua := strings.ToLower(msg.UserAgent); ua != "" {
+			for _, scanner := range d.config.ScannerUserAgents {
+				if strings.Contains(ua, scanner) && d.cooledDown(DetectorScanner, packet.SrcIP, now) {
+					raise(&writer.Alert{
+						Detector:  DetectorScanner,
+						Source:    packet.SrcIP,
+						UserAgent: msg.UserAgent,
+						Message:   fmt.Sprintf("scanner %q from %s", msg.UserAgent, packet.SrcIP),
+					})
+					break
+				}
+			}
+		}
+	} else if d.failedAuthentication(msg, tx) {
+		// The client is the destination of the challenge
+		if n, ok := d.count(DetectorBruteForce, packet.DstIP, d.config.BruteForce, now); ok {
+			raise(&writer.Alert{
+				Detector:  DetectorBruteForce,
+				Source:    packet.DstIP,
+				Account:   msg.To.User,
+				Count:     n,
+				WindowSec: d.config.BruteForce.Window.Seconds(),
+				Message:   fmt.Sprintf("%d failed registrations from %s within %s", n, packet.DstIP, d.config.BruteForce.Window),
+			})
+		}
+	}
+	d.mu.Unlock()
+
+	for _, alert := range alerts {
+		d.emit(alert)
+	}
+}
+
+// transaction returns the state of the message's transaction and whether
+// the message is the first one of it seen. Messages without Call-ID are
+// always first.
+func (d *Detector) transaction(msg *protocol.SIPMessage, now time.Time) (*transaction, bool) {
+	if msg.CallID == "" {
+		return &transaction{seen: now}, true
+	}
+	key := fmt.Sprintf("%s|%d|%s", msg.CallID, msg.CSeq, msg.CSeqMethod)
+	if tx, ok := d.transactions[key]; ok {
+		// Only a copy of the request is not first, responses are counted
+		// by failedAuthentication
+		return tx, !msg.IsRequest()
+	}
+	tx := &transaction{seen: now}
+	d.transactions[key] = tx
+	return tx, true
+}
+
+// failedAuthentication reports whether a REGISTER response is a failed
+// authentication not counted before
+func (d *Detector) failedAuthentication(msg *protocol.SIPMessage, tx *transaction) bool {
+	if msg.CSeqMethod != "REGISTER" || tx.failed {
+		return false
+	}
+	switch msg.StatusCode {
+	case 403:
+	case 401, 407:
+		if !tx.authorized {
+			return false
+		}
+	default:
+		return false
+	}
+	tx.failed = true
+	return true
+}
+
+// count adds an event and reports whether the threshold is reached and the
+// offender is not in cooldown
+func (d *Detector) count(detector, key string, threshold Threshold, now time.Time) (int, bool) {
+	if threshold.Count <= 0 || key == "" {
+		return 0, false
+	}
+
+	k := detectorKey{detector, key}
+	c, ok := d.counters[k]
+	if !ok || now.Sub(c.start) > threshold.Window {
+		c = &counter{start: now, window: threshold.Window}
+		d.counters[k] = c
+	}
+	c.count++
+	if c.count < threshold.Count {
+		return c.count, false
+	}
+	return c.count, d.cooledDown(detector, key, now)
+}
+
+// cooledDown reports whether an alert may be raised and starts the cooldown
+func (d *Detector) cooledDown(detector, key string, now time.Time) bool {
+	k := detectorKey{detector, key}
+	if last, ok := d.alerted[k]; ok && now.Sub(last) < d.config.Cooldown {
+		return false
+	}
+	d.alerted[k] = now
+	return true
+}
+
+func (d *Detector) international(number string) bool {
+	if d.config.International.Count <= 0 || number == "" {
+		return false
+	}
+	for _, prefix := range d.config.HomePrefixes {
+		if strings.HasPrefix(number, prefix) {
+			return false
+		}
+	}
+	for _, prefix := range d.config.InternationalPrefixes {
+		if strings.HasPrefix(number, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Detector) emit(alert *writer.Alert) {
+	logrus.Warnf("Fraud alert %s: %s", alert.Detector, alert.Message)
+
+	if d.alerts != nil {
+		if err := d.alerts.WriteAlert(alert); err != nil {
+			logrus.Errorf("Writing %s alert failed: %v", alert.Detector, err)
+		}
+	}
+
+	// Callers of an international spike may be a legitimate PBX, only
+	// sources of attacks are denied
+	if d.config.DenyOffenders && d.deny != nil && alert.Source != "" && alert.Detector != DetectorInternational {
+		if _, err := d.deny.Add(alert.Source, alert.Detector+": "+alert.Message, d.config.DenyTTL); err != nil {
+			logrus.Errorf("Denying %s failed: %v", alert.Source, err)
+		}
+	}
+}
+
+func (d *Detector) expireLoop() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case now := <-ticker.C:
+			d.expire(now)
+		}
+	}
+}
+
+// expire forgets finished windows, cooldowns and transactions
+func (d *Detector) expire(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for k, c := range d.counters {
+		if now.Sub(c.start) > c.window {
+			delete(d.counters, k)
+		}
+	}
+	for k, last := range d.alerted {
+		if now.Sub(last) >= d.config.Cooldown {
+			delete(d.alerted, k)
+		}
+	}
+	for k, tx := range d.transactions {
+		if now.Sub(tx.seen) > transactionTimeout {
+			delete(d.transactions, k)
+		}
+	}
+}
+
+// Close stops the detector
+func (d *Detector) Close() error {
+	close(d.done)
+	d.wg.Wait()
+	return nil
+}
@@ -0,0 +1,232 @@
+package fraud
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sipcapture/hepop-go/internal/denylist"
+	"github.com/sipcapture/hepop-go/internal/writer"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+type mockAlertWriter struct {
+	mu     sync.Mutex
+	alerts []*writer.Alert
+}
+
+func (w *mockAlertWriter) WriteAlert(alert *writer.Alert) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.alerts = append(w.alerts, alert)
+	return nil
+}
+
+func newTestDetector(config Config) (*Detector, *mockAlertWriter, *denylist.List) {
+	alerts := &mockAlertWriter{}
+	deny := denylist.New()
+	return NewDetector(config, alerts, deny), alerts, deny
+}
+
+func invite(src, from, ruri, ua string) *protocol.HEPPacket {
+	return &protocol.HEPPacket{
+		SrcIP:     src,
+		DstIP:     "192.0.2.1",
+		ProtoType: protocol.ProtoTypeSIP,
+		SIP: &protocol.SIPMessage{
+			Method:     "INVITE",
+			RequestURI: ruri,
+			From:       protocol.SIPAddress{User: from},
+			UserAgent:  ua,
+			CSeqMethod: "INVITE",
+		},
+	}
+}
+
+// register returns a REGISTER from client and the response to it
+func register(client string, cseq uint32, authorization string, status int) (*protocol.HEPPacket, *protocol.HEPPacket) {
+	request := &protocol.HEPPacket{
+		SrcIP:     client,
+		DstIP:     "192.0.2.1",
+		ProtoType: protocol.ProtoTypeSIP,
+		SIP: &protocol.SIPMessage{
+			Method:     "REGISTER",
+			CallID:     "reg-" + client,
+			CSeq:       cseq,
+			CSeqMethod: "REGISTER",
+			To:         protocol.SIPAddress{User: "100"},
+			Headers:    map[string][]string{},
+		},
+	}
+	if authorization != "" {
+		request.SIP.Headers["authorization"] = []string{authorization}
+	}
+	response := &protocol.HEPPacket{
+		SrcIP:     "192.0.2.1",
+		DstIP:     client,
+		ProtoType: protocol.ProtoTypeSIP,
+		SIP: &protocol.SIPMessage{
+			StatusCode: status,
+			CallID:     "reg-" + client,
+			CSeq:       cseq,
+			CSeqMethod: "REGISTER",
+			To:         protocol.SIPAddress{User: "100"},
+		},
+	}
+	return request, response
+}
+
+func TestDetectorBruteForce(t *testing.T) {
+	d, alerts, deny := newTestDetector(Config{
+		BruteForce:    Threshold{Count: 5, Window: time.Minute},
+		DenyOffenders: true,
+		DenyTTL:       time.Hour,
+	})
+	defer d.Close()
+
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		request, response := register("203.0.113.7", uint32(i+1), `Digest username="100"`, 401)
+		d.observe(request, now.Add(time.Duration(i)*time.Second))
+		d.observe(response, now.Add(time.Duration(i)*time.Second))
+	}
+
+	if len(alerts.alerts) != 1 {
+		t.Fatalf("Expected 1 alert within the cooldown, got %d", len(alerts.alerts))
+	}
+	alert := alerts.alerts[0]
+	if alert.Detector != DetectorBruteForce || alert.Source != "203.0.113.7" || alert.Count != 5 || alert.Account != "100" {
+		t.Errorf("Unexpected alert: %+v", alert)
+	}
+	if !deny.Denied("203.0.113.7") {
+		t.Error("Expected the offender to be denied")
+	}
+}
+
+func TestDetectorBruteForceChallengesAndCopies(t *testing.T) {
+	d, alerts, _ := newTestDetector(Config{BruteForce: Threshold{Count: 3, Window: time.Minute}})
+	defer d.Close()
+
+	now := time.Now()
+	// Challenges to REGISTERs without credentials are part of every
+	// registration
+	for i := 0; i < 10; i++ {
+		request, response := register("203.0.113.7", uint32(i+1), "", 401)
+		d.observe(request, now)
+		d.observe(response, now)
+	}
+	if len(alerts.alerts) != 0 {
+		t.Fatalf("Expected no alert for challenges, got %d", len(alerts.alerts))
+	}
+
+	// Two failed authentications seen by three agents count twice
+	for i := 0; i < 2; i++ {
+		request, response := register("203.0.113.8", uint32(i+1), `Digest username="100"`, 407)
+		for copies := 0; copies < 3; copies++ {
+			d.observe(request, now)
+			d.observe(response, now)
+		}
+	}
+	if len(alerts.alerts) != 0 {
+		t.Fatalf("Expected no alert for copies, got %d", len(alerts.alerts))
+	}
+
+	// 403 counts without credentials
+	_, response := register("203.0.113.8", 3, "", 403)
+	d.observe(response, now)
+	if len(alerts.alerts) != 1 || alerts.alerts[0].Count != 3 {
+		t.Fatalf("Expected 1 alert with count 3, got %+v", alerts.alerts)
+	}
+}
+
+func TestDetectorInviteFloodWindow(t *testing.T) {
+	d, alerts, deny := newTestDetector(Config{InviteFlood: Threshold{Count: 10, Window: 10 * time.Second}})
+	defer d.Close()
+
+	// 9 INVITEs per window stay below the threshold
+	now := time.Now()
+	for i := 0; i < 27; i++ {
+		d.observe(invite("198.51.100.5", "alice", "sip:bob@example.com", ""), now.Add(time.Duration(i)*1200*time.Millisecond))
+	}
+	if len(alerts.alerts) != 0 {
+		t.Fatalf("Expected no alert below the rate, got %+v", alerts.alerts[0])
+	}
+
+	for i := 0; i < 10; i++ {
+		d.observe(invite("198.51.100.5", "alice", "sip:bob@example.com", ""), now.Add(time.Minute))
+	}
+	if len(alerts.alerts) != 1 || alerts.alerts[0].Detector != DetectorInviteFlood {
+		t.Fatalf("Expected an INVITE flood alert, got %d alerts", len(alerts.alerts))
+	}
+	if deny.Denied("198.51.100.5") {
+		t.Error("Expected no deny list entry without DenyOffenders")
+	}
+}
+
+func TestDetectorScanner(t *testing.T) {
+	d, alerts, _ := newTestDetector(Config{ScannerUserAgents: DefaultScannerUserAgents})
+	defer d.Close()
+
+	now := time.Now()
+	d.observe(invite("198.51.100.9", "100", "sip:100@192.0.2.1", "Polycom VVX"), now)
+	d.observe(invite("198.51.100.9", "100", "sip:100@192.0.2.1", "friendly-scanner"), now)
+	d.observe(invite("198.51.100.9", "101", "sip:101@192.0.2.1", "friendly-scanner"), now)
+	d.observe(invite("198.51.100.10", "100", "sip:100@192.0.2.1", "SIPVicious 0.3"), now)
+
+	if len(alerts.alerts) != 2 {
+		t.Fatalf("Expected 1 alert per scanner source, got %d", len(alerts.alerts))
+	}
+	if alerts.alerts[1].UserAgent != "SIPVicious 0.3" {
+		t.Errorf("Unexpected alert: %+v", alerts.alerts[1])
+	}
+}
+
+func TestDetectorInternational(t *testing.T) {
+	d, alerts, deny := newTestDetector(Config{
+		International:         Threshold{Count: 3, Window: time.Hour},
+		InternationalPrefixes: []string{"+", "00"},
+		HomePrefixes:          []string{"+49", "0049"},
+		DenyOffenders:         true,
+	})
+	defer d.Close()
+
+	now := time.Now()
+	// National calls do not count
+	for i := 0; i < 5; i++ {
+		d.observe(invite("192.0.2.50", "1001", "sip:+4930123456@example.com", ""), now)
+	}
+	d.observe(invite("192.0.2.50", "1001", "sip:+882123@example.com", ""), now)
+	d.observe(invite("192.0.2.50", "1001", "tel:00252123", ""), now)
+	// A re-INVITE is not a new call
+	reinvite := invite("192.0.2.50", "1001", "sip:+882999@example.com", "")
+	reinvite.SIP.To.Tag = "abc"
+	d.observe(reinvite, now)
+	d.observe(invite("192.0.2.50", "1002", "sip:+882999@example.com", ""), now)
+	if len(alerts.alerts) != 0 {
+		t.Fatalf("Expected no alert yet, got %+v", alerts.alerts[0])
+	}
+
+	d.observe(invite("192.0.2.50", "1001", "sip:+675555@example.com", ""), now)
+	if len(alerts.alerts) != 1 || alerts.alerts[0].Account != "1001" || alerts.alerts[0].Count != 3 {
+		t.Fatalf("Expected an international spike alert for 1001, got %+v", alerts.alerts)
+	}
+	if deny.Denied("192.0.2.50") {
+		t.Error("Expected international spikes not to deny the caller")
+	}
+}
+
+func TestDetectorExpire(t *testing.T) {
+	d, _, _ := newTestDetector(Config{InviteFlood: Threshold{Count: 2, Window: time.Second}, Cooldown: time.Minute})
+	defer d.Close()
+
+	now := time.Now()
+	d.observe(invite("198.51.100.5", "alice", "sip:bob@example.com", ""), now)
+	d.observe(invite("198.51.100.5", "alice", "sip:bob@example.com", ""), now)
+	d.expire(now.Add(2 * time.Minute))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.counters) != 0 || len(d.alerted) != 0 {
+		t.Errorf("Expected state to expire, got %d counters and %d cooldowns", len(d.counters), len(d.alerted))
+	}
+}
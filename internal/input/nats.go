@@ -0,0 +1,157 @@
+package input
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/sipcapture/hepop-go/internal/writer"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// NATSInput consumes the packets the NATS writer of another instance
+// published. With a stream it reads them through a durable JetStream
+// consumer, so packets published while the instance was down are not lost
+// and instances sharing the durable split the load. Without a stream it
+// uses a core NATS queue subscription.
+type NATSInput struct {
+	config  NATSConfig
+	conn    *nats.Conn
+	sub     *nats.Subscription
+	consume jetstream.ConsumeContext
+}
+
+type NATSConfig struct {
+	URL string
+	// Subject selects the packets, default hep.>
+	Subject string
+	// Encoding must match the encoding of the writer
+	Encoding string
+	// Stream is the JetStream stream, it is created capturing Subject when
+	// it does not exist
+	Stream string
+	// Durable names the JetStream consumer or the queue group, default hepop
+	Durable  string
+	Username string
+	Password string
+	Token    string
+}
+
+func NewNATSInput(config NATSConfig) (*NATSInput, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("nats url required")
+	}
+	if config.Subject == "" {
+		config.Subject = "hep.>"
+	}
+	encoding, err := writer.CheckEncoding(config.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	config.Encoding = encoding
+	if config.Durable == "" {
+		config.Durable = "hepop"
+	}
+
+	conn, err := nats.Connect(config.URL, writer.NATSOptions("hepop input", config.Username, config.Password, config.Token)...)
+	if err != nil {
+		return nil, err
+	}
+	return &NATSInput{config: config, conn: conn}, nil
+}
+
+func (in *NATSInput) Start(handle func(packet *protocol.HEPPacket)) error {
+	if in.config.Stream == "" {
+		sub, err := in.conn.QueueSubscribe(in.config.Subject, in.config.Durable, func(msg *nats.Msg) {
+			if packet := in.decode(msg.Subject, msg.Data); packet != nil {
+				handle(packet)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		in.sub = sub
+		logrus.Infof("NATS input subscribed to %s", in.config.Subject)
+		return nil
+	}
+
+	consumer, err := in.consumer()
+	if err != nil {
+		return err
+	}
+	in.consume, err = consumer.Consume(func(msg jetstream.Msg) {
+		packet := in.decode(msg.Subject(), msg.Data())
+		if packet == nil {
+			// Redelivering cannot fix a packet that does not decode
+			msg.Term()
+			return
+		}
+		// The packet is acknowledged once the pipeline handed it to the
+		// writer. Packets still buffered in a batch writer when the
+		// instance dies are lost, delivery is at-most-once from there.
+		handle(packet)
+		msg.Ack()
+	}, jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+		logrus.Warnf("NATS input: %v", err)
+	}))
+	if err != nil {
+		return err
+	}
+	logrus.Infof("NATS input consuming %s from stream %s", in.config.Subject, in.config.Stream)
+	return nil
+}
+
+// consumer creates the stream when it is missing and the durable consumer
+func (in *NATSInput) consumer() (jetstream.Consumer, error) {
+	js, err := jetstream.New(in.conn)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := js.Stream(ctx, in.config.Stream)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		stream, err = js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:     in.config.Stream,
+			Subjects: []string{in.config.Subject},
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("nats stream %s: %w", in.config.Stream, err)
+	}
+
+	return stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:       in.config.Durable,
+		FilterSubject: in.config.Subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+	})
+}
+
+func (in *NATSInput) decode(subject string, data []byte) *protocol.HEPPacket {
+	packet, err := writer.DecodePacket(data, in.config.Encoding)
+	if err != nil {
+		logrus.Errorf("NATS input: decoding packet from %s: %v", subject, err)
+		return nil
+	}
+	return packet
+}
+
+// Stop handles the packets already received and waits until their
+// acknowledgements reached the server
+func (in *NATSInput) Stop() error {
+	if in.consume != nil {
+		in.consume.Drain()
+		<-in.consume.Closed()
+	}
+	if in.sub != nil {
+		in.sub.Drain()
+	}
+	err := in.conn.Flush()
+	in.conn.Close()
+	return err
+}
@@ -0,0 +1,422 @@
+package input
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/sipcapture/hepop-go/internal/writer"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+// fakeNATS is an in-process NATS server speaking the client protocol with
+// the JetStream API of streams and durable pull consumers, enough for the
+// NATS writer and input
+type fakeNATS struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	subs    []*fakeSub
+	streams map[string]*fakeStream
+	acked   int
+}
+
+type fakeConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+func (c *fakeConn) send(format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.conn, format, args...)
+}
+
+type fakeSub struct {
+	conn    *fakeConn
+	sid     string
+	subject string
+	queue   string
+}
+
+type fakeStream struct {
+	config    jetstream.StreamConfig
+	msgs      []fakeMsg
+	consumers map[string]*fakeConsumer
+}
+
+type fakeMsg struct {
+	subject string
+	data    []byte
+}
+
+type fakeConsumer struct {
+	config jetstream.ConsumerConfig
+	// next is the index of the next message to deliver
+	next  int
+	pulls []fakePull
+}
+
+type fakePull struct {
+	reply string
+	batch int
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	s := &fakeNATS{ln: ln, streams: make(map[string]*fakeStream)}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(&fakeConn{conn: conn})
+		}
+	}()
+	return s
+}
+
+func (s *fakeNATS) url() string {
+	return "nats://" + s.ln.Addr().String()
+}
+
+func (s *fakeNATS) serve(c *fakeConn) {
+	defer func() {
+		c.conn.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		subs := s.subs[:0]
+		for _, sub := range s.subs {
+			if sub.conn != c {
+				subs = append(subs, sub)
+			}
+		}
+		s.subs = subs
+	}()
+
+	c.send("INFO {\"server_id\":\"fake\",\"version\":\"2.10.0\",\"proto\":1,\"headers\":true,\"max_payload\":1048576,\"jetstream\":true}\r\n")
+	r := bufio.NewReader(c.conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			c.send("PONG\r\n")
+		case "SUB":
+			sub := &fakeSub{conn: c, subject: args[1], sid: args[len(args)-1]}
+			if len(args) == 4 {
+				sub.queue = args[2]
+			}
+			s.mu.Lock()
+			s.subs = append(s.subs, sub)
+			s.mu.Unlock()
+		case "UNSUB":
+			s.mu.Lock()
+			for i, sub := range s.subs {
+				if sub.conn == c && sub.sid == args[1] {
+					s.subs = append(s.subs[:i], s.subs[i+1:]...)
+					break
+				}
+			}
+			s.mu.Unlock()
+		case "PUB", "HPUB":
+			size, _ := strconv.Atoi(args[len(args)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			payload = payload[:size]
+			reply := ""
+			if len(args) == 4 && args[0] == "PUB" || len(args) == 5 {
+				reply = args[2]
+			}
+			if args[0] == "HPUB" {
+				headers, _ := strconv.Atoi(args[len(args)-2])
+				payload = payload[headers:]
+			}
+			s.publish(args[1], reply, payload)
+		}
+	}
+}
+
+func (s *fakeNATS) publish(subject, reply string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(subject, "$JS.API."):
+		resp, _ := json.Marshal(s.api(strings.TrimPrefix(subject, "$JS.API."), reply, data))
+		if reply != "" && !strings.HasPrefix(subject, "$JS.API.CONSUMER.MSG.NEXT.") {
+			s.route(reply, "", resp)
+		}
+		return
+	case strings.HasPrefix(subject, "$JS.ACK."):
+		s.acked++
+		return
+	}
+
+	for name, stream := range s.streams {
+		for _, filter := range stream.config.Subjects {
+			if fakeMatch(filter, subject) {
+				stream.msgs = append(stream.msgs, fakeMsg{subject: subject, data: data})
+				s.deliver(name, stream)
+				break
+			}
+		}
+	}
+	s.route(subject, reply, data)
+}
+
+// route sends a message to the matching subscriptions, one per queue group
+func (s *fakeNATS) route(subject, reply string, data []byte) bool {
+	queues := make(map[string]bool)
+	routed := false
+	for _, sub := range s.subs {
+		if !fakeMatch(sub.subject, subject) || sub.queue != "" && queues[sub.queue] {
+			continue
+		}
+		if sub.queue != "" {
+			queues[sub.queue] = true
+		}
+		if reply != "" {
+			sub.conn.send("MSG %s %s %s %d\r\n%s\r\n", subject, sub.sid, reply, len(data), data)
+		} else {
+			sub.conn.send("MSG %s %s %d\r\n%s\r\n", subject, sub.sid, len(data), data)
+		}
+		routed = true
+	}
+	return routed
+}
+
+func (s *fakeNATS) api(subject, reply string, data []byte) interface{} {
+	args := strings.Split(subject, ".")
+	notFound := map[string]interface{}{"error": map[string]interface{}{"code": 404, "err_code": 10059, "description": "stream not found"}}
+
+	switch {
+	case strings.HasPrefix(subject, "STREAM.INFO."):
+		stream, ok := s.streams[args[2]]
+		if !ok {
+			return notFound
+		}
+		return jetstream.StreamInfo{Config: stream.config, Created: time.Now()}
+
+	case strings.HasPrefix(subject, "STREAM.CREATE."):
+		var config jetstream.StreamConfig
+		json.Unmarshal(data, &config)
+		s.streams[config.Name] = &fakeStream{config: config, consumers: make(map[string]*fakeConsumer)}
+		return jetstream.StreamInfo{Config: config, Created: time.Now()}
+
+	case strings.HasPrefix(subject, "CONSUMER.CREATE."):
+		stream, ok := s.streams[args[2]]
+		if !ok {
+			return notFound
+		}
+		var req struct {
+			Config jetstream.ConsumerConfig `json:"config"`
+		}
+		json.Unmarshal(data, &req)
+		if _, ok := stream.consumers[args[3]]; !ok {
+			stream.consumers[args[3]] = &fakeConsumer{config: req.Config}
+		}
+		return jetstream.ConsumerInfo{Stream: args[2], Name: args[3], Config: req.Config, Created: time.Now()}
+
+	case strings.HasPrefix(subject, "CONSUMER.MSG.NEXT."):
+		stream := s.streams[args[3]]
+		var req struct {
+			Batch int `json:"batch"`
+		}
+		json.Unmarshal(data, &req)
+		consumer := stream.consumers[args[4]]
+		consumer.pulls = append(consumer.pulls, fakePull{reply: reply, batch: req.Batch})
+		s.deliver(args[3], stream)
+	}
+	return nil
+}
+
+// deliver hands the pending messages of a stream to the pull requests of
+// its consumers
+func (s *fakeNATS) deliver(name string, stream *fakeStream) {
+	for consumerName, consumer := range stream.consumers {
+		for consumer.next < len(stream.msgs) && len(consumer.pulls) > 0 {
+			msg := stream.msgs[consumer.next]
+			if !fakeMatch(consumer.config.FilterSubject, msg.subject) {
+				consumer.next++
+				continue
+			}
+			pull := &consumer.pulls[0]
+			seq := consumer.next + 1
+			ack := fmt.Sprintf("$JS.ACK.%s.%s.1.%d.%d.%d.%d", name, consumerName, seq, seq, time.Now().UnixNano(), len(stream.msgs)-seq)
+			// Drop pull requests of stopped subscriptions
+			if !s.route(pull.reply, ack, msg.data) {
+				consumer.pulls = consumer.pulls[1:]
+				continue
+			}
+			consumer.next++
+			if pull.batch--; pull.batch == 0 {
+				consumer.pulls = consumer.pulls[1:]
+			}
+		}
+	}
+}
+
+func (s *fakeNATS) streamSubjects(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var subjects []string
+	if stream, ok := s.streams[name]; ok {
+		for _, msg := range stream.msgs {
+			subjects = append(subjects, msg.subject)
+		}
+	}
+	return subjects
+}
+
+func (s *fakeNATS) acks() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acked
+}
+
+func fakeMatch(filter, subject string) bool {
+	if filter == "" {
+		return true
+	}
+	f := strings.Split(filter, ".")
+	t := strings.Split(subject, ".")
+	for i, token := range f {
+		if token == ">" {
+			return len(t) > i
+		}
+		if i >= len(t) || token != "*" && token != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func receive(t *testing.T, packets <-chan *protocol.HEPPacket, n int) []*protocol.HEPPacket {
+	t.Helper()
+	var received []*protocol.HEPPacket
+	for len(received) < n {
+		select {
+		case packet := <-packets:
+			received = append(received, packet)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %d packets, got %d", n, len(received))
+		}
+	}
+	return received
+}
+
+func TestNATSInputJetStream(t *testing.T) {
+	server := newFakeNATS(t)
+
+	w, err := writer.NewNATSWriter(writer.NATSConfig{URL: server.url(), Encoding: writer.EncodingProtobuf})
+	if err != nil {
+		t.Fatalf("NewNATSWriter failed: %v", err)
+	}
+	defer w.Close()
+
+	config := NATSConfig{URL: server.url(), Stream: "HEP", Encoding: writer.EncodingProtobuf}
+	in, err := NewNATSInput(config)
+	if err != nil {
+		t.Fatalf("NewNATSInput failed: %v", err)
+	}
+	packets := make(chan *protocol.HEPPacket, 10)
+	if err := in.Start(func(packet *protocol.HEPPacket) { packets <- packet }); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	w.Write(&protocol.HEPPacket{ProtoType: protocol.ProtoTypeSIP, NodeName: "edge.1", CID: "call-1", Payload: []byte("INVITE sip:bob@b SIP/2.0\r\n")})
+	w.Write(&protocol.HEPPacket{ProtoType: protocol.ProtoTypeLog, NodeID: 2001, CID: "call-1"})
+	received := receive(t, packets, 2)
+	if received[0].CID != "call-1" || received[0].NodeName != "edge.1" || received[1].ProtoType != protocol.ProtoTypeLog {
+		t.Errorf("Unexpected packets: %+v %+v", received[0], received[1])
+	}
+	if err := in.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	subjects := server.streamSubjects("HEP")
+	if len(subjects) != 2 || subjects[0] != "hep.sip.edge_1" || subjects[1] != "hep.log.2001" {
+		t.Errorf("Unexpected stream subjects: %v", subjects)
+	}
+	if acks := server.acks(); acks != 2 {
+		t.Errorf("Expected 2 acks, got %d", acks)
+	}
+
+	// The durable consumer resumes after the packets it already handled
+	w.Write(&protocol.HEPPacket{ProtoType: protocol.ProtoTypeSIP, NodeID: 7, CID: "call-2"})
+	in, err = NewNATSInput(config)
+	if err != nil {
+		t.Fatalf("NewNATSInput failed: %v", err)
+	}
+	if err := in.Start(func(packet *protocol.HEPPacket) { packets <- packet }); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer in.Stop()
+	if received := receive(t, packets, 1); received[0].CID != "call-2" {
+		t.Errorf("Expected the packet published while stopped, got %+v", received[0])
+	}
+}
+
+func TestNATSInputQueueGroup(t *testing.T) {
+	server := newFakeNATS(t)
+
+	packets := make(chan *protocol.HEPPacket, 20)
+	for i := 0; i < 2; i++ {
+		in, err := NewNATSInput(NATSConfig{URL: server.url(), Subject: "hep.sip.>"})
+		if err != nil {
+			t.Fatalf("NewNATSInput failed: %v", err)
+		}
+		if err := in.Start(func(packet *protocol.HEPPacket) { packets <- packet }); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer in.Stop()
+	}
+
+	w, err := writer.NewNATSWriter(writer.NATSConfig{URL: server.url()})
+	if err != nil {
+		t.Fatalf("NewNATSWriter failed: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		w.Write(&protocol.HEPPacket{ProtoType: protocol.ProtoTypeSIP, CID: fmt.Sprintf("call-%d", i)})
+	}
+	w.Write(&protocol.HEPPacket{ProtoType: protocol.ProtoTypeRTCP, CID: "call-0"})
+	w.Close()
+
+	seen := make(map[string]bool)
+	for _, packet := range receive(t, packets, 10) {
+		if seen[packet.CID] || packet.ProtoType != protocol.ProtoTypeSIP {
+			t.Errorf("Unexpected packet %+v", packet)
+		}
+		seen[packet.CID] = true
+	}
+	select {
+	case packet := <-packets:
+		t.Errorf("Expected each packet once, got %+v", packet)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -1,43 +1,336 @@
 package manager
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
-	_ "github.com/marcboeker/go-duckdb"
+	"github.com/marcboeker/go-duckdb"
 )
 
+var (
+	ErrQueryNotAllowed = errors.New("query not allowed")
+	ErrQueryTimeout    = errors.New("query timed out")
+)
+
+// sqlTableFunctions are the table functions raw queries may use, the others
+// can read arbitrary files
+var sqlTableFunctions = []string{"range", "generate_series", "unnest"}
+
+// DuckDBManager queries the partitioned parquet dataset of the parquet
+// writer with an in-memory DuckDB. Raw queries see the dataset as the view
+// hep and are limited to a single SELECT on it.
 type DuckDBManager struct {
-	db *sql.DB
+	db      *sql.DB
+	dir     string
+	timeout time.Duration
+	maxRows int
+
+	// viewMu guards the creation of the hep view, it can only be created
+	// once the first file exists
+	viewMu sync.Mutex
+	view   bool
+}
+
+type DuckDBConfig struct {
+	// Dir is the dataset directory
+	Dir string
+	// Timeout limits raw queries, default 30 seconds
+	Timeout time.Duration
+	// MaxRows is the number of rows a raw query returns, default 10000
+	MaxRows int
+	// MemoryLimit is the DuckDB memory_limit, e.g. 1GB
+	MemoryLimit string
+	// Threads is the number of DuckDB threads, default the number of CPUs
+	Threads int
+}
+
+// QueryResult is the result of a raw query
+type QueryResult struct {
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+	// Truncated is set when the query returned more than MaxRows rows
+	Truncated bool `json:"truncated"`
 }
 
-func NewDuckDBManager() (*DuckDBManager, error) {
-	db, err := sql.Open("duckdb", "?access_mode=READ_WRITE")
+func NewDuckDBManager(config DuckDBConfig) (*DuckDBManager, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = 30 * time.Second
+	}
+	if config.MaxRows <= 0 {
+		config.MaxRows = 10000
+	}
+
+	db, err := sql.Open("duckdb", "")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open DuckDB: %w", err)
 	}
-	return &DuckDBManager{db: db}, nil
+	var settings []string
+	if config.MemoryLimit != "" {
+		settings = append(settings, fmt.Sprintf("SET memory_limit = %s", quoteString(config.MemoryLimit)))
+	}
+	if config.Threads > 0 {
+		settings = append(settings, fmt.Sprintf("SET threads = %d", config.Threads))
+	}
+	// Raw queries can't change the settings
+	settings = append(settings, "SET lock_configuration = true")
+	for _, setting := range settings {
+		if _, err := db.Exec(setting); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to configure DuckDB: %w", err)
+		}
+	}
+
+	return &DuckDBManager{
+		db:      db,
+		dir:     config.Dir,
+		timeout: config.Timeout,
+		maxRows: config.MaxRows,
+	}, nil
 }
 
-func (d *DuckDBManager) QueryParquet(filePath string, query string) error {
-	_, err := d.db.Exec(fmt.Sprintf("CREATE TABLE temp AS SELECT * FROM parquet_scan('%s')", filePath))
-	if err != nil {
-		return fmt.Errorf("failed to create table from Parquet: %w", err)
+// Dataset returns the table expression reading the finished files of the
+// dataset with the partition columns date, hour and proto
+func (d *DuckDBManager) Dataset() string {
+	glob := filepath.ToSlash(filepath.Join(d.dir, "**", "*.parquet"))
+	return fmt.Sprintf("read_parquet(%s, hive_partitioning = true, hive_types = {'date': DATE, 'hour': INTEGER, 'proto': VARCHAR}, union_by_name = true)",
+		quoteString(glob))
+}
+
+// HasFiles reports if the dataset has a finished file, DuckDB fails to read
+// an empty dataset
+func (d *DuckDBManager) HasFiles() bool {
+	found := false
+	filepath.WalkDir(d.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") && strings.HasSuffix(entry.Name(), ".parquet") {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found
+}
+
+// QueryContext runs a trusted query, callers build it from Dataset and
+// pass the values as arguments
+func (d *DuckDBManager) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return d.db.QueryContext(ctx, query, args...)
+}
+
+// QueryRowContext runs a trusted query returning a single row
+func (d *DuckDBManager) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return d.db.QueryRowContext(ctx, query, args...)
+}
+
+// Query runs a raw query of an analyst. Only a single SELECT reading the
+// hep view, its own CTEs and the table functions range, generate_series and
+// unnest is allowed, so the query can't change anything or read other
+// files.
+func (d *DuckDBManager) Query(ctx context.Context, query string) (*QueryResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	if err := d.checkQuery(ctx, query); err != nil {
+		return nil, err
+	}
+	if err := d.createView(ctx); err != nil {
+		return nil, err
 	}
 
-	rows, err := d.db.Query(query)
+	rows, err := d.db.QueryContext(ctx, query)
 	if err != nil {
-		return fmt.Errorf("query failed: %w", err)
+		return nil, queryError(ctx, err)
 	}
 	defer rows.Close()
 
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := &QueryResult{Columns: columns, Rows: [][]any{}}
 	for rows.Next() {
-		// Process rows
+		if len(result.Rows) == d.maxRows {
+			result.Truncated = true
+			break
+		}
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		for i := range values {
+			values[i] = resultValue(values[i])
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
 	}
+	return result, nil
+}
+
+// checkQuery parses the query with DuckDB, which only serializes SELECT
+// statements, and checks the tables it reads
+func (d *DuckDBManager) checkQuery(ctx context.Context, query string) error {
+	var serialized string
+	if err := d.db.QueryRowContext(ctx, "SELECT json_serialize_sql(?::VARCHAR)::VARCHAR", query).Scan(&serialized); err != nil {
+		return queryError(ctx, err)
+	}
+	var parsed struct {
+		Error        bool              `json:"error"`
+		ErrorMessage string            `json:"error_message"`
+		Statements   []json.RawMessage `json:"statements"`
+	}
+	if err := json.Unmarshal([]byte(serialized), &parsed); err != nil {
+		return fmt.Errorf("can't parse query: %w", err)
+	}
+	if parsed.Error {
+		return fmt.Errorf("%w: %s", ErrQueryNotAllowed, parsed.ErrorMessage)
+	}
+	if len(parsed.Statements) != 1 {
+		return fmt.Errorf("%w: expected one statement, got %d", ErrQueryNotAllowed, len(parsed.Statements))
+	}
+
+	var tree any
+	if err := json.Unmarshal(parsed.Statements[0], &tree); err != nil {
+		return fmt.Errorf("can't parse query: %w", err)
+	}
+	ctes := make(map[string]bool)
+	collectCTEs(tree, ctes)
+	return checkTables(tree, ctes)
+}
+
+// collectCTEs adds the names of the common table expressions in a parsed
+// query
+func collectCTEs(node any, ctes map[string]bool) {
+	switch node := node.(type) {
+	case map[string]any:
+		if cteMap, ok := node["cte_map"].(map[string]any); ok {
+			entries, _ := cteMap["map"].([]any)
+			for _, entry := range entries {
+				if entry, ok := entry.(map[string]any); ok {
+					if name, ok := entry["key"].(string); ok {
+						ctes[strings.ToLower(name)] = true
+					}
+				}
+			}
+		}
+		for _, child := range node {
+			collectCTEs(child, ctes)
+		}
+	case []any:
+		for _, child := range node {
+			collectCTEs(child, ctes)
+		}
+	}
+}
+
+// checkTables rejects tables other than hep and the CTEs, DuckDB reads a
+// table named like a file from that file, and table functions other than
+// the allowed ones
+func checkTables(node any, ctes map[string]bool) error {
+	switch node := node.(type) {
+	case map[string]any:
+		switch node["type"] {
+		case "BASE_TABLE":
+			name, _ := node["table_name"].(string)
+			schema, _ := node["schema_name"].(string)
+			catalog, _ := node["catalog_name"].(string)
+			lower := strings.ToLower(name)
+			allowed := lower == "hep" || ctes[lower] && !strings.ContainsAny(name, "./\\")
+			if !allowed || schema != "" || catalog != "" {
+				return fmt.Errorf("%w: table %s, only hep can be queried", ErrQueryNotAllowed, name)
+			}
+		case "TABLE_FUNCTION":
+			function, _ := node["function"].(map[string]any)
+			name, _ := function["function_name"].(string)
+			allowed := false
+			for _, f := range sqlTableFunctions {
+				allowed = allowed || strings.EqualFold(name, f)
+			}
+			if !allowed {
+				return fmt.Errorf("%w: table function %s", ErrQueryNotAllowed, name)
+			}
+		}
+		for _, child := range node {
+			if err := checkTables(child, ctes); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, child := range node {
+			if err := checkTables(child, ctes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createView creates the hep view over the dataset once it has files
+func (d *DuckDBManager) createView(ctx context.Context) error {
+	d.viewMu.Lock()
+	defer d.viewMu.Unlock()
 
+	if d.view || !d.HasFiles() {
+		return nil
+	}
+	if _, err := d.db.ExecContext(ctx, "CREATE OR REPLACE VIEW hep AS SELECT * FROM "+d.Dataset()); err != nil {
+		return fmt.Errorf("failed to create view: %w", queryError(ctx, err))
+	}
+	d.view = true
 	return nil
 }
 
+// resultValue converts the DuckDB values JSON can't encode, maps with
+// arbitrary keys and decimals
+func resultValue(value any) any {
+	switch value := value.(type) {
+	case duckdb.Map:
+		m := make(map[string]any, len(value))
+		for k, v := range value {
+			m[fmt.Sprint(k)] = resultValue(v)
+		}
+		return m
+	case map[string]any:
+		for k, v := range value {
+			value[k] = resultValue(v)
+		}
+	case []any:
+		for i, v := range value {
+			value[i] = resultValue(v)
+		}
+	case duckdb.Decimal:
+		return value.Float64()
+	}
+	return value
+}
+
+// queryError reports queries interrupted by the timeout as ErrQueryTimeout
+func queryError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %v", ErrQueryTimeout, err)
+	}
+	return err
+}
+
+func quoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
 func (d *DuckDBManager) Close() error {
 	return d.db.Close()
 }
@@ -0,0 +1,105 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDuckDB returns a manager on a dataset with a single file of three
+// rows in the partition of 2023-11-14 22:00 UTC
+func newTestDuckDB(t *testing.T, config DuckDBConfig) *DuckDBManager {
+	t.Helper()
+	config.Dir = t.TempDir()
+	partition := filepath.Join(config.Dir, "date=2023-11-14", "hour=22", "proto=sip")
+	if err := os.MkdirAll(partition, 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	setup, err := NewDuckDBManager(DuckDBConfig{})
+	if err != nil {
+		t.Fatalf("NewDuckDBManager failed: %v", err)
+	}
+	defer setup.Close()
+	path := filepath.Join(partition, "part-1.parquet")
+	if _, err := setup.db.Exec("COPY (SELECT i AS src_port, 'call-' || i AS cid FROM range(3) t(i)) TO " + quoteString(path) + " (FORMAT PARQUET)"); err != nil {
+		t.Fatalf("COPY failed: %v", err)
+	}
+
+	d, err := NewDuckDBManager(config)
+	if err != nil {
+		t.Fatalf("NewDuckDBManager failed: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestDuckDBQuery(t *testing.T) {
+	d := newTestDuckDB(t, DuckDBConfig{MaxRows: 2})
+
+	result, err := d.Query(context.Background(), "WITH ports AS (SELECT src_port, proto, hour FROM hep) SELECT * FROM ports ORDER BY src_port")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(result.Columns) != 3 || result.Columns[1] != "proto" || len(result.Rows) != 2 || !result.Truncated {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+	if result.Rows[1][0] != int64(1) || result.Rows[1][1] != "sip" || result.Rows[1][2] != int32(22) {
+		t.Errorf("Unexpected row %v", result.Rows[1])
+	}
+
+	result, err = d.Query(context.Background(), "SELECT MAP {1: [1.5::DECIMAL(4, 2)]} AS m")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if encoded, err := json.Marshal(result.Rows); err != nil || string(encoded) != `[[{"1":[1.5]}]]` {
+		t.Errorf("Unexpected encoding %s: %v", encoded, err)
+	}
+
+	result, err = d.Query(context.Background(), "SELECT count(*) FROM hep, range(2)")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if result.Truncated || len(result.Rows) != 1 || result.Rows[0][0] != int64(6) {
+		t.Errorf("Unexpected count %+v", result)
+	}
+}
+
+func TestDuckDBQueryNotAllowed(t *testing.T) {
+	d := newTestDuckDB(t, DuckDBConfig{})
+
+	for _, query := range []string{
+		"DELETE FROM hep",
+		"CREATE TABLE t AS SELECT 1",
+		"SET lock_configuration = false",
+		"SELECT 1; SELECT 2",
+		"SELECT * FROM '/etc/passwd'",
+		"SELECT * FROM read_csv('/etc/passwd')",
+		"SELECT * FROM (SELECT * FROM read_text('/etc/passwd'))",
+		"SELECT * FROM hep WHERE cid IN (SELECT cid FROM read_parquet('/tmp/*.parquet'))",
+		"SELECT * FROM information_schema.tables",
+		"SELECT * FROM duckdb_settings()",
+		"ATTACH '/tmp/x.db'",
+		"COPY hep TO '/tmp/x.csv'",
+	} {
+		if _, err := d.Query(context.Background(), query); !errors.Is(err, ErrQueryNotAllowed) {
+			t.Errorf("Expected ErrQueryNotAllowed for %q, got %v", query, err)
+		}
+	}
+}
+
+func TestDuckDBQueryTimeout(t *testing.T) {
+	d := newTestDuckDB(t, DuckDBConfig{Timeout: 100 * time.Millisecond})
+
+	start := time.Now()
+	_, err := d.Query(context.Background(), "SELECT count(*) FROM range(1000000000000) a, range(1000) b")
+	if !errors.Is(err, ErrQueryTimeout) {
+		t.Fatalf("Expected ErrQueryTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Query was interrupted after %s", elapsed)
+	}
+}
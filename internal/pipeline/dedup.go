@@ -0,0 +1,180 @@
+package pipeline
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+// Deduplication scopes
+const (
+	// DedupGlobal drops copies of a packet seen by any capture agent
+	DedupGlobal = "global"
+	// DedupNode only drops copies seen again by the same capture agent,
+	// e.g. from mirrored interfaces
+	DedupNode = "node"
+)
+
+type DedupConfig struct {
+	// Window is how far apart two copies of a packet may arrive
+	Window time.Duration
+	Scope  string
+	// TrackNodes keeps the first copy for the window and stores the IDs of
+	// all agents that saw it in NodeIDs
+	TrackNodes bool
+}
+
+// Deduplicator drops copies of the same packet captured at several points.
+// Packets are identical when payload, addresses, ports and ProtoType match.
+type Deduplicator struct {
+	config  DedupConfig
+	seen    map[uint64]*dedupEntry
+	release func(packet *protocol.HEPPacket)
+	mu      sync.Mutex
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+type dedupEntry struct {
+	first time.Time
+	// packet is the held first copy when nodes are tracked
+	packet *protocol.HEPPacket
+}
+
+func NewDeduplicator(config DedupConfig) (*Deduplicator, error) {
+	switch config.Scope {
+	case "":
+		config.Scope = DedupGlobal
+	case DedupGlobal, DedupNode:
+	default:
+		return nil, fmt.Errorf("unknown dedup scope %q", config.Scope)
+	}
+	if config.Window <= 0 {
+		return nil, fmt.Errorf("dedup window must be positive")
+	}
+
+	d := &Deduplicator{
+		config: config,
+		seen:   make(map[uint64]*dedupEntry),
+		done:   make(chan struct{}),
+	}
+	d.wg.Add(1)
+	go d.expireLoop()
+	return d, nil
+}
+
+// SetRelease sets where held packets go when their window ends
+func (d *Deduplicator) SetRelease(release func(packet *protocol.HEPPacket)) {
+	d.release = release
+}
+
+// Process drops duplicates. With node tracking the first copy is held as
+// well and released after the window.
+func (d *Deduplicator) Process(packet *protocol.HEPPacket) bool {
+	return d.process(packet, time.Now())
+}
+
+func (d *Deduplicator) process(packet *protocol.HEPPacket, now time.Time) bool {
+	key := d.key(packet)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if entry, ok := d.seen[key]; ok && now.Sub(entry.first) <= d.config.Window {
+		if entry.packet != nil && !slices.Contains(entry.packet.NodeIDs, packet.NodeID) {
+			entry.packet.NodeIDs = append(entry.packet.NodeIDs, packet.NodeID)
+		}
+		return false
+	}
+
+	entry := &dedupEntry{first: now}
+	d.seen[key] = entry
+	if d.config.TrackNodes && d.release != nil {
+		packet.NodeIDs = []uint32{packet.NodeID}
+		entry.packet = packet
+		return false
+	}
+	return true
+}
+
+func (d *Deduplicator) key(packet *protocol.HEPPacket) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s|%d|%s|%d|%d|", packet.SrcIP, packet.SrcPort, packet.DstIP, packet.DstPort, packet.ProtoType)
+	if d.config.Scope == DedupNode {
+		binary.Write(h, binary.BigEndian, packet.NodeID)
+	}
+	h.Write(packet.Payload)
+	return h.Sum64()
+}
+
+func (d *Deduplicator) expireLoop() {
+	defer d.wg.Done()
+
+	// Held packets are delayed by at most a quarter window beyond it
+	interval := max(d.config.Window/4, 10*time.Millisecond)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case now := <-ticker.C:
+			for _, packet := range d.expire(now) {
+				d.release(packet)
+			}
+		}
+	}
+}
+
+// expire forgets packets whose window ended and returns the held ones
+func (d *Deduplicator) expire(now time.Time) []*protocol.HEPPacket {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var held []*dedupEntry
+	for key, entry := range d.seen {
+		if now.Sub(entry.first) > d.config.Window {
+			if entry.packet != nil {
+				held = append(held, entry)
+			}
+			delete(d.seen, key)
+		}
+	}
+
+	// Keep the arrival order of the released packets
+	slices.SortFunc(held, func(a, b *dedupEntry) int {
+		return a.first.Compare(b.first)
+	})
+	released := make([]*protocol.HEPPacket, len(held))
+	for i, entry := range held {
+		released[i] = entry.packet
+	}
+	return released
+}
+
+// Close stops the deduplicator and releases the held packets
+func (d *Deduplicator) Close() error {
+	close(d.done)
+	d.wg.Wait()
+
+	d.mu.Lock()
+	var released []*protocol.HEPPacket
+	for key, entry := range d.seen {
+		if entry.packet != nil {
+			released = append(released, entry.packet)
+		}
+		delete(d.seen, key)
+	}
+	d.mu.Unlock()
+
+	for _, packet := range released {
+		d.release(packet)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package pipeline
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+func dedupPacket(nodeID uint32, payload string) *protocol.HEPPacket {
+	return &protocol.HEPPacket{
+		SrcIP:     "10.0.0.1",
+		SrcPort:   5060,
+		DstIP:     "10.0.0.2",
+		DstPort:   5060,
+		ProtoType: protocol.ProtoTypeSIP,
+		NodeID:    nodeID,
+		Payload:   []byte(payload),
+	}
+}
+
+func TestDeduplicatorGlobal(t *testing.T) {
+	d, err := NewDeduplicator(DedupConfig{Window: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewDeduplicator failed: %v", err)
+	}
+	defer d.Close()
+
+	now := time.Unix(1000, 0)
+	if !d.process(dedupPacket(1, "INVITE"), now) {
+		t.Fatal("Expected the first copy to pass")
+	}
+	if d.process(dedupPacket(2, "INVITE"), now.Add(20*time.Millisecond)) {
+		t.Error("Expected the copy from another agent to be dropped")
+	}
+	if !d.process(dedupPacket(2, "ACK"), now.Add(30*time.Millisecond)) {
+		t.Error("Expected a different payload to pass")
+	}
+
+	// The first SIP retransmission comes after T1, 500ms
+	if !d.process(dedupPacket(1, "INVITE"), now.Add(500*time.Millisecond)) {
+		t.Error("Expected a retransmission to pass")
+	}
+}
+
+func TestDeduplicatorNodeScope(t *testing.T) {
+	d, err := NewDeduplicator(DedupConfig{Window: 2 * time.Second, Scope: DedupNode})
+	if err != nil {
+		t.Fatalf("NewDeduplicator failed: %v", err)
+	}
+	defer d.Close()
+
+	now := time.Unix(1000, 0)
+	d.process(dedupPacket(1, "INVITE"), now)
+	if !d.process(dedupPacket(2, "INVITE"), now) {
+		t.Error("Expected the copy from another agent to pass")
+	}
+	if d.process(dedupPacket(1, "INVITE"), now) {
+		t.Error("Expected the copy from the same agent to be dropped")
+	}
+}
+
+func TestDeduplicatorTrackNodes(t *testing.T) {
+	d, err := NewDeduplicator(DedupConfig{Window: 2 * time.Second, TrackNodes: true})
+	if err != nil {
+		t.Fatalf("NewDeduplicator failed: %v", err)
+	}
+	var released []*protocol.HEPPacket
+	d.SetRelease(func(packet *protocol.HEPPacket) {
+		released = append(released, packet)
+	})
+
+	// The background expiry runs on the wall clock, so must not see these
+	// packets as expired
+	now := time.Now()
+	first := dedupPacket(1, "INVITE")
+	if d.process(first, now) {
+		t.Fatal("Expected the first copy to be held")
+	}
+	d.process(dedupPacket(2, "INVITE"), now.Add(100*time.Millisecond))
+	d.process(dedupPacket(2, "INVITE"), now.Add(200*time.Millisecond))
+	d.process(dedupPacket(3, "BYE"), now.Add(time.Second))
+
+	for _, packet := range d.expire(now.Add(2500 * time.Millisecond)) {
+		released = append(released, packet)
+	}
+	if len(released) != 1 || released[0] != first {
+		t.Fatalf("Expected the first copy to be released, got %d packets", len(released))
+	}
+	if !slices.Equal(first.NodeIDs, []uint32{1, 2}) {
+		t.Errorf("Expected node IDs [1 2], got %v", first.NodeIDs)
+	}
+
+	// Close releases what is still held
+	d.Close()
+	if len(released) != 2 || string(released[1].Payload) != "BYE" {
+		t.Errorf("Expected the BYE to be released on close, got %d packets", len(released))
+	}
+}
+
+func TestNewDeduplicatorErrors(t *testing.T) {
+	if _, err := NewDeduplicator(DedupConfig{Window: time.Second, Scope: "cluster"}); err == nil {
+		t.Error("Expected an error for an unknown scope")
+	}
+	if _, err := NewDeduplicator(DedupConfig{}); err == nil {
+		t.Error("Expected an error for a zero window")
+	}
+}
@@ -0,0 +1,258 @@
+package pipeline
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+// Lookup table keys
+const (
+	// LookupNodeID matches the capture agent ID
+	LookupNodeID = "node_id"
+	// LookupIP matches the source and destination IP against addresses or
+	// CIDRs, the fields are prefixed with src_ and dst_
+	LookupIP = "ip"
+)
+
+var ErrLookupBadKey = errors.New("unknown lookup key")
+
+// LookupTable is a CSV file with a header row. The first column is the
+// key, the other columns are added as fields named by their header.
+type LookupTable struct {
+	File string
+	Key  string
+}
+
+type EnrichConfig struct {
+	// GeoIPDatabase is a MaxMind Country or City database
+	GeoIPDatabase string
+	// ASNDatabase is a MaxMind ASN database
+	ASNDatabase string
+	Lookups     []LookupTable
+}
+
+// Enricher annotates packets with the country and AS of their addresses
+// and with fields from lookup tables. Fields are stored in
+// HEPPacket.Enrichment, e.g. src_country, dst_asn or site.
+type Enricher struct {
+	geo    *maxminddb.Reader
+	asn    *maxminddb.Reader
+	tables []*lookupTable
+}
+
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+type lookupTable struct {
+	key      string
+	nodes    map[uint32]map[string]string
+	prefixes map[netip.Prefix]map[string]string
+	// bits are the prefix lengths in the table, longest first
+	bits []int
+}
+
+func NewEnricher(config EnrichConfig) (*Enricher, error) {
+	e := &Enricher{}
+
+	var err error
+	if config.GeoIPDatabase != "" {
+		if e.geo, err = maxminddb.Open(config.GeoIPDatabase); err != nil {
+			return nil, fmt.Errorf("open geoip database: %w", err)
+		}
+	}
+	if config.ASNDatabase != "" {
+		if e.asn, err = maxminddb.Open(config.ASNDatabase); err != nil {
+			e.Close()
+			return nil, fmt.Errorf("open asn database: %w", err)
+		}
+	}
+	for _, lookup := range config.Lookups {
+		table, err := loadLookupTable(lookup)
+		if err != nil {
+			e.Close()
+			return nil, fmt.Errorf("lookup table %s: %w", lookup.File, err)
+		}
+		e.tables = append(e.tables, table)
+	}
+	return e, nil
+}
+
+// Process adds the enrichment fields, it never drops packets
+func (e *Enricher) Process(packet *protocol.HEPPacket) bool {
+	set := func(name, value string) {
+		if value == "" {
+			return
+		}
+		if packet.Enrichment == nil {
+			packet.Enrichment = make(map[string]string)
+		}
+		packet.Enrichment[name] = value
+	}
+
+	for _, side := range []struct{ prefix, ip string }{
+		{"src_", packet.SrcIP},
+		{"dst_", packet.DstIP},
+	} {
+		ip := net.ParseIP(side.ip)
+		if ip == nil {
+			continue
+		}
+		if e.geo != nil {
+			var record geoRecord
+			if err := e.geo.Lookup(ip, &record); err == nil {
+				set(side.prefix+"country", record.Country.ISOCode)
+				set(side.prefix+"city", record.City.Names["en"])
+			}
+		}
+		if e.asn != nil {
+			var record asnRecord
+			if err := e.asn.Lookup(ip, &record); err == nil && record.Number != 0 {
+				set(side.prefix+"asn", strconv.FormatUint(uint64(record.Number), 10))
+				set(side.prefix+"as_org", record.Organization)
+			}
+		}
+	}
+
+	for _, table := range e.tables {
+		switch table.key {
+		case LookupNodeID:
+			for name, value := range table.nodes[packet.NodeID] {
+				set(name, value)
+			}
+		case LookupIP:
+			for name, value := range table.lookupIP(packet.SrcIP) {
+				set("src_"+name, value)
+			}
+			for name, value := range table.lookupIP(packet.DstIP) {
+				set("dst_"+name, value)
+			}
+		}
+	}
+	return true
+}
+
+// lookupIP returns the row of the longest prefix containing ip
+func (t *lookupTable) lookupIP(ip string) map[string]string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	for _, bits := range t.bits {
+		if bits > addr.BitLen() {
+			continue
+		}
+		prefix, _ := addr.Prefix(bits)
+		if row, ok := t.prefixes[prefix]; ok {
+			return row
+		}
+	}
+	return nil
+}
+
+func loadLookupTable(config LookupTable) (*lookupTable, error) {
+	table := &lookupTable{key: config.Key}
+	switch config.Key {
+	case LookupNodeID:
+		table.nodes = make(map[uint32]map[string]string)
+	case LookupIP:
+		table.prefixes = make(map[netip.Prefix]map[string]string)
+	default:
+		return nil, fmt.Errorf("%w %q", ErrLookupBadKey, config.Key)
+	}
+
+	f, err := os.Open(config.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("missing header row")
+	}
+
+	header := records[0]
+	for i, record := range records[1:] {
+		row := make(map[string]string, len(header)-1)
+		for j := 1; j < len(header) && j < len(record); j++ {
+			row[strings.TrimSpace(header[j])] = strings.TrimSpace(record[j])
+		}
+		key := strings.TrimSpace(record[0])
+
+		switch config.Key {
+		case LookupNodeID:
+			id, err := strconv.ParseUint(key, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid node id %q", i+2, key)
+			}
+			table.nodes[uint32(id)] = row
+		case LookupIP:
+			prefix, err := parsePrefix(key)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid ip or cidr %q", i+2, key)
+			}
+			table.prefixes[prefix] = row
+			if !slices.Contains(table.bits, prefix.Bits()) {
+				table.bits = append(table.bits, prefix.Bits())
+			}
+		}
+	}
+	slices.SortFunc(table.bits, func(a, b int) int { return b - a })
+	return table, nil
+}
+
+// parsePrefix parses a CIDR or a single address
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Close releases the databases
+func (e *Enricher) Close() error {
+	if e.geo != nil {
+		e.geo.Close()
+	}
+	if e.asn != nil {
+		e.asn.Close()
+	}
+	return nil
+}
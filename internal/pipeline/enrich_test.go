@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+func writeTable(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "table.csv")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return path
+}
+
+func TestEnricherLookups(t *testing.T) {
+	sites := writeTable(t, "node_id,site,region\n2001,fra1,eu\n2002,nyc1,us\n")
+	customers := writeTable(t, "# customer networks\n"+
+		"cidr,customer\n"+
+		"203.0.113.0/24,acme\n"+
+		"203.0.113.7,acme-pbx\n"+
+		"2001:db8::/32,globex\n")
+
+	e, err := NewEnricher(EnrichConfig{Lookups: []LookupTable{
+		{File: sites, Key: LookupNodeID},
+		{File: customers, Key: LookupIP},
+	}})
+	if err != nil {
+		t.Fatalf("NewEnricher failed: %v", err)
+	}
+	defer e.Close()
+
+	packet := &protocol.HEPPacket{NodeID: 2001, SrcIP: "203.0.113.7", DstIP: "2001:db8::5"}
+	if !e.Process(packet) {
+		t.Fatal("Expected enrichment to keep the packet")
+	}
+	want := map[string]string{
+		"site":         "fra1",
+		"region":       "eu",
+		"src_customer": "acme-pbx",
+		"dst_customer": "globex",
+	}
+	for name, value := range want {
+		if packet.Enrichment[name] != value {
+			t.Errorf("Expected %s=%s, got %q", name, value, packet.Enrichment[name])
+		}
+	}
+
+	other := &protocol.HEPPacket{NodeID: 9, SrcIP: "203.0.113.8", DstIP: "192.0.2.1"}
+	e.Process(other)
+	if len(other.Enrichment) != 1 || other.Enrichment["src_customer"] != "acme" {
+		t.Errorf("Expected only the network match, got %v", other.Enrichment)
+	}
+
+	expr, err := CompileExpr(`enrichment.src_customer == "acme" && enrichment.site != "fra1"`)
+	if err != nil {
+		t.Fatalf("CompileExpr failed: %v", err)
+	}
+	if expr.Match(packet) || expr.Match(other) {
+		t.Error("Expected missing enrichment fields to compare false")
+	}
+}
+
+func TestEnricherErrors(t *testing.T) {
+	if _, err := NewEnricher(EnrichConfig{GeoIPDatabase: filepath.Join(t.TempDir(), "missing.mmdb")}); err == nil {
+		t.Error("Expected an error for a missing database")
+	}
+
+	table := writeTable(t, "key,site\n1,a\n")
+	if _, err := NewEnricher(EnrichConfig{Lookups: []LookupTable{{File: table, Key: "cid"}}}); !errors.Is(err, ErrLookupBadKey) {
+		t.Errorf("Expected ErrLookupBadKey, got %v", err)
+	}
+
+	bad := writeTable(t, "cidr,customer\nnot-an-ip,acme\n")
+	if _, err := NewEnricher(EnrichConfig{Lookups: []LookupTable{{File: bad, Key: LookupIP}}}); err == nil {
+		t.Error("Expected an error for an invalid address")
+	}
+}
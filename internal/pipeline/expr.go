@@ -0,0 +1,663 @@
+package pipeline
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+var ErrExprSyntax = errors.New("invalid filter expression")
+
+// valueKind is the static type of an expression operand
+type valueKind int
+
+const (
+	kindString valueKind = iota + 1
+	kindNumber
+	kindBool
+)
+
+func (k valueKind) String() string {
+	switch k {
+	case kindString:
+		return "string"
+	case kindNumber:
+		return "number"
+	case kindBool:
+		return "bool"
+	}
+	return "unknown"
+}
+
+// Expr is a compiled filter expression over the HEP and decoded fields of a
+// packet, e.g.
+//
+//	sip.method == "OPTIONS" && dst_port == 5060
+//	sip.from.user in ["+4930123456", "+4930654321"]
+//	dns.qname =~ "\.example\.com$"
+//
+// Comparisons on a field the packet does not have, e.g. sip.method on a DNS
+// packet, are false.
+type Expr struct {
+	source string
+	root   exprNode
+}
+
+// CompileExpr parses and type checks a filter expression
+func CompileExpr(source string) (*Expr, error) {
+	tokens, err := lexExpr(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok, "unexpected %q", tok.text)
+	}
+	return &Expr{source: source, root: root}, nil
+}
+
+// Match reports whether the packet matches the expression
+func (e *Expr) Match(packet *protocol.HEPPacket) bool {
+	return e.root.eval(packet)
+}
+
+func (e *Expr) String() string {
+	return e.source
+}
+
+// Lexer
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var exprPunct = []string{"==", "!=", "<=", ">=", "=~", "!~", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ","}
+
+func lexExpr(source string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(source) {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			text, n, err := lexString(source[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v at position %d", ErrExprSyntax, err, i+1)
+			}
+			tokens = append(tokens, token{kind: tokString, text: text, pos: i})
+			i += n
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(source) && (source[i] >= '0' && source[i] <= '9' || source[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: source[start:i], pos: start})
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			// Identifiers may contain dots and dashes for field paths such
+			// as sip.header.x-account
+			start := i
+			for i < len(source) && isIdentChar(source[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: source[start:i], pos: start})
+		default:
+			punct := ""
+			for _, p := range exprPunct {
+				if strings.HasPrefix(source[i:], p) {
+					punct = p
+					break
+				}
+			}
+			if punct == "" {
+				return nil, fmt.Errorf("%w: unexpected character %q at position %d", ErrExprSyntax, c, i+1)
+			}
+			tokens = append(tokens, token{kind: tokPunct, text: punct, pos: i})
+			i += len(punct)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(source)}), nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '.' || c == '-' ||
+		c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// lexString reads a quoted string. Only the quote and the backslash can be
+// escaped, other backslashes are kept so regular expressions need no double
+// escaping.
+func lexString(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case quote:
+			return b.String(), i + 1, nil
+		case '\\':
+			if i+1 < len(s) && (s[i+1] == quote || s[i+1] == '\\') {
+				i++
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+// Parser
+
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is the given punctuation or keyword
+func (p *exprParser) accept(text string) bool {
+	tok := p.peek()
+	if (tok.kind == tokPunct || tok.kind == tokIdent) && tok.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) errorf(tok token, format string, args ...any) error {
+	if tok.kind == tokEOF {
+		return fmt.Errorf("%w: %s at end of expression", ErrExprSyntax, fmt.Sprintf(format, args...))
+	}
+	return fmt.Errorf("%w: %s at position %d", ErrExprSyntax, fmt.Sprintf(format, args...), tok.pos+1)
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.accept("!") {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{x: x}, nil
+	}
+	if p.accept("(") {
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.peek(); !p.accept(")") {
+			return nil, p.errorf(tok, "expected )")
+		}
+		return x, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	start := p.peek()
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	opTok := p.peek()
+	op := opTok.text
+	switch {
+	case opTok.kind == tokPunct && (op == "==" || op == "!=" || op == "<" || op == "<=" || op == ">" || op == ">="):
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if left.kind() != right.kind() {
+			return nil, p.errorf(opTok, "cannot compare %s with %s", left.kind(), right.kind())
+		}
+		if left.kind() == kindBool && op != "==" && op != "!=" {
+			return nil, p.errorf(opTok, "%s is not defined on bool", op)
+		}
+		return &compareNode{op: op, left: left, right: right}, nil
+
+	case opTok.kind == tokPunct && (op == "=~" || op == "!~"):
+		p.next()
+		tok := p.next()
+		if tok.kind != tokString {
+			return nil, p.errorf(tok, "expected a regular expression string")
+		}
+		if left.kind() != kindString {
+			return nil, p.errorf(opTok, "%s needs a string operand", op)
+		}
+		re, err := regexp.Compile(tok.text)
+		if err != nil {
+			return nil, p.errorf(tok, "%v", err)
+		}
+		return &regexNode{left: left, re: re, negate: op == "!~"}, nil
+
+	case opTok.kind == tokIdent && op == "contains":
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if left.kind() != kindString || right.kind() != kindString {
+			return nil, p.errorf(opTok, "contains needs string operands")
+		}
+		return &containsNode{left: left, right: right}, nil
+
+	case opTok.kind == tokIdent && op == "in":
+		p.next()
+		values, err := p.parseList(left.kind())
+		if err != nil {
+			return nil, err
+		}
+		return &inNode{left: left, values: values}, nil
+	}
+
+	// A bare operand is a condition when it is a bool
+	if left.kind() != kindBool {
+		return nil, p.errorf(start, "%s is not a condition", start.text)
+	}
+	return &truthNode{x: left}, nil
+}
+
+func (p *exprParser) parseList(kind valueKind) ([]any, error) {
+	if tok := p.peek(); !p.accept("[") {
+		return nil, p.errorf(tok, "expected [")
+	}
+	var values []any
+	for {
+		tok := p.peek()
+		operand, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		lit, ok := operand.(*literal)
+		if !ok {
+			return nil, p.errorf(tok, "list elements must be literals")
+		}
+		if lit.k != kind {
+			return nil, p.errorf(tok, "cannot compare %s with %s", kind, lit.k)
+		}
+		values = append(values, lit.v)
+
+		if p.accept("]") {
+			return values, nil
+		}
+		if tok := p.peek(); !p.accept(",") {
+			return nil, p.errorf(tok, "expected , or ]")
+		}
+	}
+}
+
+func (p *exprParser) parseOperand() (operand, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokString:
+		return &literal{v: tok.text, k: kindString}, nil
+	case tokNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf(tok, "invalid number %q", tok.text)
+		}
+		return &literal{v: n, k: kindNumber}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true", "false":
+			return &literal{v: tok.text == "true", k: kindBool}, nil
+		}
+		f, err := lookupField(tok.text)
+		if err != nil {
+			return nil, p.errorf(tok, "%v", err)
+		}
+		return f, nil
+	}
+	return nil, p.errorf(tok, "expected a field or value")
+}
+
+// Nodes
+
+type exprNode interface {
+	eval(packet *protocol.HEPPacket) bool
+}
+
+type operand interface {
+	value(packet *protocol.HEPPacket) (any, bool)
+	kind() valueKind
+}
+
+type literal struct {
+	v any
+	k valueKind
+}
+
+func (l *literal) value(*protocol.HEPPacket) (any, bool) { return l.v, true }
+func (l *literal) kind() valueKind                       { return l.k }
+
+type orNode struct{ left, right exprNode }
+
+func (n *orNode) eval(packet *protocol.HEPPacket) bool {
+	return n.left.eval(packet) || n.right.eval(packet)
+}
+
+type andNode struct{ left, right exprNode }
+
+func (n *andNode) eval(packet *protocol.HEPPacket) bool {
+	return n.left.eval(packet) && n.right.eval(packet)
+}
+
+type notNode struct{ x exprNode }
+
+func (n *notNode) eval(packet *protocol.HEPPacket) bool {
+	return !n.x.eval(packet)
+}
+
+type truthNode struct{ x operand }
+
+func (n *truthNode) eval(packet *protocol.HEPPacket) bool {
+	v, ok := n.x.value(packet)
+	return ok && v.(bool)
+}
+
+type compareNode struct {
+	op          string
+	left, right operand
+}
+
+func (n *compareNode) eval(packet *protocol.HEPPacket) bool {
+	a, ok := n.left.value(packet)
+	if !ok {
+		return false
+	}
+	b, ok := n.right.value(packet)
+	if !ok {
+		return false
+	}
+
+	var c int
+	switch x := a.(type) {
+	case string:
+		c = strings.Compare(x, b.(string))
+	case float64:
+		c = cmp.Compare(x, b.(float64))
+	case bool:
+		if x != b.(bool) {
+			c = 1
+		}
+	}
+
+	switch n.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+type regexNode struct {
+	left   operand
+	re     *regexp.Regexp
+	negate bool
+}
+
+func (n *regexNode) eval(packet *protocol.HEPPacket) bool {
+	v, ok := n.left.value(packet)
+	if !ok {
+		return false
+	}
+	return n.re.MatchString(v.(string)) != n.negate
+}
+
+type containsNode struct{ left, right operand }
+
+func (n *containsNode) eval(packet *protocol.HEPPacket) bool {
+	a, ok := n.left.value(packet)
+	if !ok {
+		return false
+	}
+	b, ok := n.right.value(packet)
+	if !ok {
+		return false
+	}
+	return strings.Contains(a.(string), b.(string))
+}
+
+type inNode struct {
+	left   operand
+	values []any
+}
+
+func (n *inNode) eval(packet *protocol.HEPPacket) bool {
+	v, ok := n.left.value(packet)
+	return ok && slices.Contains(n.values, v)
+}
+
+// Fields
+
+type field struct {
+	k   valueKind
+	get func(packet *protocol.HEPPacket) (any, bool)
+}
+
+func (f *field) value(packet *protocol.HEPPacket) (any, bool) { return f.get(packet) }
+func (f *field) kind() valueKind                              { return f.k }
+
+func stringField(get func(p *protocol.HEPPacket) string) *field {
+	return &field{k: kindString, get: func(p *protocol.HEPPacket) (any, bool) {
+		return get(p), true
+	}}
+}
+
+func numberField(get func(p *protocol.HEPPacket) float64) *field {
+	return &field{k: kindNumber, get: func(p *protocol.HEPPacket) (any, bool) {
+		return get(p), true
+	}}
+}
+
+// packetFields are the HEP header fields
+var packetFields = map[string]*field{
+	"version":    numberField(func(p *protocol.HEPPacket) float64 { return float64(p.Version) }),
+	"protocol":   numberField(func(p *protocol.HEPPacket) float64 { return float64(p.Protocol) }),
+	"src_ip":     stringField(func(p *protocol.HEPPacket) string { return p.SrcIP }),
+	"dst_ip":     stringField(func(p *protocol.HEPPacket) string { return p.DstIP }),
+	"src_port":   numberField(func(p *protocol.HEPPacket) float64 { return float64(p.SrcPort) }),
+	"dst_port":   numberField(func(p *protocol.HEPPacket) float64 { return float64(p.DstPort) }),
+	"proto_type": numberField(func(p *protocol.HEPPacket) float64 { return float64(p.ProtoType) }),
+	"node_id":    numberField(func(p *protocol.HEPPacket) float64 { return float64(p.NodeID) }),
+	"node_name":  stringField(func(p *protocol.HEPPacket) string { return p.NodeName }),
+	"cid":        stringField(func(p *protocol.HEPPacket) string { return p.CID }),
+	"vlan":       numberField(func(p *protocol.HEPPacket) float64 { return float64(p.Vlan) }),
+	"payload":    stringField(func(p *protocol.HEPPacket) string { return string(p.Payload) }),
+}
+
+// decodedRoots return the decoded payloads, their fields are addressed by
+// their JSON names, e.g. sip.from.user
+var decodedRoots = map[string]func(p *protocol.HEPPacket) reflect.Value{
+	"sip":      func(p *protocol.HEPPacket) reflect.Value { return reflect.ValueOf(p.SIP) },
+	"dns":      func(p *protocol.HEPPacket) reflect.Value { return reflect.ValueOf(p.DNS) },
+	"diameter": func(p *protocol.HEPPacket) reflect.Value { return reflect.ValueOf(p.Diameter) },
+	"log":      func(p *protocol.HEPPacket) reflect.Value { return reflect.ValueOf(p.Log) },
+	"rtp":      func(p *protocol.HEPPacket) reflect.Value { return reflect.ValueOf(p.RTP) },
+}
+
+func lookupField(name string) (*field, error) {
+	if f, ok := packetFields[name]; ok {
+		return f, nil
+	}
+
+	root, path, _ := strings.Cut(name, ".")
+	if root == "enrichment" && path != "" {
+		return &field{k: kindString, get: func(p *protocol.HEPPacket) (any, bool) {
+			v, ok := p.Enrichment[path]
+			return v, ok
+		}}, nil
+	}
+	if root == "sip" && strings.HasPrefix(path, "header.") {
+		header := strings.TrimPrefix(path, "header.")
+		return &field{k: kindString, get: func(p *protocol.HEPPacket) (any, bool) {
+			if p.SIP == nil {
+				return nil, false
+			}
+			return p.SIP.Header(header), true
+		}}, nil
+	}
+
+	getRoot, ok := decodedRoots[root]
+	if !ok || path == "" {
+		return nil, fmt.Errorf("unknown field %s", name)
+	}
+
+	// Resolve the path to field indexes once, a nil pointer on the way
+	// means the packet does not have the field
+	t := getRoot(&protocol.HEPPacket{}).Type()
+	var index []int
+	for _, segment := range strings.Split(path, ".") {
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("unknown field %s", name)
+		}
+		sf, ok := jsonField(t, segment)
+		if !ok {
+			return nil, fmt.Errorf("unknown field %s", name)
+		}
+		index = append(index, sf.Index[0])
+		t = sf.Type
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var k valueKind
+	switch t.Kind() {
+	case reflect.String:
+		k = kindString
+	case reflect.Bool:
+		k = kindBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		k = kindNumber
+	default:
+		return nil, fmt.Errorf("field %s cannot be compared", name)
+	}
+
+	return &field{k: k, get: func(p *protocol.HEPPacket) (any, bool) {
+		v := getRoot(p)
+		for _, i := range index {
+			if v = deref(v); !v.IsValid() {
+				return nil, false
+			}
+			v = v.Field(i)
+		}
+		if v = deref(v); !v.IsValid() {
+			return nil, false
+		}
+
+		switch v.Kind() {
+		case reflect.String:
+			return v.String(), true
+		case reflect.Bool:
+			return v.Bool(), true
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return float64(v.Int()), true
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return float64(v.Uint()), true
+		default:
+			return v.Float(), true
+		}
+	}}, nil
+}
+
+// deref follows pointers, it returns the zero Value for nil pointers
+func deref(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if tag == name && sf.IsExported() {
+			return sf, true
+		}
+	}
+	return reflect.StructField{}, false
+}
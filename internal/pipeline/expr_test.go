@@ -0,0 +1,72 @@
+package pipeline
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+func TestExprMatch(t *testing.T) {
+	packet := testPacket(t)
+	packet.DstPort = 5060
+	dns := &protocol.HEPPacket{
+		ProtoType: protocol.ProtoTypeDNS,
+		DstPort:   53,
+		DNS:       &protocol.DNSMessage{QName: "sip.example.com", QType: "SRV"},
+	}
+
+	tests := []struct {
+		expr   string
+		sip    bool
+		dnsHit bool
+	}{
+		{`sip.method == "INVITE" && dst_port == 5060`, true, false},
+		{`sip.method == "OPTIONS" || dst_port == 53`, false, true},
+		{`sip.method != "OPTIONS"`, true, false},
+		{`!(sip.method == "OPTIONS")`, true, true},
+		{`src_ip =~ "^192\.0\.2\."`, true, false},
+		{`sip.from.user in ["alice", "bob"]`, true, false},
+		{`sip.to.user in ["+4930123456"] && node_id >= 2000`, true, false},
+		{`sip.header.x-account contains "5678"`, true, false},
+		{`sip.cseq > 300000 && sip.cseq < 400000`, true, false},
+		{`sip.sdp.connection == "192.0.2.10"`, true, false},
+		{`dns.qname !~ "example\.org$" && dns.response == false`, false, true},
+		{`dns.response`, false, false},
+		{`proto_type == 53 && true`, false, true},
+	}
+
+	for _, tt := range tests {
+		expr, err := CompileExpr(tt.expr)
+		if err != nil {
+			t.Errorf("CompileExpr(%s) failed: %v", tt.expr, err)
+			continue
+		}
+		if got := expr.Match(packet); got != tt.sip {
+			t.Errorf("%s on SIP: got %v, want %v", tt.expr, got, tt.sip)
+		}
+		if got := expr.Match(dns); got != tt.dnsHit {
+			t.Errorf("%s on DNS: got %v, want %v", tt.expr, got, tt.dnsHit)
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	for _, expr := range []string{
+		`sip.method ==`,
+		`sip.method == 5`,
+		`sip.nope == "x"`,
+		`dst_port`,
+		`sip.method =~ "("`,
+		`(sip.method == "INVITE"`,
+		`sip.method == "INVITE`,
+		`dst_port in [5060, "5061"]`,
+		`src_ip < 1 @`,
+		`sip.sdp.media == "x"`,
+		`log.time == "x"`,
+	} {
+		if _, err := CompileExpr(expr); !errors.Is(err, ErrExprSyntax) {
+			t.Errorf("CompileExpr(%s): expected ErrExprSyntax, got %v", expr, err)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Filter actions
+const (
+	FilterDrop = "drop"
+	FilterKeep = "keep"
+	// FilterSample keeps one of n calls, written as sample(n)
+	FilterSample = "sample"
+)
+
+var (
+	ErrFilterBadAction = errors.New("invalid filter action")
+	ErrFilterNoFile    = errors.New("filter rules are not loaded from a file")
+)
+
+// FilterRule applies Action to the packets matching the Match expression
+type FilterRule struct {
+	Name   string `yaml:"name" json:"name"`
+	Match  string `yaml:"match" json:"match"`
+	Action string `yaml:"action" json:"action"`
+}
+
+// FilterRuleStats is a rule with the number of packets it matched since it
+// was loaded
+type FilterRuleStats struct {
+	FilterRule
+	Hits uint64 `json:"hits"`
+}
+
+type FilterConfig struct {
+	Rules []FilterRule
+	// RulesFile is a YAML file with a rules list, it is reloaded when it
+	// changes. Rules and RulesFile are exclusive.
+	RulesFile      string
+	ReloadInterval time.Duration
+}
+
+// Filter drops, keeps or samples packets by rules. The first matching rule
+// decides, packets matching no rule are kept.
+type Filter struct {
+	config  FilterConfig
+	rules   []*filterRule
+	modTime time.Time
+	mu      sync.RWMutex
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+type filterRule struct {
+	FilterRule
+	expr   *Expr
+	action string
+	sample uint32
+	hits   atomic.Uint64
+	// seq counts the sampled packets without a CID
+	seq atomic.Uint64
+}
+
+func NewFilter(config FilterConfig) (*Filter, error) {
+	f := &Filter{
+		config: config,
+		done:   make(chan struct{}),
+	}
+
+	if config.RulesFile == "" {
+		rules, err := compileFilterRules(config.Rules)
+		if err != nil {
+			return nil, err
+		}
+		f.rules = rules
+		return f, nil
+	}
+
+	if len(config.Rules) > 0 {
+		return nil, fmt.Errorf("filter rules and rules file are exclusive")
+	}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	if config.ReloadInterval > 0 {
+		f.wg.Add(1)
+		go f.watchLoop()
+	}
+	return f, nil
+}
+
+// Process applies the first matching rule
+func (f *Filter) Process(packet *protocol.HEPPacket) bool {
+	f.mu.RLock()
+	rules := f.rules
+	f.mu.RUnlock()
+
+	for _, r := range rules {
+		if r.expr.Match(packet) {
+			r.hits.Add(1)
+			return r.keep(packet)
+		}
+	}
+	return true
+}
+
+func (r *filterRule) keep(packet *protocol.HEPPacket) bool {
+	switch r.action {
+	case FilterDrop:
+		return false
+	case FilterSample:
+		// Sample by CID so the kept calls are complete
+		if packet.CID != "" {
+			h := fnv.New32a()
+			h.Write([]byte(packet.CID))
+			return h.Sum32()%r.sample == 0
+		}
+		return (r.seq.Add(1)-1)%uint64(r.sample) == 0
+	}
+	return true
+}
+
+// Rules returns the loaded rules with their hit counters
+func (f *Filter) Rules() []FilterRuleStats {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	stats := make([]FilterRuleStats, len(f.rules))
+	for i, r := range f.rules {
+		stats[i] = FilterRuleStats{FilterRule: r.FilterRule, Hits: r.hits.Load()}
+	}
+	return stats
+}
+
+// Reload loads the rules file again. The current rules stay active when the
+// file is invalid. Hit counters are kept for unchanged rules.
+func (f *Filter) Reload() error {
+	if f.config.RulesFile == "" {
+		return ErrFilterNoFile
+	}
+
+	info, err := os.Stat(f.config.RulesFile)
+	if err != nil {
+		return fmt.Errorf("read filter rules: %w", err)
+	}
+	data, err := os.ReadFile(f.config.RulesFile)
+	if err != nil {
+		return fmt.Errorf("read filter rules: %w", err)
+	}
+	var file struct {
+		Rules []FilterRule `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parse filter rules: %w", err)
+	}
+	rules, err := compileFilterRules(file.Rules)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, r := range rules {
+		for _, old := range f.rules {
+			if old.FilterRule == r.FilterRule {
+				r.hits.Store(old.hits.Load())
+				r.seq.Store(old.seq.Load())
+				break
+			}
+		}
+	}
+	f.rules = rules
+	f.modTime = info.ModTime()
+	return nil
+}
+
+func (f *Filter) watchLoop() {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(f.config.ReloadInterval)
+	defer ticker.Stop()
+
+	f.mu.RLock()
+	checked := f.modTime
+	f.mu.RUnlock()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(f.config.RulesFile)
+			if err != nil || info.ModTime().Equal(checked) {
+				continue
+			}
+			checked = info.ModTime()
+			if err := f.Reload(); err != nil {
+				logrus.Errorf("Reloading filter rules: %v", err)
+				continue
+			}
+			logrus.Infof("Reloaded filter rules from %s", f.config.RulesFile)
+		}
+	}
+}
+
+// Close stops watching the rules file
+func (f *Filter) Close() error {
+	close(f.done)
+	f.wg.Wait()
+	return nil
+}
+
+func compileFilterRules(rules []FilterRule) ([]*filterRule, error) {
+	compiled := make([]*filterRule, len(rules))
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		expr, err := CompileExpr(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("filter rule %s: %w", rule.Name, err)
+		}
+		action, sample, err := parseFilterAction(rule.Action)
+		if err != nil {
+			return nil, fmt.Errorf("filter rule %s: %w", rule.Name, err)
+		}
+		compiled[i] = &filterRule{FilterRule: rule, expr: expr, action: action, sample: sample}
+	}
+	return compiled, nil
+}
+
+// parseFilterAction parses drop, keep or sample(n)
+func parseFilterAction(s string) (string, uint32, error) {
+	s = strings.TrimSpace(s)
+	switch s {
+	case FilterDrop, FilterKeep:
+		return s, 0, nil
+	}
+
+	arg, ok := strings.CutPrefix(s, FilterSample+"(")
+	if ok {
+		arg, ok = strings.CutSuffix(arg, ")")
+	}
+	if !ok {
+		return "", 0, fmt.Errorf("%w %q", ErrFilterBadAction, s)
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(arg), 10, 32)
+	if err != nil || n == 0 {
+		return "", 0, fmt.Errorf("%w %q, sample needs a positive count", ErrFilterBadAction, s)
+	}
+	return FilterSample, uint32(n), nil
+}
@@ -0,0 +1,146 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+func sipPacket(method, cid, fromUser string) *protocol.HEPPacket {
+	return &protocol.HEPPacket{
+		ProtoType: protocol.ProtoTypeSIP,
+		DstPort:   5060,
+		CID:       cid,
+		SIP: &protocol.SIPMessage{
+			Method: method,
+			CallID: cid,
+			From:   protocol.SIPAddress{User: fromUser},
+		},
+	}
+}
+
+func TestFilterRules(t *testing.T) {
+	f, err := NewFilter(FilterConfig{Rules: []FilterRule{
+		{Name: "vip", Match: `sip.from.user in ["+4930123456"]`, Action: "keep"},
+		{Name: "keepalive", Match: `sip.method == "OPTIONS" && dst_port == 5060`, Action: "drop"},
+		{Name: "register", Match: `sip.method == "REGISTER"`, Action: "sample(10)"},
+	}})
+	if err != nil {
+		t.Fatalf("NewFilter failed: %v", err)
+	}
+	defer f.Close()
+
+	if f.Process(sipPacket("OPTIONS", "ka-1", "probe")) {
+		t.Error("Expected OPTIONS to be dropped")
+	}
+	if !f.Process(sipPacket("OPTIONS", "ka-2", "+4930123456")) {
+		t.Error("Expected OPTIONS of a listed number to be kept")
+	}
+	if !f.Process(sipPacket("INVITE", "call-1", "alice")) {
+		t.Error("Expected packets matching no rule to be kept")
+	}
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		cid := fmt.Sprintf("reg-%d", i)
+		keep := f.Process(sipPacket("REGISTER", cid, "alice"))
+		// Every message of a sampled registration is kept
+		if f.Process(sipPacket("REGISTER", cid, "alice")) != keep {
+			t.Fatalf("Expected the same decision for all packets of %s", cid)
+		}
+		if keep {
+			kept++
+		}
+	}
+	if kept < 50 || kept > 150 {
+		t.Errorf("Expected about 100 of 1000 registrations sampled, got %d", kept)
+	}
+
+	hits := map[string]uint64{}
+	for _, r := range f.Rules() {
+		hits[r.Name] = r.Hits
+	}
+	if hits["vip"] != 1 || hits["keepalive"] != 1 || hits["register"] != 2000 {
+		t.Errorf("Unexpected hit counters: %v", hits)
+	}
+}
+
+func TestFilterSampleWithoutCID(t *testing.T) {
+	f, err := NewFilter(FilterConfig{Rules: []FilterRule{
+		{Match: `dst_port == 53`, Action: "sample(4)"},
+	}})
+	if err != nil {
+		t.Fatalf("NewFilter failed: %v", err)
+	}
+	defer f.Close()
+
+	kept := 0
+	for i := 0; i < 100; i++ {
+		if f.Process(&protocol.HEPPacket{DstPort: 53}) {
+			kept++
+		}
+	}
+	if kept != 25 {
+		t.Errorf("Expected 25 of 100 packets, got %d", kept)
+	}
+	if f.Rules()[0].Name != "rule-1" {
+		t.Errorf("Expected a default rule name, got %q", f.Rules()[0].Name)
+	}
+}
+
+func TestFilterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	write("rules:\n  - name: keepalive\n    match: sip.method == \"OPTIONS\"\n    action: drop\n")
+
+	f, err := NewFilter(FilterConfig{RulesFile: path})
+	if err != nil {
+		t.Fatalf("NewFilter failed: %v", err)
+	}
+	defer f.Close()
+
+	options := sipPacket("OPTIONS", "ka-1", "probe")
+	if f.Process(options) {
+		t.Fatal("Expected OPTIONS to be dropped")
+	}
+
+	// An invalid file keeps the current rules
+	write("rules:\n  - match: sip.method ==\n    action: drop\n")
+	if err := f.Reload(); !errors.Is(err, ErrExprSyntax) {
+		t.Fatalf("Expected ErrExprSyntax, got %v", err)
+	}
+	if f.Process(options) {
+		t.Error("Expected the previous rules after a failed reload")
+	}
+
+	write("rules:\n" +
+		"  - name: keepalive\n    match: sip.method == \"OPTIONS\"\n    action: drop\n" +
+		"  - name: invites\n    match: sip.method == \"INVITE\"\n    action: drop\n")
+	if err := f.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if f.Process(sipPacket("INVITE", "call-1", "alice")) {
+		t.Error("Expected the reloaded rule to drop INVITE")
+	}
+	rules := f.Rules()
+	if len(rules) != 2 || rules[0].Hits != 2 || rules[1].Hits != 1 {
+		t.Errorf("Expected hits to survive the reload, got %+v", rules)
+	}
+}
+
+func TestFilterBadAction(t *testing.T) {
+	for _, action := range []string{"", "reject", "sample()", "sample(0)", "sample(x)"} {
+		_, err := NewFilter(FilterConfig{Rules: []FilterRule{{Match: "true", Action: action}}})
+		if !errors.Is(err, ErrFilterBadAction) {
+			t.Errorf("Action %q: expected ErrFilterBadAction, got %v", action, err)
+		}
+	}
+}
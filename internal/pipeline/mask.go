@@ -0,0 +1,655 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sipcapture/hepop-go/internal/registrar"
+	"github.com/sipcapture/hepop-go/internal/writer"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+// Masking modes
+const (
+	// MaskHash replaces values with a keyed HMAC pseudonym, the same input
+	// always gives the same pseudonym so masked calls stay correlatable
+	MaskHash = "hash"
+	// MaskRedact replaces values with a fixed placeholder
+	MaskRedact = "redact"
+)
+
+var (
+	ErrMaskKeyMissing = errors.New("hash masking requires a key")
+	ErrMaskBadMode    = errors.New("unknown masking mode")
+)
+
+// sipAddressHeaders carry name-addrs whose user parts and display names
+// identify the subscriber
+var sipAddressHeaders = map[string]bool{
+	"from":                 true,
+	"to":                   true,
+	"contact":              true,
+	"p-asserted-identity":  true,
+	"p-preferred-identity": true,
+	"p-called-party-id":    true,
+	"remote-party-id":      true,
+	"diversion":            true,
+	"history-info":         true,
+	"refer-to":             true,
+	"referred-by":          true,
+}
+
+// ipLiteral matches IPv4 addresses and bracketed IPv6 references in header
+// values such as Via and Contact
+var ipLiteral = regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}\b|\[[0-9A-Fa-f:.]+\]`)
+
+// MaskProfile selects the packets of a tenant or route and the fields to
+// mask in them
+type MaskProfile struct {
+	Name string
+	// NodeIDs and Networks select the packets by capture agent and by
+	// source or destination address, a profile without either matches all
+	NodeIDs  []uint32
+	Networks []string
+
+	Mode string
+	Key  string
+
+	// Users masks the user part of SIP and tel URIs
+	Users        bool
+	DisplayNames bool
+	// Headers are replaced as a whole
+	Headers []string
+	// SDP masks the addresses in SDP bodies
+	SDP bool
+	// IPs masks the packet source and destination addresses and the
+	// addresses in SIP headers except Call-ID
+	IPs bool
+}
+
+// Masker pseudonymizes or redacts personal data before packets are stored.
+// The first profile matching a packet is applied. The observers see the
+// original packets, the records they build are masked with the same
+// profiles by MaskCDR, MaskRTPReport, MaskAlert and MaskRegistration.
+type Masker struct {
+	profiles []*maskProfile
+	release  func(packet *protocol.HEPPacket)
+}
+
+type maskProfile struct {
+	MaskProfile
+	networks []*net.IPNet
+	headers  map[string]bool
+}
+
+func NewMasker(profiles []MaskProfile) (*Masker, error) {
+	m := &Masker{}
+	for _, config := range profiles {
+		p := &maskProfile{MaskProfile: config, headers: make(map[string]bool)}
+		switch p.Mode {
+		case MaskHash:
+			if p.Key == "" {
+				return nil, fmt.Errorf("mask profile %s: %w", p.Name, ErrMaskKeyMissing)
+			}
+		case MaskRedact:
+		default:
+			return nil, fmt.Errorf("mask profile %s: %w: %q", p.Name, ErrMaskBadMode, p.Mode)
+		}
+
+		for _, cidr := range p.Networks {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("mask profile %s: invalid network %q: %w", p.Name, cidr, err)
+			}
+			p.networks = append(p.networks, network)
+		}
+		for _, header := range p.Headers {
+			p.headers[protocol.CanonicalSIPHeader(header)] = true
+		}
+		m.profiles = append(m.profiles, p)
+	}
+	return m, nil
+}
+
+// SetRelease makes the masker mask copies of the packets and release them
+// to the following stages, observers keep a reference to the original
+// packet and must not see it change
+func (m *Masker) SetRelease(release func(packet *protocol.HEPPacket)) {
+	m.release = release
+}
+
+// Process masks the packet, packets are never dropped. Without a release
+// function the packet is masked in place.
+func (m *Masker) Process(packet *protocol.HEPPacket) bool {
+	p := m.profile(packet.NodeID, packet.SrcIP, packet.DstIP)
+	if p == nil {
+		return true
+	}
+	if m.release == nil {
+		p.mask(packet)
+		return true
+	}
+	masked := *packet
+	p.mask(&masked)
+	m.release(&masked)
+	return false
+}
+
+// profile returns the first profile matching the capture agent or one of
+// the addresses
+func (m *Masker) profile(nodeID uint32, ips ...string) *maskProfile {
+	for _, p := range m.profiles {
+		if p.matches(nodeID, ips) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (p *maskProfile) matches(nodeID uint32, ips []string) bool {
+	if len(p.NodeIDs) > 0 && !slices.Contains(p.NodeIDs, nodeID) {
+		return false
+	}
+	if len(p.networks) == 0 {
+		return true
+	}
+	for _, value := range ips {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			continue
+		}
+		for _, network := range p.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *maskProfile) mask(packet *protocol.HEPPacket) {
+	if packet.ProtoType == protocol.ProtoTypeSIP && (p.Users || p.DisplayNames || p.SDP || p.IPs || len(p.headers) > 0) {
+		if payload, ok := p.maskSIP(packet.Payload); ok {
+			packet.Payload = payload
+			// Stored SIP fields must not keep the original values
+			if msg, err := protocol.DecodeSIP(payload); err == nil {
+				if packet.SIP != nil && packet.SIP.SDP != nil {
+					msg.SDP, _ = protocol.DecodeSDP(msg.Body)
+				}
+				packet.SIP = msg
+			}
+		}
+	}
+
+	if p.IPs {
+		packet.SrcIP = p.maskIP(packet.SrcIP)
+		packet.DstIP = p.maskIP(packet.DstIP)
+	}
+}
+
+// maskSIP rewrites the start line, headers and SDP body of a SIP message.
+// Folded headers are unfolded and Content-Length is updated, so the result
+// is still a valid message.
+func (p *maskProfile) maskSIP(data []byte) ([]byte, bool) {
+	eol := "\r\n"
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		eol = "\n"
+		headerEnd = bytes.Index(data, []byte("\n\n"))
+	}
+	var body []byte
+	if headerEnd < 0 {
+		headerEnd = len(data)
+	} else {
+		body = data[headerEnd+2*len(eol):]
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(data[:headerEnd]), eol) {
+		if len(lines) > 1 && line != "" && (line[0] == ' ' || line[0] == '\t') {
+			lines[len(lines)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 || lines[0] == "" {
+		return nil, false
+	}
+
+	if !strings.HasPrefix(lines[0], "SIP/2.0 ") {
+		// METHOD Request-URI SIP/2.0
+		parts := strings.Split(lines[0], " ")
+		if len(parts) == 3 {
+			parts[1] = p.maskURI(parts[1])
+			lines[0] = strings.Join(parts, " ")
+		}
+	}
+
+	isSDP := false
+	contentLength := -1
+	for i := 1; i < len(lines); i++ {
+		colon := strings.IndexByte(lines[i], ':')
+		if colon <= 0 {
+			continue
+		}
+		name := protocol.CanonicalSIPHeader(lines[i][:colon])
+		value := strings.TrimSpace(lines[i][colon+1:])
+
+		switch {
+		case name == "content-length":
+			contentLength = i
+			continue
+		case name == "content-type":
+			isSDP = strings.Contains(strings.ToLower(value), "application/sdp")
+		}
+
+		masked := value
+		switch {
+		case p.headers[name]:
+			masked = p.token(value)
+		case sipAddressHeaders[name]:
+			masked = p.maskAddressList(value)
+		}
+		// Call-ID is kept as it is the correlation ID of the stored packets
+		if p.IPs && name != "call-id" {
+			masked = ipLiteral.ReplaceAllStringFunc(masked, p.maskIPLiteral)
+		}
+		if masked != value {
+			lines[i] = lines[i][:colon] + ": " + masked
+		}
+	}
+
+	if isSDP && (p.SDP || p.Users) {
+		body = p.maskSDP(body)
+	}
+	if contentLength >= 0 {
+		name, _, _ := strings.Cut(lines[contentLength], ":")
+		lines[contentLength] = name + ": " + strconv.Itoa(len(body))
+	}
+
+	var out bytes.Buffer
+	out.WriteString(strings.Join(lines, eol))
+	out.WriteString(eol + eol)
+	out.Write(body)
+	return out.Bytes(), true
+}
+
+// maskAddressList masks every name-addr of a header such as Contact
+func (p *maskProfile) maskAddressList(value string) string {
+	parts := protocol.SplitSIPHeaderList(value)
+	for i, part := range parts {
+		if lt := strings.IndexByte(part, '<'); lt > 0 && p.DisplayNames {
+			if display := strings.Trim(strings.TrimSpace(part[:lt]), `"`); display != "" {
+				part = `"` + p.displayName(display) + `" ` + part[lt:]
+			}
+		}
+		if p.Users {
+			part = p.maskURIUsers(part)
+		}
+		parts[i] = part
+	}
+	return strings.Join(parts, ", ")
+}
+
+// maskURIUsers replaces the user part of each sip:, sips: and tel: URI in
+// the value
+func (p *maskProfile) maskURIUsers(value string) string {
+	var out strings.Builder
+	lower := strings.ToLower(value)
+	pos := 0
+	for {
+		start, scheme := nextURI(lower, pos)
+		if start < 0 {
+			break
+		}
+		userStart := start + len(scheme)
+		rest := value[userStart:]
+
+		userEnd := 0
+		if scheme == "tel:" {
+			userEnd = strings.IndexAny(rest, ";>?, ")
+			if userEnd < 0 {
+				userEnd = len(rest)
+			}
+		} else if at := strings.IndexByte(rest, '@'); at > 0 {
+			if stop := strings.IndexAny(rest, ">?, \""); stop < 0 || at < stop {
+				userEnd = at
+			}
+		}
+
+		out.WriteString(value[pos:userStart])
+		if userEnd > 0 {
+			out.WriteString(p.user(rest[:userEnd]))
+		}
+		pos = userStart + userEnd
+	}
+	out.WriteString(value[pos:])
+	return out.String()
+}
+
+func nextURI(lower string, from int) (int, string) {
+	best, scheme := -1, ""
+	for _, s := range []string{"sip:", "sips:", "tel:"} {
+		for offset := from; ; {
+			i := strings.Index(lower[offset:], s)
+			if i < 0 {
+				break
+			}
+			i += offset
+			// Skip matches inside a longer word
+			if i > 0 && lower[i-1] >= 'a' && lower[i-1] <= 'z' {
+				offset = i + len(s)
+				continue
+			}
+			if best < 0 || i < best {
+				best, scheme = i, s
+			}
+			break
+		}
+	}
+	return best, scheme
+}
+
+// maskSDP masks the origin user name and the origin, connection, RTCP and
+// ICE candidate addresses
+func (p *maskProfile) maskSDP(body []byte) []byte {
+	eol := "\n"
+	if bytes.Contains(body, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+	lines := strings.Split(string(body), eol)
+	for i, line := range lines {
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		prefix, fields := line[:2], strings.Split(line[2:], " ")
+
+		addrField := -1
+		switch {
+		case prefix == "o=" && len(fields) == 6:
+			// o=alice 2890844526 2890844526 IN IP4 192.0.2.10
+			if p.Users {
+				fields[0] = p.user(fields[0])
+			}
+			addrField = 5
+		case prefix == "c=" && len(fields) == 3:
+			// c=IN IP4 192.0.2.10
+			addrField = 2
+		case strings.HasPrefix(line, "a=rtcp:") && len(fields) == 4:
+			// a=rtcp:53020 IN IP4 192.0.2.10
+			addrField = 3
+		case strings.HasPrefix(line, "a=candidate:") && len(fields) > 4:
+			// a=candidate:1 1 UDP 2130706431 192.0.2.10 8998 typ host
+			addrField = 4
+		}
+
+		if p.SDP && addrField >= 0 {
+			addr, ttl, hasTTL := strings.Cut(fields[addrField], "/")
+			fields[addrField] = p.maskIP(addr)
+			if hasTTL {
+				fields[addrField] += "/" + ttl
+			}
+		}
+		lines[i] = prefix + strings.Join(fields, " ")
+	}
+	return []byte(strings.Join(lines, eol))
+}
+
+func (p *maskProfile) maskIPLiteral(literal string) string {
+	if strings.HasPrefix(literal, "[") {
+		return "[" + p.maskIP(strings.Trim(literal, "[]")) + "]"
+	}
+	return p.maskIP(literal)
+}
+
+// maskIP maps an address to a pseudonymous address of the same family,
+// values that are not addresses are left alone
+func (p *maskProfile) maskIP(value string) string {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return value
+	}
+	size := net.IPv6len
+	if ip.To4() != nil {
+		size = net.IPv4len
+	}
+	if p.Mode == MaskRedact {
+		return net.IP(make([]byte, size)).String()
+	}
+	return net.IP(p.hmac(ip.String())[:size]).String()
+}
+
+// user masks a URI user part. Phone numbers keep their format so that
+// masked numbers still look like numbers.
+func (p *maskProfile) user(value string) string {
+	if digits, ok := phoneDigits(value); ok {
+		var out strings.Builder
+		if value[0] == '+' {
+			out.WriteByte('+')
+		}
+		sum := p.hmac(value)
+		for i := 0; i < digits; i++ {
+			if p.Mode == MaskRedact {
+				out.WriteByte('0')
+			} else {
+				out.WriteByte('0' + sum[i%len(sum)]%10)
+			}
+		}
+		return out.String()
+	}
+	if p.Mode == MaskRedact {
+		return "anonymous"
+	}
+	return p.token(value)
+}
+
+func (p *maskProfile) displayName(value string) string {
+	if p.Mode == MaskRedact {
+		return "Anonymous"
+	}
+	return p.token(value)
+}
+
+// token is the replacement of a whole value
+func (p *maskProfile) token(value string) string {
+	if p.Mode == MaskRedact {
+		return "redacted"
+	}
+	return hex.EncodeToString(p.hmac(value)[:8])
+}
+
+func (p *maskProfile) hmac(value string) []byte {
+	mac := hmac.New(sha256.New, []byte(p.Key))
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// phoneDigits reports whether the value is a phone number, optionally with
+// a leading +, and returns its number of digits
+func phoneDigits(value string) (int, bool) {
+	digits := strings.TrimPrefix(value, "+")
+	if digits == "" {
+		return 0, false
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return 0, false
+		}
+	}
+	return len(digits), true
+}
+
+// MaskCDR masks the parties and addresses of a call detail record in place
+func (m *Masker) MaskCDR(cdr *writer.CDR) {
+	p := m.profile(cdr.NodeID, cdr.SrcIP, cdr.DstIP)
+	if p == nil {
+		return
+	}
+	cdr.FromUser, cdr.FromURI = p.maskUser(cdr.FromUser), p.maskURI(cdr.FromURI)
+	cdr.ToUser, cdr.ToURI = p.maskUser(cdr.ToUser), p.maskURI(cdr.ToURI)
+	cdr.UserAgent = p.maskHeader("user-agent", cdr.UserAgent)
+	if p.IPs {
+		cdr.SrcIP, cdr.DstIP = p.maskIP(cdr.SrcIP), p.maskIP(cdr.DstIP)
+	}
+}
+
+// MaskRTPReport masks the stream addresses of an RTP report in place
+func (m *Masker) MaskRTPReport(report *writer.RTPReport) {
+	p := m.profile(report.NodeID, report.SrcIP, report.DstIP)
+	if p == nil || !p.IPs {
+		return
+	}
+	report.SrcIP, report.DstIP = p.maskIP(report.SrcIP), p.maskIP(report.DstIP)
+}
+
+// MaskAlert masks the source, account and called number of a fraud alert
+// in place, also where the message mentions them
+func (m *Masker) MaskAlert(alert *writer.Alert) {
+	p := m.profile(alert.NodeID, alert.Source)
+	if p == nil {
+		return
+	}
+	var replacements []string
+	replace := func(field *string, masked string) {
+		if *field != "" && masked != *field {
+			replacements = append(replacements, *field, masked)
+			*field = masked
+		}
+	}
+	if p.IPs {
+		replace(&alert.Source, p.maskIP(alert.Source))
+	}
+	replace(&alert.Account, p.maskUser(alert.Account))
+	replace(&alert.Number, p.maskUser(alert.Number))
+	replace(&alert.UserAgent, p.maskHeader("user-agent", alert.UserAgent))
+	if len(replacements) > 0 {
+		alert.Message = strings.NewReplacer(replacements...).Replace(alert.Message)
+	}
+}
+
+// MaskRegistration masks the AOR, contacts and addresses of a registration
+// in place. Bindings are shared with the registrar, they are replaced by
+// masked copies.
+func (m *Masker) MaskRegistration(reg *registrar.Registration) {
+	var ips []string
+	nodeID := uint32(0)
+	for _, b := range reg.Contacts {
+		ips = append(ips, b.SrcIP)
+		nodeID = b.NodeID
+	}
+	for _, f := range reg.Failures {
+		ips = append(ips, f.SrcIP)
+	}
+	p := m.profile(nodeID, ips...)
+	if p == nil {
+		return
+	}
+
+	reg.AOR = p.maskURI(reg.AOR)
+	contacts := make([]*registrar.Binding, len(reg.Contacts))
+	for i, b := range reg.Contacts {
+		masked := *b
+		masked.Contact = p.maskURI(b.Contact)
+		masked.UserAgent = p.maskHeader("user-agent", b.UserAgent)
+		if p.IPs {
+			masked.SrcIP = p.maskIP(b.SrcIP)
+		}
+		contacts[i] = &masked
+	}
+	reg.Contacts = contacts
+	failures := make([]registrar.Failure, len(reg.Failures))
+	for i, f := range reg.Failures {
+		f.UserAgent = p.maskHeader("user-agent", f.UserAgent)
+		if p.IPs {
+			f.SrcIP = p.maskIP(f.SrcIP)
+		}
+		failures[i] = f
+	}
+	reg.Failures = failures
+}
+
+// CDRWriter returns a writer that masks copies of the CDRs passed to w
+func (m *Masker) CDRWriter(w writer.CDRWriter) writer.CDRWriter {
+	return maskedCDRWriter{m, w}
+}
+
+// RTPReportWriter returns a writer that masks copies of the reports passed
+// to w
+func (m *Masker) RTPReportWriter(w writer.RTPReportWriter) writer.RTPReportWriter {
+	return maskedRTPReportWriter{m, w}
+}
+
+// AlertWriter returns a writer that masks copies of the alerts passed to w
+func (m *Masker) AlertWriter(w writer.AlertWriter) writer.AlertWriter {
+	return maskedAlertWriter{m, w}
+}
+
+type maskedCDRWriter struct {
+	masker *Masker
+	writer writer.CDRWriter
+}
+
+func (w maskedCDRWriter) WriteCDR(cdr *writer.CDR) error {
+	masked := *cdr
+	w.masker.MaskCDR(&masked)
+	return w.writer.WriteCDR(&masked)
+}
+
+type maskedRTPReportWriter struct {
+	masker *Masker
+	writer writer.RTPReportWriter
+}
+
+func (w maskedRTPReportWriter) WriteRTPReport(report *writer.RTPReport) error {
+	masked := *report
+	w.masker.MaskRTPReport(&masked)
+	return w.writer.WriteRTPReport(&masked)
+}
+
+type maskedAlertWriter struct {
+	masker *Masker
+	writer writer.AlertWriter
+}
+
+func (w maskedAlertWriter) WriteAlert(alert *writer.Alert) error {
+	masked := *alert
+	w.masker.MaskAlert(&masked)
+	return w.writer.WriteAlert(&masked)
+}
+
+// maskUser masks a URI user part if users are masked
+func (p *maskProfile) maskUser(value string) string {
+	if !p.Users || value == "" {
+		return value
+	}
+	return p.user(value)
+}
+
+// maskURI masks the user part and, if addresses are masked, an IP host of
+// a URI
+func (p *maskProfile) maskURI(value string) string {
+	if p.Users {
+		value = p.maskURIUsers(value)
+	}
+	if p.IPs {
+		value = ipLiteral.ReplaceAllStringFunc(value, p.maskIPLiteral)
+	}
+	return value
+}
+
+// maskHeader replaces the value of a header that is masked as a whole
+func (p *maskProfile) maskHeader(name, value string) string {
+	if !p.headers[name] || value == "" {
+		return value
+	}
+	return p.token(value)
+}
@@ -0,0 +1,279 @@
+package pipeline
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sipcapture/hepop-go/internal/registrar"
+	"github.com/sipcapture/hepop-go/internal/writer"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+const testInvite = "INVITE sip:+4930123456@example.com SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP 192.0.2.10:5060;branch=z9hG4bK776asdhds\r\n" +
+	"f: \"Alice Smith\" <sip:alice@example.com>;tag=1928301774\r\n" +
+	"To: <tel:+4930123456>\r\n" +
+	"Call-ID: a84b4c76e66710@pc33.example.com\r\n" +
+	"CSeq: 314159 INVITE\r\n" +
+	"Contact: <sip:alice@192.0.2.10:5060>\r\n" +
+	"P-Asserted-Identity: \"Alice Smith\" <sip:alice@example.com>,\r\n" +
+	" <tel:+4940111222>\r\n" +
+	"X-Account: 1234-5678\r\n" +
+	"Content-Type: application/sdp\r\n" +
+	"Content-Length: 137\r\n" +
+	"\r\n" +
+	"v=0\r\n" +
+	"o=alice 2890844526 2890844526 IN IP4 192.0.2.10\r\n" +
+	"s=-\r\n" +
+	"c=IN IP4 192.0.2.10\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 49170 RTP/AVP 0\r\n" +
+	"a=rtcp:49171 IN IP4 192.0.2.10\r\n"
+
+func testPacket(t *testing.T) *protocol.HEPPacket {
+	t.Helper()
+	msg, err := protocol.DecodeSIP([]byte(testInvite))
+	if err != nil {
+		t.Fatalf("DecodeSIP failed: %v", err)
+	}
+	msg.SDP, err = protocol.DecodeSDP(msg.Body)
+	if err != nil {
+		t.Fatalf("DecodeSDP failed: %v", err)
+	}
+	return &protocol.HEPPacket{
+		SrcIP:     "192.0.2.10",
+		DstIP:     "198.51.100.1",
+		NodeID:    2001,
+		ProtoType: protocol.ProtoTypeSIP,
+		Payload:   []byte(testInvite),
+		SIP:       msg,
+	}
+}
+
+func fullProfile(mode string) MaskProfile {
+	return MaskProfile{
+		Name:         "all",
+		Mode:         mode,
+		Key:          "secret",
+		Users:        true,
+		DisplayNames: true,
+		Headers:      []string{"x-account"},
+		SDP:          true,
+		IPs:          true,
+	}
+}
+
+func TestMaskerHash(t *testing.T) {
+	m, err := NewMasker([]MaskProfile{fullProfile(MaskHash)})
+	if err != nil {
+		t.Fatalf("NewMasker failed: %v", err)
+	}
+
+	packet := testPacket(t)
+	m.Process(packet)
+	payload := string(packet.Payload)
+
+	for _, original := range []string{"alice", "Alice Smith", "+4930123456", "+4940111222", "1234-5678", "192.0.2.10"} {
+		if strings.Contains(payload, original) {
+			t.Errorf("Masked payload still contains %q:\n%s", original, payload)
+		}
+	}
+
+	// The masked payload must still be a valid SIP message with SDP
+	msg, err := protocol.DecodeSIP(packet.Payload)
+	if err != nil {
+		t.Fatalf("Masked payload is not valid SIP: %v", err)
+	}
+	if msg.Method != "INVITE" || msg.CallID != "a84b4c76e66710@pc33.example.com" || msg.CSeq != 314159 {
+		t.Errorf("Unexpected masked message: %+v", msg)
+	}
+	if msg.From.Tag != "1928301774" || msg.From.Host != "example.com" {
+		t.Errorf("Expected tag and host to be kept, got %+v", msg.From)
+	}
+	if length, _ := strconv.Atoi(msg.Header("content-length")); length != len(msg.Body) {
+		t.Errorf("Content-Length %d does not match body length %d", length, len(msg.Body))
+	}
+	sdp, err := protocol.DecodeSDP(msg.Body)
+	if err != nil {
+		t.Fatalf("Masked body is not valid SDP: %v", err)
+	}
+	if net.ParseIP(sdp.Connection) == nil {
+		t.Errorf("Expected a masked IP address in SDP, got %q", sdp.Connection)
+	}
+
+	// Pseudonyms are stable, so the same subscriber and host correlate
+	pai := protocol.ParseSIPAddress(protocol.SplitSIPHeaderList(msg.Header("p-asserted-identity"))[0])
+	if pai.User != msg.From.User || pai.Display != msg.From.Display {
+		t.Errorf("Expected the same pseudonym in From and PAI, got %+v and %+v", msg.From, pai)
+	}
+	if msg.To.User[0] != '+' || len(msg.To.User) != len("+4930123456") {
+		t.Errorf("Expected a phone number shaped pseudonym, got %q", msg.To.User)
+	}
+	if !strings.Contains(msg.RequestURI, msg.To.User) {
+		t.Errorf("Expected Request-URI %q to use the To pseudonym %q", msg.RequestURI, msg.To.User)
+	}
+	if packet.SrcIP != sdp.Connection {
+		t.Errorf("Expected source IP %q to match the SDP address %q", packet.SrcIP, sdp.Connection)
+	}
+
+	// Decoded fields are rebuilt from the masked payload
+	if packet.SIP.From.User != msg.From.User || packet.SIP.SDP == nil {
+		t.Errorf("Expected decoded fields from the masked payload, got %+v", packet.SIP)
+	}
+}
+
+func TestMaskerRedact(t *testing.T) {
+	m, err := NewMasker([]MaskProfile{fullProfile(MaskRedact)})
+	if err != nil {
+		t.Fatalf("NewMasker failed: %v", err)
+	}
+
+	packet := testPacket(t)
+	m.Process(packet)
+
+	msg, err := protocol.DecodeSIP(packet.Payload)
+	if err != nil {
+		t.Fatalf("Masked payload is not valid SIP: %v", err)
+	}
+	if msg.From.User != "anonymous" || msg.From.Display != "Anonymous" || msg.To.User != "+0000000000" {
+		t.Errorf("Unexpected redacted addresses: %+v %+v", msg.From, msg.To)
+	}
+	if msg.Header("x-account") != "redacted" || packet.SrcIP != "0.0.0.0" {
+		t.Errorf("Unexpected redacted values: %q %q", msg.Header("x-account"), packet.SrcIP)
+	}
+}
+
+func TestMaskerProfiles(t *testing.T) {
+	m, err := NewMasker([]MaskProfile{
+		{Name: "tenant-a", NodeIDs: []uint32{1}, Mode: MaskRedact, Users: true},
+		{Name: "core", Networks: []string{"198.51.100.0/24"}, Mode: MaskHash, Key: "k", IPs: true},
+	})
+	if err != nil {
+		t.Fatalf("NewMasker failed: %v", err)
+	}
+
+	// Node 2001 is not tenant-a, the core profile matches the destination
+	packet := testPacket(t)
+	m.Process(packet)
+	if !strings.Contains(string(packet.Payload), "alice") {
+		t.Error("Expected users to be kept outside tenant-a")
+	}
+	if packet.DstIP == "198.51.100.1" {
+		t.Error("Expected the core profile to mask addresses")
+	}
+
+	other := testPacket(t)
+	other.NodeID = 1
+	m.Process(other)
+	if strings.Contains(string(other.Payload), "alice") || other.DstIP != "198.51.100.1" {
+		t.Errorf("Expected only the tenant-a profile to apply, got %s", other.DstIP)
+	}
+}
+
+func TestMaskerRequestURIHost(t *testing.T) {
+	m, err := NewMasker([]MaskProfile{{Name: "ips", Mode: MaskHash, Key: "k", IPs: true}})
+	if err != nil {
+		t.Fatalf("NewMasker failed: %v", err)
+	}
+
+	invite := strings.Replace(testInvite, "INVITE sip:+4930123456@example.com", "INVITE sip:100@203.0.113.5:5060", 1)
+	packet := &protocol.HEPPacket{SrcIP: "192.0.2.10", DstIP: "203.0.113.5", ProtoType: protocol.ProtoTypeSIP, Payload: []byte(invite)}
+	m.Process(packet)
+
+	msg, err := protocol.DecodeSIP(packet.Payload)
+	if err != nil {
+		t.Fatalf("Masked payload is not valid SIP: %v", err)
+	}
+	if strings.Contains(msg.RequestURI, "203.0.113.5") || !strings.HasPrefix(msg.RequestURI, "sip:100@") {
+		t.Errorf("Expected the Request-URI host masked and the user kept, got %q", msg.RequestURI)
+	}
+	if want := "sip:100@" + packet.DstIP + ":5060"; msg.RequestURI != want {
+		t.Errorf("Expected the pseudonym of the destination %q, got %q", want, msg.RequestURI)
+	}
+}
+
+func TestMaskerCopy(t *testing.T) {
+	m, err := NewMasker([]MaskProfile{fullProfile(MaskHash)})
+	if err != nil {
+		t.Fatalf("NewMasker failed: %v", err)
+	}
+	var released *protocol.HEPPacket
+	m.SetRelease(func(packet *protocol.HEPPacket) { released = packet })
+
+	packet := testPacket(t)
+	if m.Process(packet) {
+		t.Error("Expected the masked copy to be released instead of the packet")
+	}
+	if released == nil || released == packet || strings.Contains(string(released.Payload), "alice") {
+		t.Fatalf("Expected a masked copy, got %+v", released)
+	}
+	if string(packet.Payload) != testInvite || packet.SrcIP != "192.0.2.10" || packet.SIP.From.User != "alice" {
+		t.Error("Expected the original packet to be unchanged")
+	}
+}
+
+func TestMaskerRecords(t *testing.T) {
+	m, err := NewMasker([]MaskProfile{
+		{Name: "tenant-a", NodeIDs: []uint32{2001}, Mode: MaskHash, Key: "k", Users: true, IPs: true, Headers: []string{"User-Agent"}},
+	})
+	if err != nil {
+		t.Fatalf("NewMasker failed: %v", err)
+	}
+
+	cdr := &writer.CDR{NodeID: 2001, FromUser: "alice", FromURI: "sip:alice@example.com", ToUser: "+4930123456",
+		ToURI: "tel:+4930123456", SrcIP: "192.0.2.10", DstIP: "198.51.100.1", UserAgent: "Phone 1.0"}
+	m.MaskCDR(cdr)
+	if cdr.FromUser == "alice" || strings.Contains(cdr.FromURI, "alice") || cdr.SrcIP == "192.0.2.10" || cdr.UserAgent == "Phone 1.0" {
+		t.Errorf("Expected a masked CDR, got %+v", cdr)
+	}
+	if _, ok := phoneDigits(cdr.ToUser); !ok || cdr.ToURI != "tel:"+cdr.ToUser {
+		t.Errorf("Expected the callee number masked the same in user and URI, got %s %s", cdr.ToUser, cdr.ToURI)
+	}
+
+	report := &writer.RTPReport{NodeID: 2001, SrcIP: "192.0.2.10", DstIP: "198.51.100.1"}
+	m.MaskRTPReport(report)
+	if report.SrcIP != cdr.SrcIP || report.DstIP != cdr.DstIP {
+		t.Errorf("Expected report addresses masked like the CDR, got %s %s", report.SrcIP, report.DstIP)
+	}
+
+	alert := &writer.Alert{NodeID: 2001, Source: "192.0.2.10", Account: "alice", Number: "+4930123456",
+		Message: "3 international calls from alice within 1m0s, last to +4930123456"}
+	m.MaskAlert(alert)
+	if strings.Contains(alert.Message, "alice") || strings.Contains(alert.Message, "+4930123456") ||
+		!strings.Contains(alert.Message, alert.Account) || alert.Source != cdr.SrcIP {
+		t.Errorf("Expected a masked alert, got %+v", alert)
+	}
+
+	binding := &registrar.Binding{Contact: "sip:alice@192.0.2.10:5060", SrcIP: "192.0.2.10", NodeID: 2001}
+	reg := &registrar.Registration{AOR: "sip:alice@example.com", Contacts: []*registrar.Binding{binding}}
+	m.MaskRegistration(reg)
+	if strings.Contains(reg.AOR, "alice") || strings.Contains(reg.Contacts[0].Contact, "alice") ||
+		strings.Contains(reg.Contacts[0].Contact, "192.0.2.10") || reg.Contacts[0].SrcIP != cdr.SrcIP {
+		t.Errorf("Expected a masked registration, got %s %+v", reg.AOR, reg.Contacts[0])
+	}
+	if binding.Contact != "sip:alice@192.0.2.10:5060" {
+		t.Error("Expected the registrar binding to be unchanged")
+	}
+
+	// Records of other agents are kept
+	other := &writer.CDR{NodeID: 1, FromUser: "alice"}
+	m.MaskCDR(other)
+	if other.FromUser != "alice" {
+		t.Errorf("Expected no profile for node 1, got %s", other.FromUser)
+	}
+}
+
+func TestNewMaskerErrors(t *testing.T) {
+	if _, err := NewMasker([]MaskProfile{{Name: "a", Mode: MaskHash}}); !errors.Is(err, ErrMaskKeyMissing) {
+		t.Errorf("Expected ErrMaskKeyMissing, got %v", err)
+	}
+	if _, err := NewMasker([]MaskProfile{{Name: "a", Mode: "encrypt"}}); !errors.Is(err, ErrMaskBadMode) {
+		t.Errorf("Expected ErrMaskBadMode, got %v", err)
+	}
+	if _, err := NewMasker([]MaskProfile{{Name: "a", Mode: MaskRedact, Networks: []string{"10.0.0.1"}}}); err == nil {
+		t.Error("Expected an error for an invalid network")
+	}
+}
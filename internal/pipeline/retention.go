@@ -0,0 +1,214 @@
+package pipeline
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+type RetentionConfig struct {
+	// Keep is a filter expression, a call is stored when any of its
+	// packets matches
+	Keep string
+	// Window is how long the packets of a call are held, counted from its
+	// first packet
+	Window time.Duration
+	// Sample stores one of n calls that did not match, 0 discards them
+	Sample uint32
+	// CallTimeout is how long the decision for a call is remembered after
+	// its last packet
+	CallTimeout time.Duration
+	// MaxCalls limits the calls held at once, packets of further calls are
+	// stored without waiting. 0 is unlimited.
+	MaxCalls int
+}
+
+// Retention stores or discards whole calls. Packets are held per CID until
+// a packet of the call matches the keep expression or the window ends, so
+// failed calls are stored complete while successful ones can be sampled.
+// Packets without a CID pass unchanged.
+type Retention struct {
+	config  RetentionConfig
+	keep    *Expr
+	calls   map[string]*retainedCall
+	held    int
+	release func(packet *protocol.HEPPacket)
+	mu      sync.Mutex
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+type retainedCall struct {
+	first   time.Time
+	last    time.Time
+	packets []*protocol.HEPPacket
+	decided bool
+	store   bool
+}
+
+func NewRetention(config RetentionConfig) (*Retention, error) {
+	keep, err := CompileExpr(config.Keep)
+	if err != nil {
+		return nil, fmt.Errorf("retention keep: %w", err)
+	}
+	if config.Window <= 0 {
+		return nil, fmt.Errorf("retention window must be positive")
+	}
+	if config.CallTimeout < config.Window {
+		config.CallTimeout = config.Window
+	}
+
+	r := &Retention{
+		config: config,
+		keep:   keep,
+		calls:  make(map[string]*retainedCall),
+		done:   make(chan struct{}),
+	}
+	r.wg.Add(1)
+	go r.expireLoop()
+	return r, nil
+}
+
+// SetRelease sets where held packets go once their call is stored
+func (r *Retention) SetRelease(release func(packet *protocol.HEPPacket)) {
+	r.release = release
+}
+
+// Process holds the packets of undecided calls and passes those of stored
+// calls
+func (r *Retention) Process(packet *protocol.HEPPacket) bool {
+	return r.process(packet, time.Now())
+}
+
+func (r *Retention) process(packet *protocol.HEPPacket, now time.Time) bool {
+	if packet.CID == "" || r.release == nil {
+		return true
+	}
+	match := r.keep.Match(packet)
+
+	r.mu.Lock()
+	call, ok := r.calls[packet.CID]
+	if !ok {
+		if r.config.MaxCalls > 0 && r.held >= r.config.MaxCalls {
+			r.mu.Unlock()
+			return true
+		}
+		call = &retainedCall{first: now}
+		r.calls[packet.CID] = call
+		r.held++
+	}
+	call.last = now
+
+	if call.decided {
+		// A discarded call is stored from the first matching packet on
+		call.store = call.store || match
+		store := call.store
+		r.mu.Unlock()
+		return store
+	}
+
+	if !match {
+		call.packets = append(call.packets, packet)
+		r.mu.Unlock()
+		return false
+	}
+
+	held := call.packets
+	call.packets = nil
+	call.decided = true
+	call.store = true
+	r.held--
+	r.mu.Unlock()
+
+	for _, p := range held {
+		r.release(p)
+	}
+	return true
+}
+
+// sampled reports whether an unmatched call is stored, by CID so every
+// instance agrees
+func (r *Retention) sampled(cid string) bool {
+	if r.config.Sample == 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(cid))
+	return h.Sum32()%r.config.Sample == 0
+}
+
+func (r *Retention) expireLoop() {
+	defer r.wg.Done()
+
+	interval := max(r.config.Window/4, 10*time.Millisecond)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			for _, packet := range r.expire(now, false) {
+				r.release(packet)
+			}
+		}
+	}
+}
+
+// expire decides the calls whose window ended, or all held calls, and
+// returns the packets to store. Decisions are forgotten after the call
+// timeout.
+func (r *Retention) expire(now time.Time, all bool) []*protocol.HEPPacket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var stored []*retainedCall
+	for cid, call := range r.calls {
+		if call.decided {
+			if now.Sub(call.last) > r.config.CallTimeout {
+				delete(r.calls, cid)
+			}
+			continue
+		}
+		if !all && now.Sub(call.first) <= r.config.Window {
+			continue
+		}
+
+		call.decided = true
+		call.store = r.sampled(cid)
+		r.held--
+		if call.store {
+			stored = append(stored, call)
+		} else {
+			call.packets = nil
+		}
+	}
+
+	// Release the calls in the order they started
+	slices.SortFunc(stored, func(a, b *retainedCall) int {
+		return a.first.Compare(b.first)
+	})
+	var released []*protocol.HEPPacket
+	for _, call := range stored {
+		released = append(released, call.packets...)
+		call.packets = nil
+	}
+	return released
+}
+
+// Close stops the retention and decides the held calls as if their window
+// ended
+func (r *Retention) Close() error {
+	close(r.done)
+	r.wg.Wait()
+
+	for _, packet := range r.expire(time.Now(), true) {
+		r.release(packet)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package pipeline
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+func callPacket(cid, method string, status int) *protocol.HEPPacket {
+	return &protocol.HEPPacket{
+		ProtoType: protocol.ProtoTypeSIP,
+		CID:       cid,
+		SIP:       &protocol.SIPMessage{Method: method, StatusCode: status, CallID: cid},
+	}
+}
+
+func newTestRetention(t *testing.T, sample uint32) (*Retention, *[]*protocol.HEPPacket) {
+	t.Helper()
+	r, err := NewRetention(RetentionConfig{
+		Keep:        `sip.status_code >= 500`,
+		Window:      30 * time.Second,
+		Sample:      sample,
+		CallTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewRetention failed: %v", err)
+	}
+	var released []*protocol.HEPPacket
+	r.SetRelease(func(packet *protocol.HEPPacket) {
+		released = append(released, packet)
+	})
+	return r, &released
+}
+
+func TestRetentionKeepsMatchingCall(t *testing.T) {
+	r, released := newTestRetention(t, 0)
+	defer r.Close()
+
+	// The background expiry runs on the wall clock
+	now := time.Now()
+	if r.process(callPacket("failed", "INVITE", 0), now) {
+		t.Fatal("Expected the INVITE to be held")
+	}
+	if r.process(callPacket("failed", "", 100), now.Add(time.Millisecond)) {
+		t.Fatal("Expected the 100 Trying to be held")
+	}
+	if !r.process(callPacket("failed", "", 503), now.Add(time.Second)) {
+		t.Fatal("Expected the 503 to pass")
+	}
+	if len(*released) != 2 || (*released)[0].SIP.Method != "INVITE" {
+		t.Fatalf("Expected the held INVITE and 100 in order, got %d packets", len(*released))
+	}
+	if !r.process(callPacket("failed", "ACK", 0), now.Add(2*time.Second)) {
+		t.Error("Expected later packets of a kept call to pass")
+	}
+	if !r.process(&protocol.HEPPacket{}, now) {
+		t.Error("Expected packets without a CID to pass")
+	}
+}
+
+func TestRetentionDiscardsAfterWindow(t *testing.T) {
+	r, released := newTestRetention(t, 0)
+	defer r.Close()
+
+	now := time.Now()
+	r.process(callPacket("ok", "INVITE", 0), now)
+	r.process(callPacket("ok", "", 200), now.Add(time.Second))
+
+	if packets := r.expire(now.Add(10*time.Second), false); len(packets) != 0 {
+		t.Fatalf("Expected the call to be held within the window, got %d", len(packets))
+	}
+	if packets := r.expire(now.Add(31*time.Second), false); len(packets) != 0 {
+		t.Fatalf("Expected the unmatched call to be discarded, got %d", len(packets))
+	}
+	if r.process(callPacket("ok", "BYE", 0), now.Add(40*time.Second)) {
+		t.Error("Expected later packets of a discarded call to be dropped")
+	}
+	if !r.process(callPacket("ok", "", 500), now.Add(41*time.Second)) {
+		t.Error("Expected a matching packet of a discarded call to pass")
+	}
+
+	r.expire(now.Add(5*time.Minute), false)
+	if len(r.calls) != 0 || r.held != 0 {
+		t.Errorf("Expected the decision to be forgotten, got %d calls and %d held", len(r.calls), r.held)
+	}
+	if len(*released) != 0 {
+		t.Errorf("Expected nothing released, got %d", len(*released))
+	}
+}
+
+func TestRetentionSample(t *testing.T) {
+	r, _ := newTestRetention(t, 10)
+	defer r.Close()
+
+	now := time.Now()
+	for i := 0; i < 1000; i++ {
+		cid := fmt.Sprintf("call-%d", i)
+		r.process(callPacket(cid, "INVITE", 0), now)
+		r.process(callPacket(cid, "", 200), now)
+	}
+	calls := map[string]int{}
+	for _, p := range r.expire(now.Add(time.Minute), false) {
+		calls[p.CID]++
+	}
+	if len(calls) < 50 || len(calls) > 150 {
+		t.Errorf("Expected about 100 of 1000 calls sampled, got %d", len(calls))
+	}
+	for cid, n := range calls {
+		if n != 2 {
+			t.Errorf("Expected complete call %s, got %d packets", cid, n)
+		}
+	}
+}
+
+func TestRetentionMaxCalls(t *testing.T) {
+	r, _ := newTestRetention(t, 0)
+	r.config.MaxCalls = 1
+	defer r.Close()
+
+	now := time.Now()
+	if r.process(callPacket("first", "INVITE", 0), now) {
+		t.Fatal("Expected the first call to be held")
+	}
+	if !r.process(callPacket("second", "INVITE", 0), now) {
+		t.Error("Expected calls beyond the limit to pass")
+	}
+}
+
+func TestRetentionCloseReleasesSampled(t *testing.T) {
+	r, released := newTestRetention(t, 1)
+
+	r.process(callPacket("open", "INVITE", 0), time.Now())
+	r.Close()
+	if len(*released) != 1 {
+		t.Errorf("Expected the held call to be released on close, got %d", len(*released))
+	}
+}
@@ -0,0 +1,337 @@
+package registrar
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+// pendingTimeout matches SIP timer F, after which a REGISTER transaction
+// without a response is dropped
+const pendingTimeout = 32 * time.Second
+
+type Config struct {
+	// HistorySize is the number of failures kept per AOR
+	HistorySize int
+	// FailureRetention is how long an AOR without bindings is kept for
+	// its failure history
+	FailureRetention time.Duration
+}
+
+// Registration is the current state of an address of record
+type Registration struct {
+	AOR              string     `json:"aor"`
+	Contacts         []*Binding `json:"contacts"`
+	LastResponseCode int        `json:"last_response_code"`
+	LastUpdate       time.Time  `json:"last_update"`
+	Failures         []Failure  `json:"failures,omitempty"`
+}
+
+// Binding is a contact registered for an AOR
+type Binding struct {
+	Contact      string    `json:"contact"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+	SrcIP        string    `json:"src_ip"`
+	SrcPort      uint16    `json:"src_port"`
+	NodeID       uint32    `json:"node_id"`
+	RegisteredAt time.Time `json:"registered_at"`
+}
+
+// Failure is a REGISTER that was rejected by the registrar
+type Failure struct {
+	Time      time.Time `json:"time"`
+	Code      int       `json:"code"`
+	Reason    string    `json:"reason"`
+	SrcIP     string    `json:"src_ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// Store keeps AOR -> contact bindings built from observed REGISTER
+// transactions
+type Store struct {
+	config        Config
+	registrations map[string]*Registration
+	pending       map[string]*pendingRegister
+	mask          func(reg *Registration)
+	mu            sync.RWMutex
+	done          chan struct{}
+}
+
+type pendingRegister struct {
+	aor      string
+	packet   *protocol.HEPPacket
+	received time.Time
+}
+
+func NewStore(config Config) *Store {
+	s := &Store{
+		config:        config,
+		registrations: make(map[string]*Registration),
+		pending:       make(map[string]*pendingRegister),
+		done:          make(chan struct{}),
+	}
+	go s.cleanupLoop()
+	return s
+}
+
+// SetMask sets a function applied to the registrations returned by
+// Search, e.g. to mask personal data. It must be called before the store
+// is used.
+func (s *Store) SetMask(mask func(reg *Registration)) {
+	s.mask = mask
+}
+
+// Observe records REGISTER requests and applies their final responses
+func (s *Store) Observe(packet *protocol.HEPPacket) {
+	msg := packet.SIP
+	if msg == nil {
+		return
+	}
+
+	key := msg.CallID + "|" + strconv.FormatUint(uint64(msg.CSeq), 10)
+
+	if msg.IsRequest() {
+		if msg.Method != "REGISTER" {
+			return
+		}
+		s.mu.Lock()
+		s.pending[key] = &pendingRegister{
+			aor:      NormalizeAOR(msg.To.URI),
+			packet:   packet,
+			received: time.Now(),
+		}
+		s.mu.Unlock()
+		return
+	}
+
+	if msg.CSeqMethod != "REGISTER" || msg.StatusCode < 200 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req, ok := s.pending[key]
+	if !ok {
+		return
+	}
+	delete(s.pending, key)
+
+	reg, ok := s.registrations[req.aor]
+	if !ok {
+		reg = &Registration{AOR: req.aor}
+		s.registrations[req.aor] = reg
+	}
+	reg.LastResponseCode = msg.StatusCode
+	reg.LastUpdate = packet.Time()
+
+	if msg.StatusCode >= 300 {
+		// Digest challenges are part of every successful registration
+		if msg.StatusCode != 401 && msg.StatusCode != 407 {
+			s.addFailure(reg, req.packet, msg)
+		}
+		return
+	}
+
+	s.applyBindings(reg, req.packet, packet)
+}
+
+// applyBindings updates the contacts of an AOR from a 2xx response. The
+// registrar returns all current bindings, so the response contacts are
+// preferred over the request contacts.
+func (s *Store) applyBindings(reg *Registration, request, response *protocol.HEPPacket) {
+	now := response.Time()
+	req := request.SIP
+
+	contacts := response.SIP.HeaderValues("contact")
+	defaultExpires := response.SIP.Header("expires")
+	if len(contacts) == 0 {
+		contacts = req.HeaderValues("contact")
+		defaultExpires = req.Header("expires")
+	}
+	if defaultExpires == "" {
+		defaultExpires = req.Header("expires")
+	}
+
+	var bindings []*Binding
+	for _, header := range contacts {
+		for _, contact := range protocol.SplitSIPHeaderList(header) {
+			if contact == "*" {
+				// Wildcard de-registration of all contacts
+				reg.Contacts = nil
+				return
+			}
+
+			expires, ok := protocol.SIPHeaderParam(contact, "expires")
+			if !ok {
+				expires = defaultExpires
+			}
+			seconds, err := strconv.Atoi(expires)
+			if err != nil {
+				seconds = 3600
+			}
+
+			uri := protocol.ParseSIPAddress(contact).URI
+			if seconds <= 0 {
+				reg.Contacts = removeBinding(reg.Contacts, uri)
+				continue
+			}
+
+			bindings = append(bindings, &Binding{
+				Contact:      uri,
+				ExpiresAt:    now.Add(time.Duration(seconds) * time.Second),
+				UserAgent:    req.UserAgent,
+				SrcIP:        request.SrcIP,
+				SrcPort:      request.SrcPort,
+				NodeID:       request.NodeID,
+				RegisteredAt: now,
+			})
+		}
+	}
+
+	for _, b := range bindings {
+		reg.Contacts = append(removeBinding(reg.Contacts, b.Contact), b)
+	}
+}
+
+func (s *Store) addFailure(reg *Registration, request *protocol.HEPPacket, msg *protocol.SIPMessage) {
+	reg.Failures = append(reg.Failures, Failure{
+		Time:      request.Time(),
+		Code:      msg.StatusCode,
+		Reason:    msg.Reason,
+		SrcIP:     request.SrcIP,
+		UserAgent: request.SIP.UserAgent,
+	})
+	if len(reg.Failures) > s.config.HistorySize {
+		reg.Failures = reg.Failures[len(reg.Failures)-s.config.HistorySize:]
+	}
+}
+
+func removeBinding(bindings []*Binding, contact string) []*Binding {
+	out := bindings[:0]
+	for _, b := range bindings {
+		if b.Contact != contact {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// Search returns the registrations whose AOR contains query, sorted by AOR.
+// The query is matched against the AOR after the mask is applied.
+func (s *Store) Search(query string, onlyFailed bool, limit int) []Registration {
+	query = strings.ToLower(query)
+	now := time.Now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var results []Registration
+	for _, reg := range s.registrations {
+		if onlyFailed && len(reg.Failures) == 0 {
+			continue
+		}
+
+		r := *reg
+		r.Contacts = nil
+		for _, b := range reg.Contacts {
+			if b.ExpiresAt.After(now) {
+				r.Contacts = append(r.Contacts, b)
+			}
+		}
+		r.Failures = append([]Failure(nil), reg.Failures...)
+		if s.mask != nil {
+			s.mask(&r)
+		}
+		if query != "" && !strings.Contains(strings.ToLower(r.AOR), query) {
+			continue
+		}
+		results = append(results, r)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].AOR < results[j].AOR
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+func (s *Store) cleanupLoop() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.cleanup(now)
+		}
+	}
+}
+
+// cleanup drops expired bindings, unanswered transactions and AORs that
+// have nothing left worth showing
+func (s *Store) cleanup(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, req := range s.pending {
+		if now.Sub(req.received) > pendingTimeout {
+			delete(s.pending, key)
+		}
+	}
+
+	for aor, reg := range s.registrations {
+		contacts := reg.Contacts[:0]
+		for _, b := range reg.Contacts {
+			if b.ExpiresAt.After(now) {
+				contacts = append(contacts, b)
+			}
+		}
+		reg.Contacts = contacts
+
+		if len(reg.Contacts) == 0 && now.Sub(reg.LastUpdate) > s.config.FailureRetention {
+			delete(s.registrations, aor)
+		}
+	}
+}
+
+func (s *Store) Close() error {
+	close(s.done)
+	return nil
+}
+
+// NormalizeAOR strips URI parameters and the port and lower-cases the host,
+// so that sip:Alice@Example.com:5060;transport=tcp becomes
+// sip:Alice@example.com
+func NormalizeAOR(uri string) string {
+	if end := strings.IndexAny(uri, ";?"); end >= 0 {
+		uri = uri[:end]
+	}
+
+	scheme, rest, found := strings.Cut(uri, ":")
+	if !found {
+		scheme, rest = "sip", uri
+	}
+	user, host, found := strings.Cut(rest, "@")
+	if !found {
+		host, user = user, ""
+	}
+	if colon := strings.LastIndexByte(host, ':'); colon >= 0 && !strings.HasSuffix(host, "]") {
+		host = host[:colon]
+	}
+
+	aor := strings.ToLower(scheme) + ":"
+	if user != "" {
+		aor += user + "@"
+	}
+	return aor + strings.ToLower(host)
+}
@@ -0,0 +1,146 @@
+package registrar
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+func registerPacket(t *testing.T, ts time.Time, payload string) *protocol.HEPPacket {
+	t.Helper()
+	msg, err := protocol.DecodeSIP([]byte(payload))
+	if err != nil {
+		t.Fatalf("Failed to build SIP packet: %v", err)
+	}
+	return &protocol.HEPPacket{
+		SrcIP:     "192.0.2.10",
+		SrcPort:   5062,
+		DstIP:     "10.0.0.1",
+		DstPort:   5060,
+		NodeID:    7,
+		Timestamp: uint64(ts.Unix()),
+		ProtoType: protocol.ProtoTypeSIP,
+		SIP:       msg,
+	}
+}
+
+func register(cseq, contact, extra string) string {
+	return "REGISTER sip:example.com SIP/2.0\r\n" +
+		"From: <sip:alice@example.com>;tag=1\r\n" +
+		"To: <sip:alice@Example.com:5060>\r\n" +
+		"Call-ID: reg-1\r\n" +
+		"CSeq: " + cseq + " REGISTER\r\n" +
+		"Contact: " + contact + "\r\n" +
+		"User-Agent: Yealink T46\r\n" +
+		extra +
+		"\r\n"
+}
+
+func response(cseq, status, extra string) string {
+	return "SIP/2.0 " + status + "\r\n" +
+		"From: <sip:alice@example.com>;tag=1\r\n" +
+		"To: <sip:alice@Example.com:5060>;tag=2\r\n" +
+		"Call-ID: reg-1\r\n" +
+		"CSeq: " + cseq + " REGISTER\r\n" +
+		extra +
+		"\r\n"
+}
+
+func newTestStore() *Store {
+	return NewStore(Config{HistorySize: 2, FailureRetention: time.Hour})
+}
+
+func TestStoreRegistration(t *testing.T) {
+	s := newTestStore()
+	defer s.Close()
+	now := time.Now()
+
+	s.Observe(registerPacket(t, now, register("1", "<sip:alice@192.0.2.10:5062>", "Expires: 600\r\n")))
+	s.Observe(registerPacket(t, now, response("1", "401 Unauthorized", "")))
+	s.Observe(registerPacket(t, now, register("2", "<sip:alice@192.0.2.10:5062>", "Expires: 600\r\n")))
+	s.Observe(registerPacket(t, now, response("2", "200 OK",
+		"Contact: <sip:alice@192.0.2.10:5062>;expires=300, <sip:alice@198.51.100.1:5060>;expires=120\r\n")))
+
+	results := s.Search("alice", false, 10)
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 registration, got %d", len(results))
+	}
+	reg := results[0]
+
+	if reg.AOR != "sip:alice@example.com" {
+		t.Errorf("Expected normalized AOR sip:alice@example.com, got %s", reg.AOR)
+	}
+	if reg.LastResponseCode != 200 {
+		t.Errorf("Expected last response 200, got %d", reg.LastResponseCode)
+	}
+	if len(reg.Failures) != 0 {
+		t.Errorf("Expected digest challenge not to be recorded as failure, got %+v", reg.Failures)
+	}
+	if len(reg.Contacts) != 2 {
+		t.Fatalf("Expected 2 contacts from the response, got %d", len(reg.Contacts))
+	}
+
+	b := reg.Contacts[0]
+	if b.Contact != "sip:alice@192.0.2.10:5062" || b.UserAgent != "Yealink T46" || b.SrcIP != "192.0.2.10" {
+		t.Errorf("Unexpected binding %+v", b)
+	}
+	if got := b.ExpiresAt.Sub(b.RegisteredAt); got != 300*time.Second {
+		t.Errorf("Expected contact expires param to win, got %v", got)
+	}
+
+	// De-registration of one contact
+	s.Observe(registerPacket(t, now, register("3", "<sip:alice@198.51.100.1:5060>;expires=0", "")))
+	s.Observe(registerPacket(t, now, response("3", "200 OK", "")))
+
+	if reg := s.Search("ALICE", false, 10)[0]; len(reg.Contacts) != 1 {
+		t.Errorf("Expected 1 contact after de-registration, got %d", len(reg.Contacts))
+	}
+}
+
+func TestStoreFailures(t *testing.T) {
+	s := newTestStore()
+	defer s.Close()
+	now := time.Now()
+
+	for i, cseq := range []string{"1", "2", "3"} {
+		s.Observe(registerPacket(t, now.Add(time.Duration(i)*time.Second), register(cseq, "<sip:alice@192.0.2.10>", "")))
+		s.Observe(registerPacket(t, now, response(cseq, "403 Forbidden", "")))
+	}
+	// A response without a matching request is ignored
+	s.Observe(registerPacket(t, now, response("9", "503 Service Unavailable", "")))
+
+	results := s.Search("", true, 10)
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 failed registration, got %d", len(results))
+	}
+	reg := results[0]
+	if reg.LastResponseCode != 403 || len(reg.Contacts) != 0 {
+		t.Errorf("Unexpected registration state %+v", reg)
+	}
+	if len(reg.Failures) != 2 {
+		t.Fatalf("Expected history to be capped at 2, got %d", len(reg.Failures))
+	}
+	if reg.Failures[1].Time.Unix() != now.Add(2*time.Second).Unix() {
+		t.Errorf("Expected newest failures to be kept, got %v", reg.Failures[1].Time)
+	}
+
+	s.cleanup(now.Add(2 * time.Hour))
+	if results := s.Search("", false, 10); len(results) != 0 {
+		t.Errorf("Expected AOR without bindings to be dropped after retention, got %d", len(results))
+	}
+}
+
+func TestNormalizeAOR(t *testing.T) {
+	tests := map[string]string{
+		"sip:Alice@Example.COM:5060;transport=tcp": "sip:Alice@example.com",
+		"sips:bob@[2001:db8::1]":                   "sips:bob@[2001:db8::1]",
+		"tel:+4930123":                             "tel:+4930123",
+		"carol@example.com":                        "sip:carol@example.com",
+	}
+	for uri, want := range tests {
+		if got := NormalizeAOR(uri); got != want {
+			t.Errorf("NormalizeAOR(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
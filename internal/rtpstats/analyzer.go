@@ -0,0 +1,373 @@
+package rtpstats
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sipcapture/hepop-go/internal/writer"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Sequence number tolerances from RFC 3550 appendix A.1
+	maxDropout  = 3000
+	maxMisorder = 100
+
+	// defaultClockRate is assumed for dynamic payload types without an
+	// rtpmap, most voice codecs use 8 kHz
+	defaultClockRate = 8000
+
+	// codecTimeout bounds how long the SDP payload types of a call are kept
+	codecTimeout = 4 * time.Hour
+)
+
+type Config struct {
+	// ReportInterval is how often a summary of each active stream is
+	// emitted
+	ReportInterval time.Duration
+	// StreamTimeout ends a stream that received no packets, a final
+	// summary is emitted
+	StreamTimeout time.Duration
+}
+
+// Analyzer computes loss, jitter and MOS estimates for RTP streams keyed by
+// SSRC and addresses. Streams are linked to calls by their CID, which the
+// decoder sets from the SDP media addresses when the agent did not.
+type Analyzer struct {
+	config  Config
+	writer  writer.RTPReportWriter
+	streams map[streamKey]*stream
+	calls   map[string]*callCodecs
+	mu      sync.Mutex
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+type streamKey struct {
+	ssrc    uint32
+	srcIP   string
+	srcPort uint16
+	dstIP   string
+	dstPort uint16
+}
+
+type callCodecs struct {
+	clockRates map[uint8]uint32
+	expires    time.Time
+}
+
+type stream struct {
+	report     writer.RTPReport
+	clockRates map[uint8]uint32
+
+	baseSeq       uint16
+	maxSeq        uint16
+	cycles        int64
+	expectedPrior int64
+
+	// Capture and RTP timestamp of the previous in-order packet for the
+	// interarrival jitter
+	lastArrival time.Time
+	lastRTPTime uint32
+	hasLast     bool
+	jitter      float64
+
+	lastSeen   time.Time
+	lastReport time.Time
+}
+
+func NewAnalyzer(config Config, w writer.RTPReportWriter) *Analyzer {
+	a := &Analyzer{
+		config:  config,
+		writer:  w,
+		streams: make(map[streamKey]*stream),
+		calls:   make(map[string]*callCodecs),
+		done:    make(chan struct{}),
+	}
+	a.wg.Add(1)
+	go a.reportLoop()
+	return a
+}
+
+// Observe updates the stream statistics with an RTP packet and learns the
+// payload types from SIP messages carrying SDP
+func (a *Analyzer) Observe(packet *protocol.HEPPacket) {
+	a.observe(packet, time.Now())
+}
+
+// observe applies a packet received at now. Jitter and the stream times
+// use the capture time of the packet, now only drives the report interval
+// and timeouts.
+func (a *Analyzer) observe(packet *protocol.HEPPacket, now time.Time) {
+	switch {
+	case packet.RTP != nil:
+		a.mu.Lock()
+		a.update(packet, now)
+		a.mu.Unlock()
+	case packet.SIP != nil && packet.SIP.SDP != nil:
+		a.mu.Lock()
+		a.learnCodecs(packet.CID, packet.SIP.SDP, now)
+		a.mu.Unlock()
+	}
+}
+
+func (a *Analyzer) update(packet *protocol.HEPPacket, now time.Time) {
+	hdr := packet.RTP
+	arrival := packet.Time()
+	key := streamKey{
+		ssrc:    hdr.SSRC,
+		srcIP:   packet.SrcIP,
+		srcPort: packet.SrcPort,
+		dstIP:   packet.DstIP,
+		dstPort: packet.DstPort,
+	}
+
+	s, ok := a.streams[key]
+	if !ok {
+		s = &stream{
+			report: writer.RTPReport{
+				SSRC:        hdr.SSRC,
+				NodeID:      packet.NodeID,
+				SrcIP:       packet.SrcIP,
+				SrcPort:     packet.SrcPort,
+				DstIP:       packet.DstIP,
+				DstPort:     packet.DstPort,
+				PayloadType: hdr.PayloadType,
+				StartTime:   arrival,
+			},
+			baseSeq:    hdr.Sequence,
+			maxSeq:     hdr.Sequence,
+			lastReport: now,
+		}
+		a.streams[key] = s
+	}
+
+	if s.report.CID == "" {
+		s.report.CID = packet.CID
+	}
+	if s.clockRates == nil {
+		if call, ok := a.calls[s.report.CID]; ok {
+			s.clockRates = call.clockRates
+		}
+	}
+
+	s.lastSeen = now
+	s.report.EndTime = arrival
+
+	// A copy of the last packet, e.g. from a second capture agent, is not
+	// received media and would hide a lost one
+	if ok && hdr.Sequence == s.maxSeq {
+		s.report.Duplicates++
+		return
+	}
+	s.report.Packets++
+
+	if hdr.PayloadType != s.report.PayloadType {
+		// Jitter is only comparable within one clock rate
+		s.report.PayloadTypeChanges++
+		s.report.PayloadType = hdr.PayloadType
+		s.hasLast = false
+	}
+
+	// The first packet only sets the base sequence number
+	if ok && !s.updateSequence(hdr.Sequence) {
+		return
+	}
+
+	if s.hasLast {
+		rate := float64(s.clockRate(hdr.PayloadType))
+		arrivalDelta := arrival.Sub(s.lastArrival).Seconds() * rate
+		rtpDelta := float64(int32(hdr.Timestamp - s.lastRTPTime))
+		d := math.Abs(arrivalDelta - rtpDelta)
+		s.jitter += (d - s.jitter) / 16
+
+		jitterMs := s.jitter / rate * 1000
+		if jitterMs > s.report.MaxJitterMs {
+			s.report.MaxJitterMs = jitterMs
+		}
+	}
+	s.lastArrival = arrival
+	s.lastRTPTime = hdr.Timestamp
+	s.hasLast = true
+}
+
+// updateSequence tracks the extended sequence number and reports whether
+// the packet advanced the stream
+func (s *stream) updateSequence(seq uint16) bool {
+	delta := seq - s.maxSeq
+	switch {
+	case delta < maxDropout:
+		if seq < s.maxSeq {
+			s.cycles += 1 << 16
+		}
+		if delta > 1 {
+			s.report.SequenceGaps++
+		}
+		s.maxSeq = seq
+		return true
+	case delta <= 1<<16-maxMisorder:
+		// Large jump, the sender restarted its sequence numbering
+		s.expectedPrior = s.expected()
+		s.baseSeq = seq
+		s.maxSeq = seq
+		s.cycles = 0
+		s.hasLast = false
+		return true
+	default:
+		s.report.OutOfOrder++
+		return false
+	}
+}
+
+func (s *stream) expected() int64 {
+	return s.expectedPrior + s.cycles + int64(s.maxSeq) - int64(s.baseSeq) + 1
+}
+
+func (s *stream) clockRate(payloadType uint8) uint32 {
+	if rate, ok := s.clockRates[payloadType]; ok {
+		return rate
+	}
+	if rate := protocol.RTPClockRate(payloadType); rate != 0 {
+		return rate
+	}
+	return defaultClockRate
+}
+
+// learnCodecs records the clock rates of the dynamic payload types
+// announced for a call
+func (a *Analyzer) learnCodecs(cid string, sdp *protocol.SDPSession, now time.Time) {
+	if cid == "" {
+		return
+	}
+
+	entry, ok := a.calls[cid]
+	if !ok {
+		entry = &callCodecs{clockRates: make(map[uint8]uint32)}
+		a.calls[cid] = entry
+	}
+	entry.expires = now.Add(codecTimeout)
+	for _, media := range sdp.Media {
+		for _, codec := range media.Codecs {
+			if codec.ClockRate != 0 {
+				entry.clockRates[codec.PayloadType] = codec.ClockRate
+			}
+		}
+	}
+}
+
+// finish builds the summary of a stream up to now
+func (s *stream) finish(final bool) *writer.RTPReport {
+	report := s.report
+	report.Final = final
+	report.Expected = s.expected()
+	report.Lost = max(report.Expected-report.Packets, 0)
+	if report.Expected > 0 {
+		report.LossPercent = round2(float64(report.Lost) / float64(report.Expected) * 100)
+	}
+	report.JitterMs = round2(s.jitter / float64(s.clockRate(report.PayloadType)) * 1000)
+	report.MaxJitterMs = round2(report.MaxJitterMs)
+	report.RFactor = round2(rFactor(report.LossPercent, report.JitterMs))
+	report.MOS = round2(mos(report.RFactor))
+	return &report
+}
+
+// rFactor is a simplified ITU-T G.107 E-model. Network delay is not known
+// from one capture point, so the delay impairment only accounts for a
+// jitter buffer of twice the jitter plus a fixed processing delay.
+func rFactor(lossPercent, jitterMs float64) float64 {
+	latency := 2*jitterMs + 10
+
+	r := 93.2
+	if latency < 160 {
+		r -= latency / 40
+	} else {
+		r -= (latency - 120) / 10
+	}
+	r -= 2.5 * lossPercent
+	return math.Max(0, math.Min(100, r))
+}
+
+// mos converts an R-factor to an estimated MOS as in ITU-T G.107 annex B
+func mos(r float64) float64 {
+	switch {
+	case r <= 0:
+		return 1
+	case r >= 100:
+		return 4.5
+	}
+	return 1 + 0.035*r + 7e-6*r*(r-60)*(100-r)
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+func (a *Analyzer) emit(report *writer.RTPReport) {
+	if err := a.writer.WriteRTPReport(report); err != nil {
+		logrus.Errorf("RTP report write error for SSRC %08x: %v", report.SSRC, err)
+	}
+}
+
+func (a *Analyzer) reportLoop() {
+	defer a.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case now := <-ticker.C:
+			for _, report := range a.tick(now) {
+				a.emit(report)
+			}
+		}
+	}
+}
+
+// tick ends idle streams, emits periodic summaries of active ones and drops
+// expired call payload types
+func (a *Analyzer) tick(now time.Time) []*writer.RTPReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var reports []*writer.RTPReport
+	for key, s := range a.streams {
+		switch {
+		case now.Sub(s.lastSeen) > a.config.StreamTimeout:
+			reports = append(reports, s.finish(true))
+			delete(a.streams, key)
+		case now.Sub(s.lastReport) >= a.config.ReportInterval:
+			reports = append(reports, s.finish(false))
+			s.lastReport = now
+		}
+	}
+
+	for cid, call := range a.calls {
+		if now.After(call.expires) {
+			delete(a.calls, cid)
+		}
+	}
+	return reports
+}
+
+// Close stops the analyzer and emits final summaries for active streams
+func (a *Analyzer) Close() error {
+	close(a.done)
+	a.wg.Wait()
+
+	a.mu.Lock()
+	var reports []*writer.RTPReport
+	for key, s := range a.streams {
+		reports = append(reports, s.finish(true))
+		delete(a.streams, key)
+	}
+	a.mu.Unlock()
+
+	for _, report := range reports {
+		a.emit(report)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package rtpstats
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sipcapture/hepop-go/internal/writer"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+type mockReportWriter struct {
+	mu      sync.Mutex
+	reports []*writer.RTPReport
+}
+
+func (w *mockReportWriter) WriteRTPReport(report *writer.RTPReport) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.reports = append(w.reports, report)
+	return nil
+}
+
+func newTestAnalyzer() *Analyzer {
+	return NewAnalyzer(Config{ReportInterval: 10 * time.Second, StreamTimeout: 30 * time.Second}, &mockReportWriter{})
+}
+
+func rtpPacket(cid string, pt uint8, seq uint16, ts uint32) *protocol.HEPPacket {
+	return &protocol.HEPPacket{
+		SrcIP:     "192.0.2.10",
+		SrcPort:   40000,
+		DstIP:     "198.51.100.20",
+		DstPort:   50000,
+		ProtoType: protocol.ProtoTypeRTP,
+		CID:       cid,
+		RTP: &protocol.RTPHeader{
+			PayloadType: pt,
+			Sequence:    seq,
+			Timestamp:   ts,
+			SSRC:        0x1234,
+		},
+	}
+}
+
+// observeAt observes a packet captured and received at t
+func observeAt(a *Analyzer, packet *protocol.HEPPacket, t time.Time) {
+	packet.Timestamp = uint64(t.Unix())
+	packet.TimestampUsec = uint32(t.Nanosecond() / 1000)
+	a.observe(packet, t)
+}
+
+// onlyStream returns the summary of the single tracked stream
+func onlyStream(t *testing.T, a *Analyzer, final bool) *writer.RTPReport {
+	t.Helper()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.streams) != 1 {
+		t.Fatalf("Expected 1 stream, got %d", len(a.streams))
+	}
+	for _, s := range a.streams {
+		return s.finish(final)
+	}
+	return nil
+}
+
+func TestAnalyzerCleanStream(t *testing.T) {
+	a := newTestAnalyzer()
+	defer a.Close()
+
+	start := time.Unix(1000, 0)
+	for i := 0; i < 100; i++ {
+		arrival := start.Add(time.Duration(i) * 20 * time.Millisecond)
+		observeAt(a, rtpPacket("call-1", 0, uint16(65500+i), uint32(i*160)), arrival)
+	}
+
+	report := onlyStream(t, a, true)
+	if report.Packets != 100 || report.Expected != 100 || report.Lost != 0 {
+		t.Errorf("Expected 100/100 packets without loss, got %+v", report)
+	}
+	if report.JitterMs != 0 || report.SequenceGaps != 0 {
+		t.Errorf("Expected no jitter or gaps, got %+v", report)
+	}
+	if report.MOS < 4.3 {
+		t.Errorf("Expected a MOS above 4.3 for a clean stream, got %v", report.MOS)
+	}
+	if report.CID != "call-1" || !report.Final {
+		t.Errorf("Unexpected identity: %+v", report)
+	}
+}
+
+func TestAnalyzerLossAndReorder(t *testing.T) {
+	a := newTestAnalyzer()
+	defer a.Close()
+
+	start := time.Unix(1000, 0)
+	seqs := []uint16{1, 2, 3, 6, 5, 7, 8, 8, 9, 10}
+	for i, seq := range seqs {
+		arrival := start.Add(time.Duration(i) * 20 * time.Millisecond)
+		observeAt(a, rtpPacket("call-1", 8, seq, uint32(seq)*160), arrival)
+	}
+
+	report := onlyStream(t, a, false)
+	// 4 was lost, 5 arrived late and 8 was duplicated
+	if report.Expected != 10 || report.Packets != 9 || report.Lost != 1 {
+		t.Errorf("Expected 9 packets of 10 and 1 lost, got %d of %d and %d lost", report.Packets, report.Expected, report.Lost)
+	}
+	if report.SequenceGaps != 1 || report.OutOfOrder != 1 || report.Duplicates != 1 {
+		t.Errorf("Expected 1 gap, 1 out of order and 1 duplicate, got %d, %d and %d",
+			report.SequenceGaps, report.OutOfOrder, report.Duplicates)
+	}
+}
+
+func TestAnalyzerJitter(t *testing.T) {
+	a := newTestAnalyzer()
+	defer a.Close()
+
+	// Packets alternate between arriving 5ms early and 5ms late
+	start := time.Unix(1000, 0)
+	for i := 0; i < 500; i++ {
+		offset := 5 * time.Millisecond
+		if i%2 == 0 {
+			offset = -offset
+		}
+		arrival := start.Add(time.Duration(i)*20*time.Millisecond + offset)
+		observeAt(a, rtpPacket("", 0, uint16(i), uint32(i*160)), arrival)
+	}
+
+	// Every transit difference is 10ms, so the estimate converges there
+	report := onlyStream(t, a, false)
+	if math.Abs(report.JitterMs-10) > 0.1 {
+		t.Errorf("Expected jitter of 10ms, got %v", report.JitterMs)
+	}
+	if report.MOS >= 4.4 || report.MOS < 4 {
+		t.Errorf("Expected a slightly degraded MOS, got %v", report.MOS)
+	}
+}
+
+func TestAnalyzerCaptureTime(t *testing.T) {
+	a := newTestAnalyzer()
+	defer a.Close()
+
+	// Packets captured every 20ms but received in bursts, e.g. replayed
+	// from a queue, have no jitter
+	start := time.Unix(1000, 0)
+	for i := 0; i < 100; i++ {
+		packet := rtpPacket("", 0, uint16(i), uint32(i*160))
+		captured := start.Add(time.Duration(i) * 20 * time.Millisecond)
+		packet.Timestamp = uint64(captured.Unix())
+		packet.TimestampUsec = uint32(captured.Nanosecond() / 1000)
+		a.observe(packet, start.Add(time.Duration(i/10)*time.Second))
+	}
+
+	report := onlyStream(t, a, false)
+	if report.JitterMs != 0 || report.MaxJitterMs != 0 {
+		t.Errorf("Expected no jitter, got %v max %v", report.JitterMs, report.MaxJitterMs)
+	}
+	if !report.StartTime.Equal(start) || !report.EndTime.Equal(start.Add(99*20*time.Millisecond)) {
+		t.Errorf("Expected capture times, got %v - %v", report.StartTime, report.EndTime)
+	}
+}
+
+func TestAnalyzerPayloadTypeChange(t *testing.T) {
+	a := newTestAnalyzer()
+	defer a.Close()
+
+	start := time.Unix(1000, 0)
+	for i, pt := range []uint8{0, 0, 101, 101, 0} {
+		observeAt(a, rtpPacket("", pt, uint16(i), uint32(i*160)), start.Add(time.Duration(i)*20*time.Millisecond))
+	}
+
+	report := onlyStream(t, a, false)
+	if report.PayloadTypeChanges != 2 || report.PayloadType != 0 {
+		t.Errorf("Expected 2 payload type changes ending on PT 0, got %+v", report)
+	}
+}
+
+func TestAnalyzerSDPClockRate(t *testing.T) {
+	a := newTestAnalyzer()
+	defer a.Close()
+
+	sdp, err := protocol.DecodeSDP([]byte("v=0\r\n" +
+		"c=IN IP4 198.51.100.20\r\n" +
+		"m=audio 50000 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 opus/48000/2\r\n"))
+	if err != nil {
+		t.Fatalf("DecodeSDP failed: %v", err)
+	}
+	now := time.Unix(1000, 0)
+	a.observe(&protocol.HEPPacket{
+		ProtoType: protocol.ProtoTypeSIP,
+		CID:       "call-42",
+		SIP:       &protocol.SIPMessage{Method: "INVITE", SDP: sdp},
+	}, now)
+
+	observeAt(a, rtpPacket("call-42", 96, 1, 0), now)
+	observeAt(a, rtpPacket("call-42", 96, 2, 960), now.Add(20*time.Millisecond))
+
+	onlyStream(t, a, false)
+	a.mu.Lock()
+	for _, s := range a.streams {
+		if s.clockRate(96) != 48000 {
+			t.Errorf("Expected 48 kHz from rtpmap, got %d", s.clockRate(96))
+		}
+	}
+	a.mu.Unlock()
+}
+
+func TestAnalyzerTick(t *testing.T) {
+	a := newTestAnalyzer()
+	defer a.Close()
+
+	start := time.Unix(1000, 0)
+	observeAt(a, rtpPacket("call-1", 0, 1, 0), start)
+	observeAt(a, rtpPacket("call-1", 0, 2, 160), start.Add(20*time.Millisecond))
+
+	if reports := a.tick(start.Add(5 * time.Second)); len(reports) != 0 {
+		t.Fatalf("Expected no report before the interval, got %d", len(reports))
+	}
+	reports := a.tick(start.Add(11 * time.Second))
+	if len(reports) != 1 || reports[0].Final {
+		t.Fatalf("Expected 1 periodic report, got %+v", reports)
+	}
+	reports = a.tick(start.Add(time.Minute))
+	if len(reports) != 1 || !reports[0].Final {
+		t.Fatalf("Expected 1 final report, got %+v", reports)
+	}
+	if len(a.streams) != 0 {
+		t.Errorf("Expected the stream to be removed, got %d", len(a.streams))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"net"
 	"sync"
 
+	"github.com/sipcapture/hepop-go/internal/decoder"
 	"github.com/sipcapture/hepop-go/internal/writer"
 	"github.com/sipcapture/hepop-go/pkg/protocol"
 	"github.com/sirupsen/logrus"
@@ -12,6 +13,11 @@ import (
 type HEPServer struct {
 	config      *Config
 	writer      writer.Writer
+	decoder     *decoder.Decoder
+	observers   []Observer
+	stages      []Stage
+	denyList    DenyList
+	input       Input
 	udpConn     *net.UDPConn
 	tcpListener net.Listener
 	wg          sync.WaitGroup
@@ -23,15 +29,83 @@ type Config struct {
 	Port int
 }
 
+// Observer receives every decoded packet before it is written, e.g. to
+// follow SIP dialogs
+type Observer interface {
+	Observe(packet *protocol.HEPPacket)
+}
+
+// Stage transforms packets after the observers have seen them and before
+// they are written. Returning false drops the packet. Observers see every
+// packet a stage such as dedup drops.
+type Stage interface {
+	Process(packet *protocol.HEPPacket) bool
+}
+
+// DenyList rejects packets by their source IP before they are decoded
+type DenyList interface {
+	Denied(ip string) bool
+}
+
+// AsyncStage is a stage that may hold packets, e.g. to merge duplicates,
+// and release them later. Released packets continue with the following
+// stages and the writer.
+type AsyncStage interface {
+	Stage
+	SetRelease(release func(packet *protocol.HEPPacket))
+}
+
+// Input replaces the UDP and TCP listeners as the packet source, e.g. to
+// consume the packets a collector instance published on a message bus.
+// Start must not block, handle may be called concurrently.
+type Input interface {
+	Start(handle func(packet *protocol.HEPPacket)) error
+	Stop() error
+}
+
 func NewHEPServer(config *Config, writer writer.Writer) *HEPServer {
 	return &HEPServer{
-		config: config,
-		writer: writer,
-		done:   make(chan struct{}),
+		config:  config,
+		writer:  writer,
+		decoder: decoder.NewDecoder(),
+		done:    make(chan struct{}),
 	}
 }
 
+// AddObserver registers an observer, it must be called before Start
+func (s *HEPServer) AddObserver(o Observer) {
+	s.observers = append(s.observers, o)
+}
+
+// AddStage appends a stage to the write path, it must be called before
+// Start. Stages run in the order they were added.
+func (s *HEPServer) AddStage(st Stage) {
+	next := len(s.stages) + 1
+	if async, ok := st.(AsyncStage); ok {
+		async.SetRelease(func(packet *protocol.HEPPacket) {
+			s.write(packet, next)
+		})
+	}
+	s.stages = append(s.stages, st)
+}
+
+// SetDenyList drops packets from denied sources at ingress, it must be
+// called before Start
+func (s *HEPServer) SetDenyList(list DenyList) {
+	s.denyList = list
+}
+
+// SetInput makes the server read packets from input instead of listening
+// for HEP, it must be called before Start
+func (s *HEPServer) SetInput(input Input) {
+	s.input = input
+}
+
 func (s *HEPServer) Start() error {
+	if s.input != nil {
+		return s.input.Start(s.process)
+	}
+
 	// Start UDP server
 	udpAddr := net.UDPAddr{
 		Port: s.config.Port,
@@ -67,6 +141,9 @@ func (s *HEPServer) Start() error {
 
 func (s *HEPServer) Stop() error {
 	close(s.done)
+	if s.input != nil {
+		return s.input.Stop()
+	}
 	if s.udpConn != nil {
 		s.udpConn.Close()
 	}
@@ -145,8 +222,36 @@ func (s *HEPServer) processHEP(packet []byte, addr string) {
 		logrus.Error("HEP decode error:", err)
 		return
 	}
+	s.process(hep)
+}
+
+// process runs a HEP packet through the deny list, the payload decoder,
+// the observers and the write path
+func (s *HEPServer) process(hep *protocol.HEPPacket) {
+	if s.denyList != nil && s.denyList.Denied(hep.SrcIP) {
+		return
+	}
+
+	if err := s.decoder.Decode(hep); err != nil {
+		logrus.Debugf("Payload decode error for proto type %d: %v", hep.ProtoType, err)
+	}
+
+	for _, o := range s.observers {
+		o.Observe(hep)
+	}
+
+	s.write(hep, 0)
+}
+
+// write runs the stages starting at index from and writes the packet
+func (s *HEPServer) write(packet *protocol.HEPPacket, from int) {
+	for _, st := range s.stages[from:] {
+		if !st.Process(packet) {
+			return
+		}
+	}
 
-	if err := s.writer.Write(hep); err != nil {
+	if err := s.writer.Write(packet); err != nil {
 		logrus.Error("Writer error:", err)
 	}
 }
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sipcapture/hepop-go/internal/pipeline"
+	"github.com/sipcapture/hepop-go/internal/registrar"
+	"github.com/sipcapture/hepop-go/internal/writer"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+type mockWriter struct {
+	mu      sync.Mutex
+	packets []*protocol.HEPPacket
+}
+
+func (w *mockWriter) Write(packet *protocol.HEPPacket) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.packets = append(w.packets, packet)
+	return nil
+}
+
+func (w *mockWriter) Search(ctx context.Context, params writer.SearchParams) (writer.SearchResult, error) {
+	return writer.SearchResult{}, writer.ErrSearchNotSupported
+}
+
+func (w *mockWriter) Close() error { return nil }
+
+func (w *mockWriter) Stats() writer.WriterStats { return writer.WriterStats{} }
+
+func (w *mockWriter) written() []*protocol.HEPPacket {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]*protocol.HEPPacket(nil), w.packets...)
+}
+
+type observerFunc func(packet *protocol.HEPPacket)
+
+func (f observerFunc) Observe(packet *protocol.HEPPacket) { f(packet) }
+
+func sipPacket(payload string) *protocol.HEPPacket {
+	return &protocol.HEPPacket{
+		Protocol:  17,
+		SrcIP:     "192.0.2.10",
+		SrcPort:   5060,
+		DstIP:     "198.51.100.1",
+		DstPort:   5060,
+		Timestamp: uint64(time.Now().Unix()),
+		NodeID:    2001,
+		ProtoType: protocol.ProtoTypeSIP,
+		Payload:   []byte(payload),
+	}
+}
+
+const (
+	testRegister = "REGISTER sip:example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 192.0.2.10:5060;branch=z9hG4bK1\r\n" +
+		"From: <sip:alice@example.com>;tag=1\r\n" +
+		"To: <sip:alice@example.com>\r\n" +
+		"Call-ID: reg-1\r\n" +
+		"CSeq: 1 REGISTER\r\n" +
+		"Contact: <sip:alice@192.0.2.10:5060>\r\n" +
+		"Expires: 3600\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	testRegisterOK = "SIP/2.0 200 OK\r\n" +
+		"Via: SIP/2.0/UDP 192.0.2.10:5060;branch=z9hG4bK1\r\n" +
+		"From: <sip:alice@example.com>;tag=1\r\n" +
+		"To: <sip:alice@example.com>;tag=2\r\n" +
+		"Call-ID: reg-1\r\n" +
+		"CSeq: 1 REGISTER\r\n" +
+		"Contact: <sip:alice@192.0.2.10:5060>;expires=3600\r\n" +
+		"Content-Length: 0\r\n\r\n"
+)
+
+func TestMaskingWithRegistrar(t *testing.T) {
+	w := &mockWriter{}
+	s := NewHEPServer(&Config{}, w)
+
+	masker, err := pipeline.NewMasker([]pipeline.MaskProfile{
+		{Name: "all", Mode: pipeline.MaskHash, Key: "secret", Users: true, IPs: true},
+	})
+	if err != nil {
+		t.Fatalf("NewMasker failed: %v", err)
+	}
+	registrations := registrar.NewStore(registrar.Config{HistorySize: 5, FailureRetention: time.Hour})
+	defer registrations.Close()
+	registrations.SetMask(masker.MaskRegistration)
+
+	// The response is handled while the request is still on its way to
+	// the masker, as with concurrent listener goroutines
+	seen := make(chan struct{})
+	s.AddObserver(registrations)
+	s.AddObserver(observerFunc(func(packet *protocol.HEPPacket) {
+		if packet.SIP != nil && packet.SIP.Method == "REGISTER" {
+			close(seen)
+		}
+	}))
+	s.AddStage(masker)
+
+	register, ok := sipPacket(testRegister), sipPacket(testRegisterOK)
+	ok.SrcIP, ok.DstIP = register.DstIP, register.SrcIP
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-seen
+		s.process(ok)
+	}()
+	s.process(register)
+	wg.Wait()
+
+	if !strings.Contains(string(register.Payload), "alice") || register.SrcIP != "192.0.2.10" {
+		t.Error("Expected the observed packet to stay unmasked")
+	}
+	for _, packet := range w.written() {
+		if strings.Contains(string(packet.Payload), "alice") || packet.SrcIP == "192.0.2.10" || packet.DstIP == "192.0.2.10" {
+			t.Errorf("Expected written packets to be masked, got %s %s", packet.SrcIP, packet.Payload)
+		}
+	}
+	if n := len(w.written()); n != 2 {
+		t.Errorf("Expected 2 written packets, got %d", n)
+	}
+
+	regs := registrations.Search("", false, 0)
+	if len(regs) != 1 || len(regs[0].Contacts) != 1 {
+		t.Fatalf("Expected 1 registration with 1 contact, got %+v", regs)
+	}
+	if reg := regs[0]; strings.Contains(reg.AOR, "alice") || strings.Contains(reg.Contacts[0].Contact, "alice") ||
+		reg.Contacts[0].SrcIP == "192.0.2.10" {
+		t.Errorf("Expected a masked registration, got %s %s %s", reg.AOR, reg.Contacts[0].Contact, reg.Contacts[0].SrcIP)
+	}
+	if regs := registrations.Search("alice", false, 0); len(regs) != 0 {
+		t.Errorf("Expected no match on the unmasked AOR, got %d", len(regs))
+	}
+}
+
+type mockInput struct {
+	handle  func(packet *protocol.HEPPacket)
+	stopped bool
+}
+
+func (in *mockInput) Start(handle func(packet *protocol.HEPPacket)) error {
+	in.handle = handle
+	return nil
+}
+
+func (in *mockInput) Stop() error {
+	in.stopped = true
+	return nil
+}
+
+type denyFunc func(ip string) bool
+
+func (f denyFunc) Denied(ip string) bool { return f(ip) }
+
+// tagStage records the packets it processes and drops those from drop
+type tagStage struct {
+	name string
+	drop string
+	seen *[]string
+}
+
+func (st *tagStage) Process(packet *protocol.HEPPacket) bool {
+	*st.seen = append(*st.seen, st.name+":"+packet.CID)
+	return packet.SrcIP != st.drop
+}
+
+// holdStage holds every packet until it is released
+type holdStage struct {
+	held    []*protocol.HEPPacket
+	release func(packet *protocol.HEPPacket)
+}
+
+func (st *holdStage) Process(packet *protocol.HEPPacket) bool {
+	st.held = append(st.held, packet)
+	return false
+}
+
+func (st *holdStage) SetRelease(release func(packet *protocol.HEPPacket)) {
+	st.release = release
+}
+
+func TestInput(t *testing.T) {
+	w := &mockWriter{}
+	s := NewHEPServer(&Config{}, w)
+	in := &mockInput{}
+	s.SetInput(in)
+
+	var observed []*protocol.HEPPacket
+	s.AddObserver(observerFunc(func(packet *protocol.HEPPacket) {
+		observed = append(observed, packet)
+	}))
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if in.handle == nil {
+		t.Fatal("Expected the input to be started")
+	}
+	in.handle(sipPacket(testRegister))
+
+	if len(observed) != 1 || observed[0].SIP == nil || observed[0].SIP.Method != "REGISTER" {
+		t.Errorf("Expected the decoded packet to be observed, got %+v", observed)
+	}
+	if packets := w.written(); len(packets) != 1 || packets[0] != observed[0] {
+		t.Errorf("Expected the packet to be written, got %d", len(packets))
+	}
+
+	if err := s.Stop(); err != nil || !in.stopped {
+		t.Errorf("Expected the input to be stopped, got %v", err)
+	}
+}
+
+func TestProcess(t *testing.T) {
+	w := &mockWriter{}
+	s := NewHEPServer(&Config{}, w)
+	s.SetDenyList(denyFunc(func(ip string) bool { return ip == "203.0.113.7" }))
+
+	var observed, seen []string
+	s.AddObserver(observerFunc(func(packet *protocol.HEPPacket) {
+		observed = append(observed, packet.CID)
+	}))
+	s.AddStage(&tagStage{name: "first", drop: "192.0.2.99", seen: &seen})
+	s.AddStage(&tagStage{name: "second", seen: &seen})
+
+	denied, dropped, written := sipPacket(testRegister), sipPacket(testRegister), sipPacket(testRegister)
+	denied.SrcIP, denied.CID = "203.0.113.7", "denied"
+	dropped.SrcIP, dropped.CID = "192.0.2.99", "dropped"
+	written.CID = "written"
+	for _, packet := range []*protocol.HEPPacket{denied, dropped, written} {
+		s.process(packet)
+	}
+
+	// Denied packets are not decoded or observed, observers see the
+	// packets a stage drops
+	if denied.SIP != nil || strings.Join(observed, ",") != "dropped,written" {
+		t.Errorf("Unexpected observed packets: %v", observed)
+	}
+	if got := strings.Join(seen, ","); got != "first:dropped,first:written,second:written" {
+		t.Errorf("Unexpected stage order: %s", got)
+	}
+	if packets := w.written(); len(packets) != 1 || packets[0] != written {
+		t.Errorf("Expected only the last packet to be written, got %d", len(packets))
+	}
+}
+
+func TestAsyncStageRelease(t *testing.T) {
+	w := &mockWriter{}
+	s := NewHEPServer(&Config{}, w)
+
+	var seen []string
+	hold := &holdStage{}
+	s.AddStage(&tagStage{name: "before", seen: &seen})
+	s.AddStage(hold)
+	s.AddStage(&tagStage{name: "after", drop: "192.0.2.99", seen: &seen})
+
+	packet, dropped := sipPacket(testRegister), sipPacket(testRegister)
+	packet.CID = "held"
+	dropped.SrcIP, dropped.CID = "192.0.2.99", "dropped"
+	s.process(packet)
+	s.process(dropped)
+	if len(w.written()) != 0 || len(hold.held) != 2 {
+		t.Fatalf("Expected the stage to hold both packets, written %d", len(w.written()))
+	}
+
+	// Released packets continue after the holding stage
+	for _, p := range hold.held {
+		hold.release(p)
+	}
+	if got := strings.Join(seen, ","); got != "before:held,before:dropped,after:held,after:dropped" {
+		t.Errorf("Unexpected stage order: %s", got)
+	}
+	if packets := w.written(); len(packets) != 1 || packets[0] != packet {
+		t.Errorf("Expected the released packet to be written, got %d", len(packets))
+	}
+}
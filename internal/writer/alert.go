@@ -0,0 +1,24 @@
+package writer
+
+import "time"
+
+// Alert is raised by the fraud detectors
+type Alert struct {
+	Time     time.Time `json:"time"`
+	Detector string    `json:"detector"`
+	Message  string    `json:"message"`
+	Source   string    `json:"source,omitempty"`
+	Account  string    `json:"account,omitempty"`
+	// Number is the called number of international calls
+	Number    string  `json:"number,omitempty"`
+	Count     int     `json:"count,omitempty"`
+	WindowSec float64 `json:"window_sec,omitempty"`
+	NodeID    uint32  `json:"node_id"`
+	CID       string  `json:"cid,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"`
+}
+
+// AlertWriter is implemented by writers that deliver alerts
+type AlertWriter interface {
+	WriteAlert(alert *Alert) error
+}
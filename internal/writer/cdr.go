@@ -0,0 +1,43 @@
+package writer
+
+import "time"
+
+// CDR is a call detail record assembled from a SIP dialog
+type CDR struct {
+	CID              string    `json:"cid"`
+	CallID           string    `json:"call_id"`
+	NodeID           uint32    `json:"node_id"`
+	FromUser         string    `json:"from_user"`
+	FromURI          string    `json:"from_uri"`
+	ToUser           string    `json:"to_user"`
+	ToURI            string    `json:"to_uri"`
+	SrcIP            string    `json:"src_ip"`
+	DstIP            string    `json:"dst_ip"`
+	UserAgent        string    `json:"user_agent,omitempty"`
+	InviteTime       time.Time `json:"invite_time"`
+	RingTime         time.Time `json:"ring_time,omitempty"`
+	AnswerTime       time.Time `json:"answer_time,omitempty"`
+	EndTime          time.Time `json:"end_time"`
+	SetupTimeMs      int64     `json:"setup_time_ms"`
+	RingingTimeMs    int64     `json:"ringing_time_ms"`
+	DurationMs       int64     `json:"duration_ms"`
+	FinalStatus      int       `json:"final_status"`
+	TerminationCause string    `json:"termination_cause"`
+	TerminatedBy     string    `json:"terminated_by,omitempty"`
+	Reason           string    `json:"reason,omitempty"`
+}
+
+// Termination causes reported in CDR.TerminationCause
+const (
+	CDRCompleted = "completed"
+	CDRCancelled = "cancelled"
+	CDRFailed    = "failed"
+	CDRTimeout   = "timeout"
+	CDRShutdown  = "shutdown"
+)
+
+// CDRWriter is implemented by writers that can store call detail records
+// next to the raw packets
+type CDRWriter interface {
+	WriteCDR(cdr *CDR) error
+}
@@ -2,7 +2,9 @@ package writer
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
@@ -11,8 +13,15 @@ import (
 
 type ClickHouseWriter struct {
 	*BatchWriter
-	conn      clickhouse.Conn
-	tableName string
+	conn         clickhouse.Conn
+	tableName    string
+	cdrTableName string
+	logTableName string
+	rtpTableName string
+	// cdrs and reports are queued by WriteCDR and WriteRTPReport and
+	// inserted with the packet batch
+	cdrs    []*CDR
+	reports []*RTPReport
 }
 
 type ClickHouseConfig struct {
@@ -20,6 +29,9 @@ type ClickHouseConfig struct {
 	Port      int
 	Database  string
 	Table     string
+	CDRTable  string
+	LogTable  string
+	RTPTable  string
 	Username  string
 	Password  string
 	BatchSize int
@@ -45,31 +57,187 @@ func NewClickHouseWriter(config ClickHouseConfig) (*ClickHouseWriter, error) {
 		return nil, err
 	}
 
+	if config.Table == "" {
+		config.Table = "hep_packets"
+	}
+	if config.CDRTable == "" {
+		config.CDRTable = "hep_cdr"
+	}
+	if config.LogTable == "" {
+		config.LogTable = "hep_logs"
+	}
+	if config.RTPTable == "" {
+		config.RTPTable = "hep_rtp_stats"
+	}
+
 	w := &ClickHouseWriter{
-		BatchWriter: NewBatchWriter(config.BatchSize),
-		conn:        conn,
-		tableName:   config.Table,
+		conn:         conn,
+		tableName:    config.Table,
+		cdrTableName: config.CDRTable,
+		logTableName: config.LogTable,
+		rtpTableName: config.RTPTable,
 	}
+	if err := w.ensureSchema(context.Background()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	w.BatchWriter = newBatchWriter(config.BatchSize, w.flush)
 
 	return w, nil
 }
 
+// ensureSchema creates the packet, CDR, log and RTP tables and adds the
+// columns of newer versions to tables created before them
+func (w *ClickHouseWriter) ensureSchema(ctx context.Context) error {
+	statements := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			version UInt8,
+			protocol_family UInt8,
+			protocol UInt8,
+			src_ip String,
+			dst_ip String,
+			src_port UInt16,
+			dst_port UInt16,
+			timestamp DateTime64(6),
+			node_id UInt32,
+			payload String,
+			cid String,
+			vlan UInt16,
+			node_ids Array(UInt32),
+			enrichment Map(String, String),
+			dns String,
+			diameter String
+		) ENGINE = MergeTree
+		PARTITION BY toDate(timestamp)
+		ORDER BY (cid, timestamp)`, w.tableName),
+		fmt.Sprintf(`ALTER TABLE %s
+			ADD COLUMN IF NOT EXISTS node_id UInt32,
+			ADD COLUMN IF NOT EXISTS node_ids Array(UInt32),
+			ADD COLUMN IF NOT EXISTS enrichment Map(String, String),
+			ADD COLUMN IF NOT EXISTS dns String,
+			ADD COLUMN IF NOT EXISTS diameter String`, w.tableName),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			cid String,
+			call_id String,
+			node_id UInt32,
+			from_user String,
+			from_uri String,
+			to_user String,
+			to_uri String,
+			src_ip String,
+			dst_ip String,
+			user_agent String,
+			invite_time DateTime64(6),
+			ring_time Nullable(DateTime64(6)),
+			answer_time Nullable(DateTime64(6)),
+			end_time DateTime64(6),
+			setup_time_ms Int64,
+			ringing_time_ms Int64,
+			duration_ms Int64,
+			final_status UInt16,
+			termination_cause LowCardinality(String),
+			terminated_by LowCardinality(String),
+			reason String
+		) ENGINE = MergeTree
+		PARTITION BY toDate(invite_time)
+		ORDER BY (invite_time, cid)`, w.cdrTableName),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			timestamp DateTime64(6),
+			node_id UInt32,
+			src_ip String,
+			dst_ip String,
+			src_port UInt16,
+			dst_port UInt16,
+			cid String,
+			level LowCardinality(String),
+			module LowCardinality(String),
+			message String,
+			log_time Nullable(DateTime64(6)),
+			payload String
+		) ENGINE = MergeTree
+		PARTITION BY toDate(timestamp)
+		ORDER BY (timestamp, cid)`, w.logTableName),
+		fmt.Sprintf(`ALTER TABLE %s
+			ADD COLUMN IF NOT EXISTS log_time Nullable(DateTime64(6))`, w.logTableName),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			cid String,
+			ssrc UInt32,
+			node_id UInt32,
+			src_ip String,
+			src_port UInt16,
+			dst_ip String,
+			dst_port UInt16,
+			payload_type UInt8,
+			start_time DateTime64(6),
+			end_time DateTime64(6),
+			packets Int64,
+			expected Int64,
+			lost Int64,
+			loss_percent Float64,
+			sequence_gaps Int64,
+			out_of_order Int64,
+			duplicates Int64,
+			jitter_ms Float64,
+			max_jitter_ms Float64,
+			payload_type_changes Int64,
+			r_factor Float64,
+			mos Float64,
+			final Bool
+		) ENGINE = MergeTree
+		PARTITION BY toDate(start_time)
+		ORDER BY (start_time, cid, ssrc)`, w.rtpTableName),
+		fmt.Sprintf(`ALTER TABLE %s
+			ADD COLUMN IF NOT EXISTS duplicates Int64`, w.rtpTableName),
+	}
+	for _, statement := range statements {
+		if err := w.conn.Exec(ctx, statement); err != nil {
+			return fmt.Errorf("creating clickhouse schema failed: %w", err)
+		}
+	}
+	return nil
+}
+
 func (w *ClickHouseWriter) flush() {
 	w.mu.Lock()
 	packets := make([]*protocol.HEPPacket, len(w.buffer))
 	copy(packets, w.buffer)
 	w.buffer = w.buffer[:0]
+	cdrs, reports := w.cdrs, w.reports
+	w.cdrs, w.reports = nil, nil
 	w.mu.Unlock()
 
+	if len(cdrs) > 0 {
+		w.flushCDRs(cdrs)
+	}
+	if len(reports) > 0 {
+		w.flushRTPReports(reports)
+	}
+
+	// Application logs go to their own table
+	var logs []*protocol.HEPPacket
+	n := 0
+	for _, packet := range packets {
+		if packet.ProtoType == protocol.ProtoTypeLog {
+			logs = append(logs, packet)
+		} else {
+			packets[n] = packet
+			n++
+		}
+	}
+	packets = packets[:n]
+
+	if len(logs) > 0 {
+		w.flushLogs(logs)
+	}
 	if len(packets) == 0 {
 		return
 	}
 
 	batch, err := w.conn.PrepareBatch(context.Background(), fmt.Sprintf(`
 		INSERT INTO %s (
-			version, protocol_family, protocol, 
+			version, protocol_family, protocol,
 			src_ip, dst_ip, src_port, dst_port,
-			timestamp, payload, cid, vlan
+			timestamp, node_id, payload, cid, vlan, node_ids, enrichment, dns, diameter
 		)`, w.tableName))
 	if err != nil {
 		w.updateStats(false, 0, err)
@@ -86,10 +254,15 @@ func (w *ClickHouseWriter) flush() {
 			packet.DstIP,
 			packet.SrcPort,
 			packet.DstPort,
-			time.Unix(int64(packet.Timestamp), 0),
+			packet.Time(),
+			packet.NodeID,
 			packet.Payload,
 			packet.CID,
 			packet.Vlan,
+			packet.NodeIDs,
+			packet.Enrichment,
+			jsonColumn(packet.DNS),
+			jsonColumn(packet.Diameter),
 		)
 		if err != nil {
 			w.updateStats(false, 0, err)
@@ -106,21 +279,205 @@ func (w *ClickHouseWriter) flush() {
 	w.updateStats(true, totalBytes, nil)
 }
 
+func (w *ClickHouseWriter) flushLogs(packets []*protocol.HEPPacket) {
+	batch, err := w.conn.PrepareBatch(context.Background(), fmt.Sprintf(`
+		INSERT INTO %s (
+			timestamp, node_id, src_ip, dst_ip, src_port, dst_port,
+			cid, level, module, message, log_time, payload
+		)`, w.logTableName))
+	if err != nil {
+		w.updateStats(false, 0, err)
+		return
+	}
+
+	var totalBytes uint64
+	for _, packet := range packets {
+		var level, module, message string
+		// log_time is the time the application wrote in the line, NULL if
+		// the line had none
+		var logTime *time.Time
+		if packet.Log != nil {
+			level, module, message = packet.Log.Level, packet.Log.Module, packet.Log.Message
+			logTime = nullTime(packet.Log.Time)
+		}
+		err := batch.Append(
+			packet.Time(),
+			packet.NodeID,
+			packet.SrcIP,
+			packet.DstIP,
+			packet.SrcPort,
+			packet.DstPort,
+			packet.CID,
+			level,
+			module,
+			message,
+			logTime,
+			packet.Payload,
+		)
+		if err != nil {
+			w.updateStats(false, 0, err)
+			continue
+		}
+		totalBytes += uint64(len(packet.Payload))
+	}
+
+	if err := batch.Send(); err != nil {
+		w.updateStats(false, 0, err)
+		return
+	}
+
+	w.updateStats(true, totalBytes, nil)
+}
+
+// WriteCDR queues a call detail record for the CDR table, it is inserted
+// with the next packet batch
+func (w *ClickHouseWriter) WriteCDR(cdr *CDR) error {
+	w.mu.Lock()
+	w.cdrs = append(w.cdrs, cdr)
+	shouldFlush := len(w.cdrs) >= w.batchSize
+	w.mu.Unlock()
+
+	if shouldFlush {
+		w.flushChan <- struct{}{}
+	}
+	return nil
+}
+
+func (w *ClickHouseWriter) flushCDRs(cdrs []*CDR) {
+	batch, err := w.conn.PrepareBatch(context.Background(), fmt.Sprintf(`
+		INSERT INTO %s (
+			cid, call_id, node_id, from_user, from_uri, to_user, to_uri,
+			src_ip, dst_ip, user_agent,
+			invite_time, ring_time, answer_time, end_time,
+			setup_time_ms, ringing_time_ms, duration_ms,
+			final_status, termination_cause, terminated_by, reason
+		)`, w.cdrTableName))
+	if err != nil {
+		w.updateStats(false, 0, fmt.Errorf("cdr batch failed: %w", err))
+		return
+	}
+
+	for _, cdr := range cdrs {
+		if err := batch.Append(
+			cdr.CID, cdr.CallID, cdr.NodeID, cdr.FromUser, cdr.FromURI, cdr.ToUser, cdr.ToURI,
+			cdr.SrcIP, cdr.DstIP, cdr.UserAgent,
+			cdr.InviteTime, nullTime(cdr.RingTime), nullTime(cdr.AnswerTime), cdr.EndTime,
+			cdr.SetupTimeMs, cdr.RingingTimeMs, cdr.DurationMs,
+			uint16(cdr.FinalStatus), cdr.TerminationCause, cdr.TerminatedBy, cdr.Reason,
+		); err != nil {
+			w.updateStats(false, 0, fmt.Errorf("cdr %s: %w", cdr.CID, err))
+		}
+	}
+
+	if err := batch.Send(); err != nil {
+		w.updateStats(false, 0, fmt.Errorf("cdr batch failed: %w", err))
+	}
+}
+
+// WriteRTPReport queues an RTP stream summary for the RTP stats table, it
+// is inserted with the next packet batch
+func (w *ClickHouseWriter) WriteRTPReport(report *RTPReport) error {
+	w.mu.Lock()
+	w.reports = append(w.reports, report)
+	shouldFlush := len(w.reports) >= w.batchSize
+	w.mu.Unlock()
+
+	if shouldFlush {
+		w.flushChan <- struct{}{}
+	}
+	return nil
+}
+
+func (w *ClickHouseWriter) flushRTPReports(reports []*RTPReport) {
+	batch, err := w.conn.PrepareBatch(context.Background(), fmt.Sprintf(`
+		INSERT INTO %s (
+			cid, ssrc, node_id, src_ip, src_port, dst_ip, dst_port, payload_type,
+			start_time, end_time, packets, expected, lost, loss_percent,
+			sequence_gaps, out_of_order, duplicates, jitter_ms, max_jitter_ms,
+			payload_type_changes, r_factor, mos, final
+		)`, w.rtpTableName))
+	if err != nil {
+		w.updateStats(false, 0, fmt.Errorf("rtp report batch failed: %w", err))
+		return
+	}
+
+	for _, report := range reports {
+		if err := batch.Append(
+			report.CID, report.SSRC, report.NodeID, report.SrcIP, report.SrcPort, report.DstIP, report.DstPort, report.PayloadType,
+			report.StartTime, report.EndTime, report.Packets, report.Expected, report.Lost, report.LossPercent,
+			report.SequenceGaps, report.OutOfOrder, report.Duplicates, report.JitterMs, report.MaxJitterMs,
+			report.PayloadTypeChanges, report.RFactor, report.MOS, report.Final,
+		); err != nil {
+			w.updateStats(false, 0, fmt.Errorf("rtp report %08x: %w", report.SSRC, err))
+		}
+	}
+
+	if err := batch.Send(); err != nil {
+		w.updateStats(false, 0, fmt.Errorf("rtp report batch failed: %w", err))
+	}
+}
+
+// maxRTPReports bounds the reports read back for a call flow
+const maxRTPReports = 1000
+
+// SearchRTPReports reads the RTP stream reports of calls from the RTP stats
+// table
+func (w *ClickHouseWriter) SearchRTPReports(ctx context.Context, cids []string, from, to time.Time) ([]*RTPReport, error) {
+	rows, err := w.conn.Query(ctx, fmt.Sprintf(`
+		SELECT cid, ssrc, node_id, src_ip, src_port, dst_ip, dst_port, payload_type,
+			start_time, end_time, packets, expected, lost, loss_percent,
+			sequence_gaps, out_of_order, duplicates, jitter_ms, max_jitter_ms,
+			payload_type_changes, r_factor, mos, final
+		FROM %s
+		WHERE cid IN (?) AND start_time <= ? AND end_time >= ?
+		ORDER BY end_time
+		LIMIT ?
+	`, w.rtpTableName), cids, to, from, maxRTPReports)
+	if err != nil {
+		return nil, fmt.Errorf("rtp report query failed: %w", err)
+	}
+	defer rows.Close()
+
+	var reports []*RTPReport
+	for rows.Next() {
+		var report RTPReport
+		if err := rows.Scan(
+			&report.CID, &report.SSRC, &report.NodeID, &report.SrcIP, &report.SrcPort, &report.DstIP, &report.DstPort, &report.PayloadType,
+			&report.StartTime, &report.EndTime, &report.Packets, &report.Expected, &report.Lost, &report.LossPercent,
+			&report.SequenceGaps, &report.OutOfOrder, &report.Duplicates, &report.JitterMs, &report.MaxJitterMs,
+			&report.PayloadTypeChanges, &report.RFactor, &report.MOS, &report.Final,
+		); err != nil {
+			return nil, fmt.Errorf("rtp report scan failed: %w", err)
+		}
+		reports = append(reports, &report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rtp report query failed: %w", err)
+	}
+	return reports, nil
+}
+
 func (w *ClickHouseWriter) Search(ctx context.Context, params SearchParams) (SearchResult, error) {
 	query := `
-		SELECT version, protocol, src_ip, dst_ip, src_port, dst_port, timestamp, node_id, payload, cid
-		FROM hep_packets
+		SELECT version, protocol_family, protocol, src_ip, dst_ip, src_port, dst_port, %s, node_id, payload, cid, enrichment, dns, diameter
+		FROM %s
 		WHERE timestamp BETWEEN ? AND ?
 		%s
 		LIMIT ?
 	`
+	args := []interface{}{params.FromTime, params.ToTime}
 	condition := ""
 	if params.Query != "" {
 		condition = fmt.Sprintf("AND (%s)", params.Query)
 	}
-	query = fmt.Sprintf(query, condition)
+	if len(params.CIDs) > 0 {
+		condition += " AND cid IN (?)"
+		args = append(args, params.CIDs)
+	}
+	query = fmt.Sprintf(query, timestampColumns, w.tableName, condition)
+	args = append(args, params.Limit)
 
-	rows, err := w.conn.Query(ctx, query, params.FromTime, params.ToTime, params.Limit)
+	rows, err := w.conn.Query(ctx, query, args...)
 	if err != nil {
 		return SearchResult{}, fmt.Errorf("query failed: %w", err)
 	}
@@ -129,25 +486,148 @@ func (w *ClickHouseWriter) Search(ctx context.Context, params SearchParams) (Sea
 	var results []*protocol.HEPPacket
 	for rows.Next() {
 		var packet protocol.HEPPacket
+		var dns, diameter string
 		if err := rows.Scan(
 			&packet.Version,
 			&packet.Protocol,
+			&packet.ProtoType,
 			&packet.SrcIP,
 			&packet.DstIP,
 			&packet.SrcPort,
 			&packet.DstPort,
 			&packet.Timestamp,
+			&packet.TimestampUsec,
 			&packet.NodeID,
 			&packet.Payload,
 			&packet.CID,
+			&packet.Enrichment,
+			&dns,
+			&diameter,
 		); err != nil {
 			return SearchResult{}, fmt.Errorf("scan failed: %w", err)
 		}
+		if err := scanJSONColumn(dns, &packet.DNS); err != nil {
+			return SearchResult{}, fmt.Errorf("decode dns column failed: %w", err)
+		}
+		if err := scanJSONColumn(diameter, &packet.Diameter); err != nil {
+			return SearchResult{}, fmt.Errorf("decode diameter column failed: %w", err)
+		}
 		results = append(results, &packet)
 	}
+	if err := rows.Err(); err != nil {
+		return SearchResult{}, fmt.Errorf("query failed: %w", err)
+	}
+
+	if params.IncludeLogs {
+		logs, err := w.searchLogs(ctx, params)
+		if err != nil {
+			return SearchResult{}, err
+		}
+		results = mergeByTime(results, logs, params.Limit)
+	}
 
 	return SearchResult{
 		Total:   int64(len(results)),
 		Results: results,
 	}, nil
 }
+
+// searchLogs reads application logs from the log table. The free-form query
+// targets the packet table columns, so only time and CIDs are applied.
+func (w *ClickHouseWriter) searchLogs(ctx context.Context, params SearchParams) ([]*protocol.HEPPacket, error) {
+	query := `
+		SELECT %s, node_id, src_ip, dst_ip, src_port, dst_port, cid, level, module, message, log_time, payload
+		FROM %s
+		WHERE timestamp BETWEEN ? AND ?
+		%s
+		LIMIT ?
+	`
+	args := []interface{}{params.FromTime, params.ToTime}
+	condition := ""
+	if len(params.CIDs) > 0 {
+		condition = "AND cid IN (?)"
+		args = append(args, params.CIDs)
+	}
+	args = append(args, params.Limit)
+
+	rows, err := w.conn.Query(ctx, fmt.Sprintf(query, timestampColumns, w.logTableName, condition), args...)
+	if err != nil {
+		return nil, fmt.Errorf("log query failed: %w", err)
+	}
+	defer rows.Close()
+
+	var results []*protocol.HEPPacket
+	for rows.Next() {
+		packet := protocol.HEPPacket{ProtoType: protocol.ProtoTypeLog, Log: &protocol.LogMessage{}}
+		var logTime *time.Time
+		if err := rows.Scan(
+			&packet.Timestamp,
+			&packet.TimestampUsec,
+			&packet.NodeID,
+			&packet.SrcIP,
+			&packet.DstIP,
+			&packet.SrcPort,
+			&packet.DstPort,
+			&packet.CID,
+			&packet.Log.Level,
+			&packet.Log.Module,
+			&packet.Log.Message,
+			&logTime,
+			&packet.Payload,
+		); err != nil {
+			return nil, fmt.Errorf("log scan failed: %w", err)
+		}
+		if logTime != nil {
+			packet.Log.Time = *logTime
+		}
+		results = append(results, &packet)
+	}
+	return results, rows.Err()
+}
+
+// mergeByTime interleaves packets and logs by capture time and applies
+// the result limit
+func mergeByTime(packets, logs []*protocol.HEPPacket, limit int) []*protocol.HEPPacket {
+	merged := append(packets, logs...)
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Time().Before(merged[j].Time())
+	})
+	if limit > 0 && len(merged) > limit {
+		merged = merged[:limit]
+	}
+	return merged
+}
+
+// timestampColumns selects a timestamp column as the seconds and
+// microseconds of a packet
+const timestampColumns = "toUInt64(toUnixTimestamp(timestamp)), toUInt32(toUnixTimestamp64Micro(toDateTime64(timestamp, 6)) % 1000000)"
+
+// nullTime maps the zero time to NULL for Nullable columns
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// jsonColumn encodes decoded payload fields for a String column, nil
+// values are stored as an empty string
+func jsonColumn[T any](v *T) string {
+	if v == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// scanJSONColumn is the reverse of jsonColumn
+func scanJSONColumn[T any](column string, v **T) error {
+	if column == "" {
+		return nil
+	}
+	*v = new(T)
+	return json.Unmarshal([]byte(column), *v)
+}
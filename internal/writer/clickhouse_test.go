@@ -0,0 +1,22 @@
+package writer
+
+import (
+	"testing"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+func TestMergeByTime(t *testing.T) {
+	packets := []*protocol.HEPPacket{
+		{CID: "invite", Timestamp: 1000, TimestampUsec: 100},
+		{CID: "200", Timestamp: 1000, TimestampUsec: 900000},
+	}
+	logs := []*protocol.HEPPacket{
+		{CID: "log", Timestamp: 1000, TimestampUsec: 500000},
+	}
+
+	merged := mergeByTime(packets, logs, 2)
+	if len(merged) != 2 || merged[0].CID != "invite" || merged[1].CID != "log" {
+		t.Errorf("Expected invite and log by capture time, got %+v", merged)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
@@ -13,8 +14,15 @@ import (
 
 type ElasticWriter struct {
 	*BatchWriter
-	client    *elasticsearch.Client
-	indexName string
+	client       *elasticsearch.Client
+	indexName    string
+	cdrIndexName string
+	logIndexName string
+	rtpIndexName string
+	// cdrs and reports are queued by WriteCDR and WriteRTPReport and
+	// indexed with the packet bulk request
+	cdrs    []*CDR
+	reports []*RTPReport
 }
 
 type ElasticConfig struct {
@@ -22,6 +30,9 @@ type ElasticConfig struct {
 	Username  string
 	Password  string
 	IndexName string
+	CDRIndex  string
+	LogIndex  string
+	RTPIndex  string
 	BatchSize int
 }
 
@@ -35,11 +46,25 @@ func NewElasticWriter(config ElasticConfig) (*ElasticWriter, error) {
 		return nil, err
 	}
 
-	return &ElasticWriter{
-		BatchWriter: NewBatchWriter(config.BatchSize),
-		client:      client,
-		indexName:   config.IndexName,
-	}, nil
+	if config.CDRIndex == "" {
+		config.CDRIndex = config.IndexName + "_cdr"
+	}
+	if config.LogIndex == "" {
+		config.LogIndex = config.IndexName + "_logs"
+	}
+	if config.RTPIndex == "" {
+		config.RTPIndex = config.IndexName + "_rtp"
+	}
+
+	w := &ElasticWriter{
+		client:       client,
+		indexName:    config.IndexName,
+		cdrIndexName: config.CDRIndex,
+		logIndexName: config.LogIndex,
+		rtpIndexName: config.RTPIndex,
+	}
+	w.BatchWriter = newBatchWriter(config.BatchSize, w.flush)
+	return w, nil
 }
 
 func (w *ElasticWriter) flush() {
@@ -47,26 +72,41 @@ func (w *ElasticWriter) flush() {
 	packets := make([]*protocol.HEPPacket, len(w.buffer))
 	copy(packets, w.buffer)
 	w.buffer = w.buffer[:0]
+	cdrs, reports := w.cdrs, w.reports
+	w.cdrs, w.reports = nil, nil
 	w.mu.Unlock()
 
-	if len(packets) == 0 {
+	if len(packets) == 0 && len(cdrs) == 0 && len(reports) == 0 {
 		return
 	}
 
 	var buf bytes.Buffer
-	for _, packet := range packets {
+	add := func(index string, doc interface{}) {
 		meta := []byte(fmt.Sprintf(`{ "index" : { "_index" : "%s" } }%s`,
-			w.indexName, "\n"))
-		data, err := json.Marshal(packet)
+			index, "\n"))
+		data, err := json.Marshal(doc)
 		if err != nil {
 			w.updateStats(false, 0, err)
-			continue
+			return
 		}
 		buf.Grow(len(meta) + len(data) + 1)
 		buf.Write(meta)
 		buf.Write(data)
 		buf.WriteByte('\n')
 	}
+	for _, packet := range packets {
+		index := w.indexName
+		if packet.ProtoType == protocol.ProtoTypeLog {
+			index = w.logIndexName
+		}
+		add(index, packet)
+	}
+	for _, cdr := range cdrs {
+		add(w.cdrIndexName, cdr)
+	}
+	for _, report := range reports {
+		add(w.rtpIndexName, report)
+	}
 
 	res, err := w.client.Bulk(bytes.NewReader(buf.Bytes()))
 	if err != nil {
@@ -83,6 +123,98 @@ func (w *ElasticWriter) flush() {
 	w.updateStats(true, uint64(buf.Len()), nil)
 }
 
+// WriteCDR queues a call detail record for the CDR index, it is indexed
+// with the next bulk request
+func (w *ElasticWriter) WriteCDR(cdr *CDR) error {
+	w.mu.Lock()
+	w.cdrs = append(w.cdrs, cdr)
+	shouldFlush := len(w.cdrs) >= w.batchSize
+	w.mu.Unlock()
+
+	if shouldFlush {
+		w.flushChan <- struct{}{}
+	}
+	return nil
+}
+
+// WriteRTPReport queues an RTP stream summary for the RTP index, it is
+// indexed with the next bulk request
+func (w *ElasticWriter) WriteRTPReport(report *RTPReport) error {
+	w.mu.Lock()
+	w.reports = append(w.reports, report)
+	shouldFlush := len(w.reports) >= w.batchSize
+	w.mu.Unlock()
+
+	if shouldFlush {
+		w.flushChan <- struct{}{}
+	}
+	return nil
+}
+
+// SearchRTPReports reads the RTP stream reports of calls from the RTP index
+func (w *ElasticWriter) SearchRTPReports(ctx context.Context, cids []string, from, to time.Time) ([]*RTPReport, error) {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []interface{}{
+					map[string]interface{}{
+						"terms": map[string]interface{}{"cid.keyword": cids},
+					},
+					map[string]interface{}{
+						"range": map[string]interface{}{
+							"start_time": map[string]interface{}{"lte": to.Format(time.RFC3339Nano)},
+						},
+					},
+					map[string]interface{}{
+						"range": map[string]interface{}{
+							"end_time": map[string]interface{}{"gte": from.Format(time.RFC3339Nano)},
+						},
+					},
+				},
+			},
+		},
+		"sort": []interface{}{map[string]interface{}{"end_time": "asc"}},
+		"size": maxRTPReports,
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(query); err != nil {
+		return nil, fmt.Errorf("encoding query failed: %w", err)
+	}
+
+	res, err := w.client.Search(
+		w.client.Search.WithContext(ctx),
+		w.client.Search.WithIndex(w.rtpIndexName),
+		w.client.Search.WithBody(&buf),
+		w.client.Search.WithIgnoreUnavailable(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("rtp report query failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("rtp report query error: %s", res.String())
+	}
+
+	var esResponse struct {
+		Hits struct {
+			Hits []struct {
+				Source RTPReport `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&esResponse); err != nil {
+		return nil, fmt.Errorf("decoding response failed: %w", err)
+	}
+
+	reports := make([]*RTPReport, len(esResponse.Hits.Hits))
+	for i, hit := range esResponse.Hits.Hits {
+		reports[i] = &hit.Source
+	}
+	return reports, nil
+}
+
 func (w *ElasticWriter) Search(ctx context.Context, params SearchParams) (SearchResult, error) {
 	query := map[string]interface{}{
 		"query": map[string]interface{}{
@@ -113,14 +245,29 @@ func (w *ElasticWriter) Search(ctx context.Context, params SearchParams) (Search
 		)
 	}
 
+	if len(params.CIDs) > 0 {
+		query["query"].(map[string]interface{})["bool"].(map[string]interface{})["filter"] = []interface{}{
+			map[string]interface{}{
+				"terms": map[string]interface{}{
+					"CID.keyword": params.CIDs,
+				},
+			},
+		}
+	}
+
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(query); err != nil {
 		return SearchResult{}, fmt.Errorf("encoding query failed: %w", err)
 	}
 
+	indices := []string{w.indexName}
+	if params.IncludeLogs {
+		indices = append(indices, w.logIndexName)
+	}
+
 	res, err := w.client.Search(
 		w.client.Search.WithContext(ctx),
-		w.client.Search.WithIndex(w.indexName),
+		w.client.Search.WithIndex(indices...),
 		w.client.Search.WithBody(&buf),
 	)
 	if err != nil {
@@ -151,6 +298,12 @@ func (w *ElasticWriter) Search(ctx context.Context, params SearchParams) (Search
 	for i, hit := range esResponse.Hits.Hits {
 		results[i] = &hit.Source
 	}
+	if params.IncludeLogs {
+		// Hits from both indices come back by score, interleave them by time
+		sort.SliceStable(results, func(i, j int) bool {
+			return results[i].Timestamp < results[j].Timestamp
+		})
+	}
 
 	return SearchResult{
 		Total:   esResponse.Hits.Total.Value,
@@ -0,0 +1,194 @@
+package writer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Packet encodings of writers that forward packets to a message bus
+const (
+	EncodingJSON     = "json"
+	EncodingProtobuf = "protobuf"
+	EncodingHEP      = "hep"
+)
+
+var ErrUnknownEncoding = errors.New("unknown packet encoding")
+
+// protoName returns the lower-case name of a HEP proto type, or its number
+// for types without one
+func protoName(protoType uint8) string {
+	switch protoType {
+	case protocol.ProtoTypeSIP:
+		return "sip"
+	case protocol.ProtoTypeRTCP:
+		return "rtcp"
+	case protocol.ProtoTypeRTP:
+		return "rtp"
+	case protocol.ProtoTypeDiameter:
+		return "diameter"
+	case protocol.ProtoTypeDNS:
+		return "dns"
+	case protocol.ProtoTypeLog:
+		return "log"
+	default:
+		return strconv.Itoa(int(protoType))
+	}
+}
+
+// CheckEncoding validates an encoding name, empty selects JSON
+func CheckEncoding(encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return EncodingJSON, nil
+	case EncodingJSON, EncodingProtobuf, EncodingHEP:
+		return encoding, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownEncoding, encoding)
+	}
+}
+
+// encodePacket encodes a packet as JSON, protobuf or HEPv3
+func encodePacket(packet *protocol.HEPPacket, encoding string) ([]byte, error) {
+	switch encoding {
+	case EncodingJSON:
+		return json.Marshal(packet)
+	case EncodingProtobuf:
+		return encodePacketProtobuf(packet), nil
+	case EncodingHEP:
+		return protocol.EncodeHEP(packet)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEncoding, encoding)
+	}
+}
+
+// encodePacketProtobuf encodes the HEP fields of a packet as
+//
+//	message HEPPacket {
+//	  uint32 version    = 1;
+//	  uint32 protocol   = 2;
+//	  string src_ip     = 3;
+//	  string dst_ip     = 4;
+//	  uint32 src_port   = 5;
+//	  uint32 dst_port   = 6;
+//	  uint64 timestamp  = 7;
+//	  uint32 proto_type = 8;
+//	  uint32 node_id    = 9;
+//	  string node_name  = 10;
+//	  bytes  payload    = 11;
+//	  string cid        = 12;
+//	  uint32 vlan       = 13;
+//	  uint32 timestamp_usec = 14;
+//	}
+func encodePacketProtobuf(packet *protocol.HEPPacket) []byte {
+	var b []byte
+	varint := func(num protowire.Number, v uint64) {
+		if v != 0 {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, v)
+		}
+	}
+	bytes := func(num protowire.Number, v []byte) {
+		if len(v) != 0 {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendBytes(b, v)
+		}
+	}
+
+	varint(1, uint64(packet.Version))
+	varint(2, uint64(packet.Protocol))
+	bytes(3, []byte(packet.SrcIP))
+	bytes(4, []byte(packet.DstIP))
+	varint(5, uint64(packet.SrcPort))
+	varint(6, uint64(packet.DstPort))
+	varint(7, packet.Timestamp)
+	varint(8, uint64(packet.ProtoType))
+	varint(9, uint64(packet.NodeID))
+	bytes(10, []byte(packet.NodeName))
+	bytes(11, packet.Payload)
+	bytes(12, []byte(packet.CID))
+	varint(13, uint64(packet.Vlan))
+	varint(14, uint64(packet.TimestampUsec))
+	return b
+}
+
+// DecodePacket is the inverse of the writer encodings, it lets inputs read
+// packets a writer of another instance published
+func DecodePacket(data []byte, encoding string) (*protocol.HEPPacket, error) {
+	switch encoding {
+	case "", EncodingJSON:
+		var packet protocol.HEPPacket
+		if err := json.Unmarshal(data, &packet); err != nil {
+			return nil, err
+		}
+		return &packet, nil
+	case EncodingProtobuf:
+		return decodePacketProtobuf(data)
+	case EncodingHEP:
+		return protocol.DecodeHEP(data)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEncoding, encoding)
+	}
+}
+
+func decodePacketProtobuf(b []byte) (*protocol.HEPPacket, error) {
+	packet := &protocol.HEPPacket{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v uint64
+		var data []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch num {
+		case 1:
+			packet.Version = uint8(v)
+		case 2:
+			packet.Protocol = uint8(v)
+		case 3:
+			packet.SrcIP = string(data)
+		case 4:
+			packet.DstIP = string(data)
+		case 5:
+			packet.SrcPort = uint16(v)
+		case 6:
+			packet.DstPort = uint16(v)
+		case 7:
+			packet.Timestamp = v
+		case 8:
+			packet.ProtoType = uint8(v)
+		case 9:
+			packet.NodeID = uint32(v)
+		case 10:
+			packet.NodeName = string(data)
+		case 11:
+			packet.Payload = append([]byte(nil), data...)
+		case 12:
+			packet.CID = string(data)
+		case 13:
+			packet.Vlan = uint16(v)
+		case 14:
+			packet.TimestampUsec = uint32(v)
+		}
+	}
+	return packet, nil
+}
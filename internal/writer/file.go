@@ -0,0 +1,431 @@
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// Payload encodings and compressions of a FileWriter
+const (
+	FilePayloadText   = "text"
+	FilePayloadBase64 = "base64"
+
+	FileCompressionGzip = "gzip"
+	FileCompressionZstd = "zstd"
+)
+
+var (
+	ErrFileBadPayload     = errors.New("unknown file payload encoding")
+	ErrFileBadCompression = errors.New("unknown file compression")
+)
+
+// FileWriter writes one JSON document per packet to newline delimited JSON
+// files for log shippers and jq. Files are rotated by size and age and
+// compressed in the background once closed. Search scans the newest files.
+type FileWriter struct {
+	*BatchWriter
+	files       *fileRotator
+	payload     string
+	compression string
+	searchFiles int
+
+	// compressing tracks the background compressions for Close
+	compressing sync.WaitGroup
+}
+
+type FileConfig struct {
+	Dir string
+	// Prefix starts the file names, default hep
+	Prefix string
+	// Payload is text or base64, text falls back to base64 for payloads
+	// that are not valid UTF-8
+	Payload string
+	// Compression of closed files is gzip or zstd, empty keeps them as is
+	Compression string
+	// MaxSize rotates files reaching it in bytes, default 100 MB
+	MaxSize int64
+	// RotateInterval rotates files older than it, 0 disables
+	RotateInterval time.Duration
+	// MaxFiles is the number of files kept, 0 keeps all
+	MaxFiles int
+	// SearchFiles is the number of newest files Search scans, default 24
+	SearchFiles int
+	BatchSize   int
+}
+
+// fileRecord is the document written per packet, its field names are
+// stable across releases
+type fileRecord struct {
+	Time            time.Time                 `json:"time"`
+	Version         uint8                     `json:"version"`
+	Protocol        uint8                     `json:"protocol"`
+	SrcIP           string                    `json:"src_ip"`
+	SrcPort         uint16                    `json:"src_port"`
+	DstIP           string                    `json:"dst_ip"`
+	DstPort         uint16                    `json:"dst_port"`
+	ProtoType       uint8                     `json:"proto_type"`
+	Proto           string                    `json:"proto"`
+	NodeID          uint32                    `json:"node_id"`
+	NodeName        string                    `json:"node_name,omitempty"`
+	NodeIDs         []uint32                  `json:"node_ids,omitempty"`
+	CID             string                    `json:"cid,omitempty"`
+	Vlan            uint16                    `json:"vlan,omitempty"`
+	Payload         string                    `json:"payload"`
+	PayloadEncoding string                    `json:"payload_encoding"`
+	SIP             *protocol.SIPMessage      `json:"sip,omitempty"`
+	DNS             *protocol.DNSMessage      `json:"dns,omitempty"`
+	Diameter        *protocol.DiameterMessage `json:"diameter,omitempty"`
+	Log             *protocol.LogMessage      `json:"log,omitempty"`
+	RTP             *protocol.RTPHeader       `json:"rtp,omitempty"`
+	Enrichment      map[string]string         `json:"enrichment,omitempty"`
+}
+
+func NewFileWriter(config FileConfig) (*FileWriter, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("file dir required")
+	}
+	switch config.Payload {
+	case "":
+		config.Payload = FilePayloadText
+	case FilePayloadText, FilePayloadBase64:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrFileBadPayload, config.Payload)
+	}
+	switch config.Compression {
+	case "", FileCompressionGzip, FileCompressionZstd:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrFileBadCompression, config.Compression)
+	}
+	if config.Prefix == "" {
+		config.Prefix = "hep"
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = 100 << 20
+	}
+	if config.SearchFiles <= 0 {
+		config.SearchFiles = 24
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("can't create file dir: %w", err)
+	}
+
+	w := &FileWriter{
+		payload:     config.Payload,
+		compression: config.Compression,
+		searchFiles: config.SearchFiles,
+	}
+	w.files = &fileRotator{
+		dir:      config.Dir,
+		prefix:   config.Prefix,
+		ext:      ".ndjson",
+		maxSize:  config.MaxSize,
+		interval: config.RotateInterval,
+		maxFiles: config.MaxFiles,
+		open:     w.open,
+		closed:   w.closed,
+	}
+	w.BatchWriter = newBatchWriter(config.BatchSize, w.flush)
+	return w, nil
+}
+
+func (w *FileWriter) flush() {
+	w.mu.Lock()
+	packets := make([]*protocol.HEPPacket, len(w.buffer))
+	copy(packets, w.buffer)
+	w.buffer = w.buffer[:0]
+	w.mu.Unlock()
+
+	if err := w.files.expire(time.Now()); err != nil {
+		w.updateStats(false, 0, err)
+	}
+	if len(packets) == 0 {
+		return
+	}
+
+	for _, packet := range packets {
+		line, err := json.Marshal(newFileRecord(packet, w.payload))
+		if err != nil {
+			w.updateStats(false, 0, err)
+			continue
+		}
+		line = append(line, '\n')
+		if err := w.files.write(line); err != nil {
+			w.updateStats(false, 0, err)
+			continue
+		}
+		w.updateStats(true, uint64(len(line)), nil)
+	}
+	if err := w.files.flush(); err != nil {
+		w.updateStats(false, 0, err)
+	}
+}
+
+func newFileRecord(packet *protocol.HEPPacket, payload string) *fileRecord {
+	record := &fileRecord{
+		Time:            packet.Time().UTC(),
+		Version:         packet.Version,
+		Protocol:        packet.Protocol,
+		SrcIP:           packet.SrcIP,
+		SrcPort:         packet.SrcPort,
+		DstIP:           packet.DstIP,
+		DstPort:         packet.DstPort,
+		ProtoType:       packet.ProtoType,
+		Proto:           protoName(packet.ProtoType),
+		NodeID:          packet.NodeID,
+		NodeName:        packet.NodeName,
+		NodeIDs:         packet.NodeIDs,
+		CID:             packet.CID,
+		Vlan:            packet.Vlan,
+		Payload:         string(packet.Payload),
+		PayloadEncoding: FilePayloadText,
+		SIP:             packet.SIP,
+		DNS:             packet.DNS,
+		Diameter:        packet.Diameter,
+		Log:             packet.Log,
+		RTP:             packet.RTP,
+		Enrichment:      packet.Enrichment,
+	}
+	if payload == FilePayloadBase64 || !utf8.Valid(packet.Payload) {
+		record.Payload = base64.StdEncoding.EncodeToString(packet.Payload)
+		record.PayloadEncoding = FilePayloadBase64
+	}
+	return record
+}
+
+// packet restores the packet of a record, the decoded payload fields are
+// kept
+func (r *fileRecord) packet() (*protocol.HEPPacket, error) {
+	payload := []byte(r.Payload)
+	if r.PayloadEncoding == FilePayloadBase64 {
+		var err error
+		if payload, err = base64.StdEncoding.DecodeString(r.Payload); err != nil {
+			return nil, err
+		}
+	}
+	return &protocol.HEPPacket{
+		Version:       r.Version,
+		Protocol:      r.Protocol,
+		SrcIP:         r.SrcIP,
+		DstIP:         r.DstIP,
+		SrcPort:       r.SrcPort,
+		DstPort:       r.DstPort,
+		Timestamp:     uint64(r.Time.Unix()),
+		TimestampUsec: uint32(r.Time.Nanosecond() / 1000),
+		ProtoType:     r.ProtoType,
+		NodeID:        r.NodeID,
+		NodeName:      r.NodeName,
+		NodeIDs:       r.NodeIDs,
+		Payload:       payload,
+		CID:           r.CID,
+		Vlan:          r.Vlan,
+		SIP:           r.SIP,
+		DNS:           r.DNS,
+		Diameter:      r.Diameter,
+		Log:           r.Log,
+		RTP:           r.RTP,
+		Enrichment:    r.Enrichment,
+	}, nil
+}
+
+func (w *FileWriter) open(path string) []byte {
+	w.mu.Lock()
+	w.stats.FilePath = path
+	w.mu.Unlock()
+	return nil
+}
+
+// closed compresses a finished file in the background
+func (w *FileWriter) closed(path string) {
+	if w.compression == "" {
+		return
+	}
+	w.compressing.Add(1)
+	go func() {
+		defer w.compressing.Done()
+		if err := compressFile(path, w.compression); err != nil {
+			w.updateStats(false, 0, err)
+			logrus.Errorf("Compressing %s failed: %v", path, err)
+		}
+	}()
+}
+
+// compressFile replaces a file by its compressed copy. The copy is written
+// under a hidden name first so it is never listed incomplete.
+func compressFile(path, compression string) error {
+	ext := ".gz"
+	if compression == FileCompressionZstd {
+		ext = ".zst"
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+ext)
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	var enc io.WriteCloser
+	if compression == FileCompressionZstd {
+		enc, err = zstd.NewWriter(dst)
+		if err != nil {
+			dst.Close()
+			return err
+		}
+	} else {
+		enc = gzip.NewWriter(dst)
+	}
+	_, err = io.Copy(enc, src)
+	if cerr := enc.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path+ext); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Search scans the newest files for packets in the time range. The query is
+// matched as a substring of the JSON document, e.g. "INVITE" or
+// `"src_ip":"10.0.0.1"`.
+func (w *FileWriter) Search(ctx context.Context, params SearchParams) (SearchResult, error) {
+	files := w.files.files()
+	// A file being compressed is listed twice, read the original
+	files = slices.DeleteFunc(files, func(path string) bool {
+		ext := filepath.Ext(path)
+		return ext != ".ndjson" && slices.Contains(files, strings.TrimSuffix(path, ext))
+	})
+	if len(files) > w.searchFiles {
+		files = files[len(files)-w.searchFiles:]
+	}
+
+	var results []*protocol.HEPPacket
+	for _, path := range files {
+		if err := ctx.Err(); err != nil {
+			return SearchResult{}, err
+		}
+		packets, err := searchFile(path, params)
+		if errors.Is(err, os.ErrNotExist) {
+			// Removed or compressed meanwhile
+			continue
+		}
+		if err != nil {
+			return SearchResult{}, err
+		}
+		results = append(results, packets...)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if params.OrderDesc {
+			return results[i].Timestamp > results[j].Timestamp
+		}
+		return results[i].Timestamp < results[j].Timestamp
+	})
+	total := int64(len(results))
+	if params.Offset > 0 {
+		results = results[min(params.Offset, len(results)):]
+	}
+	if params.Limit > 0 && len(results) > params.Limit {
+		results = results[:params.Limit]
+	}
+	return SearchResult{Total: total, Results: results}, nil
+}
+
+func searchFile(path string, params SearchParams) ([]*protocol.HEPPacket, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch filepath.Ext(path) {
+	case ".gz":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	case ".zst":
+		dec, err := zstd.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", path, err)
+		}
+		defer dec.Close()
+		r = dec
+	}
+
+	var packets []*protocol.HEPPacket
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if params.Query != "" && !bytes.Contains(line, []byte(params.Query)) {
+			continue
+		}
+		var record fileRecord
+		// The last line of the current file may be incomplete
+		if err := json.Unmarshal(line, &record); err != nil {
+			continue
+		}
+		if !params.FromTime.IsZero() && record.Time.Before(params.FromTime) ||
+			!params.ToTime.IsZero() && record.Time.After(params.ToTime) {
+			continue
+		}
+		if len(params.CIDs) > 0 && !slices.Contains(params.CIDs, record.CID) {
+			continue
+		}
+		if record.ProtoType == protocol.ProtoTypeLog && !params.IncludeLogs {
+			continue
+		}
+		packet, err := record.packet()
+		if err != nil {
+			continue
+		}
+		packets = append(packets, packet)
+	}
+	if err := scanner.Err(); err != nil {
+		return packets, fmt.Errorf("can't read %s: %w", path, err)
+	}
+	return packets, nil
+}
+
+// Close writes the buffered packets, closes the current file and waits for
+// its compression
+func (w *FileWriter) Close() error {
+	w.BatchWriter.Close()
+	err := w.files.close()
+	w.compressing.Wait()
+	return err
+}
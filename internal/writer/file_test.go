@@ -0,0 +1,181 @@
+package writer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+// readFileRecords returns the records of a plain or compressed file
+func readFileRecords(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("Expected a gzip file: %v", err)
+		}
+		r = gz
+	case strings.HasSuffix(path, ".zst"):
+		dec, err := zstd.NewReader(f)
+		if err != nil {
+			t.Fatalf("Expected a zstd file: %v", err)
+		}
+		defer dec.Close()
+		r = dec
+	}
+
+	var records []map[string]any
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Invalid line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Reading %s failed: %v", path, err)
+	}
+	return records
+}
+
+func TestFileWriterRecord(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewFileWriter(FileConfig{Dir: dir, BatchSize: 10})
+	if err != nil {
+		t.Fatalf("NewFileWriter failed: %v", err)
+	}
+	w.Write(&protocol.HEPPacket{
+		Version: 3, Protocol: ipProtoUDP, SrcIP: "192.0.2.1", SrcPort: 5060, DstIP: "192.0.2.2", DstPort: 5080,
+		Timestamp: 1700000000, ProtoType: protocol.ProtoTypeSIP, NodeID: 2001, NodeName: "sbc1", CID: "call-1",
+		Payload: []byte("INVITE sip:b@c SIP/2.0\r\n\r\n"),
+		SIP:     &protocol.SIPMessage{Method: "INVITE", CallID: "call-1"},
+	})
+	w.Write(&protocol.HEPPacket{SrcIP: "192.0.2.1", DstIP: "192.0.2.2", Timestamp: 1700000001, ProtoType: protocol.ProtoTypeRTCP, Payload: []byte{0x80, 0xc8, 0xff}})
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	files := w.files.files()
+	if len(files) != 1 || !strings.HasSuffix(files[0], ".ndjson") {
+		t.Fatalf("Expected one uncompressed file, got %v", files)
+	}
+	records := readFileRecords(t, files[0])
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+
+	sip := records[0]
+	if sip["time"] != "2023-11-14T22:13:20Z" || sip["proto"] != "sip" || sip["src_port"] != 5060.0 || sip["node_name"] != "sbc1" ||
+		sip["cid"] != "call-1" || sip["payload_encoding"] != "text" || sip["payload"] != "INVITE sip:b@c SIP/2.0\r\n\r\n" {
+		t.Errorf("Unexpected SIP record %v", sip)
+	}
+	if _, ok := sip["sip"].(map[string]any); !ok {
+		t.Errorf("Expected the decoded SIP message, got %v", sip["sip"])
+	}
+	// Binary payloads are not valid UTF-8 and fall back to base64
+	if rtcp := records[1]; rtcp["payload_encoding"] != "base64" || rtcp["payload"] != "gMj/" {
+		t.Errorf("Unexpected RTCP record %v", rtcp)
+	}
+}
+
+func TestFileWriterCompression(t *testing.T) {
+	for _, compression := range []string{FileCompressionGzip, FileCompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			dir := t.TempDir()
+			w, err := NewFileWriter(FileConfig{Dir: dir, MaxSize: 600, MaxFiles: 3, Payload: FilePayloadBase64, Compression: compression, BatchSize: 100})
+			if err != nil {
+				t.Fatalf("NewFileWriter failed: %v", err)
+			}
+			for i := 0; i < 10; i++ {
+				w.Write(&protocol.HEPPacket{SrcIP: "192.0.2.1", DstIP: "192.0.2.2", Timestamp: 1700000000 + uint64(i), Payload: []byte(strings.Repeat("x", 100))})
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			files := w.files.files()
+			if len(files) != 3 {
+				t.Fatalf("Expected 3 retained files, got %v", files)
+			}
+			total := 0
+			for _, path := range files {
+				if strings.HasSuffix(path, ".ndjson") {
+					t.Errorf("Expected %s to be compressed", path)
+				}
+				for _, record := range readFileRecords(t, path) {
+					if record["payload_encoding"] != "base64" {
+						t.Errorf("Expected base64 payloads, got %v", record)
+					}
+					total++
+				}
+			}
+			if total == 0 || total == 10 {
+				t.Errorf("Expected the oldest records to be removed, got %d", total)
+			}
+		})
+	}
+
+	if _, err := NewFileWriter(FileConfig{Dir: t.TempDir(), Compression: "lz4"}); err == nil {
+		t.Errorf("Expected an error for unknown compressions")
+	}
+}
+
+func TestFileWriterSearch(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewFileWriter(FileConfig{Dir: dir, MaxSize: 1000, Compression: FileCompressionGzip, BatchSize: 1})
+	if err != nil {
+		t.Fatalf("NewFileWriter failed: %v", err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 8; i++ {
+		cid := "call-1"
+		if i%2 == 1 {
+			cid = "call-2"
+		}
+		w.Write(&protocol.HEPPacket{SrcIP: "192.0.2.1", DstIP: "192.0.2.2", Timestamp: 1700000000 + uint64(i), ProtoType: protocol.ProtoTypeSIP, CID: cid, Payload: []byte("OPTIONS sip:a@b SIP/2.0")})
+	}
+	w.Write(&protocol.HEPPacket{Timestamp: 1700000010, ProtoType: protocol.ProtoTypeLog, CID: "call-1", Payload: []byte("call-1 routed"),
+		Enrichment: map[string]string{"customer": "acme"}})
+	w.flush()
+
+	result, err := w.Search(context.Background(), SearchParams{CIDs: []string{"call-1"}, OrderDesc: true, Limit: 3})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if result.Total != 4 || len(result.Results) != 3 || result.Results[0].Timestamp != 1700000006 || result.Results[0].CID != "call-1" {
+		t.Errorf("Unexpected result: total %d, first %+v", result.Total, result.Results[0])
+	}
+
+	result, err = w.Search(context.Background(), SearchParams{
+		Query:       "routed",
+		FromTime:    time.Unix(1700000005, 0),
+		IncludeLogs: true,
+	})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if result.Total != 1 || string(result.Results[0].Payload) != "call-1 routed" {
+		t.Errorf("Expected the log line, got %+v", result)
+	} else if got := result.Results[0].Enrichment["customer"]; got != "acme" {
+		t.Errorf("Expected the enrichment to survive the file, got %v", result.Results[0].Enrichment)
+	}
+}
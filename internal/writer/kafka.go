@@ -0,0 +1,153 @@
+package writer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+var ErrKafkaBadCompression = errors.New("unknown kafka compression")
+
+// KafkaWriter publishes every packet to Kafka. Records are keyed by the
+// correlation ID so all packets of a call land on the same partition, and
+// the producer is idempotent so retries do not duplicate records.
+// Delivery is asynchronous, failures are counted in the writer stats.
+type KafkaWriter struct {
+	BaseWriter
+	client   *kgo.Client
+	topic    string
+	topics   map[uint8]string
+	encoding string
+}
+
+type KafkaConfig struct {
+	Brokers []string
+	// Topic receives the packets of types missing in Topics
+	Topic string
+	// Topics maps proto types to topics, e.g. 1 to hep_sip
+	Topics map[uint8]string
+	// Encoding is json, protobuf or hep (HEPv3)
+	Encoding string
+	// Compression is none, gzip, snappy, lz4 or zstd
+	Compression string
+	ClientID    string
+	// Linger is how long a partition batch waits for more records
+	Linger time.Duration
+	// DeliveryTimeout bounds retries before a record counts as failed
+	DeliveryTimeout time.Duration
+	// MaxBufferedRecords is the number of records waiting for delivery,
+	// further packets are dropped
+	MaxBufferedRecords int
+}
+
+func NewKafkaWriter(config KafkaConfig) (*KafkaWriter, error) {
+	if len(config.Brokers) == 0 {
+		return nil, fmt.Errorf("kafka brokers required")
+	}
+	if config.Topic == "" {
+		config.Topic = "hep"
+	}
+	encoding, err := CheckEncoding(config.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	compression, err := kafkaCompression(config.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if config.ClientID == "" {
+		config.ClientID = "hepop"
+	}
+	if config.DeliveryTimeout <= 0 {
+		config.DeliveryTimeout = 30 * time.Second
+	}
+	if config.MaxBufferedRecords <= 0 {
+		config.MaxBufferedRecords = 100000
+	}
+
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(config.Brokers...),
+		kgo.ClientID(config.ClientID),
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+		kgo.RecordPartitioner(kgo.StickyKeyPartitioner(nil)),
+		kgo.ProducerBatchCompression(compression),
+		kgo.ProducerLinger(config.Linger),
+		kgo.RecordDeliveryTimeout(config.DeliveryTimeout),
+		kgo.MaxBufferedRecords(config.MaxBufferedRecords),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KafkaWriter{
+		client:   client,
+		topic:    config.Topic,
+		topics:   config.Topics,
+		encoding: encoding,
+	}, nil
+}
+
+func kafkaCompression(name string) (kgo.CompressionCodec, error) {
+	switch name {
+	case "", "snappy":
+		return kgo.SnappyCompression(), nil
+	case "none":
+		return kgo.NoCompression(), nil
+	case "gzip":
+		return kgo.GzipCompression(), nil
+	case "lz4":
+		return kgo.Lz4Compression(), nil
+	case "zstd":
+		return kgo.ZstdCompression(), nil
+	default:
+		return kgo.CompressionCodec{}, fmt.Errorf("%w: %s", ErrKafkaBadCompression, name)
+	}
+}
+
+// Write queues the packet for delivery without waiting for the broker
+func (w *KafkaWriter) Write(packet *protocol.HEPPacket) error {
+	value, err := encodePacket(packet, w.encoding)
+	if err != nil {
+		w.updateStats(false, 0, err)
+		return err
+	}
+
+	topic, ok := w.topics[packet.ProtoType]
+	if !ok {
+		topic = w.topic
+	}
+	// The record timestamp stays unset, the client measures the delivery
+	// timeout from it
+	record := &kgo.Record{
+		Topic: topic,
+		Value: value,
+	}
+	if packet.CID != "" {
+		record.Key = []byte(packet.CID)
+	}
+
+	w.client.TryProduce(context.Background(), record, w.delivered)
+	return nil
+}
+
+func (w *KafkaWriter) delivered(record *kgo.Record, err error) {
+	if err != nil {
+		err = fmt.Errorf("kafka delivery to %s failed: %w", record.Topic, err)
+	}
+	w.updateStats(err == nil, uint64(len(record.Value)), err)
+}
+
+func (w *KafkaWriter) Search(ctx context.Context, params SearchParams) (SearchResult, error) {
+	return SearchResult{}, ErrSearchNotSupported
+}
+
+// Close waits for the queued records to be delivered or to time out
+func (w *KafkaWriter) Close() error {
+	err := w.client.Flush(context.Background())
+	w.client.Close()
+	return err
+}
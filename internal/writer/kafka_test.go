@@ -0,0 +1,336 @@
+package writer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fakeKafka is a single in-process broker that answers the requests of an
+// idempotent producer and keeps the produced records
+type fakeKafka struct {
+	ln         net.Listener
+	partitions int32
+
+	mu      sync.Mutex
+	records map[string][]fakeRecord
+	// fail makes produce requests to a topic fail with a Kafka error code
+	fail map[string]int16
+}
+
+type fakeRecord struct {
+	partition int32
+	key       []byte
+	value     []byte
+}
+
+func newFakeKafka(t *testing.T) *fakeKafka {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	b := &fakeKafka{
+		ln:         ln,
+		partitions: 3,
+		records:    make(map[string][]fakeRecord),
+		fail:       make(map[string]int16),
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeKafka) addr() string {
+	return b.ln.Addr().String()
+}
+
+func (b *fakeKafka) topicRecords(topic string) []fakeRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]fakeRecord(nil), b.records[topic]...)
+}
+
+func (b *fakeKafka) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+
+		// Request header v1/v2: key, version, correlation ID, client ID
+		key := int16(binary.BigEndian.Uint16(buf[0:2]))
+		version := int16(binary.BigEndian.Uint16(buf[2:4]))
+		correlationID := binary.BigEndian.Uint32(buf[4:8])
+		body := buf[10:]
+		if n := int16(binary.BigEndian.Uint16(buf[8:10])); n > 0 {
+			body = body[n:]
+		}
+
+		req := kmsg.RequestForKey(key)
+		if req == nil {
+			return
+		}
+		req.SetVersion(version)
+		if req.IsFlexible() {
+			body = skipKafkaTags(body)
+		}
+		if err := req.ReadFrom(body); err != nil {
+			return
+		}
+
+		resp := b.handle(req)
+		if resp == nil {
+			continue
+		}
+		resp.SetVersion(version)
+
+		out := make([]byte, 4, 64)
+		out = binary.BigEndian.AppendUint32(out, correlationID)
+		// ApiVersions responses always use header v0
+		if req.IsFlexible() && key != kmsg.ApiVersions.Int16() {
+			out = append(out, 0)
+		}
+		out = resp.AppendTo(out)
+		binary.BigEndian.PutUint32(out[:4], uint32(len(out)-4))
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+func skipKafkaTags(b []byte) []byte {
+	n, size := binary.Uvarint(b)
+	b = b[size:]
+	for i := uint64(0); i < n; i++ {
+		_, size = binary.Uvarint(b)
+		b = b[size:]
+		length, size := binary.Uvarint(b)
+		b = b[size+int(length):]
+	}
+	return b
+}
+
+func (b *fakeKafka) handle(req kmsg.Request) kmsg.Response {
+	switch req := req.(type) {
+	case *kmsg.ApiVersionsRequest:
+		resp := kmsg.NewPtrApiVersionsResponse()
+		for key := int16(0); key < 100; key++ {
+			if r := kmsg.RequestForKey(key); r != nil {
+				resp.ApiKeys = append(resp.ApiKeys, kmsg.ApiVersionsResponseApiKey{ApiKey: key, MaxVersion: r.MaxVersion()})
+			}
+		}
+		return resp
+
+	case *kmsg.MetadataRequest:
+		host, port, _ := net.SplitHostPort(b.addr())
+		portNum, _ := strconv.Atoi(port)
+		resp := kmsg.NewPtrMetadataResponse()
+		resp.Brokers = []kmsg.MetadataResponseBroker{{NodeID: 0, Host: host, Port: int32(portNum)}}
+		for _, t := range req.Topics {
+			topic := kmsg.NewMetadataResponseTopic()
+			topic.Topic = t.Topic
+			for p := int32(0); p < b.partitions; p++ {
+				partition := kmsg.NewMetadataResponseTopicPartition()
+				partition.Partition = p
+				partition.Replicas = []int32{0}
+				partition.ISR = []int32{0}
+				topic.Partitions = append(topic.Partitions, partition)
+			}
+			resp.Topics = append(resp.Topics, topic)
+		}
+		return resp
+
+	case *kmsg.InitProducerIDRequest:
+		resp := kmsg.NewPtrInitProducerIDResponse()
+		resp.ProducerID = 1
+		return resp
+
+	case *kmsg.ProduceRequest:
+		resp := kmsg.NewPtrProduceResponse()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for _, t := range req.Topics {
+			topic := kmsg.NewProduceResponseTopic()
+			topic.Topic = t.Topic
+			for _, p := range t.Partitions {
+				partition := kmsg.NewProduceResponseTopicPartition()
+				partition.Partition = p.Partition
+				partition.BaseOffset = int64(len(b.records[t.Topic]))
+				if code := b.fail[t.Topic]; code != 0 {
+					partition.ErrorCode = code
+				} else {
+					b.records[t.Topic] = append(b.records[t.Topic], readFakeRecords(p.Partition, p.Records)...)
+				}
+				topic.Partitions = append(topic.Partitions, partition)
+			}
+			resp.Topics = append(resp.Topics, topic)
+		}
+		if req.Acks == 0 {
+			return nil
+		}
+		return resp
+	}
+	return nil
+}
+
+// readFakeRecords reads an uncompressed record batch
+func readFakeRecords(partition int32, data []byte) []fakeRecord {
+	var batch kmsg.RecordBatch
+	if err := batch.ReadFrom(data); err != nil {
+		return nil
+	}
+	records := batch.Records
+	var out []fakeRecord
+	for i := int32(0); i < batch.NumRecords; i++ {
+		length, n := binary.Varint(records)
+		var record kmsg.Record
+		if err := record.ReadFrom(records[:n+int(length)]); err != nil {
+			return out
+		}
+		records = records[n+int(length):]
+		out = append(out, fakeRecord{partition: partition, key: record.Key, value: record.Value})
+	}
+	return out
+}
+
+func TestKafkaWriterTopicsAndPartitions(t *testing.T) {
+	broker := newFakeKafka(t)
+
+	w, err := NewKafkaWriter(KafkaConfig{
+		Brokers:     []string{broker.addr()},
+		Topics:      map[uint8]string{protocol.ProtoTypeSIP: "hep_sip"},
+		Compression: "none",
+	})
+	if err != nil {
+		t.Fatalf("NewKafkaWriter failed: %v", err)
+	}
+
+	for i := 0; i < 30; i++ {
+		w.Write(&protocol.HEPPacket{ProtoType: protocol.ProtoTypeSIP, CID: fmt.Sprintf("call-%d", i%5), Timestamp: 1700000000})
+	}
+	w.Write(&protocol.HEPPacket{ProtoType: protocol.ProtoTypeLog, Payload: []byte("log line")})
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	sip := broker.topicRecords("hep_sip")
+	if len(sip) != 30 {
+		t.Fatalf("Expected 30 SIP records, got %d", len(sip))
+	}
+	partitions := make(map[string]int32)
+	for _, record := range sip {
+		var packet protocol.HEPPacket
+		if err := json.Unmarshal(record.value, &packet); err != nil || packet.CID != string(record.key) {
+			t.Fatalf("Expected a JSON packet keyed by CID, got key %s value %s", record.key, record.value)
+		}
+		if p, ok := partitions[packet.CID]; ok && p != record.partition {
+			t.Errorf("Expected %s on one partition, got %d and %d", packet.CID, p, record.partition)
+		}
+		partitions[packet.CID] = record.partition
+	}
+
+	logs := broker.topicRecords("hep")
+	if len(logs) != 1 || logs[0].key != nil {
+		t.Errorf("Expected 1 unkeyed record in the default topic, got %+v", logs)
+	}
+
+	if stats := w.Stats(); stats.NumRecords != 31 || stats.Errors != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestKafkaWriterDeliveryFailure(t *testing.T) {
+	broker := newFakeKafka(t)
+	broker.fail["hep"] = 29 // TOPIC_AUTHORIZATION_FAILED
+
+	w, err := NewKafkaWriter(KafkaConfig{Brokers: []string{broker.addr()}, Compression: "none", Encoding: EncodingHEP})
+	if err != nil {
+		t.Fatalf("NewKafkaWriter failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		w.Write(&protocol.HEPPacket{SrcIP: "192.0.2.1", DstIP: "192.0.2.2", CID: "call-1"})
+	}
+	w.Close()
+
+	stats := w.Stats()
+	if stats.Errors != 3 || stats.NumRecords != 0 || !errors.Is(stats.LastError, kerr.TopicAuthorizationFailed) {
+		t.Errorf("Expected 3 failed deliveries, got %+v", stats)
+	}
+}
+
+func TestEncodePacket(t *testing.T) {
+	packet := &protocol.HEPPacket{
+		Version:       3,
+		Protocol:      17,
+		SrcIP:         "192.0.2.1",
+		DstIP:         "192.0.2.2",
+		SrcPort:       5060,
+		DstPort:       5060,
+		Timestamp:     1700000000,
+		TimestampUsec: 30000,
+		ProtoType:     protocol.ProtoTypeSIP,
+		NodeID:        2001,
+		Payload:       []byte("OPTIONS sip:a@b SIP/2.0\r\n"),
+		CID:           "call-1",
+	}
+
+	data, err := encodePacket(packet, EncodingHEP)
+	if err != nil {
+		t.Fatalf("encodePacket failed: %v", err)
+	}
+	if decoded, err := protocol.DecodeHEP(data); err != nil || decoded.CID != "call-1" || decoded.NodeID != 2001 {
+		t.Errorf("Expected a decodable HEPv3 packet, got %+v (%v)", decoded, err)
+	}
+
+	data, _ = encodePacket(packet, EncodingProtobuf)
+	if decoded, err := DecodePacket(data, EncodingProtobuf); err != nil || !decoded.Time().Equal(packet.Time()) {
+		t.Errorf("Expected the capture time to survive protobuf, got %+v (%v)", decoded, err)
+	}
+	fields := make(map[protowire.Number][]byte)
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		m := protowire.ConsumeFieldValue(num, typ, data[n:])
+		if m < 0 {
+			t.Fatalf("Invalid protobuf encoding")
+		}
+		fields[num] = data[n : n+m]
+		data = data[n+m:]
+	}
+	if cid, _ := protowire.ConsumeBytes(fields[12]); string(cid) != "call-1" {
+		t.Errorf("Expected cid in field 12, got %q", cid)
+	}
+	if ts, _ := protowire.ConsumeVarint(fields[7]); ts != 1700000000 {
+		t.Errorf("Expected timestamp in field 7, got %d", ts)
+	}
+
+	if _, err := CheckEncoding("avro"); !errors.Is(err, ErrUnknownEncoding) {
+		t.Errorf("Expected ErrUnknownEncoding, got %v", err)
+	}
+}
@@ -0,0 +1,561 @@
+package writer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/snappy"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Label names a LokiWriter can derive from packet fields
+const (
+	LokiLabelNodeID    = "node_id"
+	LokiLabelNodeName  = "node_name"
+	LokiLabelProtoType = "proto_type"
+	LokiLabelSIPMethod = "sip_method"
+)
+
+// Push formats of the Loki push API
+const (
+	LokiFormatProtobuf = "protobuf"
+	LokiFormatJSON     = "json"
+)
+
+var (
+	ErrLokiBadLabel  = errors.New("unknown loki label")
+	ErrLokiBadFormat = errors.New("unknown loki push format")
+)
+
+// lokiLabels maps label names to the packet field they are taken from, an
+// empty value leaves the label out
+var lokiLabels = map[string]func(*protocol.HEPPacket) string{
+	LokiLabelNodeID: func(p *protocol.HEPPacket) string {
+		return strconv.FormatUint(uint64(p.NodeID), 10)
+	},
+	LokiLabelNodeName: func(p *protocol.HEPPacket) string {
+		return p.NodeName
+	},
+	LokiLabelProtoType: func(p *protocol.HEPPacket) string {
+		return strconv.Itoa(int(p.ProtoType))
+	},
+	LokiLabelSIPMethod: func(p *protocol.HEPPacket) string {
+		if p.SIP == nil {
+			return ""
+		}
+		if p.SIP.IsRequest() {
+			return sipMethodLabel(p.SIP.Method)
+		}
+		return sipMethodLabel(p.SIP.CSeqMethod)
+	},
+}
+
+// LokiWriter pushes packet payloads as log lines to Grafana Loki. Every
+// stream carries the job label and a type label, "hep" for packets and "log"
+// for application logs, plus the configured packet labels. The other packet
+// fields are sent as structured metadata.
+type LokiWriter struct {
+	*BatchWriter
+	client   *http.Client
+	url      string
+	job      string
+	labels   []string
+	format   string
+	tenantID string
+	username string
+	password string
+}
+
+type LokiConfig struct {
+	URL string
+	// Labels are taken from the packet fields, see the LokiLabel constants
+	Labels    []string
+	Job       string
+	Format    string
+	TenantID  string
+	Username  string
+	Password  string
+	BatchSize int
+	Timeout   time.Duration
+}
+
+func NewLokiWriter(config LokiConfig) (*LokiWriter, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("loki url required")
+	}
+	for _, label := range config.Labels {
+		if _, ok := lokiLabels[label]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrLokiBadLabel, label)
+		}
+	}
+	switch config.Format {
+	case "":
+		config.Format = LokiFormatProtobuf
+	case LokiFormatProtobuf, LokiFormatJSON:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrLokiBadFormat, config.Format)
+	}
+	if config.Job == "" {
+		config.Job = "hepop"
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	w := &LokiWriter{
+		client:   &http.Client{Timeout: config.Timeout},
+		url:      strings.TrimSuffix(config.URL, "/"),
+		job:      config.Job,
+		labels:   config.Labels,
+		format:   config.Format,
+		tenantID: config.TenantID,
+		username: config.Username,
+		password: config.Password,
+	}
+	w.BatchWriter = newBatchWriter(config.BatchSize, w.flush)
+	return w, nil
+}
+
+// lokiStream is a set of entries sharing the same labels
+type lokiStream struct {
+	labels  map[string]string
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	time     time.Time
+	line     string
+	metadata []lokiLabel
+}
+
+type lokiLabel struct {
+	name, value string
+}
+
+// Structured metadata names of the packet fields
+const (
+	lokiSrcIP      = "src_ip"
+	lokiDstIP      = "dst_ip"
+	lokiSrcPort    = "src_port"
+	lokiDstPort    = "dst_port"
+	lokiCID        = "cid"
+	lokiVlan       = "vlan"
+	lokiVersion    = "hep_version"
+	lokiProtocol   = "protocol"
+	lokiNodeIDs    = "node_ids"
+	lokiEncoding   = "encoding"
+	lokiEnrichment = "enrichment_"
+)
+
+// lokiLine returns the payload as log line, binary payloads are base64
+// encoded and marked with an encoding field
+func lokiLine(packet *protocol.HEPPacket) (string, bool) {
+	if utf8.Valid(packet.Payload) {
+		return string(packet.Payload), false
+	}
+	return base64.StdEncoding.EncodeToString(packet.Payload), true
+}
+
+// metadata returns the packet fields that are not stream labels
+func (w *LokiWriter) metadata(packet *protocol.HEPPacket, labels map[string]string, base64Line bool) []lokiLabel {
+	var metadata []lokiLabel
+	add := func(name, value string) {
+		if _, ok := labels[name]; value != "" && !ok {
+			metadata = append(metadata, lokiLabel{name, value})
+		}
+	}
+	add(lokiSrcIP, packet.SrcIP)
+	add(lokiDstIP, packet.DstIP)
+	add(lokiSrcPort, strconv.Itoa(int(packet.SrcPort)))
+	add(lokiDstPort, strconv.Itoa(int(packet.DstPort)))
+	add(lokiCID, packet.CID)
+	if packet.Vlan != 0 {
+		add(lokiVlan, strconv.Itoa(int(packet.Vlan)))
+	}
+	add(lokiVersion, strconv.Itoa(int(packet.Version)))
+	add(lokiProtocol, strconv.Itoa(int(packet.Protocol)))
+	for name, label := range lokiLabels {
+		add(name, label(packet))
+	}
+	if len(packet.NodeIDs) > 0 {
+		ids := make([]string, len(packet.NodeIDs))
+		for i, id := range packet.NodeIDs {
+			ids[i] = strconv.FormatUint(uint64(id), 10)
+		}
+		add(lokiNodeIDs, strings.Join(ids, ","))
+	}
+	names := make([]string, 0, len(packet.Enrichment))
+	for name := range packet.Enrichment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(lokiEnrichment+name, packet.Enrichment[name])
+	}
+	if base64Line {
+		add(lokiEncoding, "base64")
+	}
+	sort.Slice(metadata, func(i, j int) bool { return metadata[i].name < metadata[j].name })
+	return metadata
+}
+
+func (w *LokiWriter) flush() {
+	w.mu.Lock()
+	packets := make([]*protocol.HEPPacket, len(w.buffer))
+	copy(packets, w.buffer)
+	w.buffer = w.buffer[:0]
+	w.mu.Unlock()
+
+	if len(packets) == 0 {
+		return
+	}
+
+	streams := make(map[string]*lokiStream)
+	var keys []string
+	for _, packet := range packets {
+		line, base64Line := lokiLine(packet)
+		labels := w.streamLabels(packet)
+		key := formatLokiLabels(labels)
+		stream, ok := streams[key]
+		if !ok {
+			stream = &lokiStream{labels: labels}
+			streams[key] = stream
+			keys = append(keys, key)
+		}
+		stream.entries = append(stream.entries, lokiEntry{
+			time:     packet.Time(),
+			line:     line,
+			metadata: w.metadata(packet, labels, base64Line),
+		})
+	}
+
+	var body []byte
+	var contentType string
+	var err error
+	if w.format == LokiFormatJSON {
+		body, err = encodeLokiJSON(keys, streams)
+		contentType = "application/json"
+	} else {
+		body = snappy.Encode(nil, encodeLokiProtobuf(keys, streams))
+		contentType = "application/x-protobuf"
+	}
+	if err != nil {
+		w.updateStats(false, 0, err)
+		return
+	}
+
+	if err := w.push(body, contentType); err != nil {
+		w.updateStats(false, 0, err)
+		return
+	}
+	w.updateStats(true, uint64(len(body)), nil)
+}
+
+func (w *LokiWriter) streamLabels(packet *protocol.HEPPacket) map[string]string {
+	labels := map[string]string{"job": w.job, "type": "hep"}
+	if packet.ProtoType == protocol.ProtoTypeLog {
+		labels["type"] = "log"
+	}
+	for _, name := range w.labels {
+		if value := lokiLabels[name](packet); value != "" {
+			labels[name] = value
+		}
+	}
+	return labels
+}
+
+func (w *LokiWriter) push(body []byte, contentType string) error {
+	req, err := http.NewRequest(http.MethodPost, w.url+"/loki/api/v1/push", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	w.authorize(req)
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("loki push failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("loki push failed: %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (w *LokiWriter) authorize(req *http.Request) {
+	if w.tenantID != "" {
+		req.Header.Set("X-Scope-OrgID", w.tenantID)
+	}
+	if w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+}
+
+// formatLokiLabels renders labels as a stream selector, sorted by name
+func formatLokiLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func encodeLokiJSON(keys []string, streams map[string]*lokiStream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][]interface{}   `json:"values"`
+	}
+	request := struct {
+		Streams []jsonStream `json:"streams"`
+	}{}
+	for _, key := range keys {
+		stream := streams[key]
+		values := make([][]interface{}, len(stream.entries))
+		for i, entry := range stream.entries {
+			metadata := make(map[string]string, len(entry.metadata))
+			for _, label := range entry.metadata {
+				metadata[label.name] = label.value
+			}
+			values[i] = []interface{}{strconv.FormatInt(entry.time.UnixNano(), 10), entry.line, metadata}
+		}
+		request.Streams = append(request.Streams, jsonStream{Stream: stream.labels, Values: values})
+	}
+	return json.Marshal(request)
+}
+
+// encodeLokiProtobuf encodes a logproto.PushRequest:
+//
+//	PushRequest  { repeated Stream streams = 1; }
+//	Stream       { string labels = 1; repeated Entry entries = 2; }
+//	Entry        { google.protobuf.Timestamp timestamp = 1; string line = 2;
+//	               repeated LabelPair structuredMetadata = 3; }
+//	LabelPair    { string name = 1; string value = 2; }
+func encodeLokiProtobuf(keys []string, streams map[string]*lokiStream) []byte {
+	var request []byte
+	for _, key := range keys {
+		var stream []byte
+		stream = protowire.AppendTag(stream, 1, protowire.BytesType)
+		stream = protowire.AppendString(stream, key)
+		for _, entry := range streams[key].entries {
+			var ts []byte
+			ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(entry.time.Unix()))
+			if nanos := entry.time.Nanosecond(); nanos != 0 {
+				ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+				ts = protowire.AppendVarint(ts, uint64(nanos))
+			}
+
+			var e []byte
+			e = protowire.AppendTag(e, 1, protowire.BytesType)
+			e = protowire.AppendBytes(e, ts)
+			e = protowire.AppendTag(e, 2, protowire.BytesType)
+			e = protowire.AppendString(e, entry.line)
+			for _, label := range entry.metadata {
+				var pair []byte
+				pair = protowire.AppendTag(pair, 1, protowire.BytesType)
+				pair = protowire.AppendString(pair, label.name)
+				pair = protowire.AppendTag(pair, 2, protowire.BytesType)
+				pair = protowire.AppendString(pair, label.value)
+				e = protowire.AppendTag(e, 3, protowire.BytesType)
+				e = protowire.AppendBytes(e, pair)
+			}
+
+			stream = protowire.AppendTag(stream, 2, protowire.BytesType)
+			stream = protowire.AppendBytes(stream, e)
+		}
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, stream)
+	}
+	return request
+}
+
+// Search runs a LogQL range query. A query starting with a stream selector
+// replaces the default one, any other query is appended to it as pipeline
+// stages, e.g. `|= "INVITE"` or `| src_ip="10.0.0.1"`. Packets are rebuilt
+// from the line and the labels, which include the structured metadata.
+func (w *LokiWriter) Search(ctx context.Context, params SearchParams) (SearchResult, error) {
+	values := url.Values{}
+	values.Set("query", w.logQL(params))
+	values.Set("start", strconv.FormatInt(params.FromTime.UnixNano(), 10))
+	values.Set("end", strconv.FormatInt(params.ToTime.UnixNano(), 10))
+	if params.Limit > 0 {
+		values.Set("limit", strconv.Itoa(params.Limit))
+	}
+	direction := "forward"
+	if params.OrderDesc {
+		direction = "backward"
+	}
+	values.Set("direction", direction)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.url+"/loki/api/v1/query_range?"+values.Encode(), nil)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	w.authorize(req)
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return SearchResult{}, fmt.Errorf("search query failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return SearchResult{}, fmt.Errorf("search query error: %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var lokiResponse struct {
+		Data struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Stream map[string]string `json:"stream"`
+				Values [][2]string       `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&lokiResponse); err != nil {
+		return SearchResult{}, fmt.Errorf("decoding response failed: %w", err)
+	}
+	if lokiResponse.Data.ResultType != "streams" {
+		return SearchResult{}, fmt.Errorf("unexpected result type %q, metric queries are not supported", lokiResponse.Data.ResultType)
+	}
+
+	type hit struct {
+		ns     int64
+		packet *protocol.HEPPacket
+	}
+	var hits []hit
+	for _, stream := range lokiResponse.Data.Result {
+		for _, value := range stream.Values {
+			ns, _ := strconv.ParseInt(value[0], 10, 64)
+			packet, err := lokiPacket(ns, value[1], stream.Stream)
+			if err != nil {
+				continue
+			}
+			hits = append(hits, hit{ns, packet})
+		}
+	}
+	// Loki orders the entries per stream only
+	sort.SliceStable(hits, func(i, j int) bool {
+		if params.OrderDesc {
+			return hits[i].ns > hits[j].ns
+		}
+		return hits[i].ns < hits[j].ns
+	})
+
+	results := make([]*protocol.HEPPacket, len(hits))
+	for i, h := range hits {
+		results[i] = h.packet
+	}
+	return SearchResult{
+		Total:   int64(len(results)),
+		Results: results,
+	}, nil
+}
+
+// lokiPacket rebuilds a packet from an entry and its labels
+func lokiPacket(ns int64, line string, labels map[string]string) (*protocol.HEPPacket, error) {
+	packet := &protocol.HEPPacket{
+		Timestamp:     uint64(ns / int64(time.Second)),
+		TimestampUsec: uint32(ns % int64(time.Second) / int64(time.Microsecond)),
+		Payload:       []byte(line),
+		SrcIP:         labels[lokiSrcIP],
+		DstIP:         labels[lokiDstIP],
+		CID:           labels[lokiCID],
+		NodeName:      labels[LokiLabelNodeName],
+	}
+	if labels[lokiEncoding] == "base64" {
+		payload, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, err
+		}
+		packet.Payload = payload
+	}
+	number := func(name string, bits int) uint64 {
+		n, _ := strconv.ParseUint(labels[name], 10, bits)
+		return n
+	}
+	packet.SrcPort = uint16(number(lokiSrcPort, 16))
+	packet.DstPort = uint16(number(lokiDstPort, 16))
+	packet.Vlan = uint16(number(lokiVlan, 16))
+	packet.Version = uint8(number(lokiVersion, 8))
+	packet.Protocol = uint8(number(lokiProtocol, 8))
+	packet.ProtoType = uint8(number(LokiLabelProtoType, 8))
+	packet.NodeID = uint32(number(LokiLabelNodeID, 32))
+	if ids := labels[lokiNodeIDs]; ids != "" {
+		for _, id := range strings.Split(ids, ",") {
+			n, _ := strconv.ParseUint(id, 10, 32)
+			packet.NodeIDs = append(packet.NodeIDs, uint32(n))
+		}
+	}
+	for name, value := range labels {
+		if strings.HasPrefix(name, lokiEnrichment) {
+			if packet.Enrichment == nil {
+				packet.Enrichment = make(map[string]string)
+			}
+			packet.Enrichment[strings.TrimPrefix(name, lokiEnrichment)] = value
+		}
+	}
+	return packet, nil
+}
+
+func (w *LokiWriter) logQL(params SearchParams) string {
+	query := strings.TrimSpace(params.Query)
+
+	var b strings.Builder
+	if strings.HasPrefix(query, "{") {
+		b.WriteString(query)
+	} else {
+		b.WriteString(`{job=`)
+		b.WriteString(strconv.Quote(w.job))
+		if params.IncludeLogs {
+			b.WriteString(`, type=~"hep|log"}`)
+		} else {
+			b.WriteString(`, type="hep"}`)
+		}
+		if query != "" {
+			b.WriteByte(' ')
+			b.WriteString(query)
+		}
+	}
+
+	if len(params.CIDs) > 0 {
+		cids := make([]string, len(params.CIDs))
+		for i, cid := range params.CIDs {
+			cids[i] = regexp.QuoteMeta(cid)
+		}
+		b.WriteString(` | cid=~`)
+		b.WriteString(strconv.Quote(strings.Join(cids, "|")))
+	}
+	return b.String()
+}
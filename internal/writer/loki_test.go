@@ -0,0 +1,278 @@
+package writer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type lokiStub struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (s *lokiStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	s.requests = append(s.requests, r)
+	s.bodies = append(s.bodies, body)
+	s.mu.Unlock()
+
+	if r.URL.Path == "/loki/api/v1/query_range" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": "streams",
+				"result": []interface{}{
+					map[string]interface{}{
+						"stream": map[string]string{"type": "hep", "cid": "call-1", "proto_type": "1", "src_ip": "10.0.0.1", "src_port": "5060", "enrichment_site": "fra"},
+						"values": [][2]string{{"1700000005000250000", "BYE sip:bob@example.com SIP/2.0\r\n"}},
+					},
+					map[string]interface{}{
+						"stream": map[string]string{"type": "log", "cid": "call-1", "proto_type": "100", "node_id": "2001"},
+						"values": [][2]string{{"1700000000000000000", "INFO: call-1 started"}},
+					},
+				},
+			},
+		})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func sipPacket(node uint32, method string) *protocol.HEPPacket {
+	return &protocol.HEPPacket{
+		NodeID:    node,
+		ProtoType: protocol.ProtoTypeSIP,
+		Timestamp: 1700000000,
+		CID:       "call-1",
+		SrcIP:     "10.0.0.1",
+		SrcPort:   5060,
+		Payload:   []byte(method + " sip:bob@example.com SIP/2.0\r\n"),
+		SIP:       &protocol.SIPMessage{Method: method},
+	}
+}
+
+type lokiTestEntry struct {
+	line     string
+	metadata map[string]string
+}
+
+// decodeLokiProtobuf returns the entries of a push request per stream
+func decodeLokiProtobuf(t *testing.T, b []byte) map[string][]lokiTestEntry {
+	t.Helper()
+	streams := make(map[string][]lokiTestEntry)
+	for len(b) > 0 {
+		_, _, n := protowire.ConsumeTag(b)
+		stream, m := protowire.ConsumeBytes(b[n:])
+		if m < 0 {
+			t.Fatalf("Invalid push request")
+		}
+		b = b[n+m:]
+
+		var labels string
+		for len(stream) > 0 {
+			num, _, n := protowire.ConsumeTag(stream)
+			field, m := protowire.ConsumeBytes(stream[n:])
+			stream = stream[n+m:]
+			if num == 1 {
+				labels = string(field)
+				continue
+			}
+			entry := lokiTestEntry{metadata: make(map[string]string)}
+			for len(field) > 0 {
+				num, _, n := protowire.ConsumeTag(field)
+				value, m := protowire.ConsumeBytes(field[n:])
+				field = field[n+m:]
+				switch num {
+				case 2:
+					entry.line = string(value)
+				case 3:
+					var pair [2]string
+					for len(value) > 0 {
+						num, _, n := protowire.ConsumeTag(value)
+						s, m := protowire.ConsumeBytes(value[n:])
+						value = value[n+m:]
+						pair[num-1] = string(s)
+					}
+					entry.metadata[pair[0]] = pair[1]
+				}
+			}
+			streams[labels] = append(streams[labels], entry)
+		}
+	}
+	return streams
+}
+
+func TestLokiWriterPushProtobuf(t *testing.T) {
+	stub := &lokiStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	w, err := NewLokiWriter(LokiConfig{
+		URL:       server.URL,
+		Labels:    []string{LokiLabelNodeID, LokiLabelSIPMethod},
+		TenantID:  "tenant-1",
+		BatchSize: 100,
+	})
+	if err != nil {
+		t.Fatalf("NewLokiWriter failed: %v", err)
+	}
+
+	w.Write(sipPacket(2001, "INVITE"))
+	w.Write(sipPacket(2001, "INVITE"))
+	w.Write(sipPacket(2002, "BYE"))
+	w.Write(&protocol.HEPPacket{NodeID: 2001, ProtoType: protocol.ProtoTypeLog, Timestamp: 1700000000, Payload: []byte("INFO: started")})
+	w.Write(&protocol.HEPPacket{NodeID: 2001, ProtoType: protocol.ProtoTypeLog, Timestamp: 1700000000, Payload: []byte{0xff, 0x00}})
+	w.Close()
+
+	// The flush ticker may split the batch
+	streams := make(map[string][]lokiTestEntry)
+	for i, req := range stub.requests {
+		if req.URL.Path != "/loki/api/v1/push" || req.Header.Get("Content-Type") != "application/x-protobuf" || req.Header.Get("X-Scope-OrgID") != "tenant-1" {
+			t.Errorf("Unexpected push request: %s %v", req.URL.Path, req.Header)
+		}
+		body, err := snappy.Decode(nil, stub.bodies[i])
+		if err != nil {
+			t.Fatalf("Snappy decode failed: %v", err)
+		}
+		for labels, lines := range decodeLokiProtobuf(t, body) {
+			streams[labels] = append(streams[labels], lines...)
+		}
+	}
+	streamsWant := map[string]int{
+		`{job="hepop", node_id="2001", sip_method="INVITE", type="hep"}`: 2,
+		`{job="hepop", node_id="2002", sip_method="BYE", type="hep"}`:    1,
+		`{job="hepop", node_id="2001", type="log"}`:                      2,
+	}
+	if len(streams) != len(streamsWant) {
+		t.Fatalf("Expected %d streams, got %v", len(streamsWant), streams)
+	}
+	for labels, n := range streamsWant {
+		if len(streams[labels]) != n {
+			t.Errorf("Expected %d entries in %s, got %d", n, labels, len(streams[labels]))
+		}
+	}
+
+	bye := streams[`{job="hepop", node_id="2002", sip_method="BYE", type="hep"}`][0]
+	if bye.line != "BYE sip:bob@example.com SIP/2.0\r\n" {
+		t.Errorf("Expected the payload as line, got %q", bye.line)
+	}
+	want := map[string]string{"cid": "call-1", "src_ip": "10.0.0.1", "src_port": "5060", "dst_port": "0", "proto_type": "1", "hep_version": "0", "protocol": "0"}
+	if !reflect.DeepEqual(bye.metadata, want) {
+		t.Errorf("Expected metadata %v, got %v", want, bye.metadata)
+	}
+	binary := streams[`{job="hepop", node_id="2001", type="log"}`][1]
+	if binary.line != "/wA=" || binary.metadata["encoding"] != "base64" {
+		t.Errorf("Expected a base64 line, got %+v", binary)
+	}
+}
+
+func TestLokiWriterPushJSON(t *testing.T) {
+	stub := &lokiStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	w, err := NewLokiWriter(LokiConfig{URL: server.URL, Format: LokiFormatJSON, Labels: []string{LokiLabelProtoType}, BatchSize: 100})
+	if err != nil {
+		t.Fatalf("NewLokiWriter failed: %v", err)
+	}
+	w.Write(sipPacket(2001, "INVITE"))
+	w.Close()
+
+	if len(stub.requests) != 1 || stub.requests[0].Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected 1 JSON push, got %d", len(stub.requests))
+	}
+	var request struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][]interface{}   `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(stub.bodies[0], &request); err != nil {
+		t.Fatalf("Decoding push failed: %v", err)
+	}
+	if len(request.Streams) != 1 || request.Streams[0].Stream["proto_type"] != "1" || request.Streams[0].Values[0][0] != "1700000000000000000" ||
+		request.Streams[0].Values[0][1] != "INVITE sip:bob@example.com SIP/2.0\r\n" {
+		t.Errorf("Unexpected push request: %s", stub.bodies[0])
+	}
+	if metadata, _ := request.Streams[0].Values[0][2].(map[string]interface{}); metadata["cid"] != "call-1" || metadata["node_id"] != "2001" {
+		t.Errorf("Expected structured metadata, got %v", request.Streams[0].Values[0])
+	}
+	if stats := w.Stats(); stats.Errors != 0 || stats.FileSize != int64(len(stub.bodies[0])) {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestLokiWriterSearch(t *testing.T) {
+	stub := &lokiStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	w, err := NewLokiWriter(LokiConfig{URL: server.URL, Job: "sbc", BatchSize: 100})
+	if err != nil {
+		t.Fatalf("NewLokiWriter failed: %v", err)
+	}
+	defer w.Close()
+
+	from := time.Unix(1700000000, 0)
+	result, err := w.Search(context.Background(), SearchParams{
+		Query:       `|= "INVITE"`,
+		FromTime:    from,
+		ToTime:      from.Add(time.Hour),
+		Limit:       50,
+		CIDs:        []string{"call-1", "a.b"},
+		IncludeLogs: true,
+	})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+
+	query := stub.requests[0].URL.Query()
+	wantQuery := `{job="sbc", type=~"hep|log"} |= "INVITE" | cid=~"call-1|a\\.b"`
+	if query.Get("query") != wantQuery {
+		t.Errorf("Expected query %s, got %s", wantQuery, query.Get("query"))
+	}
+	if query.Get("start") != "1700000000000000000" || query.Get("end") != "1700003600000000000" || query.Get("limit") != "50" || query.Get("direction") != "forward" {
+		t.Errorf("Unexpected query parameters: %v", query)
+	}
+
+	if result.Total != 2 || result.Results[0].Timestamp != 1700000000 || result.Results[1].Timestamp != 1700000005 {
+		t.Fatalf("Expected both streams ordered by time, got %+v", result)
+	}
+	log, bye := result.Results[0], result.Results[1]
+	if log.ProtoType != protocol.ProtoTypeLog || log.NodeID != 2001 || string(log.Payload) != "INFO: call-1 started" {
+		t.Errorf("Unexpected log packet: %+v", log)
+	}
+	if bye.TimestampUsec != 250 || bye.CID != "call-1" || bye.SrcIP != "10.0.0.1" || bye.SrcPort != 5060 ||
+		bye.Enrichment["site"] != "fra" || string(bye.Payload) != "BYE sip:bob@example.com SIP/2.0\r\n" {
+		t.Errorf("Unexpected packet: %+v", bye)
+	}
+
+	w.Search(context.Background(), SearchParams{Query: `{job="other"} | json`, OrderDesc: true})
+	query = stub.requests[1].URL.Query()
+	if query.Get("query") != `{job="other"} | json` || query.Get("direction") != "backward" {
+		t.Errorf("Expected the selector query as is, got %v", query)
+	}
+}
+
+func TestLokiWriterConfigErrors(t *testing.T) {
+	if _, err := NewLokiWriter(LokiConfig{URL: "http://localhost:3100", Labels: []string{"src_ip"}}); !errors.Is(err, ErrLokiBadLabel) {
+		t.Errorf("Expected ErrLokiBadLabel, got %v", err)
+	}
+	if _, err := NewLokiWriter(LokiConfig{URL: "http://localhost:3100", Format: "xml"}); !errors.Is(err, ErrLokiBadFormat) {
+		t.Errorf("Expected ErrLokiBadFormat, got %v", err)
+	}
+}
@@ -0,0 +1,439 @@
+package writer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Formats a MetricsWriter ships time series in
+const (
+	MetricsFormatInflux      = "influx"
+	MetricsFormatRemoteWrite = "remote_write"
+)
+
+var ErrMetricsBadFormat = errors.New("unknown metrics format")
+
+// MetricsWriter stores no packets but aggregates them, the CDRs and the RTP
+// reports into time series and ships them once per window: packets per
+// agent, SIP requests and responses, calls by final status, call setup
+// time and duration, and RTP MOS, jitter and loss per node. Counts are
+// per window, e.g. calls per minute with the default window.
+type MetricsWriter struct {
+	BaseWriter
+	client   *http.Client
+	url      string
+	format   string
+	window   time.Duration
+	labels   map[string]string
+	token    string
+	username string
+	password string
+
+	seriesMu sync.Mutex
+	series   map[string]*metricSeries
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type MetricsConfig struct {
+	// URL is the Influx write endpoint including the database or bucket,
+	// e.g. http://influx:8086/api/v2/write?org=voip&bucket=hep, or the
+	// Prometheus remote write endpoint
+	URL string
+	// Format is influx (line protocol) or remote_write
+	Format string
+	// Window is the aggregation interval, default 1m
+	Window time.Duration
+	// Labels are added to every series, e.g. instance
+	Labels map[string]string
+	// Token is sent as "Token" to Influx and as "Bearer" for remote write
+	Token    string
+	Username string
+	Password string
+	Timeout  time.Duration
+}
+
+type metricKind int
+
+const (
+	// metricCount sums events in the window
+	metricCount metricKind = iota
+	// metricGauge keeps the average, minimum and maximum of samples
+	metricGauge
+)
+
+type metricLabel struct {
+	name  string
+	value string
+}
+
+type metricSeries struct {
+	name   string
+	kind   metricKind
+	labels []metricLabel
+	count  int64
+	sum    float64
+	min    float64
+	max    float64
+}
+
+// metricPoint is one value of a series at the end of a window
+type metricPoint struct {
+	name   string
+	labels []metricLabel
+	value  float64
+}
+
+func NewMetricsWriter(config MetricsConfig) (*MetricsWriter, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("metrics url required")
+	}
+	switch config.Format {
+	case "":
+		config.Format = MetricsFormatInflux
+	case MetricsFormatInflux, MetricsFormatRemoteWrite:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrMetricsBadFormat, config.Format)
+	}
+	if config.Window <= 0 {
+		config.Window = time.Minute
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	w := &MetricsWriter{
+		client:   &http.Client{Timeout: config.Timeout},
+		url:      config.URL,
+		format:   config.Format,
+		window:   config.Window,
+		labels:   config.Labels,
+		token:    config.Token,
+		username: config.Username,
+		password: config.Password,
+		series:   make(map[string]*metricSeries),
+		done:     make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.flushLoop()
+	return w, nil
+}
+
+func (w *MetricsWriter) Write(packet *protocol.HEPPacket) error {
+	node := metricNode(packet.NodeID, packet.NodeName)
+	w.count("hepop_packets", "node", node, "proto", protoName(packet.ProtoType))
+
+	if msg := packet.SIP; msg != nil {
+		if msg.IsRequest() {
+			w.count("hepop_sip_requests", "node", node, "method", sipMethodLabel(msg.Method))
+		} else {
+			w.count("hepop_sip_responses", "node", node, "method", sipMethodLabel(msg.CSeqMethod), "code", strconv.Itoa(msg.StatusCode))
+		}
+	}
+	return nil
+}
+
+// WriteCDR counts the call by its final status and samples the setup time
+// and, for answered calls, the duration
+func (w *MetricsWriter) WriteCDR(cdr *CDR) error {
+	node := metricNode(cdr.NodeID, "")
+	w.count("hepop_calls", "node", node, "code", strconv.Itoa(cdr.FinalStatus), "cause", cdr.TerminationCause)
+	if cdr.SetupTimeMs > 0 {
+		w.gauge("hepop_call_setup_ms", float64(cdr.SetupTimeMs), "node", node)
+	}
+	if !cdr.AnswerTime.IsZero() {
+		w.gauge("hepop_call_duration_ms", float64(cdr.DurationMs), "node", node)
+	}
+	return nil
+}
+
+// WriteRTPReport samples the stream quality, reports of streams without
+// packets carry no estimate and are skipped
+func (w *MetricsWriter) WriteRTPReport(report *RTPReport) error {
+	if report.Packets == 0 {
+		return nil
+	}
+	node := metricNode(report.NodeID, "")
+	w.gauge("hepop_rtp_mos", report.MOS, "node", node)
+	w.gauge("hepop_rtp_jitter_ms", report.JitterMs, "node", node)
+	w.gauge("hepop_rtp_loss_percent", report.LossPercent, "node", node)
+	if report.Final {
+		w.count("hepop_rtp_streams", "node", node)
+	}
+	return nil
+}
+
+// sipMethods are the methods of RFC 3261 and its extensions
+var sipMethods = map[string]bool{
+	"INVITE": true, "ACK": true, "BYE": true, "CANCEL": true, "REGISTER": true,
+	"OPTIONS": true, "PRACK": true, "SUBSCRIBE": true, "NOTIFY": true,
+	"PUBLISH": true, "INFO": true, "REFER": true, "MESSAGE": true, "UPDATE": true,
+}
+
+// sipMethodLabel maps methods outside the RFC set to "other", so scanners
+// sending made-up methods cannot create a series per method
+func sipMethodLabel(method string) string {
+	if sipMethods[method] {
+		return method
+	}
+	return "other"
+}
+
+// metricNode labels series with the agent name when it sends one
+func metricNode(id uint32, name string) string {
+	if name != "" {
+		return name
+	}
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+func (w *MetricsWriter) count(name string, labels ...string) {
+	w.add(name, metricCount, 1, labels)
+}
+
+func (w *MetricsWriter) gauge(name string, value float64, labels ...string) {
+	w.add(name, metricGauge, value, labels)
+}
+
+// add records a sample, labels are name value pairs
+func (w *MetricsWriter) add(name string, kind metricKind, value float64, labels []string) {
+	var key strings.Builder
+	key.WriteString(name)
+	for _, s := range labels {
+		key.WriteByte(0)
+		key.WriteString(s)
+	}
+
+	w.seriesMu.Lock()
+	defer w.seriesMu.Unlock()
+
+	series, ok := w.series[key.String()]
+	if !ok {
+		series = &metricSeries{name: name, kind: kind, labels: w.seriesLabels(labels), min: value, max: value}
+		w.series[key.String()] = series
+	}
+	series.count++
+	series.sum += value
+	series.min = math.Min(series.min, value)
+	series.max = math.Max(series.max, value)
+}
+
+// seriesLabels merges the static labels and sorts them by name
+func (w *MetricsWriter) seriesLabels(pairs []string) []metricLabel {
+	labels := make([]metricLabel, 0, len(w.labels)+len(pairs)/2)
+	for name, value := range w.labels {
+		labels = append(labels, metricLabel{name, value})
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			labels = append(labels, metricLabel{pairs[i], pairs[i+1]})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
+}
+
+func (w *MetricsWriter) flushLoop() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.flush(time.Now())
+		}
+	}
+}
+
+// flush ships the series of the window ending at now and starts a new one
+func (w *MetricsWriter) flush(now time.Time) {
+	w.seriesMu.Lock()
+	series := w.series
+	w.series = make(map[string]*metricSeries)
+	w.seriesMu.Unlock()
+
+	points := windowPoints(series)
+	if len(points) == 0 {
+		return
+	}
+
+	var body []byte
+	if w.format == MetricsFormatRemoteWrite {
+		body = snappy.Encode(nil, encodeRemoteWrite(points, now))
+	} else {
+		body = encodeInfluxLines(points, now)
+	}
+	if err := w.push(body); err != nil {
+		w.updateStats(false, 0, err)
+		return
+	}
+	w.updateStats(true, uint64(len(body)), nil)
+}
+
+// windowPoints turns counts into one point and gauges into _avg, _min and
+// _max points, sorted for stable output
+func windowPoints(series map[string]*metricSeries) []metricPoint {
+	points := make([]metricPoint, 0, len(series))
+	for _, s := range series {
+		if s.kind == metricCount {
+			points = append(points, metricPoint{s.name, s.labels, s.sum})
+			continue
+		}
+		points = append(points,
+			metricPoint{s.name + "_avg", s.labels, s.sum / float64(s.count)},
+			metricPoint{s.name + "_min", s.labels, s.min},
+			metricPoint{s.name + "_max", s.labels, s.max},
+		)
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].name != points[j].name {
+			return points[i].name < points[j].name
+		}
+		return formatMetricLabels(points[i].labels) < formatMetricLabels(points[j].labels)
+	})
+	return points
+}
+
+func formatMetricLabels(labels []metricLabel) string {
+	var b strings.Builder
+	for _, label := range labels {
+		b.WriteString(label.name)
+		b.WriteByte('=')
+		b.WriteString(label.value)
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+var (
+	influxNameEscaper  = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxLabelEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// encodeInfluxLines renders points in line protocol, one measurement per
+// series with the labels as tags and a single value field
+func encodeInfluxLines(points []metricPoint, now time.Time) []byte {
+	var b bytes.Buffer
+	ts := strconv.FormatInt(now.UnixNano(), 10)
+	for _, point := range points {
+		b.WriteString(influxNameEscaper.Replace(point.name))
+		for _, label := range point.labels {
+			b.WriteByte(',')
+			b.WriteString(influxLabelEscaper.Replace(label.name))
+			b.WriteByte('=')
+			b.WriteString(influxLabelEscaper.Replace(label.value))
+		}
+		b.WriteString(" value=")
+		b.WriteString(strconv.FormatFloat(point.value, 'g', -1, 64))
+		b.WriteByte(' ')
+		b.WriteString(ts)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// encodeRemoteWrite encodes a prometheus.WriteRequest:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeRemoteWrite(points []metricPoint, now time.Time) []byte {
+	label := func(b []byte, name, value string) []byte {
+		var l []byte
+		l = protowire.AppendTag(l, 1, protowire.BytesType)
+		l = protowire.AppendString(l, name)
+		l = protowire.AppendTag(l, 2, protowire.BytesType)
+		l = protowire.AppendString(l, value)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		return protowire.AppendBytes(b, l)
+	}
+
+	var request []byte
+	for _, point := range points {
+		labels := append([]metricLabel{{"__name__", point.name}}, point.labels...)
+		sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+		var ts []byte
+		for _, l := range labels {
+			ts = label(ts, l.name, l.value)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(point.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(now.UnixMilli()))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, ts)
+	}
+	return request
+}
+
+func (w *MetricsWriter) push(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if w.format == MetricsFormatRemoteWrite {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		if w.token != "" {
+			req.Header.Set("Authorization", "Bearer "+w.token)
+		}
+	} else {
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if w.token != "" {
+			req.Header.Set("Authorization", "Token "+w.token)
+		}
+	}
+	if w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("metrics push failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("metrics push failed: %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (w *MetricsWriter) Search(ctx context.Context, params SearchParams) (SearchResult, error) {
+	return SearchResult{}, ErrSearchNotSupported
+}
+
+// Close ships the series of the unfinished window
+func (w *MetricsWriter) Close() error {
+	close(w.done)
+	w.wg.Wait()
+	w.flush(time.Now())
+	return nil
+}
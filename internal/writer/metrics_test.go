@@ -0,0 +1,193 @@
+package writer
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type metricsStub struct {
+	server  *httptest.Server
+	headers http.Header
+	body    []byte
+}
+
+func newMetricsStub(t *testing.T) *metricsStub {
+	stub := &metricsStub{}
+	stub.server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		stub.headers = r.Header.Clone()
+		stub.body, _ = io.ReadAll(r.Body)
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(stub.server.Close)
+	return stub
+}
+
+func writeMetricsSamples(w *MetricsWriter) {
+	sip := func(method string, status int) *protocol.HEPPacket {
+		return &protocol.HEPPacket{ProtoType: protocol.ProtoTypeSIP, NodeName: "sbc 1", SIP: &protocol.SIPMessage{Method: method, StatusCode: status, CSeqMethod: "INVITE"}}
+	}
+	w.Write(sip("INVITE", 0))
+	w.Write(sip("", 486))
+	w.Write(sip("", 486))
+	w.Write(&protocol.HEPPacket{ProtoType: protocol.ProtoTypeRTCP, NodeID: 2001})
+
+	w.WriteCDR(&CDR{NodeID: 2001, FinalStatus: 200, TerminationCause: CDRCompleted, SetupTimeMs: 300, AnswerTime: time.Unix(1700000000, 0), DurationMs: 60000})
+	w.WriteCDR(&CDR{NodeID: 2001, FinalStatus: 486, TerminationCause: CDRFailed, SetupTimeMs: 100})
+
+	w.WriteRTPReport(&RTPReport{NodeID: 2001, Packets: 100, MOS: 4.2, JitterMs: 2})
+	w.WriteRTPReport(&RTPReport{NodeID: 2001, Packets: 100, MOS: 3.4, JitterMs: 6, Final: true})
+	w.WriteRTPReport(&RTPReport{NodeID: 2001})
+}
+
+func TestMetricsWriterInflux(t *testing.T) {
+	stub := newMetricsStub(t)
+	w, err := NewMetricsWriter(MetricsConfig{URL: stub.server.URL, Token: "secret", Labels: map[string]string{"instance": "hepop1"}})
+	if err != nil {
+		t.Fatalf("NewMetricsWriter failed: %v", err)
+	}
+	defer w.Close()
+
+	writeMetricsSamples(w)
+	now := time.Unix(1700000060, 0)
+	w.flush(now)
+
+	if got := stub.headers.Get("Authorization"); got != "Token secret" {
+		t.Errorf("Expected Influx token auth, got %q", got)
+	}
+	lines := strings.Split(strings.TrimSpace(string(stub.body)), "\n")
+	want := []string{
+		`hepop_call_duration_ms_avg,instance=hepop1,node=2001 value=60000 1700000060000000000`,
+		`hepop_call_setup_ms_avg,instance=hepop1,node=2001 value=200 1700000060000000000`,
+		`hepop_calls,cause=completed,code=200,instance=hepop1,node=2001 value=1 1700000060000000000`,
+		`hepop_calls,cause=failed,code=486,instance=hepop1,node=2001 value=1 1700000060000000000`,
+		`hepop_packets,instance=hepop1,node=2001,proto=rtcp value=1 1700000060000000000`,
+		`hepop_packets,instance=hepop1,node=sbc\ 1,proto=sip value=3 1700000060000000000`,
+		`hepop_rtp_mos_avg,instance=hepop1,node=2001 value=3.8 1700000060000000000`,
+		`hepop_rtp_mos_min,instance=hepop1,node=2001 value=3.4 1700000060000000000`,
+		`hepop_rtp_streams,instance=hepop1,node=2001 value=1 1700000060000000000`,
+		`hepop_sip_requests,instance=hepop1,method=INVITE,node=sbc\ 1 value=1 1700000060000000000`,
+		`hepop_sip_responses,code=486,instance=hepop1,method=INVITE,node=sbc\ 1 value=2 1700000060000000000`,
+	}
+	for _, line := range want {
+		found := false
+		for _, got := range lines {
+			found = found || got == line
+		}
+		if !found {
+			t.Errorf("Missing line %s in\n%s", line, stub.body)
+		}
+	}
+
+	// A window without samples is not pushed
+	stub.body = nil
+	w.flush(now.Add(time.Minute))
+	if stub.body != nil {
+		t.Errorf("Expected no push for an empty window, got %s", stub.body)
+	}
+	if stats := w.Stats(); stats.NumRecords != 1 || stats.Errors != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestMetricsWriterUnknownMethods(t *testing.T) {
+	stub := newMetricsStub(t)
+	w, err := NewMetricsWriter(MetricsConfig{URL: stub.server.URL})
+	if err != nil {
+		t.Fatalf("NewMetricsWriter failed: %v", err)
+	}
+	defer w.Close()
+
+	for _, method := range []string{"XYZZY", "FOO", "invite"} {
+		w.Write(&protocol.HEPPacket{NodeID: 7, ProtoType: protocol.ProtoTypeSIP, SIP: &protocol.SIPMessage{Method: method, CSeqMethod: method}})
+		w.Write(&protocol.HEPPacket{NodeID: 7, ProtoType: protocol.ProtoTypeSIP, SIP: &protocol.SIPMessage{StatusCode: 501, CSeqMethod: method}})
+	}
+	w.flush(time.Unix(1700000060, 0))
+
+	lines := strings.Split(strings.TrimSpace(string(stub.body)), "\n")
+	want := map[string]bool{
+		`hepop_packets,node=7,proto=sip value=6 1700000060000000000`:                   true,
+		`hepop_sip_requests,method=other,node=7 value=3 1700000060000000000`:           true,
+		`hepop_sip_responses,code=501,method=other,node=7 value=3 1700000060000000000`: true,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("Expected %d series, got\n%s", len(want), stub.body)
+	}
+	for _, line := range lines {
+		if !want[line] {
+			t.Errorf("Unexpected line %s", line)
+		}
+	}
+}
+
+func TestMetricsWriterRemoteWrite(t *testing.T) {
+	stub := newMetricsStub(t)
+	w, err := NewMetricsWriter(MetricsConfig{URL: stub.server.URL, Format: MetricsFormatRemoteWrite})
+	if err != nil {
+		t.Fatalf("NewMetricsWriter failed: %v", err)
+	}
+	defer w.Close()
+
+	w.Write(&protocol.HEPPacket{ProtoType: protocol.ProtoTypeSIP, NodeID: 7, SIP: &protocol.SIPMessage{StatusCode: 200, CSeqMethod: "INVITE"}})
+	w.flush(time.UnixMilli(1700000060123))
+
+	if stub.headers.Get("Content-Encoding") != "snappy" || stub.headers.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+		t.Errorf("Unexpected headers: %v", stub.headers)
+	}
+	data, err := snappy.Decode(nil, stub.body)
+	if err != nil {
+		t.Fatalf("Expected a snappy body: %v", err)
+	}
+
+	series := make(map[string]float64)
+	for len(data) > 0 {
+		_, _, n := protowire.ConsumeTag(data)
+		ts, m := protowire.ConsumeBytes(data[n:])
+		data = data[n+m:]
+
+		var labels []string
+		var value float64
+		for len(ts) > 0 {
+			num, _, n := protowire.ConsumeTag(ts)
+			field, m := protowire.ConsumeBytes(ts[n:])
+			ts = ts[n+m:]
+			if num == 1 {
+				_, _, n := protowire.ConsumeTag(field)
+				name, m := protowire.ConsumeBytes(field[n:])
+				_, _, k := protowire.ConsumeTag(field[n+m:])
+				val, _ := protowire.ConsumeBytes(field[n+m+k:])
+				labels = append(labels, string(name)+"="+string(val))
+				continue
+			}
+			_, _, n = protowire.ConsumeTag(field)
+			bits, m := protowire.ConsumeFixed64(field[n:])
+			value = math.Float64frombits(bits)
+			_, _, k := protowire.ConsumeTag(field[n+m:])
+			if ms, _ := protowire.ConsumeVarint(field[n+m+k:]); ms != 1700000060123 {
+				t.Errorf("Expected the window end as sample time, got %d", ms)
+			}
+		}
+		series[strings.Join(labels, ",")] = value
+	}
+
+	want := map[string]float64{
+		"__name__=hepop_packets,node=7,proto=sip":                    1,
+		"__name__=hepop_sip_responses,code=200,method=INVITE,node=7": 1,
+	}
+	if len(series) != len(want) {
+		t.Errorf("Expected %d series, got %v", len(want), series)
+	}
+	for labels, value := range want {
+		if series[labels] != value {
+			t.Errorf("Expected %s = %v, got %v", labels, value, series)
+		}
+	}
+}
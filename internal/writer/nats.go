@@ -0,0 +1,118 @@
+package writer
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+// NATSWriter publishes every packet on a subject <prefix>.<proto>.<node>,
+// e.g. hep.sip.node1, so consumers can subscribe to what they need. A
+// JetStream stream capturing <prefix>.> makes the packets durable for the
+// NATS input of another instance.
+type NATSWriter struct {
+	BaseWriter
+	conn     *nats.Conn
+	prefix   string
+	encoding string
+}
+
+type NATSConfig struct {
+	URL string
+	// SubjectPrefix is the first subject token, default hep
+	SubjectPrefix string
+	// Encoding is json, protobuf or hep (HEPv3)
+	Encoding string
+	Username string
+	Password string
+	Token    string
+}
+
+func NewNATSWriter(config NATSConfig) (*NATSWriter, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("nats url required")
+	}
+	if config.SubjectPrefix == "" {
+		config.SubjectPrefix = "hep"
+	}
+	encoding, err := CheckEncoding(config.Encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := nats.Connect(config.URL, NATSOptions("hepop writer", config.Username, config.Password, config.Token)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NATSWriter{
+		conn:     conn,
+		prefix:   config.SubjectPrefix,
+		encoding: encoding,
+	}, nil
+}
+
+// NATSOptions returns the connection options shared by the NATS writer and
+// input. The connection reconnects forever and buffers packets meanwhile.
+func NATSOptions(name, username, password, token string) []nats.Option {
+	options := []nats.Option{
+		nats.Name(name),
+		nats.MaxReconnects(-1),
+	}
+	if username != "" {
+		options = append(options, nats.UserInfo(username, password))
+	}
+	if token != "" {
+		options = append(options, nats.Token(token))
+	}
+	return options
+}
+
+func (w *NATSWriter) Write(packet *protocol.HEPPacket) error {
+	data, err := encodePacket(packet, w.encoding)
+	if err != nil {
+		w.updateStats(false, 0, err)
+		return err
+	}
+
+	err = w.conn.Publish(NATSSubject(w.prefix, packet), data)
+	w.updateStats(err == nil, uint64(len(data)), err)
+	return err
+}
+
+// NATSSubject returns the subject of a packet, the node is the node name
+// when the agent sends one and the node ID otherwise
+func NATSSubject(prefix string, packet *protocol.HEPPacket) string {
+	node := strconv.FormatUint(uint64(packet.NodeID), 10)
+	if packet.NodeName != "" {
+		node = natsToken(packet.NodeName)
+	}
+	return prefix + "." + protoName(packet.ProtoType) + "." + node
+}
+
+// natsToken replaces the characters that separate subject tokens or act as
+// wildcards
+func natsToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func (w *NATSWriter) Search(ctx context.Context, params SearchParams) (SearchResult, error) {
+	return SearchResult{}, ErrSearchNotSupported
+}
+
+// Close waits until the server received the published packets
+func (w *NATSWriter) Close() error {
+	err := w.conn.Flush()
+	w.conn.Close()
+	return err
+}
@@ -0,0 +1,63 @@
+package writer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+func TestNATSSubject(t *testing.T) {
+	tests := []struct {
+		packet *protocol.HEPPacket
+		want   string
+	}{
+		{&protocol.HEPPacket{ProtoType: protocol.ProtoTypeSIP, NodeID: 2001}, "hep.sip.2001"},
+		{&protocol.HEPPacket{ProtoType: protocol.ProtoTypeSIP, NodeID: 2001, NodeName: "sbc.eu-1 *a>"}, "hep.sip.sbc_eu-1__a_"},
+		{&protocol.HEPPacket{ProtoType: protocol.ProtoTypeRTCP, NodeName: "edge"}, "hep.rtcp.edge"},
+		{&protocol.HEPPacket{ProtoType: 99}, "hep.99.0"},
+	}
+	for _, test := range tests {
+		if got := NATSSubject("hep", test.packet); got != test.want {
+			t.Errorf("NATSSubject(%d, %q) = %s, want %s", test.packet.ProtoType, test.packet.NodeName, got, test.want)
+		}
+	}
+}
+
+func TestDecodePacket(t *testing.T) {
+	packet := &protocol.HEPPacket{
+		Version:   3,
+		Protocol:  17,
+		SrcIP:     "192.0.2.1",
+		DstIP:     "192.0.2.2",
+		SrcPort:   5060,
+		DstPort:   5080,
+		Timestamp: 1700000000,
+		ProtoType: protocol.ProtoTypeSIP,
+		NodeID:    2001,
+		NodeName:  "edge",
+		Payload:   []byte("OPTIONS sip:a@b SIP/2.0\r\n"),
+		CID:       "call-1",
+		Vlan:      10,
+	}
+
+	for _, encoding := range []string{EncodingJSON, EncodingProtobuf, EncodingHEP} {
+		data, err := encodePacket(packet, encoding)
+		if err != nil {
+			t.Fatalf("encodePacket(%s) failed: %v", encoding, err)
+		}
+		decoded, err := DecodePacket(data, encoding)
+		if err != nil {
+			t.Fatalf("DecodePacket(%s) failed: %v", encoding, err)
+		}
+		if decoded.SrcIP != packet.SrcIP || decoded.DstPort != packet.DstPort || decoded.Timestamp != packet.Timestamp ||
+			decoded.NodeID != packet.NodeID || decoded.CID != packet.CID || decoded.Vlan != packet.Vlan ||
+			!bytes.Equal(decoded.Payload, packet.Payload) {
+			t.Errorf("DecodePacket(%s) = %+v", encoding, decoded)
+		}
+	}
+
+	if _, err := DecodePacket([]byte{0x0a}, EncodingProtobuf); err == nil {
+		t.Errorf("Expected an error for truncated protobuf")
+	}
+}
@@ -2,129 +2,549 @@ package writer
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/sipcapture/hepop-go/internal/manager"
 	"github.com/sipcapture/hepop-go/pkg/protocol"
+	"github.com/sirupsen/logrus"
 	"github.com/xitongsys/parquet-go-source/local"
-	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
 	"github.com/xitongsys/parquet-go/writer"
 )
 
+// Compressions of a ParquetWriter
+const (
+	ParquetCompressionSnappy = "snappy"
+	ParquetCompressionZstd   = "zstd"
+	ParquetCompressionGzip   = "gzip"
+	ParquetCompressionNone   = "none"
+)
+
+var (
+	ErrParquetBadCompression = errors.New("unknown parquet compression")
+	ErrParquetBadQuery       = errors.New("invalid parquet query")
+)
+
+// ParquetWriter writes a Hive style partitioned dataset,
+// <dir>/date=2024-03-05/hour=12/proto=sip/part-<time>-<id>.parquet, that
+// DuckDB, Spark or Athena read with hive partitioning. Every partition has
+// one open file, written under a hidden name and renamed once it holds
+// MaxRows rows or is MaxAge old, so readers only see complete files and a
+// crash loses the open files only. Search and raw SQL queries run on an
+// embedded DuckDB.
 type ParquetWriter struct {
-	filePath string
-	pw       *writer.ParquetWriter
-	stats    WriterStats
+	*BatchWriter
+	dir          string
+	compression  parquet.CompressionCodec
+	rowGroupSize int64
+	maxRows      int64
+	maxAge       time.Duration
+	closed       func(path string)
+	engine       *manager.DuckDBManager
+
+	// parts is only used by flush
+	parts map[string]*parquetPart
 }
 
 type ParquetConfig struct {
-	FilePath string `yaml:"file_path"`
+	Dir string
+	// Compression is snappy, zstd, gzip or none, default snappy
+	Compression string
+	// RowGroupSize is the uncompressed size of a row group in bytes,
+	// default 128 MB
+	RowGroupSize int64
+	// MaxRows closes files reaching it, default 1000000
+	MaxRows int64
+	// MaxAge closes files older than it, default 5 minutes. Search only
+	// reads finished files, so packets show up in it within MaxAge.
+	MaxAge    time.Duration
+	BatchSize int
+	// Closed is called with the path of every finished file
+	Closed func(path string)
+	// QueryTimeout and QueryMaxRows limit raw SQL queries, default 30
+	// seconds and 10000 rows
+	QueryTimeout time.Duration
+	QueryMaxRows int
+	// MemoryLimit is the DuckDB memory limit, e.g. 1GB
+	MemoryLimit string
+}
+
+// parquetPart is the open file of a partition
+type parquetPart struct {
+	tmp    string
+	path   string
+	file   source.ParquetFile
+	pw     *writer.ParquetWriter
+	rows   int64
+	opened time.Time
+}
+
+// parquetRow is the schema of the dataset files. The partition columns date,
+// hour and proto are in the path only. The decoded DNS, Diameter, log and
+// RTP fields, the enrichment and the agents of merged copies are JSON, empty
+// when the packet has none.
+type parquetRow struct {
+	Time        int64  `parquet:"name=time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Version     int32  `parquet:"name=version, type=INT32"`
+	Protocol    int32  `parquet:"name=protocol, type=INT32"`
+	SrcIP       string `parquet:"name=src_ip, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	SrcPort     int32  `parquet:"name=src_port, type=INT32"`
+	DstIP       string `parquet:"name=dst_ip, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	DstPort     int32  `parquet:"name=dst_port, type=INT32"`
+	ProtoType   int32  `parquet:"name=proto_type, type=INT32"`
+	NodeID      int64  `parquet:"name=node_id, type=INT64"`
+	NodeName    string `parquet:"name=node_name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	CID         string `parquet:"name=cid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Vlan        int32  `parquet:"name=vlan, type=INT32"`
+	SIPMethod   string `parquet:"name=sip_method, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	SIPStatus   int32  `parquet:"name=sip_status, type=INT32"`
+	SIPFromUser string `parquet:"name=sip_from_user, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SIPToUser   string `parquet:"name=sip_to_user, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Payload     string `parquet:"name=payload, type=BYTE_ARRAY"`
+	DNS         string `parquet:"name=dns, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Diameter    string `parquet:"name=diameter, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Log         string `parquet:"name=log, type=BYTE_ARRAY, convertedtype=UTF8"`
+	RTP         string `parquet:"name=rtp, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Enrichment  string `parquet:"name=enrichment, type=BYTE_ARRAY, convertedtype=UTF8"`
+	NodeIDs     string `parquet:"name=node_ids, type=BYTE_ARRAY, convertedtype=UTF8"`
 }
 
 func NewParquetWriter(config ParquetConfig) (*ParquetWriter, error) {
-	fw, err := local.NewLocalFileWriter(config.FilePath)
+	if config.Dir == "" {
+		return nil, fmt.Errorf("parquet dir required")
+	}
+	w := &ParquetWriter{
+		dir:          config.Dir,
+		rowGroupSize: config.RowGroupSize,
+		maxRows:      config.MaxRows,
+		maxAge:       config.MaxAge,
+		closed:       config.Closed,
+		parts:        make(map[string]*parquetPart),
+	}
+	switch config.Compression {
+	case "", ParquetCompressionSnappy:
+		w.compression = parquet.CompressionCodec_SNAPPY
+	case ParquetCompressionZstd:
+		w.compression = parquet.CompressionCodec_ZSTD
+	case ParquetCompressionGzip:
+		w.compression = parquet.CompressionCodec_GZIP
+	case ParquetCompressionNone:
+		w.compression = parquet.CompressionCodec_UNCOMPRESSED
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrParquetBadCompression, config.Compression)
+	}
+	if w.rowGroupSize <= 0 {
+		w.rowGroupSize = 128 << 20
+	}
+	if w.maxRows <= 0 {
+		w.maxRows = 1000000
+	}
+	if w.maxAge <= 0 {
+		w.maxAge = 5 * time.Minute
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("can't create parquet dir: %w", err)
+	}
+	engine, err := manager.NewDuckDBManager(manager.DuckDBConfig{
+		Dir:         config.Dir,
+		Timeout:     config.QueryTimeout,
+		MaxRows:     config.QueryMaxRows,
+		MemoryLimit: config.MemoryLimit,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("can't create local file writer: %w", err)
+		return nil, err
 	}
+	w.engine = engine
 
-	pw, err := writer.NewParquetWriter(fw, new(protocol.HEPPacket), 4)
-	if err != nil {
-		return nil, fmt.Errorf("can't create parquet writer: %w", err)
+	w.BatchWriter = newBatchWriter(config.BatchSize, w.flush)
+	return w, nil
+}
+
+// flush writes the buffered packets and closes the full and old files. The
+// batch writer calls it every second, even with an empty buffer.
+func (w *ParquetWriter) flush() {
+	w.mu.Lock()
+	packets := make([]*protocol.HEPPacket, len(w.buffer))
+	copy(packets, w.buffer)
+	w.buffer = w.buffer[:0]
+	w.mu.Unlock()
+
+	for _, packet := range packets {
+		partition := parquetPartition(packet)
+		part, err := w.part(partition)
+		if err != nil {
+			w.updateStats(false, 0, err)
+			continue
+		}
+		if err := part.pw.Write(newParquetRow(packet)); err != nil {
+			w.updateStats(false, 0, fmt.Errorf("can't write packet to parquet: %w", err))
+			continue
+		}
+		part.rows++
+		w.updateStats(true, uint64(len(packet.Payload)), nil)
+		if part.rows >= w.maxRows {
+			w.closePart(partition)
+		}
+	}
+
+	now := time.Now()
+	for partition, part := range w.parts {
+		if now.Sub(part.opened) >= w.maxAge {
+			w.closePart(partition)
+		}
 	}
+}
 
-	return &ParquetWriter{
-		filePath: config.FilePath,
-		pw:       pw,
-		stats:    WriterStats{},
-	}, nil
+// parquetPartition returns the partition directory of a packet
+func parquetPartition(packet *protocol.HEPPacket) string {
+	t := packet.Time().UTC()
+	return filepath.Join("date="+t.Format(time.DateOnly), "hour="+t.Format("15"), "proto="+protoName(packet.ProtoType))
 }
 
-func (w *ParquetWriter) Write(packet *protocol.HEPPacket) error {
-	if err := w.pw.Write(packet); err != nil {
-		return fmt.Errorf("can't write packet to parquet: %w", err)
+func newParquetRow(packet *protocol.HEPPacket) *parquetRow {
+	row := &parquetRow{
+		Time:      packet.Time().UnixMilli(),
+		Version:   int32(packet.Version),
+		Protocol:  int32(packet.Protocol),
+		SrcIP:     packet.SrcIP,
+		SrcPort:   int32(packet.SrcPort),
+		DstIP:     packet.DstIP,
+		DstPort:   int32(packet.DstPort),
+		ProtoType: int32(packet.ProtoType),
+		NodeID:    int64(packet.NodeID),
+		NodeName:  packet.NodeName,
+		CID:       packet.CID,
+		Vlan:      int32(packet.Vlan),
+		Payload:   string(packet.Payload),
+	}
+	if sip := packet.SIP; sip != nil {
+		row.SIPMethod = sip.Method
+		row.SIPStatus = int32(sip.StatusCode)
+		row.SIPFromUser = sip.From.User
+		row.SIPToUser = sip.To.User
+	}
+	if packet.DNS != nil {
+		row.DNS = parquetJSON(packet.DNS)
+	}
+	if packet.Diameter != nil {
+		row.Diameter = parquetJSON(packet.Diameter)
+	}
+	if packet.Log != nil {
+		row.Log = parquetJSON(packet.Log)
 	}
-	return nil
+	if packet.RTP != nil {
+		row.RTP = parquetJSON(packet.RTP)
+	}
+	if len(packet.Enrichment) > 0 {
+		row.Enrichment = parquetJSON(packet.Enrichment)
+	}
+	if len(packet.NodeIDs) > 0 {
+		row.NodeIDs = parquetJSON(packet.NodeIDs)
+	}
+	return row
 }
 
-func (w *ParquetWriter) Close() error {
-	if err := w.pw.WriteStop(); err != nil {
-		return fmt.Errorf("can't stop parquet writer: %w", err)
+// parquetJSON encodes a JSON column, the decoded fields always marshal
+func parquetJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// parquetUnmarshal decodes a JSON column into v unless it is empty
+func parquetUnmarshal(column string, v interface{}) {
+	if column != "" {
+		json.Unmarshal([]byte(column), v)
 	}
-	return nil
 }
 
-func (w *ParquetWriter) Search(ctx context.Context, params SearchParams) (SearchResult, error) {
-	fr, err := local.NewLocalFileReader(w.filePath)
-	if err != nil {
-		return SearchResult{}, fmt.Errorf("can't open parquet file: %w", err)
+// packet restores the packet of a row, the SIP message only has the stored
+// fields
+func (r *parquetRow) packet() *protocol.HEPPacket {
+	packet := &protocol.HEPPacket{
+		Version:       uint8(r.Version),
+		Protocol:      uint8(r.Protocol),
+		SrcIP:         r.SrcIP,
+		DstIP:         r.DstIP,
+		SrcPort:       uint16(r.SrcPort),
+		DstPort:       uint16(r.DstPort),
+		Timestamp:     uint64(r.Time / 1000),
+		TimestampUsec: uint32(r.Time%1000) * 1000,
+		ProtoType:     uint8(r.ProtoType),
+		NodeID:        uint32(r.NodeID),
+		NodeName:      r.NodeName,
+		Payload:       []byte(r.Payload),
+		CID:           r.CID,
+		Vlan:          uint16(r.Vlan),
+	}
+	if r.SIPMethod != "" || r.SIPStatus != 0 {
+		packet.SIP = &protocol.SIPMessage{
+			Method:     r.SIPMethod,
+			StatusCode: int(r.SIPStatus),
+			CallID:     r.CID,
+			From:       protocol.SIPAddress{User: r.SIPFromUser},
+			To:         protocol.SIPAddress{User: r.SIPToUser},
+		}
+	}
+	if r.DNS != "" {
+		packet.DNS = &protocol.DNSMessage{}
+		parquetUnmarshal(r.DNS, packet.DNS)
+	}
+	if r.Diameter != "" {
+		packet.Diameter = &protocol.DiameterMessage{}
+		parquetUnmarshal(r.Diameter, packet.Diameter)
 	}
-	defer fr.Close()
+	if r.Log != "" {
+		packet.Log = &protocol.LogMessage{}
+		parquetUnmarshal(r.Log, packet.Log)
+	}
+	if r.RTP != "" {
+		packet.RTP = &protocol.RTPHeader{}
+		parquetUnmarshal(r.RTP, packet.RTP)
+	}
+	parquetUnmarshal(r.Enrichment, &packet.Enrichment)
+	parquetUnmarshal(r.NodeIDs, &packet.NodeIDs)
+	return packet
+}
 
-	pr, err := reader.NewParquetReader(fr, new(protocol.HEPPacket), 4)
-	if err != nil {
-		return SearchResult{}, fmt.Errorf("can't create parquet reader: %w", err)
+// part returns the open file of a partition, creating it if needed
+func (w *ParquetWriter) part(partition string) (*parquetPart, error) {
+	if part, ok := w.parts[partition]; ok {
+		return part, nil
 	}
-	defer pr.ReadStop()
 
-	var results []*protocol.HEPPacket
-	num := int(pr.GetNumRows())
-	for i := 0; i < num; i++ {
-		packet := make([]protocol.HEPPacket, 1)
-		if err := pr.Read(&packet); err != nil {
-			return SearchResult{}, fmt.Errorf("can't read from parquet file: %w", err)
-		}
+	dir := filepath.Join(w.dir, partition)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("can't create partition: %w", err)
+	}
+	now := time.Now()
+	name := fmt.Sprintf("part-%s-%s.parquet", now.UTC().Format("20060102-150405"), uuid.NewString()[:8])
+	part := &parquetPart{
+		tmp:    filepath.Join(dir, "."+name+".inprogress"),
+		path:   filepath.Join(dir, name),
+		opened: now,
+	}
 
-		// Apply search filters
-		if matchesSearchCriteria(packet[0], params) {
-			results = append(results, &packet[0])
-		}
+	file, err := local.NewLocalFileWriter(part.tmp)
+	if err != nil {
+		return nil, fmt.Errorf("can't create parquet file: %w", err)
+	}
+	pw, err := writer.NewParquetWriter(file, new(parquetRow), 4)
+	if err != nil {
+		file.Close()
+		os.Remove(part.tmp)
+		return nil, fmt.Errorf("can't create parquet writer: %w", err)
 	}
+	pw.CompressionType = w.compression
+	pw.RowGroupSize = w.rowGroupSize
+	part.file, part.pw = file, pw
 
-	return SearchResult{
-		Total:   int64(len(results)),
-		Results: results,
-	}, nil
+	w.parts[partition] = part
+	return part, nil
 }
 
-func (w *ParquetWriter) Stats() WriterStats {
-	fileInfo, err := os.Stat(w.filePath)
+// closePart finishes the file of a partition and moves it into place
+func (w *ParquetWriter) closePart(partition string) {
+	part := w.parts[partition]
+	delete(w.parts, partition)
+
+	err := part.pw.WriteStop()
+	if cerr := part.file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(part.tmp, part.path)
+	}
 	if err != nil {
-		w.stats.Errors++
-		w.stats.LastError = err
-		return w.stats
+		os.Remove(part.tmp)
+		w.updateStats(false, 0, fmt.Errorf("can't finish %s: %w", part.path, err))
+		logrus.Errorf("Finishing %s failed, %d rows lost: %v", part.path, part.rows, err)
+		return
 	}
 
-	fr, err := local.NewLocalFileReader(w.filePath)
+	w.mu.Lock()
+	w.stats.FilePath = part.path
+	w.mu.Unlock()
+	if w.closed != nil {
+		w.closed(part.path)
+	}
+}
+
+// DuckDB returns the query engine of the dataset, e.g. for raw SQL queries
+func (w *ParquetWriter) DuckDB() *manager.DuckDBManager {
+	return w.engine
+}
+
+// Close writes the buffered packets and finishes all open files
+func (w *ParquetWriter) Close() error {
+	w.BatchWriter.Close()
+	for partition := range w.parts {
+		w.closePart(partition)
+	}
+	return w.engine.Close()
+}
+
+// Search queries the finished files with DuckDB. The query is a list of
+// field:value terms, e.g. "src_ip:192.0.2.1 sip.method:INVITE", a value
+// with * matches as wildcard and a term without field matches the source
+// IP. Filters on the time and the partition columns skip whole files.
+func (w *ParquetWriter) Search(ctx context.Context, params SearchParams) (SearchResult, error) {
+	if !w.engine.HasFiles() {
+		return SearchResult{}, nil
+	}
+
+	where, args, err := parquetConditions(params)
 	if err != nil {
-		w.stats.Errors++
-		w.stats.LastError = err
-		return w.stats
+		return SearchResult{}, err
+	}
+	order, ok := parquetFields[params.OrderBy]
+	if params.OrderBy == "" || params.OrderBy == "timestamp" {
+		order, ok = parquetField{column: "time"}, true
+	}
+	if !ok {
+		return SearchResult{}, fmt.Errorf("%w: can't order by %s", ErrParquetBadQuery, params.OrderBy)
+	}
+	direction := "ASC"
+	if params.OrderDesc {
+		direction = "DESC"
 	}
-	defer fr.Close()
 
-	pr, err := reader.NewParquetReader(fr, new(protocol.HEPPacket), 4)
+	from := " FROM (SELECT * FROM " + w.engine.Dataset() + " UNION ALL BY NAME " + parquetJSONColumns + ") WHERE " + strings.Join(where, " AND ")
+	var total int64
+	if err := w.engine.QueryRowContext(ctx, "SELECT count(*)"+from, args...).Scan(&total); err != nil {
+		return SearchResult{}, fmt.Errorf("can't count parquet rows: %w", err)
+	}
+
+	query := "SELECT " + parquetColumns + from +
+		fmt.Sprintf(" ORDER BY %s %s, time %s", order.column, direction, direction)
+	if params.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", params.Limit)
+	}
+	if params.Offset > 0 {
+		query += fmt.Sprintf(" OFFSET %d", params.Offset)
+	}
+	rows, err := w.engine.QueryContext(ctx, query, args...)
 	if err != nil {
-		w.stats.Errors++
-		w.stats.LastError = err
-		return w.stats
+		return SearchResult{}, fmt.Errorf("can't query parquet files: %w", err)
+	}
+	defer rows.Close()
+
+	var results []*protocol.HEPPacket
+	for rows.Next() {
+		var row parquetRow
+		var t time.Time
+		var payload []byte
+		if err := rows.Scan(&t, &row.Version, &row.Protocol, &row.SrcIP, &row.SrcPort, &row.DstIP, &row.DstPort, &row.ProtoType,
+			&row.NodeID, &row.NodeName, &row.CID, &row.Vlan, &row.SIPMethod, &row.SIPStatus, &row.SIPFromUser, &row.SIPToUser, &payload,
+			&row.DNS, &row.Diameter, &row.Log, &row.RTP, &row.Enrichment, &row.NodeIDs); err != nil {
+			return SearchResult{}, fmt.Errorf("can't read parquet row: %w", err)
+		}
+		row.Time = t.UnixMilli()
+		row.Payload = string(payload)
+		results = append(results, row.packet())
+	}
+	if err := rows.Err(); err != nil {
+		return SearchResult{}, fmt.Errorf("can't query parquet files: %w", err)
 	}
-	defer pr.ReadStop()
+	return SearchResult{Total: total, Results: results}, nil
+}
+
+// parquetJSONColumns adds the JSON columns to a dataset whose files were all
+// written before they existed, union_by_name only adds columns some file has
+const parquetJSONColumns = "SELECT NULL::VARCHAR AS dns, NULL::VARCHAR AS diameter, NULL::VARCHAR AS log, NULL::VARCHAR AS rtp, " +
+	"NULL::VARCHAR AS enrichment, NULL::VARCHAR AS node_ids WHERE false"
+
+// parquetColumns are the columns of a parquetRow in the order Search scans
+// them. The JSON columns are null in files written before they were added.
+const parquetColumns = "time, version, protocol, src_ip, src_port, dst_ip, dst_port, proto_type, node_id, node_name, cid, vlan, " +
+	"sip_method, sip_status, sip_from_user, sip_to_user, payload, " +
+	"coalesce(dns, ''), coalesce(diameter, ''), coalesce(log, ''), coalesce(rtp, ''), coalesce(enrichment, ''), coalesce(node_ids, '')"
 
-	w.stats.FileSize = fileInfo.Size()
-	w.stats.NumRecords = pr.GetNumRows()
-	w.stats.FilePath = w.filePath
-	w.stats.LastModified = fileInfo.ModTime().Format(time.RFC3339)
+// parquetField is a search field and its dataset column
+type parquetField struct {
+	column  string
+	numeric bool
+}
 
-	return w.stats
+var parquetFields = map[string]parquetField{
+	"version":         {column: "version", numeric: true},
+	"protocol":        {column: "protocol", numeric: true},
+	"src_ip":          {column: "src_ip"},
+	"dst_ip":          {column: "dst_ip"},
+	"src_port":        {column: "src_port", numeric: true},
+	"dst_port":        {column: "dst_port", numeric: true},
+	"proto_type":      {column: "proto_type", numeric: true},
+	"proto":           {column: "proto"},
+	"node_id":         {column: "node_id", numeric: true},
+	"node_name":       {column: "node_name"},
+	"cid":             {column: "cid"},
+	"vlan":            {column: "vlan", numeric: true},
+	"sip.method":      {column: "sip_method"},
+	"sip.status_code": {column: "sip_status", numeric: true},
+	"sip.from.user":   {column: "sip_from_user"},
+	"sip.to.user":     {column: "sip_to_user"},
 }
 
-func matchesSearchCriteria(packet protocol.HEPPacket, params SearchParams) bool {
-	// Implement your search criteria here
-	// Example: filter by source IP
-	if params.Query != "" && packet.SrcIP != params.Query {
-		return false
+// parquetConditions returns the WHERE conditions and their arguments for the
+// search parameters
+func parquetConditions(params SearchParams) ([]string, []any, error) {
+	where := []string{"true"}
+	var args []any
+	if !params.FromTime.IsZero() {
+		where = append(where, "date >= CAST(? AS DATE)", "time >= CAST(? AS TIMESTAMP)")
+		args = append(args, params.FromTime.UTC().Format(time.DateOnly), params.FromTime.UTC())
+	}
+	if !params.ToTime.IsZero() {
+		where = append(where, "date <= CAST(? AS DATE)", "time <= CAST(? AS TIMESTAMP)")
+		args = append(args, params.ToTime.UTC().Format(time.DateOnly), params.ToTime.UTC())
+	}
+	if len(params.CIDs) > 0 {
+		where = append(where, "cid IN (?"+strings.Repeat(", ?", len(params.CIDs)-1)+")")
+		for _, cid := range params.CIDs {
+			args = append(args, cid)
+		}
+	}
+	if !params.IncludeLogs {
+		where = append(where, fmt.Sprintf("proto_type <> %d", protocol.ProtoTypeLog))
+	}
+
+	for _, term := range strings.Fields(params.Query) {
+		if term == "AND" {
+			continue
+		}
+		name, value, found := strings.Cut(term, ":")
+		if !found {
+			name, value = "src_ip", term
+		}
+		field, ok := parquetFields[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: unknown field %s", ErrParquetBadQuery, name)
+		}
+		switch {
+		case field.numeric:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w: %s is not a number", ErrParquetBadQuery, term)
+			}
+			where = append(where, field.column+" = ?")
+			args = append(args, n)
+		case strings.Contains(value, "*"):
+			where = append(where, field.column+` LIKE ? ESCAPE '\'`)
+			args = append(args, strings.ReplaceAll(likeEscaper.Replace(value), "*", "%"))
+		default:
+			where = append(where, field.column+" = ?")
+			args = append(args, value)
+		}
 	}
-	// Add more conditions as needed
-	return true
+	return where, args, nil
 }
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
@@ -0,0 +1,279 @@
+package writer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+	"github.com/xitongsys/parquet-go-source/local"
+	parquetwriter "github.com/xitongsys/parquet-go/writer"
+)
+
+// listParquetFiles returns the finished and in progress files below dir
+func listParquetFiles(t *testing.T, dir string) (done, open []string) {
+	t.Helper()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		if strings.HasSuffix(path, ".inprogress") {
+			open = append(open, rel)
+		} else {
+			done = append(done, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	return done, open
+}
+
+func TestParquetWriterPartitions(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewParquetWriter(ParquetConfig{Dir: dir, Compression: ParquetCompressionZstd, MaxRows: 3, BatchSize: 100})
+	if err != nil {
+		t.Fatalf("NewParquetWriter failed: %v", err)
+	}
+
+	// 2023-11-14 22:13:20 UTC, the last SIP packet falls into the next hour
+	for i := 0; i < 5; i++ {
+		w.Write(&protocol.HEPPacket{SrcIP: "192.0.2.1", DstIP: "192.0.2.2", SrcPort: 5060, Timestamp: 1700000000 + uint64(i), ProtoType: protocol.ProtoTypeSIP, CID: "call-1",
+			Payload: []byte("INVITE sip:b@c SIP/2.0"), SIP: &protocol.SIPMessage{Method: "INVITE", From: protocol.SIPAddress{User: "alice"}}})
+	}
+	w.Write(&protocol.HEPPacket{SrcIP: "192.0.2.3", DstIP: "192.0.2.2", Timestamp: 1700000000 + 3600, ProtoType: protocol.ProtoTypeSIP, CID: "call-2"})
+	w.Write(&protocol.HEPPacket{SrcIP: "192.0.2.1", DstIP: "192.0.2.2", Timestamp: 1700000000, ProtoType: protocol.ProtoTypeRTCP, Payload: []byte{0x80, 0xc8}})
+	w.flush()
+
+	// The first three SIP rows are finished, the others are still open
+	done, open := listParquetFiles(t, dir)
+	if len(done) != 1 || !strings.HasPrefix(done[0], filepath.Join("date=2023-11-14", "hour=22", "proto=sip", "part-")) {
+		t.Errorf("Expected one finished SIP file, got %v", done)
+	}
+	if len(open) != 3 {
+		t.Errorf("Expected 3 open files, got %v", open)
+	}
+	result, err := w.Search(context.Background(), SearchParams{})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if result.Total != 3 {
+		t.Errorf("Expected the finished rows only, got %d", result.Total)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	done, open = listParquetFiles(t, dir)
+	if len(done) != 4 || len(open) != 0 {
+		t.Fatalf("Expected 4 finished files, got %v and %v", done, open)
+	}
+
+	// A new writer queries the files of the previous one
+	w, err = NewParquetWriter(ParquetConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewParquetWriter failed: %v", err)
+	}
+	defer w.Close()
+
+	result, err = w.Search(context.Background(), SearchParams{Query: "192.0.2.1", OrderDesc: true})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if result.Total != 6 {
+		t.Fatalf("Expected 6 packets from 192.0.2.1, got %d", result.Total)
+	}
+	first := result.Results[0]
+	if first.Timestamp != 1700000004 || first.SrcPort != 5060 || first.CID != "call-1" || string(first.Payload) != "INVITE sip:b@c SIP/2.0" ||
+		first.SIP == nil || first.SIP.Method != "INVITE" || first.SIP.From.User != "alice" {
+		t.Errorf("Unexpected packet %+v", first)
+	}
+
+	// Hours outside the range are skipped
+	result, err = w.Search(context.Background(), SearchParams{FromTime: time.Unix(1700000000+3600, 0)})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if result.Total != 1 || result.Results[0].CID != "call-2" {
+		t.Errorf("Expected the packet of the next hour, got %+v", result)
+	}
+}
+
+func TestParquetWriterMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	var closed []string
+	w, err := NewParquetWriter(ParquetConfig{Dir: dir, MaxAge: time.Nanosecond, BatchSize: 100, Closed: func(path string) { closed = append(closed, path) }})
+	if err != nil {
+		t.Fatalf("NewParquetWriter failed: %v", err)
+	}
+	defer w.Close()
+
+	w.Write(&protocol.HEPPacket{SrcIP: "192.0.2.1", Timestamp: 1700000000, ProtoType: protocol.ProtoTypeSIP})
+	w.flush()
+	if done, open := listParquetFiles(t, dir); len(done) != 1 || len(open) != 0 {
+		t.Errorf("Expected the old file to be finished, got %v and %v", done, open)
+	}
+	if stats := w.Stats(); stats.NumRecords != 1 || !strings.HasSuffix(stats.FilePath, ".parquet") {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if len(closed) != 1 || closed[0] != w.Stats().FilePath {
+		t.Errorf("Expected the finished file to be reported, got %v", closed)
+	}
+
+	if _, err := NewParquetWriter(ParquetConfig{Dir: dir, Compression: "lzo"}); err == nil {
+		t.Errorf("Expected an error for unknown compressions")
+	}
+}
+
+func TestParquetWriterSearch(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewParquetWriter(ParquetConfig{Dir: dir, BatchSize: 100})
+	if err != nil {
+		t.Fatalf("NewParquetWriter failed: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		w.Write(&protocol.HEPPacket{SrcIP: "192.0.2.1", DstIP: "192.0.2.2", SrcPort: uint16(5060 + i%2), Timestamp: 1700000000 + uint64(i),
+			ProtoType: protocol.ProtoTypeSIP, CID: "call-" + string(rune('a'+i))})
+	}
+	w.Write(&protocol.HEPPacket{SrcIP: "192.0.2.1", Timestamp: 1700000000, ProtoType: protocol.ProtoTypeLog, Payload: []byte("log")})
+	w.flush()
+	for partition := range w.parts {
+		w.closePart(partition)
+	}
+	defer w.Close()
+
+	search := func(params SearchParams) SearchResult {
+		t.Helper()
+		result, err := w.Search(context.Background(), params)
+		if err != nil {
+			t.Fatalf("Search %+v failed: %v", params, err)
+		}
+		return result
+	}
+
+	result := search(SearchParams{Query: "src_port:5061 AND dst_ip:192.0.2.2", Limit: 2, Offset: 1, OrderDesc: true})
+	if result.Total != 5 || len(result.Results) != 2 || result.Results[0].Timestamp != 1700000007 || result.Results[1].Timestamp != 1700000005 {
+		t.Errorf("Unexpected page %+v", result)
+	}
+	if result := search(SearchParams{Query: "cid:call-*", OrderBy: "cid", Limit: 1}); result.Total != 10 || result.Results[0].CID != "call-a" {
+		t.Errorf("Unexpected wildcard result %+v", result)
+	}
+	if result := search(SearchParams{CIDs: []string{"call-c", "call-d"}}); result.Total != 2 {
+		t.Errorf("Expected 2 packets of the CIDs, got %d", result.Total)
+	}
+	if result := search(SearchParams{IncludeLogs: true}); result.Total != 11 {
+		t.Errorf("Expected the log to be included, got %d", result.Total)
+	}
+	if result := search(SearchParams{ToTime: time.Unix(1700000002, 0)}); result.Total != 3 {
+		t.Errorf("Expected 3 packets until the end time, got %d", result.Total)
+	}
+
+	for _, query := range []string{"unknown:1", "src_port:abc"} {
+		if _, err := w.Search(context.Background(), SearchParams{Query: query}); !errors.Is(err, ErrParquetBadQuery) {
+			t.Errorf("Expected ErrParquetBadQuery for %s, got %v", query, err)
+		}
+	}
+}
+
+func TestParquetWriterJSONColumns(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewParquetWriter(ParquetConfig{Dir: dir, BatchSize: 100})
+	if err != nil {
+		t.Fatalf("NewParquetWriter failed: %v", err)
+	}
+	w.Write(&protocol.HEPPacket{
+		SrcIP:      "192.0.2.1",
+		Timestamp:  1700000000,
+		ProtoType:  protocol.ProtoTypeDNS,
+		CID:        "dns-1",
+		DNS:        &protocol.DNSMessage{ID: 7, Response: true, QName: "example.com", QType: "A", LatencyMs: 12.5},
+		Enrichment: map[string]string{"src_country": "DE"},
+		NodeIDs:    []uint32{2001, 2002},
+	})
+	w.Write(&protocol.HEPPacket{SrcIP: "192.0.2.1", Timestamp: 1700000001, ProtoType: protocol.ProtoTypeRTP, CID: "rtp-1",
+		RTP: &protocol.RTPHeader{PayloadType: 8, Sequence: 100, SSRC: 42}})
+	w.flush()
+	for partition := range w.parts {
+		w.closePart(partition)
+	}
+	defer w.Close()
+
+	result, err := w.Search(context.Background(), SearchParams{})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if result.Total != 2 {
+		t.Fatalf("Expected 2 packets, got %+v", result)
+	}
+	dns, rtp := result.Results[0], result.Results[1]
+	if dns.DNS == nil || dns.DNS.QName != "example.com" || dns.DNS.LatencyMs != 12.5 || dns.Enrichment["src_country"] != "DE" ||
+		len(dns.NodeIDs) != 2 || dns.NodeIDs[1] != 2002 || dns.RTP != nil || dns.Log != nil {
+		t.Errorf("Unexpected DNS packet: %+v", dns)
+	}
+	if rtp.RTP == nil || rtp.RTP.SSRC != 42 || rtp.RTP.PayloadType != 8 || rtp.DNS != nil || rtp.Enrichment != nil {
+		t.Errorf("Unexpected RTP packet: %+v", rtp)
+	}
+}
+
+// parquetRowV1 is the schema of files written before the JSON columns
+type parquetRowV1 struct {
+	Time        int64  `parquet:"name=time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Version     int32  `parquet:"name=version, type=INT32"`
+	Protocol    int32  `parquet:"name=protocol, type=INT32"`
+	SrcIP       string `parquet:"name=src_ip, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SrcPort     int32  `parquet:"name=src_port, type=INT32"`
+	DstIP       string `parquet:"name=dst_ip, type=BYTE_ARRAY, convertedtype=UTF8"`
+	DstPort     int32  `parquet:"name=dst_port, type=INT32"`
+	ProtoType   int32  `parquet:"name=proto_type, type=INT32"`
+	NodeID      int64  `parquet:"name=node_id, type=INT64"`
+	NodeName    string `parquet:"name=node_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	CID         string `parquet:"name=cid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Vlan        int32  `parquet:"name=vlan, type=INT32"`
+	SIPMethod   string `parquet:"name=sip_method, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SIPStatus   int32  `parquet:"name=sip_status, type=INT32"`
+	SIPFromUser string `parquet:"name=sip_from_user, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SIPToUser   string `parquet:"name=sip_to_user, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Payload     string `parquet:"name=payload, type=BYTE_ARRAY"`
+}
+
+func TestParquetWriterOldFiles(t *testing.T) {
+	dir := t.TempDir()
+	partition := filepath.Join(dir, "date=2023-11-14", "hour=22", "proto=sip")
+	if err := os.MkdirAll(partition, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := local.NewLocalFileWriter(filepath.Join(partition, "part-old.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err := parquetwriter.NewParquetWriter(file, new(parquetRowV1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw.Write(parquetRowV1{Time: 1700000000000, ProtoType: int32(protocol.ProtoTypeSIP), CID: "call-1"})
+	if err := pw.WriteStop(); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	w, err := NewParquetWriter(ParquetConfig{Dir: dir, BatchSize: 100})
+	if err != nil {
+		t.Fatalf("NewParquetWriter failed: %v", err)
+	}
+	defer w.Close()
+
+	// No file has the JSON columns yet
+	result, err := w.Search(context.Background(), SearchParams{})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if result.Total != 1 || result.Results[0].CID != "call-1" || result.Results[0].DNS != nil {
+		t.Errorf("Unexpected result %+v", result)
+	}
+}
@@ -0,0 +1,368 @@
+package writer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+// File formats of a PcapWriter
+const (
+	PcapFormatPcap   = "pcap"
+	PcapFormatPcapNG = "pcapng"
+)
+
+const (
+	pcapSnapLen      = 262144
+	pcapLinkEthernet = 1
+	pcapMaxFlows     = 100000
+
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+)
+
+var ErrPcapBadFormat = errors.New("unknown pcap format")
+
+// PcapWriter writes packets as Ethernet frames to pcap or pcapng files
+// that open in Wireshark. The IP and UDP or TCP headers are rebuilt from
+// the HEP fields, other transports are written as UDP. pcapng frames carry
+// the node and correlation ID as packet comment. Files are rotated by size
+// and age, the oldest ones are removed beyond the retention count.
+type PcapWriter struct {
+	*BatchWriter
+	format string
+	files  *fileRotator
+	// tcpSeqs is only used from flush
+	tcpSeqs map[pcapFlow]uint32
+}
+
+type PcapConfig struct {
+	Dir string
+	// Prefix starts the file names, default hep
+	Prefix string
+	// Format is pcap or pcapng
+	Format string
+	// MaxSize rotates files reaching it in bytes, default 100 MB
+	MaxSize int64
+	// RotateInterval rotates files older than it, 0 disables
+	RotateInterval time.Duration
+	// MaxFiles is the number of files kept, 0 keeps all
+	MaxFiles  int
+	BatchSize int
+	// Closed is called with the path of every finished file
+	Closed func(path string)
+	// Pending reports finished files not archived yet, MaxFiles keeps
+	// them
+	Pending func(path string) bool
+}
+
+// pcapFlow identifies a TCP direction to continue its sequence numbers
+type pcapFlow struct {
+	src, dst         string
+	srcPort, dstPort uint16
+}
+
+func NewPcapWriter(config PcapConfig) (*PcapWriter, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("pcap dir required")
+	}
+	switch config.Format {
+	case "":
+		config.Format = PcapFormatPcap
+	case PcapFormatPcap, PcapFormatPcapNG:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrPcapBadFormat, config.Format)
+	}
+	if config.Prefix == "" {
+		config.Prefix = "hep"
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = 100 << 20
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("can't create pcap dir: %w", err)
+	}
+
+	w := &PcapWriter{
+		format:  config.Format,
+		tcpSeqs: make(map[pcapFlow]uint32),
+	}
+	w.files = &fileRotator{
+		dir:      config.Dir,
+		prefix:   config.Prefix,
+		ext:      "." + config.Format,
+		maxSize:  config.MaxSize,
+		interval: config.RotateInterval,
+		maxFiles: config.MaxFiles,
+		open:     w.open,
+		closed:   config.Closed,
+		pending:  config.Pending,
+	}
+	w.BatchWriter = newBatchWriter(config.BatchSize, w.flush)
+	return w, nil
+}
+
+func (w *PcapWriter) flush() {
+	w.mu.Lock()
+	packets := make([]*protocol.HEPPacket, len(w.buffer))
+	copy(packets, w.buffer)
+	w.buffer = w.buffer[:0]
+	w.mu.Unlock()
+
+	if err := w.files.expire(time.Now()); err != nil {
+		w.updateStats(false, 0, err)
+	}
+	if len(packets) == 0 {
+		return
+	}
+	// Bound the flows kept, a restarted sequence only confuses the analysis
+	// of streams spanning the reset
+	if len(w.tcpSeqs) > pcapMaxFlows {
+		w.tcpSeqs = make(map[pcapFlow]uint32)
+	}
+
+	for _, packet := range packets {
+		frame, err := pcapFrame(packet, w.tcpSeqs)
+		if err != nil {
+			w.updateStats(false, 0, err)
+			continue
+		}
+		record := w.record(packet, frame)
+		if err := w.files.write(record); err != nil {
+			w.updateStats(false, 0, err)
+			continue
+		}
+		w.updateStats(true, uint64(len(record)), nil)
+	}
+	if err := w.files.flush(); err != nil {
+		w.updateStats(false, 0, err)
+	}
+}
+
+// open starts a new file with the pcap or pcapng header
+func (w *PcapWriter) open(path string) []byte {
+	w.mu.Lock()
+	w.stats.FilePath = path
+	w.mu.Unlock()
+
+	if w.format == PcapFormatPcapNG {
+		return pcapngFileHeader()
+	}
+	return pcapFileHeader()
+}
+
+func (w *PcapWriter) record(packet *protocol.HEPPacket, frame []byte) []byte {
+	if w.format == PcapFormatPcapNG {
+		return pcapngPacketBlock(packet, frame)
+	}
+	return pcapRecord(packet, frame)
+}
+
+func (w *PcapWriter) Search(ctx context.Context, params SearchParams) (SearchResult, error) {
+	return SearchResult{}, ErrSearchNotSupported
+}
+
+// Close writes the buffered packets and closes the current file
+func (w *PcapWriter) Close() error {
+	w.BatchWriter.Close()
+	return w.files.close()
+}
+
+// pcapFileHeader is the classic pcap global header with microsecond
+// timestamps
+func pcapFileHeader() []byte {
+	b := make([]byte, 24)
+	binary.LittleEndian.PutUint32(b[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(b[4:], 2)
+	binary.LittleEndian.PutUint16(b[6:], 4)
+	binary.LittleEndian.PutUint32(b[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(b[20:], pcapLinkEthernet)
+	return b
+}
+
+func pcapRecord(packet *protocol.HEPPacket, frame []byte) []byte {
+	b := make([]byte, 16, 16+len(frame))
+	binary.LittleEndian.PutUint32(b[0:], uint32(packet.Timestamp))
+	binary.LittleEndian.PutUint32(b[4:], packet.TimestampUsec)
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(b[12:], uint32(len(frame)))
+	return append(b, frame...)
+}
+
+// pcapngFileHeader is a section header block followed by the description
+// of the single Ethernet interface
+func pcapngFileHeader() []byte {
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], 0x1a2b3c4d)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint64(shb[8:], 0xffffffffffffffff) // section length unknown
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], pcapLinkEthernet)
+	binary.LittleEndian.PutUint32(idb[4:], pcapSnapLen)
+
+	return append(pcapngBlock(0x0a0d0d0a, shb), pcapngBlock(1, idb)...)
+}
+
+// pcapngPacketBlock is an enhanced packet block with the node and the
+// correlation ID as comment
+func pcapngPacketBlock(packet *protocol.HEPPacket, frame []byte) []byte {
+	us := packet.Timestamp*1000000 + uint64(packet.TimestampUsec)
+	b := make([]byte, 20, 20+len(frame)+64)
+	binary.LittleEndian.PutUint32(b[4:], uint32(us>>32))
+	binary.LittleEndian.PutUint32(b[8:], uint32(us))
+	binary.LittleEndian.PutUint32(b[12:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(b[16:], uint32(len(frame)))
+	b = append(b, frame...)
+	b = pcapngPad(b)
+
+	comment := pcapComment(packet)
+	opt := make([]byte, 4)
+	binary.LittleEndian.PutUint16(opt[0:], 1) // opt_comment
+	binary.LittleEndian.PutUint16(opt[2:], uint16(len(comment)))
+	b = append(b, opt...)
+	b = pcapngPad(append(b, comment...))
+	b = append(b, 0, 0, 0, 0) // opt_endofopt
+	return pcapngBlock(6, b)
+}
+
+func pcapComment(packet *protocol.HEPPacket) string {
+	parts := []string{fmt.Sprintf("node_id=%d", packet.NodeID)}
+	if packet.NodeName != "" {
+		parts = append(parts, "node_name="+packet.NodeName)
+	}
+	if packet.CID != "" {
+		parts = append(parts, "cid="+packet.CID)
+	}
+	return strings.Join(parts, " ")
+}
+
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	length := uint32(12 + len(body))
+	b := make([]byte, 8, length)
+	binary.LittleEndian.PutUint32(b[0:], blockType)
+	binary.LittleEndian.PutUint32(b[4:], length)
+	b = append(b, body...)
+	return binary.LittleEndian.AppendUint32(b, length)
+}
+
+func pcapngPad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// pcapFrame rebuilds the Ethernet frame of a packet. TCP sequence numbers
+// continue per direction so Wireshark can reassemble streams.
+func pcapFrame(packet *protocol.HEPPacket, tcpSeqs map[pcapFlow]uint32) ([]byte, error) {
+	src := net.ParseIP(packet.SrcIP)
+	dst := net.ParseIP(packet.DstIP)
+	if src == nil || dst == nil {
+		return nil, fmt.Errorf("invalid packet addresses %q and %q", packet.SrcIP, packet.DstIP)
+	}
+	v4 := src.To4() != nil && dst.To4() != nil
+
+	var transport []byte
+	proto := uint8(ipProtoUDP)
+	if packet.Protocol == ipProtoTCP {
+		proto = ipProtoTCP
+		flow := pcapFlow{packet.SrcIP, packet.DstIP, packet.SrcPort, packet.DstPort}
+		seq := tcpSeqs[flow]
+		tcpSeqs[flow] = seq + uint32(len(packet.Payload))
+		transport = tcpSegment(packet, seq)
+	} else {
+		transport = udpDatagram(packet)
+	}
+
+	// Ethernet with zero addresses and an 802.1Q tag for the VLAN
+	frame := make([]byte, 12, 18+40+len(transport))
+	if packet.Vlan != 0 {
+		frame = binary.BigEndian.AppendUint16(frame, 0x8100)
+		frame = binary.BigEndian.AppendUint16(frame, packet.Vlan&0x0fff)
+	}
+
+	if v4 {
+		frame = binary.BigEndian.AppendUint16(frame, 0x0800)
+		src, dst = src.To4(), dst.To4()
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(transport)))
+		ip[6] = 0x40 // don't fragment
+		ip[8] = 64
+		ip[9] = proto
+		copy(ip[12:], src)
+		copy(ip[16:], dst)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+		frame = append(frame, ip...)
+	} else {
+		frame = binary.BigEndian.AppendUint16(frame, 0x86dd)
+		src, dst = src.To16(), dst.To16()
+		ip := make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(transport)))
+		ip[6] = proto
+		ip[7] = 64
+		copy(ip[8:], src)
+		copy(ip[24:], dst)
+		frame = append(frame, ip...)
+	}
+
+	// Transport checksum over the pseudo header
+	var sum uint32
+	for _, addr := range [][]byte{src, dst} {
+		for i := 0; i < len(addr); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(addr[i:]))
+		}
+	}
+	sum += uint32(proto) + uint32(len(transport))
+	if proto == ipProtoTCP {
+		binary.BigEndian.PutUint16(transport[16:], checksum(transport, sum))
+	} else if c := checksum(transport, sum); c != 0 {
+		binary.BigEndian.PutUint16(transport[6:], c)
+	} else {
+		// A zero UDP checksum means none was computed
+		binary.BigEndian.PutUint16(transport[6:], 0xffff)
+	}
+	return append(frame, transport...), nil
+}
+
+func udpDatagram(packet *protocol.HEPPacket) []byte {
+	b := make([]byte, 8, 8+len(packet.Payload))
+	binary.BigEndian.PutUint16(b[0:], packet.SrcPort)
+	binary.BigEndian.PutUint16(b[2:], packet.DstPort)
+	binary.BigEndian.PutUint16(b[4:], uint16(8+len(packet.Payload)))
+	return append(b, packet.Payload...)
+}
+
+func tcpSegment(packet *protocol.HEPPacket, seq uint32) []byte {
+	b := make([]byte, 20, 20+len(packet.Payload))
+	binary.BigEndian.PutUint16(b[0:], packet.SrcPort)
+	binary.BigEndian.PutUint16(b[2:], packet.DstPort)
+	binary.BigEndian.PutUint32(b[4:], seq)
+	b[12] = 5 << 4
+	b[13] = 0x18 // PSH, ACK
+	binary.BigEndian.PutUint16(b[14:], 65535)
+	return append(b, packet.Payload...)
+}
+
+// checksum is the Internet checksum of b added to a partial sum
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,186 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+// readPcapFrames returns the frames of a classic pcap file
+func readPcapFrames(t *testing.T, path string) [][]byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if binary.LittleEndian.Uint32(data) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(data[20:]) != pcapLinkEthernet {
+		t.Fatalf("Invalid pcap header % x", data[:24])
+	}
+	var frames [][]byte
+	for data = data[24:]; len(data) > 0; {
+		length := binary.LittleEndian.Uint32(data[8:])
+		frames = append(frames, data[16:16+length])
+		data = data[16+length:]
+	}
+	return frames
+}
+
+func TestPcapFrameUDP(t *testing.T) {
+	packet := &protocol.HEPPacket{
+		Protocol: ipProtoUDP,
+		SrcIP:    "192.0.2.1",
+		DstIP:    "192.0.2.2",
+		SrcPort:  5060,
+		DstPort:  5080,
+		Payload:  []byte("OPTIONS sip:a@b SIP/2.0\r\n\r\n"),
+	}
+	frame, err := pcapFrame(packet, nil)
+	if err != nil {
+		t.Fatalf("pcapFrame failed: %v", err)
+	}
+
+	if binary.BigEndian.Uint16(frame[12:]) != 0x0800 {
+		t.Fatalf("Expected an IPv4 ethertype, got % x", frame[12:14])
+	}
+	ip := frame[14:34]
+	if checksum(ip, 0) != 0 || ip[9] != ipProtoUDP || !bytes.Equal(ip[12:16], []byte{192, 0, 2, 1}) {
+		t.Errorf("Invalid IPv4 header % x", ip)
+	}
+	udp := frame[34:]
+	if binary.BigEndian.Uint16(udp[0:]) != 5060 || binary.BigEndian.Uint16(udp[2:]) != 5080 ||
+		int(binary.BigEndian.Uint16(udp[4:])) != 8+len(packet.Payload) || !bytes.Equal(udp[8:], packet.Payload) {
+		t.Errorf("Invalid UDP datagram % x", udp)
+	}
+
+	// The checksum over the pseudo header and the datagram must verify
+	pseudo := append(append([]byte{}, ip[12:20]...), 0, ipProtoUDP, 0, byte(len(udp)))
+	if checksum(append(pseudo, udp...), 0) != 0 {
+		t.Errorf("Invalid UDP checksum")
+	}
+}
+
+func TestPcapFrameTCPv6(t *testing.T) {
+	seqs := make(map[pcapFlow]uint32)
+	packet := &protocol.HEPPacket{
+		Protocol: ipProtoTCP,
+		SrcIP:    "2001:db8::1",
+		DstIP:    "2001:db8::2",
+		SrcPort:  40000,
+		DstPort:  5060,
+		Vlan:     42,
+		Payload:  []byte("INVITE sip:b@c SIP/2.0\r\n\r\n"),
+	}
+	pcapFrame(packet, seqs)
+	frame, err := pcapFrame(packet, seqs)
+	if err != nil {
+		t.Fatalf("pcapFrame failed: %v", err)
+	}
+
+	if binary.BigEndian.Uint16(frame[12:]) != 0x8100 || binary.BigEndian.Uint16(frame[14:]) != 42 || binary.BigEndian.Uint16(frame[16:]) != 0x86dd {
+		t.Fatalf("Expected a VLAN tagged IPv6 frame, got % x", frame[:18])
+	}
+	ip := frame[18:58]
+	if ip[6] != ipProtoTCP || int(binary.BigEndian.Uint16(ip[4:])) != 20+len(packet.Payload) {
+		t.Errorf("Invalid IPv6 header % x", ip)
+	}
+	tcp := frame[58:]
+	if seq := binary.BigEndian.Uint32(tcp[4:]); seq != uint32(len(packet.Payload)) {
+		t.Errorf("Expected the second segment to continue the sequence, got %d", seq)
+	}
+	pseudo := append(append([]byte{}, ip[8:40]...), 0, 0, 0, byte(len(tcp)), 0, 0, 0, ipProtoTCP)
+	if checksum(append(pseudo, tcp...), 0) != 0 {
+		t.Errorf("Invalid TCP checksum")
+	}
+
+	if _, err := pcapFrame(&protocol.HEPPacket{SrcIP: "bad"}, seqs); err == nil {
+		t.Errorf("Expected an error for invalid addresses")
+	}
+}
+
+func TestPcapWriterRotation(t *testing.T) {
+	dir := t.TempDir()
+	var closed []string
+	w, err := NewPcapWriter(PcapConfig{Dir: dir, MaxSize: 500, MaxFiles: 2, BatchSize: 100, Closed: func(path string) { closed = append(closed, path) }})
+	if err != nil {
+		t.Fatalf("NewPcapWriter failed: %v", err)
+	}
+	// Each record is 16 + 14 + 20 + 8 + 100 bytes, three fit in a file
+	for i := 0; i < 10; i++ {
+		w.Write(&protocol.HEPPacket{Protocol: ipProtoUDP, SrcIP: "192.0.2.1", DstIP: "192.0.2.2", Timestamp: 1700000000, Payload: bytes.Repeat([]byte{'x'}, 100)})
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	files := w.files.files()
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 retained files, got %v", files)
+	}
+	if frames := readPcapFrames(t, files[0]); len(frames) != 3 {
+		t.Errorf("Expected 3 frames in %s, got %d", files[0], len(frames))
+	}
+	if frames := readPcapFrames(t, files[1]); len(frames) != 1 {
+		t.Errorf("Expected the last frame in %s, got %d", files[1], len(frames))
+	}
+	if stats := w.Stats(); stats.NumRecords != 10 || stats.FilePath != files[1] {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if len(closed) != 4 || closed[3] != files[1] {
+		t.Errorf("Expected the 4 finished files to be reported, got %v", closed)
+	}
+}
+
+func TestPcapWriterPcapNG(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewPcapWriter(PcapConfig{Dir: dir, Format: PcapFormatPcapNG, BatchSize: 10})
+	if err != nil {
+		t.Fatalf("NewPcapWriter failed: %v", err)
+	}
+	w.Write(&protocol.HEPPacket{Protocol: ipProtoUDP, SrcIP: "192.0.2.1", DstIP: "192.0.2.2", Timestamp: 1700000000, NodeID: 2001, NodeName: "sbc1", CID: "call-1", Payload: []byte("BYE")})
+	w.Close()
+
+	files := w.files.files()
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 file, got %v", files)
+	}
+	data, _ := os.ReadFile(files[0])
+
+	var types []uint32
+	var epb []byte
+	for len(data) > 0 {
+		blockType := binary.LittleEndian.Uint32(data)
+		length := binary.LittleEndian.Uint32(data[4:])
+		if length%4 != 0 || binary.LittleEndian.Uint32(data[length-4:]) != length {
+			t.Fatalf("Invalid block length %d", length)
+		}
+		if blockType == 6 {
+			epb = data[8 : length-4]
+		}
+		types = append(types, blockType)
+		data = data[length:]
+	}
+	if len(types) != 3 || types[0] != 0x0a0d0d0a || types[1] != 1 {
+		t.Fatalf("Expected section, interface and packet blocks, got %x", types)
+	}
+
+	us := uint64(binary.LittleEndian.Uint32(epb[4:]))<<32 | uint64(binary.LittleEndian.Uint32(epb[8:]))
+	if us != 1700000000*1000000 {
+		t.Errorf("Expected microsecond timestamp, got %d", us)
+	}
+	captured := binary.LittleEndian.Uint32(epb[12:])
+	options := epb[20+(captured+3)/4*4:]
+	if code := binary.LittleEndian.Uint16(options); code != 1 {
+		t.Fatalf("Expected a comment option, got %d", code)
+	}
+	comment := string(options[4 : 4+binary.LittleEndian.Uint16(options[2:])])
+	if comment != "node_id=2001 node_name=sbc1 cid=call-1" {
+		t.Errorf("Unexpected comment %q", comment)
+	}
+	if !strings.HasSuffix(string(epb[20:20+captured]), "BYE") {
+		t.Errorf("Expected the payload in the frame")
+	}
+}
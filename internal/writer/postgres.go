@@ -0,0 +1,492 @@
+package writer
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+// ErrPostgresBadQuery is returned by Search for parameters it can't apply
+var ErrPostgresBadQuery = errors.New("invalid postgres query")
+
+// PostgresWriter stores packets in the HOMER 7 hep_proto_* tables so the
+// HOMER UI can read them. Tables are partitioned by day on create_date, the
+// parent tables and partitions are created when the first packet for them
+// arrives.
+type PostgresWriter struct {
+	*BatchWriter
+	pool *pgxpool.Pool
+	// partitions holds the partitions known to exist, keyed by table and day
+	partitions map[postgresPartition]bool
+	partMu     sync.Mutex
+}
+
+type PostgresConfig struct {
+	Host      string
+	Port      int
+	Database  string
+	Username  string
+	Password  string
+	SSLMode   string
+	BatchSize int
+}
+
+// postgresPartition is one daily partition of a hep_proto table
+type postgresPartition struct {
+	table string
+	day   time.Time
+}
+
+// name returns the partition table name, e.g. hep_proto_1_call_20240101
+func (p postgresPartition) name() string {
+	return p.table + "_" + p.day.Format("20060102")
+}
+
+// homerCallMethods are the SIP methods HOMER stores in hep_proto_1_call
+var homerCallMethods = map[string]bool{
+	"INVITE": true,
+	"ACK":    true,
+	"BYE":    true,
+	"CANCEL": true,
+	"UPDATE": true,
+	"PRACK":  true,
+	"REFER":  true,
+	"INFO":   true,
+}
+
+func NewPostgresWriter(config PostgresConfig) (*PostgresWriter, error) {
+	if config.Port == 0 {
+		config.Port = 5432
+	}
+	if config.SSLMode == "" {
+		config.SSLMode = "disable"
+	}
+	dsn := (&url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(config.Username, config.Password),
+		Host:     fmt.Sprintf("%s:%d", config.Host, config.Port),
+		Path:     config.Database,
+		RawQuery: "sslmode=" + url.QueryEscape(config.SSLMode),
+	}).String()
+
+	pool, err := pgxpool.New(context.Background(), dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &PostgresWriter{
+		pool:       pool,
+		partitions: make(map[postgresPartition]bool),
+	}
+	w.BatchWriter = newBatchWriter(config.BatchSize, w.flush)
+	return w, nil
+}
+
+// Close flushes the buffer and closes the connection pool
+func (w *PostgresWriter) Close() error {
+	err := w.BatchWriter.Close()
+	w.pool.Close()
+	return err
+}
+
+func (w *PostgresWriter) flush() {
+	w.mu.Lock()
+	packets := make([]*protocol.HEPPacket, len(w.buffer))
+	copy(packets, w.buffer)
+	w.buffer = w.buffer[:0]
+	w.mu.Unlock()
+
+	if len(packets) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	tables := make(map[string][][]interface{})
+	sizes := make(map[string]uint64)
+	for _, packet := range packets {
+		row, err := homerRow(packet)
+		if err != nil {
+			w.updateStats(false, 0, err)
+			continue
+		}
+		table := homerTable(packet)
+		created := row[1].(time.Time)
+		if err := w.ensurePartition(ctx, postgresPartition{table, homerDay(created)}); err != nil {
+			w.updateStats(false, 0, err)
+			continue
+		}
+		tables[table] = append(tables[table], row)
+		sizes[table] += uint64(len(row[2].(json.RawMessage)) + len(row[3].(json.RawMessage)) + len(row[4].(string)))
+	}
+
+	w.copyTables(ctx, w.pool, tables, sizes)
+}
+
+// postgresCopier is the part of the pool used to copy rows
+type postgresCopier interface {
+	CopyFrom(ctx context.Context, table pgx.Identifier, columns []string, rows pgx.CopyFromSource) (int64, error)
+}
+
+// copyTables copies the rows of every table, a failed table does not keep
+// the others from being written
+func (w *PostgresWriter) copyTables(ctx context.Context, copier postgresCopier, tables map[string][][]interface{}, sizes map[string]uint64) {
+	for table, rows := range tables {
+		if _, err := copier.CopyFrom(ctx,
+			pgx.Identifier{table},
+			[]string{"sid", "create_date", "protocol_header", "data_header", "raw"},
+			pgx.CopyFromRows(rows),
+		); err != nil {
+			w.updateStats(false, 0, fmt.Errorf("copy into %s failed: %w", table, err))
+			continue
+		}
+		w.updateStats(true, sizes[table], nil)
+	}
+}
+
+// ensurePartition creates the parent table and the daily partition unless
+// they are known to exist
+func (w *PostgresWriter) ensurePartition(ctx context.Context, partition postgresPartition) error {
+	w.partMu.Lock()
+	defer w.partMu.Unlock()
+
+	if w.partitions[partition] {
+		return nil
+	}
+
+	table := pgx.Identifier{partition.table}.Sanitize()
+	statements := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			id BIGSERIAL NOT NULL,
+			sid VARCHAR NOT NULL,
+			create_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			protocol_header JSONB NOT NULL,
+			data_header JSONB NOT NULL,
+			raw VARCHAR NOT NULL
+		) PARTITION BY RANGE (create_date)`, table),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s ON %s (sid)`, pgx.Identifier{partition.table + "_sid"}.Sanitize(), table),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s ON %s (create_date)`, pgx.Identifier{partition.table + "_create_date"}.Sanitize(), table),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')`,
+			pgx.Identifier{partition.name()}.Sanitize(), table,
+			partition.day.Format(time.RFC3339), partition.day.AddDate(0, 0, 1).Format(time.RFC3339)),
+	}
+	for _, statement := range statements {
+		if _, err := w.pool.Exec(ctx, statement); err != nil {
+			// The HOMER retention job may have created a partition for the
+			// day under its own name
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == "42P17" {
+				continue
+			}
+			return fmt.Errorf("creating partition %s failed: %w", partition.name(), err)
+		}
+	}
+
+	w.partitions[partition] = true
+	return nil
+}
+
+// homerTable returns the HOMER table a packet is stored in
+func homerTable(packet *protocol.HEPPacket) string {
+	if packet.ProtoType == protocol.ProtoTypeSIP && packet.SIP != nil {
+		switch method := packet.SIP.CSeqMethod; {
+		case homerCallMethods[method]:
+			return "hep_proto_1_call"
+		case method == "REGISTER":
+			return "hep_proto_1_registration"
+		}
+	}
+	return fmt.Sprintf("hep_proto_%d_default", packet.ProtoType)
+}
+
+// homerDay returns the start of the UTC day of t
+func homerDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// homerProtocolHeader is the protocol_header layout written by heplify-server
+type homerProtocolHeader struct {
+	ProtocolFamily int    `json:"protocolFamily"`
+	Protocol       uint8  `json:"protocol"`
+	SrcIP          string `json:"srcIp"`
+	DstIP          string `json:"dstIp"`
+	SrcPort        uint16 `json:"srcPort"`
+	DstPort        uint16 `json:"dstPort"`
+	TimeSeconds    uint64 `json:"timeSeconds"`
+	TimeUseconds   uint64 `json:"timeUseconds"`
+	PayloadType    uint8  `json:"payloadType"`
+	CaptureID      string `json:"captureId"`
+	CapturePass    string `json:"capturePass"`
+	CorrelationID  string `json:"correlation_id,omitempty"`
+	Vlan           uint16 `json:"vlan,omitempty"`
+	// RawEncoding is hex when the raw column holds a hex encoded binary
+	// payload, HOMER ignores it
+	RawEncoding string `json:"rawEncoding,omitempty"`
+}
+
+// homerRow converts a packet to the sid, create_date, protocol_header,
+// data_header and raw columns
+func homerRow(packet *protocol.HEPPacket) ([]interface{}, error) {
+	family := 2
+	if ip := net.ParseIP(packet.SrcIP); ip != nil && ip.To4() == nil {
+		family = 10
+	}
+	raw, encoded := homerRaw(packet.Payload)
+	rawEncoding := ""
+	if encoded {
+		rawEncoding = "hex"
+	}
+	protocolHeader, err := json.Marshal(homerProtocolHeader{
+		ProtocolFamily: family,
+		Protocol:       packet.Protocol,
+		SrcIP:          packet.SrcIP,
+		DstIP:          packet.DstIP,
+		SrcPort:        packet.SrcPort,
+		DstPort:        packet.DstPort,
+		TimeSeconds:    packet.Timestamp,
+		TimeUseconds:   uint64(packet.TimestampUsec),
+		PayloadType:    packet.ProtoType,
+		CaptureID:      strconv.FormatUint(uint64(packet.NodeID), 10),
+		CorrelationID:  packet.CID,
+		Vlan:           packet.Vlan,
+		RawEncoding:    rawEncoding,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encoding protocol header failed: %w", err)
+	}
+	dataHeader, err := json.Marshal(homerDataHeader(packet))
+	if err != nil {
+		return nil, fmt.Errorf("encoding data header failed: %w", err)
+	}
+
+	sid := packet.CID
+	if sid == "" && packet.SIP != nil {
+		sid = packet.SIP.CallID
+	}
+	return []interface{}{
+		sid,
+		packet.Time().UTC(),
+		json.RawMessage(protocolHeader),
+		json.RawMessage(dataHeader),
+		raw,
+	}, nil
+}
+
+// homerPacket restores the packet of a row
+func homerPacket(sid string, created time.Time, header homerProtocolHeader, raw string) (*protocol.HEPPacket, error) {
+	payload := []byte(raw)
+	if header.RawEncoding == "hex" {
+		var err error
+		if payload, err = hex.DecodeString(raw); err != nil {
+			return nil, fmt.Errorf("decoding raw of %s failed: %w", sid, err)
+		}
+	}
+	nodeID, _ := strconv.ParseUint(header.CaptureID, 10, 32)
+	return &protocol.HEPPacket{
+		Version:       3,
+		Protocol:      header.Protocol,
+		SrcIP:         header.SrcIP,
+		DstIP:         header.DstIP,
+		SrcPort:       header.SrcPort,
+		DstPort:       header.DstPort,
+		Timestamp:     uint64(created.Unix()),
+		TimestampUsec: uint32(created.Nanosecond() / 1000),
+		ProtoType:     header.PayloadType,
+		NodeID:        uint32(nodeID),
+		Payload:       payload,
+		CID:           sid,
+		Vlan:          header.Vlan,
+	}, nil
+}
+
+// homerDataHeader returns the data_header fields HOMER searches on
+func homerDataHeader(packet *protocol.HEPPacket) map[string]string {
+	node := packet.NodeName
+	if node == "" {
+		node = strconv.FormatUint(uint64(packet.NodeID), 10)
+	}
+	header := map[string]string{"node": node}
+
+	msg := packet.SIP
+	if msg == nil {
+		header["proto"] = protoName(packet.ProtoType)
+		return header
+	}
+
+	header["protocol"] = "SIP/2.0"
+	header["callid"] = msg.CallID
+	header["method"] = msg.Method
+	if !msg.IsRequest() {
+		header["method"] = strconv.Itoa(msg.StatusCode)
+	}
+	ruri := protocol.ParseSIPAddress(msg.RequestURI)
+	header["ruri_user"] = ruri.User
+	header["ruri_domain"] = ruri.Host
+	header["from_user"] = msg.From.User
+	header["from_domain"] = msg.From.Host
+	header["from_tag"] = msg.From.Tag
+	header["to_user"] = msg.To.User
+	header["to_domain"] = msg.To.Host
+	header["to_tag"] = msg.To.Tag
+	header["user_agent"] = msg.UserAgent
+	header["cseq"] = fmt.Sprintf("%d %s", msg.CSeq, msg.CSeqMethod)
+	for name, value := range header {
+		if value == "" {
+			delete(header, name)
+		}
+	}
+	return header
+}
+
+// homerRaw returns the payload for the raw VARCHAR column and whether it is
+// hex encoded, binary payloads such as RTCP are since Postgres text cannot
+// hold them
+func homerRaw(payload []byte) (string, bool) {
+	if utf8.Valid(payload) && bytes.IndexByte(payload, 0) < 0 {
+		return string(payload), false
+	}
+	return hex.EncodeToString(payload), true
+}
+
+// Search reads packets from all hep_proto tables. The query is an SQL
+// condition on the table columns, e.g. data_header->>'method' = 'INVITE'.
+func (w *PostgresWriter) Search(ctx context.Context, params SearchParams) (SearchResult, error) {
+	tables, err := w.searchTables(ctx, params.IncludeLogs)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	if len(tables) == 0 {
+		return SearchResult{}, nil
+	}
+
+	query, count, args, err := postgresSearchQuery(tables, params)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	var total int64
+	if err := w.pool.QueryRow(ctx, count, args...).Scan(&total); err != nil {
+		return SearchResult{}, fmt.Errorf("count failed: %w", err)
+	}
+
+	rows, err := w.pool.Query(ctx, query, args...)
+	if err != nil {
+		return SearchResult{}, fmt.Errorf("query failed: %w", err)
+	}
+	defer rows.Close()
+
+	var results []*protocol.HEPPacket
+	for rows.Next() {
+		var sid, raw string
+		var created time.Time
+		var header homerProtocolHeader
+		if err := rows.Scan(&sid, &created, &header, &raw); err != nil {
+			return SearchResult{}, fmt.Errorf("scan failed: %w", err)
+		}
+		packet, err := homerPacket(sid, created, header, raw)
+		if err != nil {
+			return SearchResult{}, err
+		}
+		results = append(results, packet)
+	}
+	if err := rows.Err(); err != nil {
+		return SearchResult{}, fmt.Errorf("query failed: %w", err)
+	}
+
+	return SearchResult{
+		Total:   total,
+		Results: results,
+	}, nil
+}
+
+// postgresOrders maps the search order_by fields to the columns of the
+// search union
+var postgresOrders = map[string]string{
+	"":          "create_date",
+	"timestamp": "create_date",
+	"cid":       "sid",
+	"src_ip":    "protocol_header->>'srcIp'",
+	"dst_ip":    "protocol_header->>'dstIp'",
+	"src_port":  "(protocol_header->>'srcPort')::int",
+	"dst_port":  "(protocol_header->>'dstPort')::int",
+	"node_id":   "(protocol_header->>'captureId')::bigint",
+}
+
+// postgresSearchQuery returns the search query over the tables, the query
+// counting all its matches and their arguments
+func postgresSearchQuery(tables []string, params SearchParams) (string, string, []any, error) {
+	order, ok := postgresOrders[params.OrderBy]
+	if !ok {
+		return "", "", nil, fmt.Errorf("%w: can't order by %s", ErrPostgresBadQuery, params.OrderBy)
+	}
+	direction := "ASC"
+	if params.OrderDesc {
+		direction = "DESC"
+	}
+
+	args := []any{params.FromTime, params.ToTime}
+	condition := ""
+	if params.Query != "" {
+		condition = fmt.Sprintf("AND (%s)", params.Query)
+	}
+	if len(params.CIDs) > 0 {
+		condition += " AND sid = ANY($3)"
+		args = append(args, params.CIDs)
+	}
+
+	selects := make([]string, len(tables))
+	for i, table := range tables {
+		selects[i] = fmt.Sprintf(`SELECT sid, create_date, protocol_header, raw FROM %s WHERE create_date BETWEEN $1 AND $2 %s`,
+			pgx.Identifier{table}.Sanitize(), condition)
+	}
+	from := " FROM (" + strings.Join(selects, " UNION ALL ") + ") AS search"
+	query := "SELECT sid, create_date, protocol_header, raw" + from +
+		fmt.Sprintf(" ORDER BY %s %s, create_date %s", order, direction, direction)
+	if params.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", params.Limit)
+	}
+	if params.Offset > 0 {
+		query += fmt.Sprintf(" OFFSET %d", params.Offset)
+	}
+	return query, "SELECT count(*)" + from, args, nil
+}
+
+// searchTables lists the partitioned hep_proto tables in the database
+func (w *PostgresWriter) searchTables(ctx context.Context, includeLogs bool) ([]string, error) {
+	rows, err := w.pool.Query(ctx, `SELECT relname FROM pg_class WHERE relkind = 'p' AND relname LIKE 'hep\_proto\_%'`)
+	if err != nil {
+		return nil, fmt.Errorf("listing tables failed: %w", err)
+	}
+	tables, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("listing tables failed: %w", err)
+	}
+
+	logTable := fmt.Sprintf("hep_proto_%d_default", protocol.ProtoTypeLog)
+	n := 0
+	for _, table := range tables {
+		if table == logTable && !includeLogs {
+			continue
+		}
+		tables[n] = table
+		n++
+	}
+	tables = tables[:n]
+	sort.Strings(tables)
+	return tables, nil
+}
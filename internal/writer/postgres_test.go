@@ -0,0 +1,215 @@
+package writer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/sipcapture/hepop-go/pkg/protocol"
+)
+
+// failingCopier fails the copy into one table
+type failingCopier struct {
+	fail   string
+	copied map[string]int
+}
+
+func (c *failingCopier) CopyFrom(ctx context.Context, table pgx.Identifier, columns []string, rows pgx.CopyFromSource) (int64, error) {
+	if table[0] == c.fail {
+		return 0, errors.New("connection reset")
+	}
+	for rows.Next() {
+		c.copied[table[0]]++
+	}
+	return int64(c.copied[table[0]]), nil
+}
+
+func TestPostgresCopyTables(t *testing.T) {
+	w := &PostgresWriter{BatchWriter: &BatchWriter{}}
+	copier := &failingCopier{fail: "hep_proto_1_call", copied: make(map[string]int)}
+	row := []interface{}{"call-1", time.Now(), json.RawMessage("{}"), json.RawMessage("{}"), "raw"}
+	w.copyTables(context.Background(), copier,
+		map[string][][]interface{}{
+			"hep_proto_1_call":         {row, row},
+			"hep_proto_1_registration": {row},
+			"hep_proto_100_default":    {row},
+		},
+		map[string]uint64{"hep_proto_1_call": 20, "hep_proto_1_registration": 10, "hep_proto_100_default": 5},
+	)
+
+	if copier.copied["hep_proto_1_registration"] != 1 || copier.copied["hep_proto_100_default"] != 1 {
+		t.Errorf("Expected the other tables to be copied, got %v", copier.copied)
+	}
+	if stats := w.Stats(); stats.NumRecords != 2 || stats.FileSize != 15 || stats.Errors != 1 {
+		t.Errorf("Expected stats per table, got %+v", stats)
+	}
+}
+
+func TestHomerTable(t *testing.T) {
+	sip := func(method, cseqMethod string) *protocol.HEPPacket {
+		return &protocol.HEPPacket{ProtoType: protocol.ProtoTypeSIP, SIP: &protocol.SIPMessage{Method: method, CSeqMethod: cseqMethod}}
+	}
+	tests := []struct {
+		packet *protocol.HEPPacket
+		want   string
+	}{
+		{sip("INVITE", "INVITE"), "hep_proto_1_call"},
+		{sip("", "BYE"), "hep_proto_1_call"},
+		{sip("REGISTER", "REGISTER"), "hep_proto_1_registration"},
+		{sip("OPTIONS", "OPTIONS"), "hep_proto_1_default"},
+		{&protocol.HEPPacket{ProtoType: protocol.ProtoTypeSIP}, "hep_proto_1_default"},
+		{&protocol.HEPPacket{ProtoType: protocol.ProtoTypeRTCP}, "hep_proto_5_default"},
+		{&protocol.HEPPacket{ProtoType: protocol.ProtoTypeLog}, "hep_proto_100_default"},
+	}
+	for _, test := range tests {
+		if got := homerTable(test.packet); got != test.want {
+			t.Errorf("homerTable(%+v) = %s, want %s", test.packet.SIP, got, test.want)
+		}
+	}
+
+	partition := postgresPartition{"hep_proto_1_call", homerDay(time.Date(2024, 3, 5, 23, 59, 0, 0, time.FixedZone("", -3600)))}
+	if partition.name() != "hep_proto_1_call_20240306" {
+		t.Errorf("Expected the UTC day in the partition name, got %s", partition.name())
+	}
+}
+
+func TestHomerRow(t *testing.T) {
+	packet := &protocol.HEPPacket{
+		Protocol:  17,
+		SrcIP:     "2001:db8::1",
+		DstIP:     "2001:db8::2",
+		SrcPort:   5060,
+		DstPort:   5080,
+		Timestamp: 1700000000,
+		ProtoType: protocol.ProtoTypeSIP,
+		NodeID:    2001,
+		Payload:   []byte("SIP/2.0 180 Ringing\r\n"),
+		SIP: &protocol.SIPMessage{
+			StatusCode: 180,
+			CallID:     "abc@host",
+			From:       protocol.SIPAddress{User: "alice", Host: "example.com", Tag: "1"},
+			To:         protocol.SIPAddress{User: "bob", Host: "example.com"},
+			CSeq:       1,
+			CSeqMethod: "INVITE",
+		},
+	}
+
+	row, err := homerRow(packet)
+	if err != nil {
+		t.Fatalf("homerRow failed: %v", err)
+	}
+	if row[0] != "abc@host" || !row[1].(time.Time).Equal(time.Unix(1700000000, 0)) || row[4] != "SIP/2.0 180 Ringing\r\n" {
+		t.Errorf("Unexpected row: %v", row)
+	}
+
+	var protocolHeader map[string]interface{}
+	json.Unmarshal(row[2].(json.RawMessage), &protocolHeader)
+	if protocolHeader["protocolFamily"] != float64(10) || protocolHeader["srcIp"] != "2001:db8::1" ||
+		protocolHeader["dstPort"] != float64(5080) || protocolHeader["captureId"] != "2001" || protocolHeader["payloadType"] != float64(1) {
+		t.Errorf("Unexpected protocol header: %s", row[2])
+	}
+
+	var dataHeader map[string]string
+	json.Unmarshal(row[3].(json.RawMessage), &dataHeader)
+	want := map[string]string{
+		"protocol":    "SIP/2.0",
+		"node":        "2001",
+		"callid":      "abc@host",
+		"method":      "180",
+		"from_user":   "alice",
+		"from_domain": "example.com",
+		"from_tag":    "1",
+		"to_user":     "bob",
+		"to_domain":   "example.com",
+		"cseq":        "1 INVITE",
+	}
+	if len(dataHeader) != len(want) {
+		t.Errorf("Expected %d data header fields, got %v", len(want), dataHeader)
+	}
+	for name, value := range want {
+		if dataHeader[name] != value {
+			t.Errorf("Expected %s=%s, got %q", name, value, dataHeader[name])
+		}
+	}
+}
+
+func TestHomerRaw(t *testing.T) {
+	if got, encoded := homerRaw([]byte("level=info msg=ok")); got != "level=info msg=ok" || encoded {
+		t.Errorf("Expected text payloads as is, got %s", got)
+	}
+	if got, encoded := homerRaw([]byte{0x81, 0xc8, 0x00, 0x0c}); got != "81c8000c" || !encoded {
+		t.Errorf("Expected binary payloads hex encoded, got %s", got)
+	}
+}
+
+func TestHomerPacketRoundTrip(t *testing.T) {
+	for _, payload := range [][]byte{
+		[]byte("SIP/2.0 200 OK\r\n"),
+		{0x81, 0xc8, 0x00, 0x0c, 0x00, 0x00, 0x30, 0x39},
+		// Text that happens to look like hex stays text
+		[]byte("81c8000c"),
+	} {
+		packet := &protocol.HEPPacket{
+			Protocol:      17,
+			SrcIP:         "192.0.2.1",
+			DstIP:         "192.0.2.2",
+			SrcPort:       5004,
+			DstPort:       5005,
+			Timestamp:     1700000000,
+			TimestampUsec: 123456,
+			ProtoType:     protocol.ProtoTypeRTCP,
+			NodeID:        2001,
+			CID:           "call-1",
+			Payload:       payload,
+		}
+		row, err := homerRow(packet)
+		if err != nil {
+			t.Fatalf("homerRow failed: %v", err)
+		}
+		var header homerProtocolHeader
+		if err := json.Unmarshal(row[2].(json.RawMessage), &header); err != nil {
+			t.Fatalf("Decoding protocol header failed: %v", err)
+		}
+		got, err := homerPacket(row[0].(string), row[1].(time.Time), header, row[4].(string))
+		if err != nil {
+			t.Fatalf("homerPacket failed: %v", err)
+		}
+		if !bytes.Equal(got.Payload, payload) || !got.Time().Equal(packet.Time()) || got.SrcPort != 5004 ||
+			got.NodeID != 2001 || got.CID != "call-1" || got.ProtoType != protocol.ProtoTypeRTCP {
+			t.Errorf("Unexpected packet for %q: %+v", payload, got)
+		}
+	}
+}
+
+func TestPostgresSearchQuery(t *testing.T) {
+	query, count, args, err := postgresSearchQuery([]string{"hep_proto_1_call", "hep_proto_5_default"}, SearchParams{
+		CIDs:      []string{"call-1"},
+		Limit:     10,
+		Offset:    20,
+		OrderBy:   "src_ip",
+		OrderDesc: true,
+	})
+	if err != nil {
+		t.Fatalf("postgresSearchQuery failed: %v", err)
+	}
+	from := ` FROM (SELECT sid, create_date, protocol_header, raw FROM "hep_proto_1_call" WHERE create_date BETWEEN $1 AND $2  AND sid = ANY($3)` +
+		` UNION ALL SELECT sid, create_date, protocol_header, raw FROM "hep_proto_5_default" WHERE create_date BETWEEN $1 AND $2  AND sid = ANY($3)) AS search`
+	if want := "SELECT sid, create_date, protocol_header, raw" + from +
+		" ORDER BY protocol_header->>'srcIp' DESC, create_date DESC LIMIT 10 OFFSET 20"; query != want {
+		t.Errorf("Expected query\n%s\ngot\n%s", want, query)
+	}
+	if want := "SELECT count(*)" + from; count != want {
+		t.Errorf("Expected count query\n%s\ngot\n%s", want, count)
+	}
+	if len(args) != 3 {
+		t.Errorf("Expected 3 arguments, got %d", len(args))
+	}
+
+	if _, _, _, err := postgresSearchQuery([]string{"hep_proto_1_call"}, SearchParams{OrderBy: "payload"}); !errors.Is(err, ErrPostgresBadQuery) {
+		t.Errorf("Expected ErrPostgresBadQuery for an unknown order, got %v", err)
+	}
+}
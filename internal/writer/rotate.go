@@ -0,0 +1,191 @@
+package writer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fileRotator writes to files named <prefix>-<UTC time><ext> in a
+// directory and starts a new file when the current one is full or too old.
+// Files opened within the same second get a sequence number, e.g.
+// hep-20240305-120000-001.pcap. It is not safe for concurrent use.
+type fileRotator struct {
+	dir      string
+	prefix   string
+	ext      string
+	maxSize  int64
+	interval time.Duration
+	// maxFiles is the number of files kept, 0 keeps all
+	maxFiles int
+	// open is called for every new file and returns the bytes the file
+	// starts with
+	open func(path string) []byte
+	// closed is called with the path of every finished file
+	closed func(path string)
+	// pending reports files not archived yet, maxFiles does not remove
+	// them
+	pending func(path string) bool
+
+	file *os.File
+	out  *bufio.Writer
+	path string
+	size int64
+	// headerLen is the size of the file before the first record
+	headerLen int64
+	opened    time.Time
+	stamp     string
+	seq       int
+}
+
+// write appends b to the current file, rotating first when b does not fit
+func (r *fileRotator) write(b []byte) error {
+	if err := r.rotate(int64(len(b))); err != nil {
+		return err
+	}
+	n, err := r.out.Write(b)
+	r.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("can't write %s: %w", r.path, err)
+	}
+	return nil
+}
+
+func (r *fileRotator) flush() error {
+	if r.file == nil {
+		return nil
+	}
+	if err := r.out.Flush(); err != nil {
+		return fmt.Errorf("can't write %s: %w", r.path, err)
+	}
+	return nil
+}
+
+// expire finishes the current file when it is older than the interval, so
+// a file is closed and archived on time while no packets arrive
+func (r *fileRotator) expire(now time.Time) error {
+	if r.file == nil || !r.old(now) {
+		return nil
+	}
+	return r.close()
+}
+
+func (r *fileRotator) old(now time.Time) bool {
+	return r.interval > 0 && now.Sub(r.opened) >= r.interval
+}
+
+func (r *fileRotator) rotate(next int64) error {
+	now := time.Now()
+	if r.file != nil {
+		// A record larger than a file still gets one of its own
+		full := r.size+next > r.maxSize && r.size > r.headerLen
+		if !full && !r.old(now) {
+			return nil
+		}
+		if err := r.close(); err != nil {
+			return err
+		}
+	}
+
+	// Names of removed or compressed files are not reused
+	stamp := now.UTC().Format("20060102-150405")
+	if stamp == r.stamp {
+		r.seq++
+	} else {
+		r.stamp, r.seq = stamp, 0
+	}
+	var path string
+	for {
+		path = filepath.Join(r.dir, r.prefix+"-"+stamp+r.ext)
+		if r.seq > 0 {
+			path = filepath.Join(r.dir, fmt.Sprintf("%s-%s-%03d%s", r.prefix, stamp, r.seq, r.ext))
+		}
+		if matches, _ := filepath.Glob(path + "*"); len(matches) == 0 {
+			break
+		}
+		r.seq++
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("can't create %s: %w", path, err)
+	}
+	r.file = file
+	r.out = bufio.NewWriter(file)
+	r.path = path
+	r.opened = now
+	r.size = 0
+	r.headerLen = 0
+
+	if r.open != nil {
+		header := r.open(path)
+		if _, err := r.out.Write(header); err != nil {
+			return fmt.Errorf("can't write %s: %w", path, err)
+		}
+		r.size = int64(len(header))
+		r.headerLen = r.size
+	}
+
+	r.removeOld()
+	return nil
+}
+
+// close finishes the current file, the next write opens a new one
+func (r *fileRotator) close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.out.Flush()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	r.file = nil
+	if err != nil {
+		return fmt.Errorf("can't close %s: %w", r.path, err)
+	}
+	if r.closed != nil {
+		r.closed(r.path)
+	}
+	return nil
+}
+
+// files lists the files oldest first, including the ones renamed with a
+// further extension such as .gz
+func (r *fileRotator) files() []string {
+	files, _ := filepath.Glob(filepath.Join(r.dir, r.prefix+"-*"+r.ext+"*"))
+	// hep-<time>.pcap comes before hep-<time>-001.pcap once the extension
+	// is cut
+	key := func(path string) string {
+		return path[:strings.LastIndex(path, r.ext)]
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return key(files[i]) < key(files[j])
+	})
+	return files
+}
+
+func (r *fileRotator) removeOld() {
+	if r.maxFiles <= 0 {
+		return
+	}
+	files := r.files()
+	excess := len(files) - r.maxFiles
+	for _, file := range files {
+		if excess <= 0 {
+			break
+		}
+		if file == r.path || (r.pending != nil && r.pending(file)) {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			logrus.Warnf("Can't remove old file: %v", err)
+		}
+		excess--
+	}
+}
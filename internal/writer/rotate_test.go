@@ -0,0 +1,79 @@
+package writer
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFileRotatorExpire(t *testing.T) {
+	var closed []string
+	r := &fileRotator{
+		dir:      t.TempDir(),
+		prefix:   "hep",
+		ext:      ".log",
+		maxSize:  1 << 20,
+		interval: time.Minute,
+		closed:   func(path string) { closed = append(closed, path) },
+	}
+	if err := r.expire(time.Now()); err != nil || len(closed) != 0 {
+		t.Fatalf("Expected nothing to expire without a file, got %v %v", closed, err)
+	}
+	if err := r.write([]byte("first\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := r.expire(time.Now()); err != nil || len(closed) != 0 {
+		t.Fatalf("Expected the new file to stay open, got %v %v", closed, err)
+	}
+
+	// No records arrive after the file became too old
+	if err := r.expire(r.opened.Add(time.Minute)); err != nil {
+		t.Fatalf("expire failed: %v", err)
+	}
+	if len(closed) != 1 || r.file != nil {
+		t.Fatalf("Expected the idle file to be finished, got %v", closed)
+	}
+	if b, _ := os.ReadFile(closed[0]); string(b) != "first\n" {
+		t.Errorf("Expected the record in %s, got %q", closed[0], b)
+	}
+
+	if err := r.write([]byte("second\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	r.close()
+	if len(closed) != 2 || closed[1] == closed[0] {
+		t.Errorf("Expected the next record in a new file, got %v", closed)
+	}
+}
+
+func TestFileRotatorPending(t *testing.T) {
+	dir := t.TempDir()
+	var old []string
+	for _, name := range []string{"hep-20240101-000000.log", "hep-20240101-010000.log", "hep-20240101-020000.log"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("old\n"), 0o644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		old = append(old, path)
+	}
+	r := &fileRotator{
+		dir:      dir,
+		prefix:   "hep",
+		ext:      ".log",
+		maxSize:  1 << 20,
+		maxFiles: 2,
+		// The oldest file is still waiting for its upload
+		pending: func(path string) bool { return path == old[0] },
+	}
+	if err := r.write([]byte("new\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	defer r.close()
+
+	want := []string{old[0], r.path}
+	if files := r.files(); !slices.Equal(files, want) {
+		t.Errorf("Expected the pending file kept over the limit, got %v", files)
+	}
+}
@@ -0,0 +1,48 @@
+package writer
+
+import (
+	"context"
+	"time"
+)
+
+// RTPReport summarizes the quality of one RTP stream over an interval or,
+// when Final is set, over its whole lifetime
+type RTPReport struct {
+	CID                string    `json:"cid,omitempty"`
+	SSRC               uint32    `json:"ssrc"`
+	NodeID             uint32    `json:"node_id"`
+	SrcIP              string    `json:"src_ip"`
+	SrcPort            uint16    `json:"src_port"`
+	DstIP              string    `json:"dst_ip"`
+	DstPort            uint16    `json:"dst_port"`
+	PayloadType        uint8     `json:"payload_type"`
+	StartTime          time.Time `json:"start_time"`
+	EndTime            time.Time `json:"end_time"`
+	Packets            int64     `json:"packets"`
+	Expected           int64     `json:"expected"`
+	Lost               int64     `json:"lost"`
+	LossPercent        float64   `json:"loss_percent"`
+	SequenceGaps       int64     `json:"sequence_gaps"`
+	OutOfOrder         int64     `json:"out_of_order"`
+	Duplicates         int64     `json:"duplicates"`
+	JitterMs           float64   `json:"jitter_ms"`
+	MaxJitterMs        float64   `json:"max_jitter_ms"`
+	PayloadTypeChanges int64     `json:"payload_type_changes"`
+	RFactor            float64   `json:"r_factor"`
+	MOS                float64   `json:"mos"`
+	Final              bool      `json:"final"`
+}
+
+// RTPReportWriter is implemented by writers that can store RTP stream
+// statistics next to the raw packets
+type RTPReportWriter interface {
+	WriteRTPReport(report *RTPReport) error
+}
+
+// RTPReportSearcher is implemented by writers that can read the stored RTP
+// stream statistics of calls back, e.g. for the call flow
+type RTPReportSearcher interface {
+	// SearchRTPReports returns the reports of the calls overlapping the
+	// time range, ordered by end time
+	SearchRTPReports(ctx context.Context, cids []string, from, to time.Time) ([]*RTPReport, error)
+}
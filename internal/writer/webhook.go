@@ -0,0 +1,112 @@
+package writer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrWebhookQueueFull = errors.New("webhook queue is full")
+
+type WebhookConfig struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout time.Duration     `yaml:"timeout"`
+	// QueueSize is the number of alerts waiting for delivery, further
+	// alerts are dropped
+	QueueSize int `yaml:"queue_size"`
+}
+
+// WebhookWriter posts each alert as JSON to a URL. Delivery is
+// asynchronous so a slow endpoint does not delay packet processing.
+type WebhookWriter struct {
+	config WebhookConfig
+	client *http.Client
+	queue  chan *Alert
+	wg     sync.WaitGroup
+}
+
+func NewWebhookWriter(config WebhookConfig) (*WebhookWriter, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("webhook url is required")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1000
+	}
+
+	w := &WebhookWriter{
+		config: config,
+		client: &http.Client{},
+		queue:  make(chan *Alert, config.QueueSize),
+	}
+	w.wg.Add(1)
+	go w.deliverLoop()
+	return w, nil
+}
+
+// WriteAlert queues the alert for delivery
+func (w *WebhookWriter) WriteAlert(alert *Alert) error {
+	select {
+	case w.queue <- alert:
+		return nil
+	default:
+		return ErrWebhookQueueFull
+	}
+}
+
+func (w *WebhookWriter) deliverLoop() {
+	defer w.wg.Done()
+
+	for alert := range w.queue {
+		if err := w.post(alert); err != nil {
+			logrus.Errorf("Webhook delivery of %s alert failed: %v", alert.Detector, err)
+		}
+	}
+}
+
+func (w *WebhookWriter) post(alert *Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range w.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Close delivers the queued alerts and stops the writer
+func (w *WebhookWriter) Close() error {
+	close(w.queue)
+	w.wg.Wait()
+	return nil
+}
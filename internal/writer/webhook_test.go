@@ -0,0 +1,48 @@
+package writer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookWriter(t *testing.T) {
+	var mu sync.Mutex
+	var received []Alert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var alert Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, alert)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	w, err := NewWebhookWriter(WebhookConfig{
+		URL:     server.URL,
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+	})
+	if err != nil {
+		t.Fatalf("NewWebhookWriter failed: %v", err)
+	}
+
+	alert := &Alert{Time: time.Now(), Detector: "scanner", Source: "203.0.113.7", Message: "scanner user agent"}
+	if err := w.WriteAlert(alert); err != nil {
+		t.Fatalf("WriteAlert failed: %v", err)
+	}
+	w.Close()
+
+	if len(received) != 1 || received[0].Source != "203.0.113.7" || received[0].Detector != "scanner" {
+		t.Errorf("Unexpected alerts received: %+v", received)
+	}
+}
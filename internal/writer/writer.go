@@ -2,12 +2,16 @@ package writer
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"time"
 
 	"github.com/sipcapture/hepop-go/pkg/protocol"
 )
 
+// ErrSearchNotSupported is returned by writers that only forward packets
+var ErrSearchNotSupported = errors.New("writer does not support search")
+
 // Writer интерфейс определяет методы для записи и поиска HEP пакетов
 type Writer interface {
 	Write(*protocol.HEPPacket) error
@@ -25,6 +29,11 @@ type SearchParams struct {
 	Offset    int
 	OrderBy   string
 	OrderDesc bool
+	// CIDs restricts the results to packets with one of these correlation IDs
+	CIDs []string
+	// IncludeLogs adds application logs (ProtoType 100) from writers that
+	// store them separately
+	IncludeLogs bool
 }
 
 // SearchResult contains search results
@@ -53,7 +62,6 @@ func (w *BaseWriter) updateStats(written bool, bytes uint64, err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	w.stats.NumRecords++
 	if written {
 		w.stats.NumRecords++
 		w.stats.FileSize += int64(bytes)
@@ -78,15 +86,27 @@ type BatchWriter struct {
 	buffer    []*protocol.HEPPacket
 	flushChan chan struct{}
 	done      chan struct{}
+	// flushFunc sends the buffer of the embedding writer, the promoted
+	// flush method cannot reach its override
+	flushFunc func()
+	wg        sync.WaitGroup
 }
 
 func NewBatchWriter(batchSize int) *BatchWriter {
+	return newBatchWriter(batchSize, nil)
+}
+
+// newBatchWriter creates a batch writer that calls flush for the buffered
+// packets, a nil flush discards them
+func newBatchWriter(batchSize int, flush func()) *BatchWriter {
 	w := &BatchWriter{
 		batchSize: batchSize,
 		buffer:    make([]*protocol.HEPPacket, 0, batchSize),
 		flushChan: make(chan struct{}),
 		done:      make(chan struct{}),
+		flushFunc: flush,
 	}
+	w.wg.Add(1)
 	go w.flushLoop()
 	return w
 }
@@ -105,10 +125,19 @@ func (w *BatchWriter) Write(packet *protocol.HEPPacket) error {
 
 func (w *BatchWriter) Close() error {
 	close(w.done)
-	w.flush() // Final flush
+	w.wg.Wait()
+	w.flushBuffer() // Final flush
 	return nil
 }
 
+func (w *BatchWriter) flushBuffer() {
+	if w.flushFunc != nil {
+		w.flushFunc()
+		return
+	}
+	w.flush()
+}
+
 func (w *BatchWriter) flush() {
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -122,6 +151,8 @@ func (w *BatchWriter) flush() {
 }
 
 func (w *BatchWriter) flushLoop() {
+	defer w.wg.Done()
+
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
@@ -130,9 +161,9 @@ func (w *BatchWriter) flushLoop() {
 		case <-w.done:
 			return
 		case <-w.flushChan:
-			w.flush()
+			w.flushBuffer()
 		case <-ticker.C:
-			w.flush()
+			w.flushBuffer()
 		}
 	}
 }
@@ -0,0 +1,245 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Diameter AVP codes extracted by the decoder
+const (
+	AVPUserName               = 1
+	AVPFramedIPAddress        = 8
+	AVPCalledStationID        = 30
+	AVPAuthApplicationID      = 258
+	AVPAcctApplicationID      = 259
+	AVPVendorSpecificAppID    = 260
+	AVPSessionID              = 263
+	AVPOriginHost             = 264
+	AVPResultCode             = 268
+	AVPDestinationRealm       = 283
+	AVPDestinationHost        = 293
+	AVPOriginRealm            = 296
+	AVPExperimentalResult     = 297
+	AVPExperimentalResultCode = 298
+	AVPCCRequestNumber        = 415
+	AVPCCRequestType          = 416
+	AVPSubscriptionID         = 443
+	AVPSubscriptionIDData     = 444
+	AVPPublicIdentity         = 601 // 3GPP vendor
+	AVPAFChargingIdentifier   = 505 // 3GPP vendor
+)
+
+const diameterHeaderLen = 20
+
+var (
+	ErrDiameterTooShort   = errors.New("diameter message too short")
+	ErrDiameterBadVersion = errors.New("invalid diameter version")
+	ErrDiameterBadAVP     = errors.New("invalid diameter avp")
+)
+
+var diameterCommandNames = map[uint32]string{
+	257: "Capabilities-Exchange",
+	258: "Re-Auth",
+	265: "AA",
+	271: "Accounting",
+	272: "Credit-Control",
+	274: "Abort-Session",
+	275: "Session-Termination",
+	280: "Device-Watchdog",
+	282: "Disconnect-Peer",
+	300: "User-Authorization",
+	301: "Server-Assignment",
+	302: "Location-Info",
+	303: "Multimedia-Auth",
+	304: "Registration-Termination",
+	305: "Push-Profile",
+	306: "User-Data",
+	307: "Profile-Update",
+	308: "Subscribe-Notifications",
+	309: "Push-Notification",
+	316: "Update-Location",
+	318: "Authentication-Information",
+}
+
+var diameterApplicationNames = map[uint32]string{
+	0:        "Base",
+	3:        "Base-Accounting",
+	4:        "Gy",
+	16777216: "Cx",
+	16777217: "Sh",
+	16777236: "Rx",
+	16777238: "Gx",
+	16777251: "S6a",
+}
+
+// selected AVPs kept in DiameterMessage.AVPs, keyed by code
+var diameterAVPNames = map[uint32]string{
+	AVPUserName:             "User-Name",
+	AVPFramedIPAddress:      "Framed-IP-Address",
+	AVPCalledStationID:      "Called-Station-Id",
+	AVPAuthApplicationID:    "Auth-Application-Id",
+	AVPAcctApplicationID:    "Acct-Application-Id",
+	AVPCCRequestNumber:      "CC-Request-Number",
+	AVPCCRequestType:        "CC-Request-Type",
+	AVPSubscriptionIDData:   "Subscription-Id-Data",
+	AVPPublicIdentity:       "Public-Identity",
+	AVPAFChargingIdentifier: "AF-Charging-Identifier",
+}
+
+// DiameterMessage holds the fields decoded from a Diameter payload (ProtoType 38)
+type DiameterMessage struct {
+	CommandCode      uint32            `json:"command_code"`
+	Command          string            `json:"command"`
+	Request          bool              `json:"request"`
+	ApplicationID    uint32            `json:"application_id"`
+	Application      string            `json:"application,omitempty"`
+	HopByHopID       uint32            `json:"hop_by_hop_id"`
+	EndToEndID       uint32            `json:"end_to_end_id"`
+	SessionID        string            `json:"session_id,omitempty"`
+	OriginHost       string            `json:"origin_host,omitempty"`
+	OriginRealm      string            `json:"origin_realm,omitempty"`
+	DestinationHost  string            `json:"destination_host,omitempty"`
+	DestinationRealm string            `json:"destination_realm,omitempty"`
+	ResultCode       uint32            `json:"result_code,omitempty"`
+	AVPs             map[string]string `json:"avps,omitempty"`
+}
+
+// DiameterCommandName returns the short name of a command, e.g. "CCR" for a
+// Credit-Control request
+func DiameterCommandName(code uint32, request bool) string {
+	name, ok := diameterCommandNames[code]
+	if !ok {
+		return strconv.FormatUint(uint64(code), 10)
+	}
+	abbrev := make([]byte, 0, 4)
+	for i := 0; i < len(name); i++ {
+		if name[i] >= 'A' && name[i] <= 'Z' {
+			abbrev = append(abbrev, name[i])
+		}
+	}
+	if request {
+		return string(abbrev) + "R"
+	}
+	return string(abbrev) + "A"
+}
+
+// DecodeDiameter decodes the header and top-level AVPs of a Diameter message
+func DecodeDiameter(data []byte) (*DiameterMessage, error) {
+	if len(data) < diameterHeaderLen {
+		return nil, ErrDiameterTooShort
+	}
+	if data[0] != 1 {
+		return nil, ErrDiameterBadVersion
+	}
+
+	length := int(uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3]))
+	if length < diameterHeaderLen || length > len(data) {
+		return nil, ErrDiameterTooShort
+	}
+
+	flags := data[4]
+	msg := &DiameterMessage{
+		CommandCode:   uint32(data[5])<<16 | uint32(data[6])<<8 | uint32(data[7]),
+		Request:       flags&0x80 != 0,
+		ApplicationID: binary.BigEndian.Uint32(data[8:12]),
+		HopByHopID:    binary.BigEndian.Uint32(data[12:16]),
+		EndToEndID:    binary.BigEndian.Uint32(data[16:20]),
+	}
+	msg.Command = DiameterCommandName(msg.CommandCode, msg.Request)
+	msg.Application = diameterApplicationNames[msg.ApplicationID]
+
+	if err := msg.decodeAVPs(data[diameterHeaderLen:length]); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (m *DiameterMessage) decodeAVPs(data []byte) error {
+	return walkDiameterAVPs(data, func(code uint32, value []byte) error {
+		switch code {
+		case AVPSessionID:
+			m.SessionID = string(value)
+		case AVPOriginHost:
+			m.OriginHost = string(value)
+		case AVPOriginRealm:
+			m.OriginRealm = string(value)
+		case AVPDestinationHost:
+			m.DestinationHost = string(value)
+		case AVPDestinationRealm:
+			m.DestinationRealm = string(value)
+		case AVPResultCode:
+			if len(value) == 4 {
+				m.ResultCode = binary.BigEndian.Uint32(value)
+			}
+		case AVPExperimentalResult, AVPSubscriptionID, AVPVendorSpecificAppID:
+			// Grouped AVPs, the interesting values are one level down
+			return m.decodeAVPs(value)
+		case AVPExperimentalResultCode:
+			if len(value) == 4 && m.ResultCode == 0 {
+				m.ResultCode = binary.BigEndian.Uint32(value)
+			}
+		default:
+			if name, ok := diameterAVPNames[code]; ok {
+				if m.AVPs == nil {
+					m.AVPs = make(map[string]string)
+				}
+				m.AVPs[name] = formatDiameterAVP(code, value)
+			}
+		}
+		return nil
+	})
+}
+
+// walkDiameterAVPs calls fn for every AVP in data with the padding and the
+// vendor ID stripped
+func walkDiameterAVPs(data []byte, fn func(code uint32, value []byte) error) error {
+	cursor := 0
+	for cursor < len(data) {
+		if cursor+8 > len(data) {
+			return ErrDiameterBadAVP
+		}
+
+		code := binary.BigEndian.Uint32(data[cursor : cursor+4])
+		flags := data[cursor+4]
+		length := int(uint32(data[cursor+5])<<16 | uint32(data[cursor+6])<<8 | uint32(data[cursor+7]))
+
+		headerLen := 8
+		if flags&0x80 != 0 {
+			headerLen = 12
+		}
+		if length < headerLen || cursor+length > len(data) {
+			return ErrDiameterBadAVP
+		}
+
+		if err := fn(code, data[cursor+headerLen:cursor+length]); err != nil {
+			return err
+		}
+
+		// AVPs are padded to a multiple of four bytes
+		cursor += (length + 3) &^ 3
+	}
+	return nil
+}
+
+func formatDiameterAVP(code uint32, value []byte) string {
+	switch code {
+	case AVPCCRequestNumber, AVPCCRequestType, AVPAuthApplicationID, AVPAcctApplicationID:
+		if len(value) == 4 {
+			return strconv.FormatUint(uint64(binary.BigEndian.Uint32(value)), 10)
+		}
+	case AVPFramedIPAddress:
+		if len(value) == net.IPv4len || len(value) == net.IPv6len {
+			return net.IP(value).String()
+		}
+	}
+	for _, b := range value {
+		if b < 0x20 || b > 0x7e {
+			return fmt.Sprintf("%x", value)
+		}
+	}
+	return string(value)
+}
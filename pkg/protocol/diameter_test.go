@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func diameterTestAVP(code uint32, vendor uint32, value []byte) []byte {
+	headerLen := 8
+	flags := byte(0x40) // mandatory
+	if vendor != 0 {
+		headerLen = 12
+		flags |= 0x80
+	}
+	length := headerLen + len(value)
+
+	avp := binary.BigEndian.AppendUint32(nil, code)
+	avp = append(avp, flags, byte(length>>16), byte(length>>8), byte(length))
+	if vendor != 0 {
+		avp = binary.BigEndian.AppendUint32(avp, vendor)
+	}
+	avp = append(avp, value...)
+	for len(avp)%4 != 0 {
+		avp = append(avp, 0)
+	}
+	return avp
+}
+
+func diameterTestUint32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func diameterTestMessage(code uint32, request bool, appID uint32, avps ...[]byte) []byte {
+	var body []byte
+	for _, avp := range avps {
+		body = append(body, avp...)
+	}
+	length := diameterHeaderLen + len(body)
+
+	var flags byte
+	if request {
+		flags = 0x80
+	}
+	msg := []byte{1, byte(length >> 16), byte(length >> 8), byte(length),
+		flags, byte(code >> 16), byte(code >> 8), byte(code)}
+	msg = binary.BigEndian.AppendUint32(msg, appID)
+	msg = binary.BigEndian.AppendUint32(msg, 0x1111)
+	msg = binary.BigEndian.AppendUint32(msg, 0x2222)
+	return append(msg, body...)
+}
+
+func TestDiameterDecodeCCR(t *testing.T) {
+	data := diameterTestMessage(272, true, 16777238,
+		diameterTestAVP(AVPSessionID, 0, []byte("pcef.example.com;1;2")),
+		diameterTestAVP(AVPOriginHost, 0, []byte("pcef.example.com")),
+		diameterTestAVP(AVPOriginRealm, 0, []byte("example.com")),
+		diameterTestAVP(AVPDestinationRealm, 0, []byte("pcrf.example.com")),
+		diameterTestAVP(AVPCCRequestType, 0, diameterTestUint32(1)),
+		diameterTestAVP(AVPSubscriptionID, 0, diameterTestAVP(AVPSubscriptionIDData, 0, []byte("491234567"))),
+		diameterTestAVP(AVPFramedIPAddress, 0, []byte{10, 45, 0, 1}),
+	)
+
+	msg, err := DecodeDiameter(data)
+	if err != nil {
+		t.Fatalf("Failed to decode Diameter: %v", err)
+	}
+
+	if msg.Command != "CCR" || !msg.Request {
+		t.Errorf("Expected CCR request, got %s (request=%v)", msg.Command, msg.Request)
+	}
+	if msg.Application != "Gx" {
+		t.Errorf("Expected application Gx, got %s", msg.Application)
+	}
+	if msg.HopByHopID != 0x1111 || msg.EndToEndID != 0x2222 {
+		t.Errorf("Unexpected hop-by-hop/end-to-end IDs %#x/%#x", msg.HopByHopID, msg.EndToEndID)
+	}
+	if msg.SessionID != "pcef.example.com;1;2" {
+		t.Errorf("Expected session id pcef.example.com;1;2, got %s", msg.SessionID)
+	}
+	if msg.OriginHost != "pcef.example.com" || msg.OriginRealm != "example.com" {
+		t.Errorf("Unexpected origin %s/%s", msg.OriginHost, msg.OriginRealm)
+	}
+	if msg.DestinationRealm != "pcrf.example.com" {
+		t.Errorf("Expected destination realm pcrf.example.com, got %s", msg.DestinationRealm)
+	}
+
+	wantAVPs := map[string]string{
+		"CC-Request-Type":      "1",
+		"Subscription-Id-Data": "491234567",
+		"Framed-IP-Address":    "10.45.0.1",
+	}
+	for name, want := range wantAVPs {
+		if got := msg.AVPs[name]; got != want {
+			t.Errorf("Expected AVP %s=%s, got %q", name, want, got)
+		}
+	}
+}
+
+func TestDiameterDecodeExperimentalResult(t *testing.T) {
+	data := diameterTestMessage(301, false, 16777216,
+		diameterTestAVP(AVPSessionID, 0, []byte("scscf;42")),
+		diameterTestAVP(AVPExperimentalResult, 0, append(
+			diameterTestAVP(266, 0, diameterTestUint32(10415)),
+			diameterTestAVP(AVPExperimentalResultCode, 0, diameterTestUint32(5001))...,
+		)),
+		diameterTestAVP(AVPPublicIdentity, 10415, []byte("sip:alice@ims.example.com")),
+	)
+
+	msg, err := DecodeDiameter(data)
+	if err != nil {
+		t.Fatalf("Failed to decode Diameter: %v", err)
+	}
+
+	if msg.Command != "SAA" || msg.Request {
+		t.Errorf("Expected SAA answer, got %s (request=%v)", msg.Command, msg.Request)
+	}
+	if msg.ResultCode != 5001 {
+		t.Errorf("Expected result code 5001, got %d", msg.ResultCode)
+	}
+	if msg.AVPs["Public-Identity"] != "sip:alice@ims.example.com" {
+		t.Errorf("Expected vendor AVP Public-Identity, got %q", msg.AVPs["Public-Identity"])
+	}
+}
+
+func TestDiameterInvalidMessages(t *testing.T) {
+	badAVP := diameterTestMessage(280, true, 0)
+	badAVP = append(badAVP, 0, 0, 1, 7, 0, 0, 0, 4)
+	badAVP[3] = byte(len(badAVP))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{
+			name:    "Short header",
+			data:    []byte{1, 0, 0},
+			wantErr: ErrDiameterTooShort,
+		},
+		{
+			name:    "Bad version",
+			data:    append([]byte{2}, make([]byte, 19)...),
+			wantErr: ErrDiameterBadVersion,
+		},
+		{
+			name:    "Length past end",
+			data:    append([]byte{1, 0, 0, 40}, make([]byte, 16)...),
+			wantErr: ErrDiameterTooShort,
+		},
+		{
+			name:    "AVP shorter than header",
+			data:    badAVP,
+			wantErr: ErrDiameterBadAVP,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeDiameter(tt.data)
+			if err != tt.wantErr {
+				t.Errorf("DecodeDiameter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
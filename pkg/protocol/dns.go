@@ -0,0 +1,287 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DNS record types commonly seen next to SIP traffic
+const (
+	DNSTypeA     = 1
+	DNSTypeNS    = 2
+	DNSTypeCNAME = 5
+	DNSTypeSOA   = 6
+	DNSTypePTR   = 12
+	DNSTypeMX    = 15
+	DNSTypeTXT   = 16
+	DNSTypeAAAA  = 28
+	DNSTypeSRV   = 33
+	DNSTypeNAPTR = 35
+)
+
+var (
+	ErrDNSTooShort   = errors.New("dns message too short")
+	ErrDNSNoQuestion = errors.New("dns message has no question")
+	ErrDNSBadName    = errors.New("invalid dns name")
+)
+
+var dnsTypeNames = map[uint16]string{
+	DNSTypeA:     "A",
+	DNSTypeNS:    "NS",
+	DNSTypeCNAME: "CNAME",
+	DNSTypeSOA:   "SOA",
+	DNSTypePTR:   "PTR",
+	DNSTypeMX:    "MX",
+	DNSTypeTXT:   "TXT",
+	DNSTypeAAAA:  "AAAA",
+	DNSTypeSRV:   "SRV",
+	DNSTypeNAPTR: "NAPTR",
+}
+
+var dnsRCodeNames = []string{
+	"NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED",
+}
+
+// DNSMessage holds the fields decoded from a DNS payload (ProtoType 53)
+type DNSMessage struct {
+	ID        uint16      `json:"id"`
+	Response  bool        `json:"response"`
+	QName     string      `json:"qname"`
+	QType     string      `json:"qtype"`
+	RCode     string      `json:"rcode,omitempty"`
+	Answers   []DNSAnswer `json:"answers,omitempty"`
+	LatencyMs float64     `json:"latency_ms,omitempty"`
+}
+
+// DNSAnswer is a single resource record from the answer section
+type DNSAnswer struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"`
+}
+
+// DNSTypeName returns the mnemonic for a record type, e.g. "NAPTR"
+func DNSTypeName(t uint16) string {
+	if name, ok := dnsTypeNames[t]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// DNSRCodeName returns the mnemonic for a response code, e.g. "NXDOMAIN"
+func DNSRCodeName(rcode uint8) string {
+	if int(rcode) < len(dnsRCodeNames) {
+		return dnsRCodeNames[rcode]
+	}
+	return "RCODE" + strconv.Itoa(int(rcode))
+}
+
+// DecodeDNS decodes the header, first question and answer section of a DNS message
+func DecodeDNS(data []byte) (*DNSMessage, error) {
+	if len(data) < 12 {
+		return nil, ErrDNSTooShort
+	}
+
+	flags := binary.BigEndian.Uint16(data[2:4])
+	qdCount := binary.BigEndian.Uint16(data[4:6])
+	anCount := binary.BigEndian.Uint16(data[6:8])
+
+	msg := &DNSMessage{
+		ID:       binary.BigEndian.Uint16(data[0:2]),
+		Response: flags&0x8000 != 0,
+	}
+	if msg.Response {
+		msg.RCode = DNSRCodeName(uint8(flags & 0x000f))
+	}
+
+	if qdCount == 0 {
+		return nil, ErrDNSNoQuestion
+	}
+
+	cursor := 12
+	for i := 0; i < int(qdCount); i++ {
+		name, next, err := readDNSName(data, cursor)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(data) {
+			return nil, ErrDNSTooShort
+		}
+		// Only the first question is kept, resolvers never send more
+		if i == 0 {
+			msg.QName = name
+			msg.QType = DNSTypeName(binary.BigEndian.Uint16(data[next : next+2]))
+		}
+		cursor = next + 4
+	}
+
+	for i := 0; i < int(anCount); i++ {
+		name, next, err := readDNSName(data, cursor)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(data) {
+			return nil, ErrDNSTooShort
+		}
+
+		rrType := binary.BigEndian.Uint16(data[next : next+2])
+		ttl := binary.BigEndian.Uint32(data[next+4 : next+8])
+		rdLength := int(binary.BigEndian.Uint16(data[next+8 : next+10]))
+		rdStart := next + 10
+		if rdStart+rdLength > len(data) {
+			return nil, ErrDNSTooShort
+		}
+
+		rdata, err := formatDNSRData(data, rrType, rdStart, rdLength)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Answers = append(msg.Answers, DNSAnswer{
+			Name: name,
+			Type: DNSTypeName(rrType),
+			TTL:  ttl,
+			Data: rdata,
+		})
+		cursor = rdStart + rdLength
+	}
+
+	return msg, nil
+}
+
+// readDNSName reads a possibly compressed name starting at offset and
+// returns it along with the offset of the first byte after it
+func readDNSName(data []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	cursor := offset
+
+	// Bound the number of pointer jumps to avoid loops in crafted packets
+	for jumps := 0; jumps < 32; {
+		if cursor >= len(data) {
+			return "", 0, ErrDNSBadName
+		}
+
+		length := int(data[cursor])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = cursor + 1
+			}
+			if len(labels) == 0 {
+				return ".", next, nil
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if cursor+2 > len(data) {
+				return "", 0, ErrDNSBadName
+			}
+			if next < 0 {
+				next = cursor + 2
+			}
+			cursor = int(binary.BigEndian.Uint16(data[cursor:cursor+2]) & 0x3fff)
+			jumps++
+		case length&0xc0 != 0:
+			return "", 0, ErrDNSBadName
+		default:
+			if cursor+1+length > len(data) {
+				return "", 0, ErrDNSBadName
+			}
+			labels = append(labels, string(data[cursor+1:cursor+1+length]))
+			cursor += 1 + length
+		}
+	}
+
+	return "", 0, ErrDNSBadName
+}
+
+// readDNSString reads a length-prefixed character string
+func readDNSString(data []byte, offset, end int) (string, int, error) {
+	if offset >= end {
+		return "", 0, ErrDNSTooShort
+	}
+	length := int(data[offset])
+	if offset+1+length > end {
+		return "", 0, ErrDNSTooShort
+	}
+	return string(data[offset+1 : offset+1+length]), offset + 1 + length, nil
+}
+
+func formatDNSRData(data []byte, rrType uint16, offset, length int) (string, error) {
+	rdata := data[offset : offset+length]
+	end := offset + length
+
+	switch rrType {
+	case DNSTypeA, DNSTypeAAAA:
+		if len(rdata) != net.IPv4len && len(rdata) != net.IPv6len {
+			return "", ErrDNSTooShort
+		}
+		return net.IP(rdata).String(), nil
+	case DNSTypeNS, DNSTypeCNAME, DNSTypePTR:
+		name, _, err := readDNSName(data, offset)
+		return name, err
+	case DNSTypeMX:
+		if length < 3 {
+			return "", ErrDNSTooShort
+		}
+		name, _, err := readDNSName(data, offset+2)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rdata[0:2]), name), nil
+	case DNSTypeSRV:
+		if length < 7 {
+			return "", ErrDNSTooShort
+		}
+		target, _, err := readDNSName(data, offset+6)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d %d %d %s",
+			binary.BigEndian.Uint16(rdata[0:2]),
+			binary.BigEndian.Uint16(rdata[2:4]),
+			binary.BigEndian.Uint16(rdata[4:6]),
+			target), nil
+	case DNSTypeNAPTR:
+		if length < 7 {
+			return "", ErrDNSTooShort
+		}
+		cursor := offset + 4
+		fields := make([]string, 3)
+		for i := range fields {
+			s, next, err := readDNSString(data, cursor, end)
+			if err != nil {
+				return "", err
+			}
+			fields[i] = strconv.Quote(s)
+			cursor = next
+		}
+		replacement, _, err := readDNSName(data, cursor)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d %d %s %s",
+			binary.BigEndian.Uint16(rdata[0:2]),
+			binary.BigEndian.Uint16(rdata[2:4]),
+			strings.Join(fields, " "),
+			replacement), nil
+	case DNSTypeTXT:
+		var parts []string
+		for cursor := offset; cursor < end; {
+			s, next, err := readDNSString(data, cursor, end)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, strconv.Quote(s))
+			cursor = next
+		}
+		return strings.Join(parts, " "), nil
+	default:
+		return fmt.Sprintf("%x", rdata), nil
+	}
+}
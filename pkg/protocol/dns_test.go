@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// dnsTestName encodes a name without compression
+func dnsTestName(name string) []byte {
+	var out []byte
+	start := 0
+	for i := 0; i <= len(name); i++ {
+		if i == len(name) || name[i] == '.' {
+			out = append(out, byte(i-start))
+			out = append(out, name[start:i]...)
+			start = i + 1
+		}
+	}
+	return append(out, 0)
+}
+
+func dnsTestMessage(id uint16, flags uint16, qname string, qtype uint16, answers [][]byte) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], flags)
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	binary.BigEndian.PutUint16(msg[6:8], uint16(len(answers)))
+
+	msg = append(msg, dnsTestName(qname)...)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // IN
+	for _, answer := range answers {
+		msg = append(msg, answer...)
+	}
+	return msg
+}
+
+// dnsTestAnswer builds a record whose owner name points to the question
+func dnsTestAnswer(rrType uint16, ttl uint32, rdata []byte) []byte {
+	rr := []byte{0xc0, 0x0c}
+	rr = binary.BigEndian.AppendUint16(rr, rrType)
+	rr = binary.BigEndian.AppendUint16(rr, 1)
+	rr = binary.BigEndian.AppendUint32(rr, ttl)
+	rr = binary.BigEndian.AppendUint16(rr, uint16(len(rdata)))
+	return append(rr, rdata...)
+}
+
+func TestDNSDecodeQuery(t *testing.T) {
+	msg, err := DecodeDNS(dnsTestMessage(0x1234, 0x0100, "_sip._udp.example.com", DNSTypeSRV, nil))
+	if err != nil {
+		t.Fatalf("Failed to decode DNS query: %v", err)
+	}
+
+	if msg.ID != 0x1234 {
+		t.Errorf("Expected id 0x1234, got %#x", msg.ID)
+	}
+	if msg.Response {
+		t.Error("Expected query, got response")
+	}
+	if msg.QName != "_sip._udp.example.com" {
+		t.Errorf("Expected qname _sip._udp.example.com, got %s", msg.QName)
+	}
+	if msg.QType != "SRV" {
+		t.Errorf("Expected qtype SRV, got %s", msg.QType)
+	}
+	if msg.RCode != "" {
+		t.Errorf("Expected no rcode on query, got %s", msg.RCode)
+	}
+}
+
+func TestDNSDecodeResponse(t *testing.T) {
+	srv := []byte{0x00, 0x0a, 0x00, 0x3c, 0x13, 0xc4}
+	srv = append(srv, dnsTestName("sbc1.example.com")...)
+
+	naptr := []byte{0x00, 0x64, 0x00, 0x0a}
+	naptr = append(naptr, 1, 'u')
+	naptr = append(naptr, 7)
+	naptr = append(naptr, "E2U+sip"...)
+	naptr = append(naptr, 0)
+	naptr = append(naptr, 0)
+
+	answers := [][]byte{
+		dnsTestAnswer(DNSTypeSRV, 300, srv),
+		dnsTestAnswer(DNSTypeA, 60, net.ParseIP("10.0.0.1").To4()),
+		dnsTestAnswer(DNSTypeNAPTR, 120, naptr),
+	}
+	msg, err := DecodeDNS(dnsTestMessage(0x1234, 0x8180, "_sip._udp.example.com", DNSTypeSRV, answers))
+	if err != nil {
+		t.Fatalf("Failed to decode DNS response: %v", err)
+	}
+
+	if !msg.Response {
+		t.Error("Expected response, got query")
+	}
+	if msg.RCode != "NOERROR" {
+		t.Errorf("Expected rcode NOERROR, got %s", msg.RCode)
+	}
+	if len(msg.Answers) != 3 {
+		t.Fatalf("Expected 3 answers, got %d", len(msg.Answers))
+	}
+
+	tests := []DNSAnswer{
+		{Name: "_sip._udp.example.com", Type: "SRV", TTL: 300, Data: "10 60 5060 sbc1.example.com"},
+		{Name: "_sip._udp.example.com", Type: "A", TTL: 60, Data: "10.0.0.1"},
+		{Name: "_sip._udp.example.com", Type: "NAPTR", TTL: 120, Data: `100 10 "u" "E2U+sip" "" .`},
+	}
+	for i, want := range tests {
+		if msg.Answers[i] != want {
+			t.Errorf("Answer %d: expected %+v, got %+v", i, want, msg.Answers[i])
+		}
+	}
+}
+
+func TestDNSDecodeNXDomain(t *testing.T) {
+	msg, err := DecodeDNS(dnsTestMessage(1, 0x8183, "missing.example.com", DNSTypeA, nil))
+	if err != nil {
+		t.Fatalf("Failed to decode DNS response: %v", err)
+	}
+	if msg.RCode != "NXDOMAIN" {
+		t.Errorf("Expected rcode NXDOMAIN, got %s", msg.RCode)
+	}
+}
+
+func TestDNSInvalidMessages(t *testing.T) {
+	loop := dnsTestMessage(1, 0x0100, "a", DNSTypeA, nil)
+	loop[12] = 0xc0
+	loop[13] = 0x0c
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{
+			name:    "Short header",
+			data:    []byte{0x00, 0x01},
+			wantErr: ErrDNSTooShort,
+		},
+		{
+			name:    "No question",
+			data:    make([]byte, 12),
+			wantErr: ErrDNSNoQuestion,
+		},
+		{
+			name:    "Compression loop",
+			data:    loop,
+			wantErr: ErrDNSBadName,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeDNS(tt.data)
+			if err != tt.wantErr {
+				t.Errorf("DecodeDNS() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
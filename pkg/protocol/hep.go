@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"net"
+	"time"
 )
 
 const (
@@ -12,7 +13,9 @@ const (
 	HEPv3 = 3
 )
 
-// HEP chunk types
+// Chunk types of the legacy HEPv3 layout, which starts with the version
+// byte 3 instead of the "HEP3" magic. It is still decoded for agents and
+// instances that send it.
 const (
 	TypeIPProtocolFamily  = 0x0001
 	TypeIPProtocolID      = 0x0002
@@ -30,10 +33,48 @@ const (
 	TypeVLAN              = 0x0012
 )
 
+// hep3Magic starts every HEPv3 packet of the HEP specification
+const hep3Magic = "HEP3"
+
+// Chunk types of HEPv3 as specified and sent by heplify, captagent,
+// Kamailio and FreeSWITCH
+const (
+	ChunkIPFamily          = 0x0001
+	ChunkIPProtocol        = 0x0002
+	ChunkIPv4SrcIP         = 0x0003
+	ChunkIPv4DstIP         = 0x0004
+	ChunkIPv6SrcIP         = 0x0005
+	ChunkIPv6DstIP         = 0x0006
+	ChunkSrcPort           = 0x0007
+	ChunkDstPort           = 0x0008
+	ChunkTimeSec           = 0x0009
+	ChunkTimeUsec          = 0x000a
+	ChunkProtoType         = 0x000b
+	ChunkCaptureAgentID    = 0x000c
+	ChunkKeepAliveTimer    = 0x000d
+	ChunkAuthKey           = 0x000e
+	ChunkPayload           = 0x000f
+	ChunkCompressedPayload = 0x0010
+	ChunkCorrelationID     = 0x0011
+	ChunkVLAN              = 0x0012
+	ChunkCaptureAgentName  = 0x0013
+)
+
+// Payload protocol types carried in the ProtoType field
+const (
+	ProtoTypeSIP      = 1
+	ProtoTypeRTCP     = 5
+	ProtoTypeRTP      = 34
+	ProtoTypeDiameter = 38
+	ProtoTypeDNS      = 53
+	ProtoTypeLog      = 100
+)
+
 var (
 	ErrInvalidVersion = errors.New("invalid HEP version")
 	ErrPacketTooShort = errors.New("packet too short")
 	ErrInvalidChunk   = errors.New("invalid chunk")
+	ErrPacketTooLong  = errors.New("packet too long")
 )
 
 type HEPPacket struct {
@@ -44,12 +85,39 @@ type HEPPacket struct {
 	SrcPort   uint16
 	DstPort   uint16
 	Timestamp uint64
-	ProtoType uint8
-	NodeID    uint32
-	NodeName  string
-	Payload   []byte
-	CID       string
-	Vlan      uint16
+	// TimestampUsec is the microsecond part of the capture time, HEPv1,
+	// HEPv2 and the legacy HEPv3 layout only carry seconds
+	TimestampUsec uint32 `json:",omitempty"`
+	ProtoType     uint8
+	NodeID        uint32
+	NodeName      string
+	Payload       []byte
+	CID           string
+	Vlan          uint16
+
+	// NodeIDs lists the capture agents that saw the packet when copies
+	// were merged by deduplication
+	NodeIDs []uint32 `json:"node_ids,omitempty"`
+
+	// Decoded payload fields, set depending on ProtoType
+	SIP      *SIPMessage      `json:"sip,omitempty"`
+	DNS      *DNSMessage      `json:"dns,omitempty"`
+	Diameter *DiameterMessage `json:"diameter,omitempty"`
+	Log      *LogMessage      `json:"log,omitempty"`
+	RTP      *RTPHeader       `json:"rtp,omitempty"`
+
+	// Enrichment holds fields added by the enrichment stage, e.g.
+	// src_country or site
+	Enrichment map[string]string `json:"enrichment,omitempty"`
+
+	// Host aliases, resolved when packets are returned by the API
+	SrcAlias string `json:"src_alias,omitempty"`
+	DstAlias string `json:"dst_alias,omitempty"`
+}
+
+// Time returns the packet capture time
+func (p *HEPPacket) Time() time.Time {
+	return time.Unix(int64(p.Timestamp), int64(p.TimestampUsec)*1000)
 }
 
 type hepChunk struct {
@@ -77,6 +145,10 @@ func DecodeHEP(data []byte) (*HEPPacket, error) {
 		return nil, ErrPacketTooShort
 	}
 
+	if string(data[:4]) == hep3Magic {
+		return decodeHEP3(data)
+	}
+
 	// Check HEP version
 	switch data[0] {
 	case HEPv3:
@@ -125,7 +197,7 @@ func decodeHEPv3(data []byte) (*HEPPacket, error) {
 		cursor += int(chunk.Length - 6)
 
 		switch chunk.ChunkType {
-		case TypeIPProtocolFamily:
+		case TypeIPProtocolID:
 			packet.Protocol = chunk.Data[0]
 		case TypeIPSourceIP:
 			packet.SrcIP = net.IP(chunk.Data).String()
@@ -154,6 +226,86 @@ func decodeHEPv3(data []byte) (*HEPPacket, error) {
 	return packet, nil
 }
 
+// decodeHEP3 decodes a HEPv3 packet of the HEP specification. Chunks of
+// other vendors and unknown types are skipped.
+func decodeHEP3(data []byte) (*HEPPacket, error) {
+	if len(data) < 6 {
+		return nil, ErrPacketTooShort
+	}
+	length := int(binary.BigEndian.Uint16(data[4:6]))
+	if length < 6 || length > len(data) {
+		return nil, ErrPacketTooShort
+	}
+	data = data[:length]
+
+	packet := &HEPPacket{Version: HEPv3}
+	for cursor := 6; cursor < len(data); {
+		if cursor+6 > len(data) {
+			return nil, ErrInvalidChunk
+		}
+		vendor := binary.BigEndian.Uint16(data[cursor : cursor+2])
+		chunkType := binary.BigEndian.Uint16(data[cursor+2 : cursor+4])
+		chunkLength := int(binary.BigEndian.Uint16(data[cursor+4 : cursor+6]))
+		if chunkLength < 6 || cursor+chunkLength > len(data) {
+			return nil, ErrInvalidChunk
+		}
+		value := data[cursor+6 : cursor+chunkLength]
+		cursor += chunkLength
+		if vendor != 0 {
+			continue
+		}
+
+		if size := hep3ChunkSize(chunkType); size > 0 && len(value) != size {
+			return nil, ErrInvalidChunk
+		}
+		switch chunkType {
+		case ChunkIPProtocol:
+			packet.Protocol = value[0]
+		case ChunkIPv4SrcIP, ChunkIPv6SrcIP:
+			packet.SrcIP = net.IP(value).String()
+		case ChunkIPv4DstIP, ChunkIPv6DstIP:
+			packet.DstIP = net.IP(value).String()
+		case ChunkSrcPort:
+			packet.SrcPort = binary.BigEndian.Uint16(value)
+		case ChunkDstPort:
+			packet.DstPort = binary.BigEndian.Uint16(value)
+		case ChunkTimeSec:
+			packet.Timestamp = uint64(binary.BigEndian.Uint32(value))
+		case ChunkTimeUsec:
+			packet.TimestampUsec = binary.BigEndian.Uint32(value)
+		case ChunkProtoType:
+			packet.ProtoType = value[0]
+		case ChunkCaptureAgentID:
+			packet.NodeID = binary.BigEndian.Uint32(value)
+		case ChunkPayload:
+			packet.Payload = append([]byte(nil), value...)
+		case ChunkCorrelationID:
+			packet.CID = string(value)
+		case ChunkVLAN:
+			packet.Vlan = binary.BigEndian.Uint16(value)
+		case ChunkCaptureAgentName:
+			packet.NodeName = string(value)
+		}
+	}
+	return packet, nil
+}
+
+// hep3ChunkSize returns the value size of fixed size chunks, 0 for the
+// others
+func hep3ChunkSize(chunkType uint16) int {
+	switch chunkType {
+	case ChunkIPFamily, ChunkIPProtocol, ChunkProtoType:
+		return 1
+	case ChunkSrcPort, ChunkDstPort, ChunkVLAN:
+		return 2
+	case ChunkIPv4SrcIP, ChunkIPv4DstIP, ChunkTimeSec, ChunkTimeUsec, ChunkCaptureAgentID:
+		return 4
+	case ChunkIPv6SrcIP, ChunkIPv6DstIP:
+		return 16
+	}
+	return 0
+}
+
 func decodeHEPv2(data []byte) (*HEPPacket, error) {
 	if len(data) < 31 { // minimum HEPv2 packet size
 		return nil, ErrPacketTooShort
@@ -206,11 +358,70 @@ func decodeHEPv1(data []byte) (*HEPPacket, error) {
 	return packet, nil
 }
 
+// EncodeHEP encodes a packet as HEPv3 of the HEP specification, readable
+// by heplify-server, HOMER and Wireshark
+func EncodeHEP(packet *HEPPacket) ([]byte, error) {
+	family := byte(2) // AF_INET
+	srcType, dstType := uint16(ChunkIPv4SrcIP), uint16(ChunkIPv4DstIP)
+	srcIP := net.ParseIP(packet.SrcIP)
+	dstIP := net.ParseIP(packet.DstIP)
+	if srcIP.To4() != nil && dstIP.To4() != nil {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	} else {
+		family = 10 // AF_INET6
+		srcType, dstType = ChunkIPv6SrcIP, ChunkIPv6DstIP
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+
+	data := make([]byte, 6, 6+15*6+len(srcIP)+len(dstIP)+len(packet.Payload)+len(packet.CID)+len(packet.NodeName)+32)
+	copy(data, hep3Magic)
+	chunk := func(chunkType uint16, value []byte) {
+		data = binary.BigEndian.AppendUint16(data, 0) // vendor ID
+		data = binary.BigEndian.AppendUint16(data, chunkType)
+		data = binary.BigEndian.AppendUint16(data, uint16(6+len(value)))
+		data = append(data, value...)
+	}
+
+	chunk(ChunkIPFamily, []byte{family})
+	chunk(ChunkIPProtocol, []byte{packet.Protocol})
+	if srcIP != nil {
+		chunk(srcType, srcIP)
+	}
+	if dstIP != nil {
+		chunk(dstType, dstIP)
+	}
+	chunk(ChunkSrcPort, binary.BigEndian.AppendUint16(nil, packet.SrcPort))
+	chunk(ChunkDstPort, binary.BigEndian.AppendUint16(nil, packet.DstPort))
+	chunk(ChunkTimeSec, binary.BigEndian.AppendUint32(nil, uint32(packet.Timestamp)))
+	chunk(ChunkTimeUsec, binary.BigEndian.AppendUint32(nil, packet.TimestampUsec))
+	chunk(ChunkProtoType, []byte{packet.ProtoType})
+	chunk(ChunkCaptureAgentID, binary.BigEndian.AppendUint32(nil, packet.NodeID))
+	if packet.CID != "" {
+		chunk(ChunkCorrelationID, []byte(packet.CID))
+	}
+	if packet.Vlan != 0 {
+		chunk(ChunkVLAN, binary.BigEndian.AppendUint16(nil, packet.Vlan))
+	}
+	if packet.NodeName != "" {
+		chunk(ChunkCaptureAgentName, []byte(packet.NodeName))
+	}
+	chunk(ChunkPayload, packet.Payload)
+
+	if len(data) > 0xffff {
+		return nil, ErrPacketTooLong
+	}
+	binary.BigEndian.PutUint16(data[4:6], uint16(len(data)))
+	return data, nil
+}
+
 // Add a helper function to determine the HEP version
 func GetHEPVersion(data []byte) (uint8, error) {
 	if len(data) < 4 {
 		return 0, ErrPacketTooShort
 	}
+	if string(data[:4]) == hep3Magic {
+		return HEPv3, nil
+	}
 	version := data[0]
 	if version < HEPv1 || version > HEPv3 {
 		return 0, ErrInvalidVersion
@@ -3,6 +3,7 @@ package protocol
 import (
 	"encoding/binary"
 	"net"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -101,8 +102,8 @@ func makeHEPv3Packet() []byte {
 
 	offset := 6
 	for _, chunk := range chunks {
-		binary.BigEndian.PutUint16(packet[offset:offset+2], chunk.chunkType)
-		binary.BigEndian.PutUint16(packet[offset+2:offset+4], uint16(6+len(chunk.data)))
+		binary.BigEndian.PutUint16(packet[offset+2:offset+4], chunk.chunkType)
+		binary.BigEndian.PutUint16(packet[offset+4:offset+6], uint16(6+len(chunk.data)))
 		copy(packet[offset+6:], chunk.data)
 		offset += 6 + len(chunk.data)
 	}
@@ -141,7 +142,7 @@ func BenchmarkHEPPayloadSizes(b *testing.B) {
 
 	for _, size := range sizes {
 		payload := make([]byte, size)
-		b.Run("Size-"+string(size), func(b *testing.B) {
+		b.Run("Size-"+strconv.Itoa(size), func(b *testing.B) {
 			v1 := makeHEPv1PacketWithPayload(payload)
 			v2 := makeHEPv2PacketWithPayload(payload)
 			v3 := makeHEPv3PacketWithPayload(payload)
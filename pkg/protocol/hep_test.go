@@ -3,6 +3,7 @@ package protocol
 import (
 	"encoding/binary"
 	"net"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -126,8 +127,8 @@ func createHEPv3TestPacket() []byte {
 	offset := 6
 	for _, chunk := range chunks {
 		// Vendor ID = 0x0000
-		binary.BigEndian.PutUint16(packet[offset:offset+2], chunk.chunkType)
-		binary.BigEndian.PutUint16(packet[offset+2:offset+4], uint16(6+len(chunk.data)))
+		binary.BigEndian.PutUint16(packet[offset+2:offset+4], chunk.chunkType)
+		binary.BigEndian.PutUint16(packet[offset+4:offset+6], uint16(6+len(chunk.data)))
 		copy(packet[offset+6:], chunk.data)
 		offset += 6 + len(chunk.data)
 	}
@@ -135,6 +136,100 @@ func createHEPv3TestPacket() []byte {
 	return packet
 }
 
+func TestHEPv3EncodeRoundTrip(t *testing.T) {
+	for _, want := range []*HEPPacket{
+		{
+			Version:       HEPv3,
+			Protocol:      17,
+			SrcIP:         "192.168.1.1",
+			DstIP:         "192.168.1.2",
+			SrcPort:       5060,
+			DstPort:       5080,
+			Timestamp:     1700000000,
+			TimestampUsec: 123456,
+			ProtoType:     ProtoTypeSIP,
+			NodeID:        2001,
+			NodeName:      "sbc1",
+			Payload:       []byte("INVITE sip:bob@example.com SIP/2.0\r\n"),
+			CID:           "abc@host",
+			Vlan:          42,
+		},
+		{
+			Version:   HEPv3,
+			Protocol:  6,
+			SrcIP:     "2001:db8::1",
+			DstIP:     "2001:db8::2",
+			ProtoType: ProtoTypeLog,
+			Payload:   []byte("log"),
+		},
+	} {
+		data, err := EncodeHEP(want)
+		if err != nil {
+			t.Fatalf("EncodeHEP failed: %v", err)
+		}
+		if string(data[:4]) != "HEP3" {
+			t.Errorf("Expected the HEP3 magic, got %q", data[:4])
+		}
+		got, err := DecodeHEP(data)
+		if err != nil {
+			t.Fatalf("DecodeHEP failed: %v", err)
+		}
+		if got.TimestampUsec != want.TimestampUsec || got.NodeName != want.NodeName {
+			t.Errorf("Round trip mismatch:\n got %+v\nwant %+v", got, want)
+		}
+		if got.SrcIP != want.SrcIP || got.DstIP != want.DstIP || got.SrcPort != want.SrcPort || got.DstPort != want.DstPort ||
+			got.Protocol != want.Protocol || got.Timestamp != want.Timestamp || got.ProtoType != want.ProtoType ||
+			got.NodeID != want.NodeID || got.CID != want.CID || got.Vlan != want.Vlan || string(got.Payload) != string(want.Payload) {
+			t.Errorf("Round trip mismatch:\n got %+v\nwant %+v", got, want)
+		}
+	}
+
+	if _, err := EncodeHEP(&HEPPacket{Payload: make([]byte, 70000)}); err != ErrPacketTooLong {
+		t.Errorf("Expected ErrPacketTooLong, got %v", err)
+	}
+}
+
+// A SIP packet as sent by heplify
+func TestHEP3Decode(t *testing.T) {
+	data := []byte("HEP3\x00\x00" +
+		"\x00\x00\x00\x01\x00\x07\x02" + // IP family
+		"\x00\x00\x00\x02\x00\x07\x11" + // IP protocol, UDP
+		"\x00\x00\x00\x03\x00\x0a\xc0\x00\x02\x01" + // source IPv4
+		"\x00\x00\x00\x04\x00\x0a\xc0\x00\x02\x02" + // destination IPv4
+		"\x00\x00\x00\x07\x00\x08\x13\xc4" + // source port
+		"\x00\x00\x00\x08\x00\x08\x13\xc5" + // destination port
+		"\x00\x00\x00\x09\x00\x0a\x65\x53\xf1\x00" + // seconds
+		"\x00\x00\x00\x0a\x00\x0a\x00\x00\x75\x30" + // microseconds
+		"\x00\x00\x00\x0b\x00\x07\x01" + // proto type SIP
+		"\x00\x00\x00\x0c\x00\x0a\x00\x00\x07\xd1" + // capture agent ID
+		"\x00\x00\x00\x0e\x00\x0b\x6d\x79\x48\x65\x70" + // auth key
+		"\x00\x00\x00\x11\x00\x0a\x61\x62\x63\x64" + // correlation ID
+		"\x00\x00\x00\x13\x00\x0a\x73\x62\x63\x31" + // capture agent name
+		"\x00\x2b\x00\x01\x00\x07\xff" + // vendor chunk
+		"\x00\x00\x00\x0f\x00\x0a\x4f\x50\x54\x53") // payload
+	binary.BigEndian.PutUint16(data[4:6], uint16(len(data)))
+
+	hep, err := DecodeHEP(data)
+	if err != nil {
+		t.Fatalf("Failed to decode HEP3: %v", err)
+	}
+	want := HEPPacket{Version: HEPv3, Protocol: 17, SrcIP: "192.0.2.1", DstIP: "192.0.2.2", SrcPort: 5060, DstPort: 5061,
+		Timestamp: 1700000000, TimestampUsec: 30000, ProtoType: ProtoTypeSIP, NodeID: 2001, NodeName: "sbc1", CID: "abcd"}
+	payload := hep.Payload
+	hep.Payload = nil
+	if !reflect.DeepEqual(*hep, want) || string(payload) != "OPTS" {
+		t.Errorf("Unexpected packet\n got %+v\nwant %+v", *hep, want)
+	}
+	if !hep.Time().Equal(time.Unix(1700000000, 30000000)) {
+		t.Errorf("Unexpected time %v", hep.Time())
+	}
+
+	data[len(data)-5] = 0x20 // payload chunk longer than the packet
+	if _, err := DecodeHEP(data); err != ErrInvalidChunk {
+		t.Errorf("Expected ErrInvalidChunk, got %v", err)
+	}
+}
+
 func TestInvalidPackets(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var ErrLogEmpty = errors.New("empty log payload")
+
+// LogMessage holds the fields decoded from an application log (ProtoType 100)
+type LogMessage struct {
+	Level   string    `json:"level,omitempty"`
+	Module  string    `json:"module,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time,omitempty"`
+}
+
+var (
+	// 2024-01-15 10:00:00.123456 [ERR] sofia.c:1234 message, optionally
+	// prefixed by the channel UUID
+	freeswitchLogPattern = regexp.MustCompile(
+		`^(?:[0-9a-f-]{36} )?(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?) (?:\d+\.\d+% )?\[([A-Z]+)\] (\S+?)(?:\.c)?:\d+ (.*)$`)
+
+	// ERROR: tm [t_lookup.c:1234]: t_check_msg(): message or
+	// ERROR: <core> [core/tcp_main.c:1234]: ..., optionally prefixed by a
+	// syslog header whose RFC 3164 or RFC 3339 time is kept
+	kamailioLogPattern = regexp.MustCompile(
+		`^(?:([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2}|\d{4}-\d{2}-\d{2}T[\d:.]+(?:Z|[+-]\d{2}:\d{2})) )?(?:.*?\[\d+\]: )?(?:\d+\(\d+\) )?([A-Z]+): <?([\w-]+)>? \[[^\]]*\]: (?:\w+\(\): )?(.*)$`)
+)
+
+var logLevelAliases = map[string]string{
+	"ERR":      "ERROR",
+	"WARN":     "WARNING",
+	"CRIT":     "CRITICAL",
+	"ALERT":    "CRITICAL",
+	"DBG":      "DEBUG",
+	"CONSOLE":  "INFO",
+	"NOTICE":   "NOTICE",
+	"WARNING":  "WARNING",
+	"ERROR":    "ERROR",
+	"INFO":     "INFO",
+	"DEBUG":    "DEBUG",
+	"CRITICAL": "CRITICAL",
+}
+
+// DecodeLog decodes JSON, Kamailio and FreeSWITCH style log lines. Lines in
+// an unknown format are kept as the message.
+func DecodeLog(data []byte) (*LogMessage, error) {
+	line := strings.TrimSpace(string(data))
+	if line == "" {
+		return nil, ErrLogEmpty
+	}
+
+	if line[0] == '{' {
+		if msg, ok := decodeJSONLog(data); ok {
+			return msg, nil
+		}
+	}
+
+	if m := freeswitchLogPattern.FindStringSubmatch(line); m != nil {
+		msg := &LogMessage{
+			Level:   normalizeLogLevel(m[2]),
+			Module:  m[3],
+			Message: m[4],
+		}
+		msg.Time, _ = time.ParseInLocation("2006-01-02 15:04:05.999999", m[1], time.UTC)
+		return msg, nil
+	}
+
+	if m := kamailioLogPattern.FindStringSubmatch(line); m != nil {
+		return &LogMessage{
+			Level:   normalizeLogLevel(m[2]),
+			Module:  m[3],
+			Message: m[4],
+			Time:    syslogTime(m[1], time.Now()),
+		}, nil
+	}
+
+	return &LogMessage{Message: line}, nil
+}
+
+func decodeJSONLog(data []byte) (*LogMessage, bool) {
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, false
+	}
+
+	msg := &LogMessage{
+		Level:   normalizeLogLevel(firstString(fields, "level", "severity", "lvl")),
+		Module:  firstString(fields, "module", "logger", "component"),
+		Message: firstString(fields, "message", "msg", "text"),
+	}
+	if ts := firstString(fields, "timestamp", "time", "ts", "@timestamp"); ts != "" {
+		msg.Time, _ = time.Parse(time.RFC3339Nano, ts)
+	}
+	if msg.Message == "" {
+		msg.Message = string(bytes.TrimSpace(data))
+	}
+	return msg, true
+}
+
+// syslogTime parses an RFC 3339 or RFC 3164 syslog time. The latter has no
+// year and no zone, it is taken as UTC in the year that puts it closest
+// before now.
+func syslogTime(ts string, now time.Time) time.Time {
+	if ts == "" {
+		return time.Time{}
+	}
+	if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+		return t
+	}
+	t, err := time.ParseInLocation(time.Stamp, ts, time.UTC)
+	if err != nil {
+		return time.Time{}
+	}
+	now = now.UTC()
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
+
+func firstString(fields map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		if s, ok := fields[key].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+func normalizeLogLevel(level string) string {
+	level = strings.ToUpper(strings.TrimSpace(level))
+	if normalized, ok := logLevelAliases[level]; ok {
+		return normalized
+	}
+	return level
+}
@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecodeLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		level   string
+		module  string
+		message string
+		time    time.Time
+	}{
+		{
+			name:    "kamailio",
+			line:    "ERROR: tm [t_lookup.c:1370]: t_check_msg(): no transaction found",
+			level:   "ERROR",
+			module:  "tm",
+			message: "no transaction found",
+		},
+		{
+			name:    "kamailio syslog",
+			line:    "Jan 15 10:00:00 sbc1 /usr/sbin/kamailio[4242]: WARNING: dispatcher [dispatch.c:2105]: ds_select_dst(): no destination",
+			level:   "WARNING",
+			module:  "dispatcher",
+			message: "no destination",
+			time:    syslogTime("Jan 15 10:00:00", time.Now()),
+		},
+		{
+			name:    "kamailio rsyslog",
+			line:    "2024-01-15T10:00:00.250+00:00 sbc1 kamailio[4242]: ERROR: tm [t_reply.c:601]: _reply_light(): failed",
+			level:   "ERROR",
+			module:  "tm",
+			message: "failed",
+			time:    time.Date(2024, 1, 15, 10, 0, 0, 250000000, time.UTC),
+		},
+		{
+			name:    "kamailio core",
+			line:    "ERROR: <core> [core/tcp_main.c:1542]: tcpconn_connect(): connect failed",
+			level:   "ERROR",
+			module:  "core",
+			message: "connect failed",
+		},
+		{
+			name:    "freeswitch",
+			line:    "2024-01-15 10:00:00.123456 [ERR] sofia.c:7012 Channel hangup NORMAL_TEMPORARY_FAILURE",
+			level:   "ERROR",
+			module:  "sofia",
+			message: "Channel hangup NORMAL_TEMPORARY_FAILURE",
+			time:    time.Date(2024, 1, 15, 10, 0, 0, 123456000, time.UTC),
+		},
+		{
+			name:    "json",
+			line:    `{"level":"warn","module":"b2bua","msg":"leg timeout","timestamp":"2024-01-15T10:00:01Z"}`,
+			level:   "WARNING",
+			module:  "b2bua",
+			message: "leg timeout",
+			time:    time.Date(2024, 1, 15, 10, 0, 1, 0, time.UTC),
+		},
+		{
+			name:    "plain",
+			line:    "call answered\n",
+			message: "call answered",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := DecodeLog([]byte(tt.line))
+			if err != nil {
+				t.Fatalf("DecodeLog failed: %v", err)
+			}
+			if msg.Level != tt.level || msg.Module != tt.module || msg.Message != tt.message {
+				t.Errorf("Expected %q/%q/%q, got %q/%q/%q",
+					tt.level, tt.module, tt.message, msg.Level, msg.Module, msg.Message)
+			}
+			if !msg.Time.Equal(tt.time) {
+				t.Errorf("Expected time %v, got %v", tt.time, msg.Time)
+			}
+		})
+	}
+}
+
+func TestSyslogTime(t *testing.T) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	if got := syslogTime("Dec 31 23:59:00", now); !got.Equal(time.Date(2023, 12, 31, 23, 59, 0, 0, time.UTC)) {
+		t.Errorf("Expected the last year for a date after now, got %v", got)
+	}
+	if got := syslogTime("Jan  1 10:00:00", now); !got.Equal(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the current year, got %v", got)
+	}
+}
+
+func TestDecodeLogEmpty(t *testing.T) {
+	if _, err := DecodeLog([]byte("  \n")); err != ErrLogEmpty {
+		t.Errorf("Expected ErrLogEmpty, got %v", err)
+	}
+}
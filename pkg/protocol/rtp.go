@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrRTPTooShort   = errors.New("rtp packet too short")
+	ErrRTPBadVersion = errors.New("unsupported rtp version")
+)
+
+// RTPHeader holds the fixed RTP header fields from RFC 3550 (ProtoType 34).
+// Agents mirroring RTP over HEP may send the header only, the media payload
+// is not needed.
+type RTPHeader struct {
+	Marker      bool   `json:"marker,omitempty"`
+	PayloadType uint8  `json:"payload_type"`
+	Sequence    uint16 `json:"sequence"`
+	Timestamp   uint32 `json:"timestamp"`
+	SSRC        uint32 `json:"ssrc"`
+}
+
+// DecodeRTP decodes the fixed header of an RTP packet
+func DecodeRTP(data []byte) (*RTPHeader, error) {
+	if len(data) < 12 {
+		return nil, ErrRTPTooShort
+	}
+	if data[0]>>6 != 2 {
+		return nil, ErrRTPBadVersion
+	}
+
+	return &RTPHeader{
+		Marker:      data[1]&0x80 != 0,
+		PayloadType: data[1] & 0x7f,
+		Sequence:    binary.BigEndian.Uint16(data[2:4]),
+		Timestamp:   binary.BigEndian.Uint32(data[4:8]),
+		SSRC:        binary.BigEndian.Uint32(data[8:12]),
+	}, nil
+}
+
+// rtpClockRates are the clock rates of the static payload types from
+// RFC 3551, dynamic types are announced in SDP
+var rtpClockRates = map[uint8]uint32{
+	0:  8000,  // PCMU
+	3:  8000,  // GSM
+	4:  8000,  // G723
+	8:  8000,  // PCMA
+	9:  8000,  // G722, RTP clock is 8000 for historical reasons
+	10: 44100, // L16 stereo
+	11: 44100, // L16 mono
+	13: 8000,  // CN
+	18: 8000,  // G729
+	26: 90000, // JPEG
+	31: 90000, // H261
+	34: 90000, // H263
+}
+
+// RTPClockRate returns the clock rate of a static payload type, or 0 for
+// dynamic and unknown types
+func RTPClockRate(payloadType uint8) uint32 {
+	return rtpClockRates[payloadType]
+}
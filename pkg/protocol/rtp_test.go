@@ -0,0 +1,35 @@
+package protocol
+
+import "testing"
+
+func TestDecodeRTP(t *testing.T) {
+	data := []byte{
+		0x80, 0x88, // V=2, marker, PT 8
+		0x12, 0x34, // sequence
+		0x00, 0x00, 0x1f, 0x40, // timestamp 8000
+		0xde, 0xad, 0xbe, 0xef, // SSRC
+		0xd5, 0xd5, // payload
+	}
+
+	hdr, err := DecodeRTP(data)
+	if err != nil {
+		t.Fatalf("DecodeRTP failed: %v", err)
+	}
+	if !hdr.Marker || hdr.PayloadType != 8 || hdr.Sequence != 0x1234 ||
+		hdr.Timestamp != 8000 || hdr.SSRC != 0xdeadbeef {
+		t.Errorf("Unexpected header: %+v", hdr)
+	}
+	if RTPClockRate(hdr.PayloadType) != 8000 {
+		t.Errorf("Expected 8000 Hz for PCMA, got %d", RTPClockRate(hdr.PayloadType))
+	}
+}
+
+func TestDecodeRTPErrors(t *testing.T) {
+	if _, err := DecodeRTP([]byte{0x80, 0x00}); err != ErrRTPTooShort {
+		t.Errorf("Expected ErrRTPTooShort, got %v", err)
+	}
+	// RTCP-like version 1 header
+	if _, err := DecodeRTP(make([]byte, 12)); err != ErrRTPBadVersion {
+		t.Errorf("Expected ErrRTPBadVersion, got %v", err)
+	}
+}
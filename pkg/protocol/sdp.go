@@ -0,0 +1,200 @@
+package protocol
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrSDPNoMedia = errors.New("sdp has no media description")
+
+// SDPSession holds the fields of an SDP offer or answer (RFC 4566) needed to
+// correlate media with the call
+type SDPSession struct {
+	Connection string     `json:"connection,omitempty"`
+	Direction  string     `json:"direction,omitempty"`
+	Media      []SDPMedia `json:"media"`
+}
+
+// SDPMedia is one m= section. Connection and Direction fall back to the
+// session level values.
+type SDPMedia struct {
+	Type       string     `json:"type"`
+	Port       uint16     `json:"port"`
+	RTCPPort   uint16     `json:"rtcp_port,omitempty"`
+	Protocol   string     `json:"protocol"`
+	Connection string     `json:"connection,omitempty"`
+	Codecs     []SDPCodec `json:"codecs,omitempty"`
+	Ptime      int        `json:"ptime,omitempty"`
+	Direction  string     `json:"direction"`
+	ICE        bool       `json:"ice,omitempty"`
+	Crypto     bool       `json:"crypto,omitempty"`
+}
+
+// SDPCodec is a payload type of a media section with its rtpmap, static
+// payload types without rtpmap get the RFC 3551 name and clock rate
+type SDPCodec struct {
+	PayloadType uint8  `json:"payload_type"`
+	Name        string `json:"name,omitempty"`
+	ClockRate   uint32 `json:"clock_rate,omitempty"`
+}
+
+var sdpStaticCodecs = map[uint8]string{
+	0:  "PCMU",
+	3:  "GSM",
+	4:  "G723",
+	8:  "PCMA",
+	9:  "G722",
+	13: "CN",
+	18: "G729",
+}
+
+// DecodeSDP decodes the connection, media and attribute lines of an SDP body
+func DecodeSDP(data []byte) (*SDPSession, error) {
+	session := &SDPSession{}
+	var media *SDPMedia
+	var iceSession, cryptoSession bool
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		value := line[2:]
+
+		switch line[0] {
+		case 'c':
+			// c=IN IP4 192.0.2.1, multicast addresses may carry a /ttl
+			fields := strings.Fields(value)
+			if len(fields) != 3 {
+				continue
+			}
+			addr, _, _ := strings.Cut(fields[2], "/")
+			if media != nil {
+				media.Connection = addr
+			} else {
+				session.Connection = addr
+			}
+		case 'm':
+			// m=audio 49170 RTP/AVP 0 8 101
+			fields := strings.Fields(value)
+			if len(fields) < 3 {
+				continue
+			}
+			portField, _, _ := strings.Cut(fields[1], "/")
+			port, err := strconv.ParseUint(portField, 10, 16)
+			if err != nil {
+				continue
+			}
+			session.Media = append(session.Media, SDPMedia{
+				Type:     fields[0],
+				Port:     uint16(port),
+				Protocol: fields[2],
+			})
+			media = &session.Media[len(session.Media)-1]
+			for _, format := range fields[3:] {
+				pt, err := strconv.ParseUint(format, 10, 7)
+				if err != nil {
+					continue
+				}
+				media.Codecs = append(media.Codecs, SDPCodec{
+					PayloadType: uint8(pt),
+					Name:        sdpStaticCodecs[uint8(pt)],
+					ClockRate:   RTPClockRate(uint8(pt)),
+				})
+			}
+		case 'a':
+			name, attr, _ := strings.Cut(value, ":")
+			switch name {
+			case "sendrecv", "sendonly", "recvonly", "inactive":
+				if media != nil {
+					media.Direction = name
+				} else {
+					session.Direction = name
+				}
+			case "ice-ufrag", "candidate":
+				if media != nil {
+					media.ICE = true
+				} else {
+					iceSession = true
+				}
+			case "crypto", "fingerprint":
+				// SDES keys or DTLS-SRTP
+				if media != nil {
+					media.Crypto = true
+				} else {
+					cryptoSession = true
+				}
+			case "rtpmap":
+				if media != nil {
+					media.applyRTPMap(attr)
+				}
+			case "ptime":
+				if media != nil {
+					media.Ptime, _ = strconv.Atoi(strings.TrimSpace(attr))
+				}
+			case "rtcp":
+				// a=rtcp:53020 IN IP4 126.16.64.4
+				if media != nil {
+					port, _, _ := strings.Cut(attr, " ")
+					if n, err := strconv.ParseUint(port, 10, 16); err == nil {
+						media.RTCPPort = uint16(n)
+					}
+				}
+			case "rtcp-mux":
+				if media != nil {
+					media.RTCPPort = media.Port
+				}
+			}
+		}
+	}
+
+	if len(session.Media) == 0 {
+		return nil, ErrSDPNoMedia
+	}
+
+	for i := range session.Media {
+		m := &session.Media[i]
+		if m.Connection == "" {
+			m.Connection = session.Connection
+		}
+		if m.Direction == "" {
+			m.Direction = session.Direction
+		}
+		if m.Direction == "" {
+			m.Direction = "sendrecv"
+		}
+		if m.RTCPPort == 0 && m.Port != 0 {
+			m.RTCPPort = m.Port + 1
+		}
+		m.ICE = m.ICE || iceSession
+		m.Crypto = m.Crypto || cryptoSession || strings.Contains(m.Protocol, "SAVP")
+	}
+	return session, nil
+}
+
+// applyRTPMap sets the codec name and clock rate from an rtpmap attribute,
+// e.g. 101 telephone-event/8000
+func (m *SDPMedia) applyRTPMap(attr string) {
+	pt, encoding, _ := strings.Cut(attr, " ")
+	n, err := strconv.ParseUint(pt, 10, 7)
+	if err != nil {
+		return
+	}
+	parts := strings.Split(strings.TrimSpace(encoding), "/")
+	if len(parts) < 2 {
+		return
+	}
+	rate, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return
+	}
+
+	for i := range m.Codecs {
+		if m.Codecs[i].PayloadType == uint8(n) {
+			m.Codecs[i].Name = parts[0]
+			m.Codecs[i].ClockRate = uint32(rate)
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package protocol
+
+import "testing"
+
+func TestDecodeSDP(t *testing.T) {
+	body := "v=0\r\n" +
+		"o=alice 2890844526 2890844526 IN IP4 192.0.2.10\r\n" +
+		"s=-\r\n" +
+		"c=IN IP4 192.0.2.10\r\n" +
+		"t=0 0\r\n" +
+		"a=sendrecv\r\n" +
+		"m=audio 49170 RTP/AVP 0 8 101\r\n" +
+		"a=rtpmap:101 telephone-event/8000\r\n" +
+		"a=ptime:20\r\n" +
+		"m=video 51372 RTP/SAVP 96\r\n" +
+		"c=IN IP4 192.0.2.20\r\n" +
+		"a=rtpmap:96 H264/90000\r\n" +
+		"a=rtcp:53020\r\n" +
+		"a=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR\r\n" +
+		"a=recvonly\r\n"
+
+	sdp, err := DecodeSDP([]byte(body))
+	if err != nil {
+		t.Fatalf("DecodeSDP failed: %v", err)
+	}
+	if sdp.Connection != "192.0.2.10" || len(sdp.Media) != 2 {
+		t.Fatalf("Unexpected session: %+v", sdp)
+	}
+
+	audio := sdp.Media[0]
+	if audio.Type != "audio" || audio.Port != 49170 || audio.RTCPPort != 49171 ||
+		audio.Connection != "192.0.2.10" || audio.Ptime != 20 || audio.Direction != "sendrecv" {
+		t.Errorf("Unexpected audio media: %+v", audio)
+	}
+	if len(audio.Codecs) != 3 || audio.Codecs[0].Name != "PCMU" ||
+		audio.Codecs[2].Name != "telephone-event" || audio.Codecs[2].ClockRate != 8000 {
+		t.Errorf("Unexpected audio codecs: %+v", audio.Codecs)
+	}
+	if audio.Crypto || audio.ICE {
+		t.Errorf("Expected plain RTP audio, got %+v", audio)
+	}
+
+	video := sdp.Media[1]
+	if video.Connection != "192.0.2.20" || video.RTCPPort != 53020 || video.Direction != "recvonly" {
+		t.Errorf("Unexpected video media: %+v", video)
+	}
+	if !video.Crypto || video.Codecs[0].ClockRate != 90000 {
+		t.Errorf("Expected SRTP H264 video, got %+v", video)
+	}
+}
+
+func TestDecodeSDPICE(t *testing.T) {
+	body := "v=0\n" +
+		"c=IN IP6 2001:db8::1\n" +
+		"a=ice-ufrag:F7gI\n" +
+		"a=fingerprint:sha-256 4A:AD:B9\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\n" +
+		"a=rtpmap:111 opus/48000/2\n" +
+		"a=rtcp-mux\n"
+
+	sdp, err := DecodeSDP([]byte(body))
+	if err != nil {
+		t.Fatalf("DecodeSDP failed: %v", err)
+	}
+	m := sdp.Media[0]
+	if !m.ICE || !m.Crypto || m.RTCPPort != 9 || m.Connection != "2001:db8::1" {
+		t.Errorf("Unexpected media: %+v", m)
+	}
+	if m.Codecs[0].Name != "opus" || m.Codecs[0].ClockRate != 48000 {
+		t.Errorf("Unexpected codec: %+v", m.Codecs[0])
+	}
+}
+
+func TestDecodeSDPNoMedia(t *testing.T) {
+	if _, err := DecodeSDP([]byte("v=0\r\ns=-\r\n")); err != ErrSDPNoMedia {
+		t.Errorf("Expected ErrSDPNoMedia, got %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrSIPNotSIP       = errors.New("payload is not a sip message")
+	ErrSIPBadStartLine = errors.New("invalid sip start line")
+)
+
+// compact header forms from RFC 3261 section 7.3.3 and extensions
+var sipCompactHeaders = map[string]string{
+	"i": "call-id",
+	"m": "contact",
+	"e": "content-encoding",
+	"l": "content-length",
+	"c": "content-type",
+	"f": "from",
+	"s": "subject",
+	"k": "supported",
+	"t": "to",
+	"v": "via",
+	"o": "event",
+	"r": "refer-to",
+}
+
+// SIPMessage holds the fields decoded from a SIP payload (ProtoType 1)
+type SIPMessage struct {
+	Method     string     `json:"method,omitempty"`
+	RequestURI string     `json:"request_uri,omitempty"`
+	StatusCode int        `json:"status_code,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	CallID     string     `json:"call_id"`
+	From       SIPAddress `json:"from"`
+	To         SIPAddress `json:"to"`
+	CSeq       uint32     `json:"cseq"`
+	CSeqMethod string     `json:"cseq_method"`
+	UserAgent  string     `json:"user_agent,omitempty"`
+
+	// SDP is set by the decoder for messages with an SDP body
+	SDP *SDPSession `json:"sdp,omitempty"`
+
+	// Headers are keyed by lower-case full header name
+	Headers map[string][]string `json:"-"`
+	Body    []byte              `json:"-"`
+}
+
+// SIPAddress is a parsed From/To/Contact style name-addr
+type SIPAddress struct {
+	Display string `json:"display,omitempty"`
+	URI     string `json:"uri"`
+	User    string `json:"user,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Tag     string `json:"tag,omitempty"`
+}
+
+// IsRequest reports whether the message is a request rather than a response
+func (m *SIPMessage) IsRequest() bool {
+	return m.Method != ""
+}
+
+// Header returns the first value of a header, name is case insensitive and
+// may use the compact form
+func (m *SIPMessage) Header(name string) string {
+	values := m.Headers[CanonicalSIPHeader(name)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// HeaderValues returns all values of a header in message order
+func (m *SIPMessage) HeaderValues(name string) []string {
+	return m.Headers[CanonicalSIPHeader(name)]
+}
+
+// CanonicalSIPHeader returns the lower-case full form of a header name,
+// e.g. "f" and "FROM" both become "from"
+func CanonicalSIPHeader(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if full, ok := sipCompactHeaders[name]; ok {
+		return full
+	}
+	return name
+}
+
+// DecodeSIP decodes the start line, the common headers and the body of a
+// SIP message
+func DecodeSIP(data []byte) (*SIPMessage, error) {
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	separatorLen := 4
+	if headerEnd < 0 {
+		// Tolerate agents that normalize line endings
+		headerEnd = bytes.Index(data, []byte("\n\n"))
+		separatorLen = 2
+	}
+	if headerEnd < 0 {
+		headerEnd = len(data)
+		separatorLen = 0
+	}
+
+	lines := strings.Split(strings.ReplaceAll(string(data[:headerEnd]), "\r\n", "\n"), "\n")
+	if len(lines) == 0 || lines[0] == "" {
+		return nil, ErrSIPNotSIP
+	}
+
+	msg := &SIPMessage{Headers: make(map[string][]string)}
+	if err := msg.parseStartLine(lines[0]); err != nil {
+		return nil, err
+	}
+
+	var current string
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		// Header folding, continuation lines start with whitespace
+		if (line[0] == ' ' || line[0] == '\t') && current != "" {
+			values := msg.Headers[current]
+			values[len(values)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			continue
+		}
+		current = CanonicalSIPHeader(line[:colon])
+		value := strings.TrimSpace(line[colon+1:])
+		msg.Headers[current] = append(msg.Headers[current], value)
+	}
+
+	if headerEnd+separatorLen < len(data) {
+		msg.Body = data[headerEnd+separatorLen:]
+	}
+
+	msg.CallID = msg.Header("call-id")
+	msg.From = ParseSIPAddress(msg.Header("from"))
+	msg.To = ParseSIPAddress(msg.Header("to"))
+	msg.UserAgent = msg.Header("user-agent")
+	if msg.UserAgent == "" {
+		msg.UserAgent = msg.Header("server")
+	}
+
+	if cseq := strings.Fields(msg.Header("cseq")); len(cseq) == 2 {
+		n, _ := strconv.ParseUint(cseq[0], 10, 32)
+		msg.CSeq = uint32(n)
+		msg.CSeqMethod = strings.ToUpper(cseq[1])
+	}
+
+	return msg, nil
+}
+
+func (m *SIPMessage) parseStartLine(line string) error {
+	if strings.HasPrefix(line, "SIP/2.0 ") {
+		parts := strings.SplitN(line, " ", 3)
+		code, err := strconv.Atoi(parts[1])
+		if err != nil || code < 100 || code > 699 {
+			return ErrSIPBadStartLine
+		}
+		m.StatusCode = code
+		if len(parts) == 3 {
+			m.Reason = parts[2]
+		}
+		return nil
+	}
+
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || parts[2] != "SIP/2.0" {
+		return ErrSIPNotSIP
+	}
+	m.Method = strings.ToUpper(parts[0])
+	m.RequestURI = parts[1]
+	return nil
+}
+
+// ParseSIPAddress parses a name-addr or addr-spec with optional parameters,
+// e.g. `"Alice" <sip:alice@example.com>;tag=1928301774`
+func ParseSIPAddress(value string) SIPAddress {
+	var addr SIPAddress
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return addr
+	}
+
+	params := ""
+	if lt := strings.IndexByte(value, '<'); lt >= 0 {
+		gt := strings.IndexByte(value[lt:], '>')
+		if gt < 0 {
+			addr.URI = value[lt+1:]
+		} else {
+			addr.URI = value[lt+1 : lt+gt]
+			params = value[lt+gt+1:]
+		}
+		addr.Display = strings.Trim(strings.TrimSpace(value[:lt]), `"`)
+	} else if semi := strings.IndexByte(value, ';'); semi >= 0 {
+		// Without angle brackets parameters belong to the header, not the URI
+		addr.URI = value[:semi]
+		params = value[semi:]
+	} else {
+		addr.URI = value
+	}
+
+	for _, param := range strings.Split(params, ";") {
+		if name, val, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(name, "tag") {
+			addr.Tag = val
+		}
+	}
+
+	addr.User, addr.Host = splitSIPURI(addr.URI)
+	return addr
+}
+
+// splitSIPURI returns the user and host parts of a sip:, sips: or tel: URI
+func splitSIPURI(uri string) (string, string) {
+	rest := uri
+	if colon := strings.IndexByte(rest, ':'); colon >= 0 {
+		scheme := strings.ToLower(rest[:colon])
+		if scheme == "tel" {
+			number, _, _ := strings.Cut(rest[colon+1:], ";")
+			return number, ""
+		}
+		rest = rest[colon+1:]
+	}
+	if end := strings.IndexAny(rest, ";?"); end >= 0 {
+		rest = rest[:end]
+	}
+
+	user, host, found := strings.Cut(rest, "@")
+	if !found {
+		return "", user
+	}
+	if colon := strings.IndexByte(user, ':'); colon >= 0 {
+		// Strip the password from user:password@host
+		user = user[:colon]
+	}
+	return user, host
+}
+
+// SplitSIPHeaderList splits a comma separated header value such as Contact
+// into its elements, ignoring commas inside quotes and angle brackets
+func SplitSIPHeaderList(value string) []string {
+	var parts []string
+	var quoted, bracketed bool
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '"':
+			quoted = !quoted
+		case '<':
+			if !quoted {
+				bracketed = true
+			}
+		case '>':
+			if !quoted {
+				bracketed = false
+			}
+		case ',':
+			if !quoted && !bracketed {
+				if part := strings.TrimSpace(value[start:i]); part != "" {
+					parts = append(parts, part)
+				}
+				start = i + 1
+			}
+		}
+	}
+	if part := strings.TrimSpace(value[start:]); part != "" {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// SIPHeaderParam returns a header parameter that follows the address, e.g.
+// the expires parameter of a Contact
+func SIPHeaderParam(value, name string) (string, bool) {
+	params := value
+	if gt := strings.LastIndexByte(value, '>'); gt >= 0 {
+		params = value[gt+1:]
+	} else if semi := strings.IndexByte(value, ';'); semi >= 0 {
+		params = value[semi:]
+	} else {
+		return "", false
+	}
+
+	for _, param := range strings.Split(params, ";") {
+		key, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(key, name) {
+			return strings.Trim(val, `"`), true
+		}
+	}
+	return "", false
+}
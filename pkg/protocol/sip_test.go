@@ -0,0 +1,154 @@
+package protocol
+
+import (
+	"testing"
+)
+
+const testSIPInvite = "INVITE sip:bob@example.com SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK776asdhds\r\n" +
+	"From: \"Alice\" <sip:alice@example.com>;tag=1928301774\r\n" +
+	"t: <sip:bob@example.com>\r\n" +
+	"i: a84b4c76e66710@pc33.example.com\r\n" +
+	"CSeq: 314159 INVITE\r\n" +
+	"Contact: <sip:alice@10.0.0.1:5060>\r\n" +
+	"User-Agent: Linphone/5.0\r\n" +
+	"Subject: folded\r\n" +
+	" header\r\n" +
+	"Content-Type: application/sdp\r\n" +
+	"Content-Length: 4\r\n" +
+	"\r\n" +
+	"v=0\n"
+
+func TestSIPDecodeRequest(t *testing.T) {
+	msg, err := DecodeSIP([]byte(testSIPInvite))
+	if err != nil {
+		t.Fatalf("Failed to decode SIP: %v", err)
+	}
+
+	if !msg.IsRequest() || msg.Method != "INVITE" {
+		t.Errorf("Expected INVITE request, got %q", msg.Method)
+	}
+	if msg.RequestURI != "sip:bob@example.com" {
+		t.Errorf("Expected request uri sip:bob@example.com, got %s", msg.RequestURI)
+	}
+	if msg.CallID != "a84b4c76e66710@pc33.example.com" {
+		t.Errorf("Expected call id from compact header, got %s", msg.CallID)
+	}
+	if msg.CSeq != 314159 || msg.CSeqMethod != "INVITE" {
+		t.Errorf("Expected CSeq 314159 INVITE, got %d %s", msg.CSeq, msg.CSeqMethod)
+	}
+	if msg.From.Display != "Alice" || msg.From.User != "alice" || msg.From.Tag != "1928301774" {
+		t.Errorf("Unexpected From %+v", msg.From)
+	}
+	if msg.To.User != "bob" || msg.To.Host != "example.com" || msg.To.Tag != "" {
+		t.Errorf("Unexpected To %+v", msg.To)
+	}
+	if msg.UserAgent != "Linphone/5.0" {
+		t.Errorf("Expected user agent Linphone/5.0, got %s", msg.UserAgent)
+	}
+	if msg.Header("subject") != "folded header" {
+		t.Errorf("Expected folded header to be joined, got %q", msg.Header("subject"))
+	}
+	if msg.Header("T") != "<sip:bob@example.com>" {
+		t.Errorf("Expected compact header lookup, got %q", msg.Header("T"))
+	}
+	if string(msg.Body) != "v=0\n" {
+		t.Errorf("Expected body v=0, got %q", msg.Body)
+	}
+}
+
+func TestSIPDecodeResponse(t *testing.T) {
+	payload := "SIP/2.0 486 Busy Here\r\n" +
+		"From: <sip:alice@example.com>;tag=1\r\n" +
+		"To: <sip:bob@example.com>;tag=2\r\n" +
+		"Call-ID: abc\r\n" +
+		"CSeq: 1 invite\r\n" +
+		"Server: Asterisk\r\n" +
+		"\r\n"
+
+	msg, err := DecodeSIP([]byte(payload))
+	if err != nil {
+		t.Fatalf("Failed to decode SIP: %v", err)
+	}
+
+	if msg.IsRequest() {
+		t.Error("Expected response, got request")
+	}
+	if msg.StatusCode != 486 || msg.Reason != "Busy Here" {
+		t.Errorf("Expected 486 Busy Here, got %d %s", msg.StatusCode, msg.Reason)
+	}
+	if msg.CSeqMethod != "INVITE" {
+		t.Errorf("Expected CSeq method to be upper-cased, got %s", msg.CSeqMethod)
+	}
+	if msg.UserAgent != "Asterisk" {
+		t.Errorf("Expected user agent from Server header, got %s", msg.UserAgent)
+	}
+	if msg.Body != nil {
+		t.Errorf("Expected no body, got %q", msg.Body)
+	}
+}
+
+func TestParseSIPAddress(t *testing.T) {
+	tests := []struct {
+		value string
+		want  SIPAddress
+	}{
+		{
+			value: `"Bob" <sips:bob:secret@biloxi.example.com:5061;transport=tls>;tag=a6c85cf`,
+			want:  SIPAddress{Display: "Bob", URI: "sips:bob:secret@biloxi.example.com:5061;transport=tls", User: "bob", Host: "biloxi.example.com:5061", Tag: "a6c85cf"},
+		},
+		{
+			value: `sip:+4930123@gw.example.com;tag=xyz`,
+			want:  SIPAddress{URI: "sip:+4930123@gw.example.com", User: "+4930123", Host: "gw.example.com", Tag: "xyz"},
+		},
+		{
+			value: `<tel:+14085551212;phone-context=example.com>`,
+			want:  SIPAddress{URI: "tel:+14085551212;phone-context=example.com", User: "+14085551212"},
+		},
+		{
+			value: `<sip:example.com>`,
+			want:  SIPAddress{URI: "sip:example.com", Host: "example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := ParseSIPAddress(tt.value); got != tt.want {
+				t.Errorf("ParseSIPAddress() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSIPInvalidMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{
+			name:    "Empty payload",
+			data:    []byte{},
+			wantErr: ErrSIPNotSIP,
+		},
+		{
+			name:    "Not SIP",
+			data:    []byte("GET / HTTP/1.1\r\n\r\n"),
+			wantErr: ErrSIPNotSIP,
+		},
+		{
+			name:    "Bad status code",
+			data:    []byte("SIP/2.0 99 Odd\r\n\r\n"),
+			wantErr: ErrSIPBadStartLine,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeSIP(tt.data)
+			if err != tt.wantErr {
+				t.Errorf("DecodeSIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}